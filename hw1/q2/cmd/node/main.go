@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"1005129_RYAN_TOH/hw1/q2/lib"
+)
+
+// Runs a single node as its own process, talking to its peers over TCP. For example, a cluster of 3:
+//
+//	go run ./cmd/node -id 0 -peers 0=127.0.0.1:7000,1=127.0.0.1:7001,2=127.0.0.1:7002 &
+//	go run ./cmd/node -id 1 -peers 0=127.0.0.1:7000,1=127.0.0.1:7001,2=127.0.0.1:7002 &
+//	go run ./cmd/node -id 2 -peers 0=127.0.0.1:7000,1=127.0.0.1:7001,2=127.0.0.1:7002 &
+//
+// SIGINT or SIGTERM lets the node exit. SIGKILL crashes it, and running it again restarts it.
+
+var id = flag.Int("id", -1, "ID of this node, which must be in the list of peers")
+var peers = flag.String("peers", "", "comma-separated id=host:port of every node in the cluster, including this one")
+var report = flag.String("report", "", "address of an orchestrator to report events to")
+var sendIntv = flag.Duration("send-intv", 5*time.Second, "how often the coordinator sends data")
+var timeout = flag.Duration("timeout", 1*time.Second, "estimated RTT for messages")
+var dataDir = flag.String("data", "", "directory to persist the term and state in, so they survive a crash")
+
+func main() {
+	flag.Parse()
+
+	endpoints, err := lib.ParsePeers(*peers)
+	if err != nil {
+		log.Fatalf("SYSTEM: %v", err)
+	}
+	nodeId := lib.NodeId(*id)
+	addr := ""
+	for _, endpoint := range endpoints {
+		if endpoint.Id == nodeId {
+			addr = endpoint.Addr
+		}
+	}
+	if addr == "" {
+		log.Fatalf("SYSTEM: N%d is not in the list of peers %q", nodeId, *peers)
+	}
+
+	node := lib.NewNode(nodeId, *sendIntv, *timeout, false, len(endpoints))
+	if *dataDir != "" {
+		if err := node.EnablePersistence(*dataDir); err != nil {
+			log.Fatalf("SYSTEM: %v", err)
+		}
+	}
+	if err := node.EnableTCP(addr); err != nil {
+		log.Fatalf("SYSTEM: %v", err)
+	}
+	if *report != "" {
+		if err := node.ReportTo(*report); err != nil {
+			log.Fatalf("SYSTEM: %v", err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	node.Initialise(endpoints)
+	log.Printf("SYSTEM: N%d listening on %s", nodeId, addr)
+
+	<-signals
+	node.Exit()
+}
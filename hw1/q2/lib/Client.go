@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Consistency level of a client read.
+type ReadConsistency int
+
+const (
+	READ_LOCAL       ReadConsistency = iota // Read this node's copy of the state, which may be stale
+	READ_COORDINATOR                        // Read the state from the coordinator
+)
+
+// Writes a value of a key to the system through this node. Keys cannot contain '|'.
+// Any node can be written to -- if this node is not the coordinator, the write is forwarded to the coordinator.
+// Blocks until the coordinator acknowledges the write, retrying across elections.
+// Returns an error if the write is not acknowledged after `deadline`.
+func (node *Node) Write(key, value string, deadline time.Duration) error {
+	if strings.Contains(key, "|") {
+		return errors.New(fmt.Sprintf("N%d: Invalid key \"%s\", keys cannot contain '|'.", node.Id, key))
+	}
+	_, err := node.forwardToCoordinator(MSG_TYPE_CLIENT_WRITE, key+"|"+value, deadline)
+	return err
+}
+
+// Reads the value of a key through this node, which is empty if the key has no value.
+// With READ_LOCAL, this node's own copy is returned immediately.
+// With READ_COORDINATOR, the read is forwarded to the coordinator, retrying across elections.
+// Returns an error if the coordinator does not respond after `deadline`.
+func (node *Node) Read(key string, consistency ReadConsistency, deadline time.Duration) (string, error) {
+	if consistency == READ_LOCAL {
+		if !node.IsAlive() {
+			return "", errors.New(fmt.Sprintf("N%d: Read failed, node is dead.", node.Id))
+		}
+		value, _ := node.Value(key)
+		return value, nil
+	}
+
+	return node.forwardToCoordinator(MSG_TYPE_CLIENT_READ, key, deadline)
+}
+
+// Sends a client request to the coordinator, and blocks until it is acknowledged.
+// If there is no coordinator, or the coordinator does not respond within the RTT, we retry
+// with whichever node is the coordinator then, until `deadline` passes.
+func (node *Node) forwardToCoordinator(mType msgType, data string, deadline time.Duration) (string, error) {
+	expiry := time.Now().Add(deadline)
+
+	for time.Now().Before(expiry) {
+		if !node.IsAlive() {
+			return "", errors.New(fmt.Sprintf("N%d: %s failed, node is dead.", node.Id, mType))
+		}
+
+		coordId := node.CoordinatorId()
+		if coordId == node.Id && node.acceptsUpdates() {
+			// We are the coordinator, serve the request ourselves.
+			return node.applyClientRequest(mType, data), nil
+		}
+
+		if coordEndpoint, ok := node.getEndpoint(coordId); ok {
+			// Wait for a response for at most one RTT, or till the deadline.
+			waitTime := node.timeout
+			if remaining := time.Until(expiry); remaining < waitTime {
+				waitTime = remaining
+			}
+
+			resp, ok := node.awaitClientResp(mType, coordEndpoint, data, waitTime)
+			if ok {
+				return resp.Data, nil
+			}
+			log.Printf("N%d: No response for %s from N%d, retrying.", node.Id, mType, coordId)
+			continue
+		}
+
+		// No known coordinator (e.g. an election is ongoing), wait before retrying.
+		time.Sleep(node.timeout / 4)
+	}
+
+	return "", errors.New(fmt.Sprintf("N%d: %s not acknowledged by a coordinator after %v.", node.Id, mType, deadline))
+}
+
+// Sends a single client request to the coordinator, and waits up to `waitTime` for its response.
+func (node *Node) awaitClientResp(mType msgType, coordEndpoint NodeEndpoint, data string, waitTime time.Duration) (Message, bool) {
+	respChan := make(chan Message, 1)
+
+	node.clientLock.Lock()
+	node.clientReqCount++
+	reqId := node.clientReqCount
+	node.clientReqs[reqId] = respChan
+	node.clientLock.Unlock()
+
+	defer func() {
+		node.clientLock.Lock()
+		delete(node.clientReqs, reqId)
+		node.clientLock.Unlock()
+	}()
+
+	node.sendWithReqId(mType, coordEndpoint, data, reqId)
+
+	select {
+	case resp := <-respChan:
+		return resp, true
+	case <-time.After(waitTime):
+		return Message{}, false
+	}
+}
+
+// Handles a response to a client request, passing it to the waiting request if any.
+func (node *Node) handleClientResp(msg Message) {
+	node.clientLock.Lock()
+	defer node.clientLock.Unlock()
+
+	respChan, ok := node.clientReqs[msg.ReqId]
+	if !ok {
+		// The request already timed out, drop the late response.
+		log.Printf("N%d: Received late CLIENT_RESP from N%d.", node.Id, msg.SrcId)
+		return
+	}
+	respChan <- msg
+	delete(node.clientReqs, msg.ReqId)
+}
+
+// Applies a client request on the coordinator, returning the value to respond with.
+// The data of a write is the key and value, and of a read is the key.
+func (node *Node) applyClientRequest(mType msgType, data string) string {
+	if mType == MSG_TYPE_CLIENT_WRITE {
+		parts := strings.SplitN(data, "|", 2)
+		if len(parts) != 2 {
+			log.Printf("N%d: Dropped invalid client write: %v", node.Id, data)
+			return ""
+		}
+		log.Printf("N%d: Applied client write: %s=%s", node.Id, parts[0], parts[1])
+		node.writeValue(parts[0], parts[1])
+		return parts[1]
+	}
+	value, _ := node.Value(data)
+	return value
+}
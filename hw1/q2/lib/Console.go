@@ -0,0 +1,366 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gaps between commands shorter than this are not recorded.
+const MIN_RECORDED_SLEEP = 100 * time.Millisecond
+
+// An interactive console over an Orchestrator.
+// Commands are read line by line, from a user or a script. Lines starting with '#' are comments.
+// While recording, every successful command is written out, along with `sleep` commands for the time between them,
+// so the session can be replayed as a script.
+type Console struct {
+	o           *Orchestrator
+	out         io.Writer
+	record      io.Writer // If set, commands are recorded here
+	lastCommand time.Time // When the last command was recorded
+	timeout     time.Duration
+}
+
+type consoleCommand struct {
+	usage       string
+	description string
+	run         func(c *Console, args []string) error
+}
+
+var consoleCommands map[string]consoleCommand
+
+func init() {
+	// Initialised here, since `help` refers to the commands
+	consoleCommands = map[string]consoleCommand{
+		"help":      {"help", "Lists the commands.", (*Console).help},
+		"status":    {"status", "Shows the liveness, coordinator, term and values of each node.", (*Console).status},
+		"kill":      {"kill <id>", "Kills a node.", (*Console).kill},
+		"restart":   {"restart <id>", "Restarts a dead node.", (*Console).restart},
+		"update":    {"update <id> <key> <value>", "Writes the value of a key through a node.", (*Console).update},
+		"read":      {"read <id> <key> [local|coordinator]", "Reads the value of a key through a node.", (*Console).read},
+		"add":       {"add <via id>", "Adds a node to the cluster, joining through a node.", (*Console).add},
+		"remove":    {"remove <id>", "Removes a node from the cluster.", (*Console).remove},
+		"partition": {"partition <ids> <ids>...", "Partitions the network into groups of comma-separated IDs, e.g. `partition 0,1 2,3,4`.", (*Console).partition},
+		"heal":      {"heal", "Heals the partition.", (*Console).heal},
+		"profile":   {"profile <name>", "Applies a network profile.", (*Console).profile},
+		"wait":      {"wait [timeout]", "Waits for an election (if any) to finish and the coordinator to be consistent.", (*Console).wait},
+		"report":    {"report", "Shows the report of the last election.", (*Console).report},
+		"sleep":     {"sleep <duration>", "Does nothing for the duration, e.g. `sleep 1.5s`.", (*Console).sleep},
+	}
+}
+
+// Creates a console over the orchestrator, writing output to `out`.
+// Waits on elections time out after `timeout`, unless a timeout is given.
+func NewConsole(o *Orchestrator, out io.Writer, timeout time.Duration) *Console {
+	return &Console{o, out, nil, time.Time{}, timeout}
+}
+
+// Records all commands run from here on to `record`. Recording stops if `record` is nil.
+func (c *Console) Record(record io.Writer) {
+	c.record = record
+	c.lastCommand = time.Now()
+}
+
+// Runs a single line. Returns an error if the command fails, without stopping the console.
+func (c *Console) Execute(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	fields := strings.Fields(line)
+	command, ok := consoleCommands[fields[0]]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown command: %s (try `help`)", fields[0]))
+	}
+
+	start := time.Now()
+	if err := command.run(c, fields[1:]); err != nil {
+		return err
+	}
+	c.recordLine(line, start)
+	return nil
+}
+
+// Runs every line from `in` until it is exhausted, or an `exit` line.
+// If `stopOnError` is false, errors are printed and the next line is run, as for an interactive session.
+func (c *Console) Run(in io.Reader, prompt bool, stopOnError bool) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprint(c.out, "> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "exit" {
+			return nil
+		}
+		if err := c.Execute(line); err != nil {
+			if stopOnError {
+				return err
+			}
+			fmt.Fprintf(c.out, "Error: %v\n", err)
+		}
+	}
+}
+
+// Records a command that started at `start`, preceded by the time between the last command finishing and it starting.
+// Only successful commands are recorded, since failed commands have no effect.
+func (c *Console) recordLine(line string, start time.Time) {
+	if c.record == nil {
+		return
+	}
+	if gap := start.Sub(c.lastCommand).Round(MIN_RECORDED_SLEEP); gap >= MIN_RECORDED_SLEEP {
+		fmt.Fprintf(c.record, "sleep %v\n", gap)
+	}
+	fmt.Fprintln(c.record, line)
+	c.lastCommand = time.Now()
+}
+
+/**
+  COMMANDS
+*/
+
+func parseNodeId(arg string) (NodeId, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return -1, errors.New(fmt.Sprintf("Invalid node ID: %s", arg))
+	}
+	return NodeId(id), nil
+}
+
+// Parses the node ID in the only argument, ensuring the node exists.
+func (c *Console) parseNodeArg(args []string) (*Node, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Expected a node ID.")
+	}
+	id, err := parseNodeId(args[0])
+	if err != nil {
+		return nil, err
+	}
+	node := c.o.getNode(id)
+	if node == nil {
+		return nil, errors.New(fmt.Sprintf("No node N%d.", id))
+	}
+	return node, nil
+}
+
+func (c *Console) help(args []string) error {
+	names := make([]string, 0, len(consoleCommands))
+	for name := range consoleCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.out, "  %-32s %s\n", consoleCommands[name].usage, consoleCommands[name].description)
+	}
+	fmt.Fprintf(c.out, "  %-32s %s\n", "exit", "Exits the console.")
+	return nil
+}
+
+func (c *Console) status(args []string) error {
+	nodes := c.o.getNodes()
+	nodeIds := make([]NodeId, 0, len(nodes))
+	for nodeId := range nodes {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Slice(nodeIds, func(i, j int) bool { return nodeIds[i] < nodeIds[j] })
+
+	for _, nodeId := range nodeIds {
+		node := nodes[nodeId]
+		status := "DEAD "
+		if node.IsAlive() {
+			status = "ALIVE"
+		}
+		fmt.Fprintf(c.out, "N%d: %s coordinator=N%d term=%d values=%v\n", nodeId, status, node.CoordinatorId(), node.Term(), node.Values())
+	}
+	return nil
+}
+
+func (c *Console) kill(args []string) error {
+	node, err := c.parseNodeArg(args)
+	if err != nil {
+		return err
+	}
+	node.Kill()
+	fmt.Fprintf(c.out, "Killed N%d.\n", node.Id)
+	return nil
+}
+
+func (c *Console) restart(args []string) error {
+	node, err := c.parseNodeArg(args)
+	if err != nil {
+		return err
+	}
+	if node.IsAlive() {
+		return errors.New(fmt.Sprintf("N%d is alive.", node.Id))
+	}
+	node.Restart()
+	fmt.Fprintf(c.out, "Restarted N%d.\n", node.Id)
+	return nil
+}
+
+func (c *Console) update(args []string) error {
+	if len(args) < 3 {
+		return errors.New("Expected a node ID, a key and a value.")
+	}
+	node, err := c.parseNodeArg(args[:1])
+	if err != nil {
+		return err
+	}
+	key, value := args[1], strings.Join(args[2:], " ")
+	if err := node.Write(key, value, c.timeout); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Wrote %s=\"%s\" through N%d.\n", key, value, node.Id)
+	return nil
+}
+
+func (c *Console) read(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New("Expected a node ID, a key, and optionally a consistency.")
+	}
+	node, err := c.parseNodeArg(args[:1])
+	if err != nil {
+		return err
+	}
+	key := args[1]
+
+	consistency := READ_LOCAL
+	if len(args) == 3 {
+		switch args[2] {
+		case "local":
+		case "coordinator":
+			consistency = READ_COORDINATOR
+		default:
+			return errors.New(fmt.Sprintf("Unknown consistency: %s", args[2]))
+		}
+	}
+
+	value, err := node.Read(key, consistency, c.timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "N%d read %s=\"%s\".\n", node.Id, key, value)
+	return nil
+}
+
+func (c *Console) add(args []string) error {
+	via, err := c.parseNodeArg(args)
+	if err != nil {
+		return err
+	}
+	nodeId, err := c.o.AddNode(via.Id)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Added N%d through N%d.\n", nodeId, via.Id)
+	return nil
+}
+
+func (c *Console) remove(args []string) error {
+	node, err := c.parseNodeArg(args)
+	if err != nil {
+		return err
+	}
+	c.o.RemoveNode(node.Id)
+	fmt.Fprintf(c.out, "Removed N%d.\n", node.Id)
+	return nil
+}
+
+func (c *Console) partition(args []string) error {
+	if len(args) < 2 {
+		return errors.New("Expected at least 2 groups of node IDs.")
+	}
+	groups := make([][]NodeId, 0, len(args))
+	for _, arg := range args {
+		group := make([]NodeId, 0)
+		for _, idStr := range strings.Split(arg, ",") {
+			id, err := parseNodeId(idStr)
+			if err != nil {
+				return err
+			}
+			group = append(group, id)
+		}
+		groups = append(groups, group)
+	}
+	c.o.Partition(groups...)
+	fmt.Fprintf(c.out, "Partitioned into %v.\n", groups)
+	return nil
+}
+
+func (c *Console) heal(args []string) error {
+	c.o.HealPartition()
+	fmt.Fprintln(c.out, "Healed partition.")
+	return nil
+}
+
+func (c *Console) profile(args []string) error {
+	if len(args) != 1 {
+		return errors.New(fmt.Sprintf("Expected a profile, one of %v.", NetworkProfileNames()))
+	}
+	if err := c.o.UseNetworkProfile(args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Using network profile %s.\n", args[0])
+	return nil
+}
+
+func (c *Console) wait(args []string) error {
+	timeout := c.timeout
+	if len(args) == 1 {
+		var err error
+		if timeout, err = time.ParseDuration(args[0]); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	coordIds, err := c.o.BlockUntilPartitionsConsistent(ctx)
+	if err != nil {
+		return err
+	}
+
+	coords := make(map[NodeId]bool)
+	for _, coordId := range coordIds {
+		coords[coordId] = true
+	}
+	coordList := make([]NodeId, 0, len(coords))
+	for coordId := range coords {
+		coordList = append(coordList, coordId)
+	}
+	sort.Slice(coordList, func(i, j int) bool { return coordList[i] < coordList[j] })
+	fmt.Fprintf(c.out, "Coordinators: %v\n", coordList)
+	return nil
+}
+
+func (c *Console) report(args []string) error {
+	report, ok := c.o.LastElectionReport()
+	if !ok {
+		return errors.New("No election has completed.")
+	}
+	fmt.Fprintln(c.out, report)
+	return nil
+}
+
+func (c *Console) sleep(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Expected a duration.")
+	}
+	duration, err := time.ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+	time.Sleep(duration)
+	return nil
+}
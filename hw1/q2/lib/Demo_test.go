@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"testing"
@@ -10,6 +11,7 @@ import (
 const DEMO_SEND_INTV = 5 * time.Second
 const DEMO_TIMEOUT = 2 * time.Second
 const DEMO_NODECOUNT = 10
+const DEMO_ELECTION_WAIT = 3 * (DEMO_SEND_INTV + DEMO_TIMEOUT) // Max time for a dead coordinator to be detected and replaced
 
 func systemPrint(s string) {
 	fmt.Printf("\n---SYSTEM: %v---\n", s)
@@ -26,11 +28,10 @@ func Test_BasicInit_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -48,11 +49,10 @@ func Test_BasicSync_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -60,13 +60,13 @@ func Test_BasicSync_DEMO(t *testing.T) {
 	// Update value
 	update_value := "Hello there."
 	systemPrint(fmt.Sprintf("Updating coordinator N%d with value: \"%v\".", coordId, update_value))
-	o.UpdateNodeValue(coordId, update_value, true)
+	o.UpdateNodeValue(coordId, "message", update_value, true)
 	systemPrint(fmt.Sprintf("Updated. Waiting for (send_interval + RTT/2) for values to propagate."))
 
 	time.Sleep(DEMO_SEND_INTV + DEMO_TIMEOUT/2) // Wait for the maximum time for values to be propagated (Send interval + RTT/2)
 
 	// Detect value
-	values := o.GetValues()
+	values := o.GetValues("message")
 	systemPrint(fmt.Sprintf("Wait complete. Printing values."))
 	for nodeId, value := range values {
 		fmt.Printf("SYSTEM: N%d Value : %v\n", nodeId, value)
@@ -84,11 +84,10 @@ func Test_BasicCrashAndReboot_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -98,12 +97,10 @@ func Test_BasicCrashAndReboot_DEMO(t *testing.T) {
 	systemPrint(fmt.Sprintf("Killing off coordinator node N%d.", coordId))
 	o.KillNode(coordId)
 	systemPrint(fmt.Sprintf("N%d killed. Blocking until election is completed...", coordId))
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	newCoordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	newCoordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -113,10 +110,9 @@ func Test_BasicCrashAndReboot_DEMO(t *testing.T) {
 	systemPrint(fmt.Sprintf("Rebooting original coordinator node N%d...", coordId))
 	o.RestartNode(coordId)
 	systemPrint(fmt.Sprintf("Rebooted N%d. Blocking until election is completed...", coordId))
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -134,11 +130,10 @@ func Test_DurabilityCrashAndReboot_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -157,12 +152,10 @@ func Test_DurabilityCrashAndReboot_DEMO(t *testing.T) {
 	o.KillNode(7)
 	o.KillNode(5)
 	systemPrint("Nodes killed. Blocking till re-election is done.")
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	newCoordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	newCoordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -173,12 +166,10 @@ func Test_DurabilityCrashAndReboot_DEMO(t *testing.T) {
 	o.KillNode(23)
 	o.KillNode(20)
 	systemPrint("Nodes killed. Blocking till re-election is done.")
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	newCoordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	newCoordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -187,11 +178,10 @@ func Test_DurabilityCrashAndReboot_DEMO(t *testing.T) {
 	// Reboot
 	systemPrint("Rebooting N22...")
 	o.RestartNode(22)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	newCoordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	newCoordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -213,11 +203,10 @@ func Test_NonCoordCrashDuringElection_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -227,17 +216,16 @@ func Test_NonCoordCrashDuringElection_DEMO(t *testing.T) {
 	systemPrint(fmt.Sprintf("Killing off coordinator node N%d.", coordId))
 	o.KillNode(coordId)
 	systemPrint(fmt.Sprintf("N%d killed. Blocking until election starts...", coordId))
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
+	blockTillElectionStart(o, DEMO_ELECTION_WAIT)
 
 	// Killing of arbitrary non-coordinator during election
 	arbId := NodeId(coordId - 2)
 	o.KillNode(arbId)
 	systemPrint(fmt.Sprintf("N%d killed. Blocking until election is over...", arbId))
-	o.BlockTillElectionDone(5, time.Second)
+	blockTillElectionDone(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	newCoordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	newCoordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -247,10 +235,9 @@ func Test_NonCoordCrashDuringElection_DEMO(t *testing.T) {
 	systemPrint(fmt.Sprintf("Rebooting non-coordinator node N%d...", arbId))
 	o.RestartNode(arbId)
 	systemPrint(fmt.Sprintf("Rebooted N%d. Blocking until election is completed...", arbId))
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -279,21 +266,19 @@ func Test_PartialAnnouncement_DEMO(t *testing.T) {
 	// Manually set node coordinators to simulate partial announcement
 	halfId := (DEMO_NODECOUNT - 2) / 2
 	for i := 0; i < halfId; i++ {
-		o.Nodes[NodeId(i)].CoordinatorId = DEMO_NODECOUNT - 2
+		o.Nodes[NodeId(i)].setCoordinatorId(DEMO_NODECOUNT - 2)
 	}
 	systemPrint(fmt.Sprintf("Nodes with IDs from %d to %d have coordinator N%d.", 0, halfId, DEMO_NODECOUNT-1))
 	for i := halfId; i < DEMO_NODECOUNT-2; i++ {
-		o.Nodes[NodeId(i)].CoordinatorId = DEMO_NODECOUNT - 1
+		o.Nodes[NodeId(i)].setCoordinatorId(DEMO_NODECOUNT - 1)
 	}
 	systemPrint(fmt.Sprintf("Nodes with IDs from %d to %d have coordinator N%d.", halfId, DEMO_NODECOUNT-2, DEMO_NODECOUNT))
 
 	// Initialise the messed-up system
 	o.Initiate()
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -311,11 +296,10 @@ func Test_SyncCrashReboot_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -324,13 +308,13 @@ func Test_SyncCrashReboot_DEMO(t *testing.T) {
 	// Update values
 	update_value := "i love the bully algorithm"
 	systemPrint(fmt.Sprintf("Updating N%d with value \"%v\".", coordId, update_value))
-	o.UpdateNodeValue(coordId, update_value, true)
+	o.UpdateNodeValue(coordId, "message", update_value, true)
 	systemPrint(fmt.Sprintf("Updated. Waiting for (send_interval + RTT/2) for values to propagate."))
 
 	time.Sleep(DEMO_SEND_INTV + DEMO_TIMEOUT/2) // Wait for the maximum time for values to be propagated (Send interval + RTT/2)
 
 	// Detect value
-	values := o.GetValues()
+	values := o.GetValues("message")
 	systemPrint(fmt.Sprintf("Wait complete. Printing values."))
 	for nodeId, value := range values {
 		fmt.Printf("SYSTEM: N%d Value : %v\n", nodeId, value)
@@ -340,10 +324,8 @@ func Test_SyncCrashReboot_DEMO(t *testing.T) {
 	systemPrint(fmt.Sprintf("Killing off coordinator node N%d.", coordId))
 	o.KillNode(coordId)
 	systemPrint(fmt.Sprintf("N%d killed. Blocking until election is completed...", coordId))
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
-	newCoordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
+	newCoordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -352,7 +334,7 @@ func Test_SyncCrashReboot_DEMO(t *testing.T) {
 	// Update second coordinator
 	update_value = "no i dont"
 	systemPrint(fmt.Sprintf("Updating N%d with value \"%v\".", newCoordId, update_value))
-	o.UpdateNodeValue(newCoordId, update_value, true)
+	o.UpdateNodeValue(newCoordId, "message", update_value, true)
 	systemPrint(fmt.Sprintf("Updated. Waiting for (send_interval + RTT/2) for values to propagate."))
 
 	time.Sleep(DEMO_SEND_INTV + DEMO_TIMEOUT/2) // Wait for the maximum time for values to be propagated (Send interval + RTT/2)
@@ -361,10 +343,9 @@ func Test_SyncCrashReboot_DEMO(t *testing.T) {
 	systemPrint(fmt.Sprintf("Rebooting original coordinator node N%d...", coordId))
 	o.RestartNode(coordId)
 	systemPrint(fmt.Sprintf("Rebooted N%d. Blocking until election is completed...", coordId))
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -373,13 +354,13 @@ func Test_SyncCrashReboot_DEMO(t *testing.T) {
 	// Update values
 	update_value = "yes i do"
 	systemPrint(fmt.Sprintf("Updating N%d with value \"%v\".", coordId, update_value))
-	o.UpdateNodeValue(coordId, update_value, true)
+	o.UpdateNodeValue(coordId, "message", update_value, true)
 	systemPrint(fmt.Sprintf("Updated. Waiting for (send_interval + RTT/2) for values to propagate."))
 
 	time.Sleep(DEMO_SEND_INTV + DEMO_TIMEOUT/2) // Wait for the maximum time for values to be propagated (Send interval + RTT/2)
 
 	// Detect value
-	values = o.GetValues()
+	values = o.GetValues("message")
 	systemPrint(fmt.Sprintf("Wait complete. Printing values."))
 	for nodeId, value := range values {
 		fmt.Printf("SYSTEM: N%d Value : %v\n", nodeId, value)
@@ -397,11 +378,10 @@ func Test_SimulateBestCase_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -417,22 +397,22 @@ func Test_SimulateBestCase_DEMO(t *testing.T) {
 
 	systemPrint(fmt.Sprintf("Killing coordinator N%d.", coordId))
 	o.KillNode(coordId)
-	time.Sleep(DEMO_SEND_INTV + DEMO_TIMEOUT/2) // Wait for the maximum time for values to be propagated (Send interval + RTT/2)
-
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
 
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
 	systemPrint(fmt.Sprintf("Re-election complete with coordinator N%d.", coordId))
+	if report, ok := o.LastElectionReport(); ok {
+		systemPrint(report.String())
+	}
 }
 
 func Test_SimulateWorstCase_DEMO(t *testing.T) {
@@ -446,11 +426,10 @@ func Test_SimulateWorstCase_DEMO(t *testing.T) {
 	defer o.Exit()
 
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
@@ -466,20 +445,73 @@ func Test_SimulateWorstCase_DEMO(t *testing.T) {
 
 	systemPrint(fmt.Sprintf("Killing coordinator N%d.", coordId))
 	o.KillNode(coordId)
-	time.Sleep(DEMO_SEND_INTV + DEMO_TIMEOUT/2) // Wait for the maximum time for values to be propagated (Send interval + RTT/2)
-
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, DEMO_ELECTION_WAIT)
 
 	// Detect coordinator
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
 
-	coordId, err = o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err = blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
 	systemPrint(fmt.Sprintf("Re-election complete with coordinator N%d.", coordId))
+	if report, ok := o.LastElectionReport(); ok {
+		systemPrint(report.String())
+	}
+}
+
+func Test_GossipVsBroadcast_DEMO(t *testing.T) {
+	if testing.Short() {
+		t.Skip("DEMO GossipVsBroadcast Test skipped in short mode.")
+	}
+
+	nodeCount := 25
+	for _, gossip := range []bool{false, true} {
+		mode := "broadcast"
+		if gossip {
+			mode = "gossip"
+		}
+		systemPrint(fmt.Sprintf("Running GossipVsBroadcast with %d nodes, using %s.", nodeCount, mode))
+		o := NewOrchestrator(nodeCount, DEMO_SEND_INTV, DEMO_TIMEOUT)
+		if gossip {
+			if err := o.EnableGossip(DEFAULT_GOSSIP_CONFIG); err != nil {
+				log.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		o.Initiate()
+		waitForElection(o, DEMO_ELECTION_WAIT)
+		coordId, err := blockUntilCoordinatorConsistent(o, DEMO_ELECTION_WAIT)
+		if err != nil {
+			log.Fatalf("Unexpected error: %v", err)
+		}
+
+		// Measure the time for an update to reach every node, and the messages sent over the next few send intervals
+		before := o.MessageCountsByNode()
+		start := time.Now()
+		o.UpdateNodeValue(coordId, "message", "Hello there.", false)
+		ctx, cancel := context.WithTimeout(context.Background(), DEMO_ELECTION_WAIT)
+		if err := o.BlockUntilStateConsistent(ctx, map[string]string{"message": "Hello there."}); err != nil {
+			log.Fatalf("Unexpected error: %v", err)
+		}
+		cancel()
+		convergence := time.Since(start)
+		time.Sleep(3*DEMO_SEND_INTV - convergence)
+		after := o.MessageCountsByNode()
+
+		maxSent, totalSent := 0, 0
+		for nodeId, counts := range after {
+			sent := counts[MSG_TYPE_SYNC] + counts[MSG_TYPE_GOSSIP] - before[nodeId][MSG_TYPE_SYNC] - before[nodeId][MSG_TYPE_GOSSIP]
+			totalSent += sent
+			if sent > maxSent {
+				maxSent = sent
+			}
+		}
+		systemPrint(fmt.Sprintf("%s: converged in %v. Over %v, sent %d data messages in total, at most %d from a single node.",
+			mode, convergence, 3*DEMO_SEND_INTV, totalSent, maxSent))
+		o.Exit()
+	}
 }
@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EVENT_ELECTION_START      EventType = "ELECTION_START"      // A node started its own election
+	EVENT_ELECTION_VETOED               = "ELECTION_VETOED"     // A node's election was vetoed by a higher node, ending it
+	EVENT_ELECTION_WON                  = "ELECTION_WON"        // A node's election received no vetoes, ending it
+	EVENT_ELECTION_NO_QUORUM            = "ELECTION_NO_QUORUM"  // A node's election received no vetoes, but no majority acknowledged it, ending it
+	EVENT_COORDINATOR_CHANGED           = "COORDINATOR_CHANGED" // A node's coordinator ID changed
+	EVENT_NODE_KILLED                   = "NODE_KILLED"         // A node was killed
+	EVENT_NODE_RESTARTED                = "NODE_RESTARTED"      // A node was restarted
+	EVENT_DATA_CHANGED                  = "DATA_CHANGED"        // A node's data changed
+)
+
+// An event published by a node.
+// The `CoordinatorId` field is the node's coordinator ID at the time of the event.
+type Event struct {
+	Type          EventType
+	NodeId        NodeId
+	CoordinatorId NodeId
+	Time          time.Time
+}
+
+// Handles an event. This is called synchronously by the publishing node, so it should not block.
+type EventHandler func(Event)
+
+// Publishes events to subscribed handlers.
+// Handlers are called synchronously, so once Publish returns, every subscriber has seen the event.
+type EventBus struct {
+	lock         *sync.Mutex
+	handlers     map[int]EventHandler
+	handlerCount int // Used to generate subscription IDs
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{&sync.Mutex{}, make(map[int]EventHandler), 0}
+}
+
+// Subscribes a handler to all future events. Returns a function to unsubscribe the handler.
+func (bus *EventBus) Subscribe(handler EventHandler) func() {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.handlerCount++
+	subId := bus.handlerCount
+	bus.handlers[subId] = handler
+
+	return func() {
+		bus.lock.Lock()
+		defer bus.lock.Unlock()
+		delete(bus.handlers, subId)
+	}
+}
+
+// Publishes an event to all subscribed handlers.
+func (bus *EventBus) Publish(event Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	for _, handler := range bus.handlers {
+		handler(event)
+	}
+}
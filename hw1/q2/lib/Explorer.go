@@ -0,0 +1,732 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+  INTERLEAVING EXPLORER
+  Runs a small cluster of real Nodes under a deterministic scheduler, where every message send and delivery, timeout,
+  SYNC broadcast, kill, restart, join and leave is an explicit choice point. The explorer enumerates (or randomly
+  walks) the interleavings of the cluster, checking invariants along the way.
+
+  The nodes run the Bully algorithm with their own handlers, but none of their goroutines:
+  - Nodes send through an explorer transport, which queues each message in the sender's outbox. Messages leave the
+    outbox one per step, so a node can crash midway through a broadcast, and are delivered one per step, through the
+    handler of HandleControl or HandleData.
+  - Elections are stepped (see Node.stepped), so StartElection only sends ELECTION_START. The explorer ends the
+    election once a veto has arrived, or once no veto can arrive. Like the real system, we assume a veto arrives
+    within the timeout.
+  - A coordinator's SYNC broadcast is a step, like a tick of SyncData. It is only taken once nothing else is in
+    flight, and only if it changes the state, so a settled cluster doesn't keep exchanging heartbeats.
+  - A detection timeout, the `time.After` in HandleData, only fires once the cluster has settled, for a node that
+    no live coordinator sends SYNCs to.
+  - Joins go through the messages of Join, and time out once neither the JOIN nor its response is in flight.
+  Each step is taken on a copy of the cluster (see cloneNode). A violation is described by replaying its interleaving
+  on a new cluster, so the nodes must be deterministic: a node sending to several others sends in order of ID (see
+  sortEndpoints).
+
+  The quorum election, invitation algorithm and gossip depend on the wall clock, and aren't explored.
+*/
+
+// Invariants checked by the explorer.
+const (
+	INVARIANT_ONE_COORDINATOR    = "no two live nodes believe they are coordinator once the cluster has settled"
+	INVARIANT_EVENTUAL_AGREEMENT = "eventually all live nodes agree on the highest live node as coordinator"
+)
+
+type ExplorerConfig struct {
+	NodeCount   int
+	MaxKills    int  // Maximum number of kills in an interleaving
+	MaxRestarts int  // Maximum number of restarts in an interleaving
+	MaxLeaves   int  // Maximum number of nodes leaving the cluster in an interleaving
+	Joiners     int  // Number of nodes that may join the cluster, with the IDs after the initial nodes
+	MaxDepth    int  // Interleavings are cut off after this many steps
+	Stable      bool // If true, start with the highest node as coordinator, instead of every node starting an election
+	NoDetection bool // If true, nodes don't detect a dead coordinator (see DisableDeadCoordDetection)
+}
+
+// An interleaving that breaks an invariant.
+type Violation struct {
+	Invariant string
+	Trace     []string // The steps leading to the violation
+}
+
+func (v *Violation) String() string {
+	return fmt.Sprintf("Violated \"%s\" after:\n  %s", v.Invariant, strings.Join(v.Trace, "\n  "))
+}
+
+type ExplorerResult struct {
+	States    int        // Number of distinct states visited
+	Terminal  int        // Number of states where no step is possible, where agreement is checked
+	Truncated int        // Number of interleavings cut off at MaxDepth
+	Violation *Violation // The first violation found, if any
+}
+
+/**
+  EXPLORED CLUSTER
+*/
+
+// Whether a node of the explored cluster is a member of it.
+type explorerMembership int
+
+const (
+	MEMBER_OUTSIDE explorerMembership = iota // Yet to join
+	MEMBER_JOINING
+	MEMBER_JOINED
+	MEMBER_LEFT // Left the cluster, or gave up on joining
+)
+
+// Queues the messages of a node in its outbox, to be sent by the explorer.
+type explorerTransport struct {
+	cluster *explorerCluster
+	nodeId  NodeId
+}
+
+func (t *explorerTransport) Deliver(msg Message, dst NodeEndpoint) {
+	t.cluster.outboxes[t.nodeId] = append(t.cluster.outboxes[t.nodeId], msg)
+}
+
+func (t *explorerTransport) Close() {}
+
+type explorerCluster struct {
+	config   ExplorerConfig
+	nodes    []*Node
+	members  []explorerMembership
+	outboxes [][]Message // Messages sent by each node, yet to leave the node
+	inFlight []Message
+	kills    int
+	restarts int
+	leaves   int
+	trace    []explorerStep // The steps taken to reach this state
+}
+
+func newExplorerCluster(config ExplorerConfig) *explorerCluster {
+	total := config.NodeCount + config.Joiners
+	c := &explorerCluster{
+		config,
+		make([]*Node, total), make([]explorerMembership, total),
+		make([][]Message, total), make([]Message, 0),
+		0, 0, 0,
+		make([]explorerStep, 0),
+	}
+
+	endpoints := make([]NodeEndpoint, 0, config.NodeCount)
+	for i := range c.nodes {
+		// Stepped nodes never wait on a timer, so the send interval and timeout are unused
+		node := NewNode(NodeId(i), 0, 0, config.NoDetection, total)
+		node.transport = &explorerTransport{c, node.Id}
+		node.stepped = true
+		c.nodes[i] = node
+		if i < config.NodeCount {
+			c.members[i] = MEMBER_JOINED
+			endpoints = append(endpoints, node.Endpoint)
+		}
+	}
+	for _, endpoint := range endpoints {
+		c.nodes[endpoint.Id].setEndpoints(endpoints)
+	}
+
+	if config.Stable {
+		coord := c.nodes[config.NodeCount-1]
+		term := coord.nextTerm()
+		for _, endpoint := range endpoints {
+			c.nodes[endpoint.Id].observeTerm(term)
+			c.nodes[endpoint.Id].setCoordinatorId(coord.Id)
+		}
+	} else {
+		// Every node starts an election upon initialisation
+		for _, endpoint := range endpoints {
+			c.nodes[endpoint.Id].StartElection()
+		}
+	}
+	return c
+}
+
+// Returns a copy of the cluster, to take a step from without changing this one.
+func (c *explorerCluster) clone() *explorerCluster {
+	other := &explorerCluster{
+		c.config,
+		make([]*Node, len(c.nodes)), append([]explorerMembership(nil), c.members...),
+		make([][]Message, len(c.outboxes)), append([]Message(nil), c.inFlight...),
+		c.kills, c.restarts, c.leaves,
+		append([]explorerStep(nil), c.trace...),
+	}
+	for i, node := range c.nodes {
+		other.nodes[i] = cloneNode(node, &explorerTransport{other, node.Id})
+		other.outboxes[i] = append([]Message(nil), c.outboxes[i]...)
+	}
+	return other
+}
+
+// Returns a copy of a stepped node, sending through `transport`.
+// Only the state used by the Bully algorithm is copied, the rest is shared.
+func cloneNode(node *Node, transport Transport) *Node {
+	other := *node
+	other.transport = transport
+
+	node.state.lock.RLock()
+	state := *node.state
+	node.state.lock.RUnlock()
+	state.lock = &sync.RWMutex{}
+	state.kv = state.kv.copy()
+	state.dirtyKeys = make(map[string]bool, len(node.state.dirtyKeys))
+	for key := range node.state.dirtyKeys {
+		state.dirtyKeys[key] = true
+	}
+	state.endpoints = make(map[NodeId]NodeEndpoint, len(node.state.endpoints))
+	for nodeId, endpoint := range node.state.endpoints {
+		state.endpoints[nodeId] = endpoint
+	}
+	other.state = &state
+
+	other.electionLock = &sync.Mutex{}
+	if electing(node) {
+		other.electionLock.Lock()
+	}
+	other.vetoChan = cloneChan(node.vetoChan)
+	other.joinChan = cloneChan(node.joinChan)
+	other.quitChan = make(chan bool)
+	return &other
+}
+
+// Returns a channel with the same capacity and messages as `ch`, leaving `ch` as it was.
+func cloneChan(ch chan Message) chan Message {
+	other := make(chan Message, cap(ch))
+	for i := len(ch); i > 0; i-- {
+		msg := <-ch
+		other <- msg
+		ch <- msg
+	}
+	return other
+}
+
+// Returns true if the node holds its election lock.
+func electing(node *Node) bool {
+	if node.electionLock.TryLock() {
+		node.electionLock.Unlock()
+		return false
+	}
+	return true
+}
+
+// Returns true if the node is a member of the cluster and alive.
+func (c *explorerCluster) live(id NodeId) bool {
+	return c.members[id] == MEMBER_JOINED && c.nodes[id].IsAlive()
+}
+
+// Returns true if a veto to the node could still arrive within its timeout.
+func (c *explorerCluster) awaitingVeto(id NodeId) bool {
+	for _, msg := range c.pending() {
+		if (msg.Type == MSG_TYPE_ELECTION_START && msg.SrcId == id && msg.DstId > id) ||
+			(msg.Type == MSG_TYPE_ELECTION_VETO && msg.DstId == id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the node's SYNC broadcast has yet to be delivered.
+func (c *explorerCluster) syncPending(id NodeId) bool {
+	for _, msg := range c.pending() {
+		if msg.Type == MSG_TYPE_SYNC && msg.SrcId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the node's JOIN, or the response to it, has yet to be delivered.
+func (c *explorerCluster) joinPending(id NodeId) bool {
+	for _, msg := range c.pending() {
+		if (msg.Type == MSG_TYPE_JOIN && msg.SrcId == id) || (msg.Type == MSG_TYPE_JOIN_RESP && msg.DstId == id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns every message in an outbox or in flight.
+func (c *explorerCluster) pending() []Message {
+	msgs := append([]Message(nil), c.inFlight...)
+	for _, outbox := range c.outboxes {
+		msgs = append(msgs, outbox...)
+	}
+	return msgs
+}
+
+// Returns true if no messages are in flight or queued, and no election is ongoing.
+// Detection timeouts are much longer than an election, so they only fire once everything else has settled.
+func (c *explorerCluster) quiescent() bool {
+	if len(c.pending()) > 0 {
+		return false
+	}
+	for _, node := range c.nodes {
+		if electing(node) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the node would hear from no coordinator within its detection timeout.
+func (c *explorerCluster) detectionDue(id NodeId) bool {
+	node := c.nodes[id]
+	if !node.IsAlive() || node.isCoordinator() || node.detectDeadCoordDisabled() {
+		return false
+	}
+	for otherId, other := range c.nodes {
+		if NodeId(otherId) == id || c.members[otherId] == MEMBER_OUTSIDE || !other.isCoordinator() {
+			continue
+		}
+		if _, ok := other.getEndpoint(id); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if a SYNC broadcast by the node, once delivered, changes the state.
+func (c *explorerCluster) syncChanges(id NodeId) bool {
+	other := c.clone()
+	other.apply(explorerStep{STEP_SYNC, id, -1, ""})
+	for len(other.outboxes[id]) > 0 {
+		other.apply(explorerStep{STEP_SEND, id, -1, ""})
+	}
+	for len(other.inFlight) > 0 {
+		other.apply(explorerStep{STEP_DELIVER, other.inFlight[0].DstId, -1, msgKey(other.inFlight[0])})
+	}
+	return other.key() != c.key()
+}
+
+// Returns true if all live nodes agree on the highest live node as coordinator.
+func (c *explorerCluster) agreed() bool {
+	highest := NodeId(-1)
+	for id := range c.nodes {
+		if c.live(NodeId(id)) {
+			highest = NodeId(id)
+		}
+	}
+	for id, node := range c.nodes {
+		if c.live(NodeId(id)) && node.CoordinatorId() != highest {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the number of live nodes that believe they are coordinator.
+func (c *explorerCluster) coordinatorCount() int {
+	count := 0
+	for id, node := range c.nodes {
+		if c.live(NodeId(id)) && node.isCoordinator() {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the violated invariant, if any, given the steps possible from the state.
+func (c *explorerCluster) check(steps []explorerStep) string {
+	settled := c.quiescent()
+	for _, step := range steps {
+		if step.Type == STEP_SYNC {
+			settled = false
+		}
+	}
+	if settled && c.coordinatorCount() > 1 {
+		return INVARIANT_ONE_COORDINATOR
+	}
+	if len(steps) == 0 && !c.agreed() {
+		return INVARIANT_EVENTUAL_AGREEMENT
+	}
+	return ""
+}
+
+/**
+  STATE KEYS
+*/
+
+// Returns a key identifying a message.
+func msgKey(msg Message) string {
+	b := make([]byte, 0, 64)
+	b = append(b, msg.Type...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(msg.SrcId), 10)
+	b = append(b, '>')
+	b = strconv.AppendInt(b, int64(msg.DstId), 10)
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, msg.Data)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(msg.ReqId), 10)
+	for _, endpoint := range msg.Endpoints {
+		b = append(b, ',')
+		b = strconv.AppendInt(b, int64(endpoint.Id), 10)
+	}
+	return string(b)
+}
+
+func msgString(msg Message) string {
+	if msg.Type == MSG_TYPE_ELECTION_WIN {
+		return fmt.Sprintf("N%d -> N%d: %s (term %s)", msg.SrcId, msg.DstId, msg.Type, msg.Data)
+	}
+	return fmt.Sprintf("N%d -> N%d: %s", msg.SrcId, msg.DstId, msg.Type)
+}
+
+// Returns a key identifying the state of a node.
+func nodeKey(node *Node) string {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	endpointIds := make([]int, 0, len(node.state.endpoints))
+	for nodeId := range node.state.endpoints {
+		endpointIds = append(endpointIds, int(nodeId))
+	}
+	sort.Ints(endpointIds)
+	return fmt.Sprintf("%s,%d,%d,%t,%d,%v,%v,%v", node.state.status, node.state.coordinatorId, node.state.term,
+		electing(node), len(node.vetoChan), node.state.kv.Version, node.state.syncedVersion, endpointIds)
+}
+
+// Returns a key identifying the state, treating in-flight messages as a multiset.
+func (c *explorerCluster) key() string {
+	b := make([]byte, 0, 512)
+	for id, node := range c.nodes {
+		b = strconv.AppendInt(b, int64(c.members[id]), 10)
+		b = append(b, ',')
+		b = append(b, nodeKey(node)...)
+		for _, msg := range c.outboxes[id] {
+			b = append(b, '(')
+			b = append(b, msgKey(msg)...)
+			b = append(b, ')')
+		}
+		b = append(b, '|')
+	}
+
+	msgs := make([]string, len(c.inFlight))
+	for i, msg := range c.inFlight {
+		msgs[i] = msgKey(msg)
+	}
+	sort.Strings(msgs)
+	for _, msg := range msgs {
+		b = append(b, '(')
+		b = append(b, msg...)
+		b = append(b, ')')
+	}
+
+	return fmt.Sprintf("%s|%d,%d,%d", b, c.kills, c.restarts, c.leaves)
+}
+
+/**
+  CHOICE POINTS
+*/
+
+type explorerStepType int
+
+const (
+	STEP_DELIVER explorerStepType = iota
+	STEP_SEND
+	STEP_ELECTION_TIMEOUT
+	STEP_DETECTION_TIMEOUT
+	STEP_SYNC
+	STEP_KILL
+	STEP_RESTART
+	STEP_JOIN
+	STEP_JOIN_TIMEOUT
+	STEP_LEAVE
+)
+
+type explorerStep struct {
+	Type   explorerStepType
+	NodeId NodeId
+	Via    NodeId // The node joined through, for STEP_JOIN
+	Msg    string // Key of the message delivered, for STEP_DELIVER
+}
+
+// Returns every step possible from the state.
+func (c *explorerCluster) steps() []explorerStep {
+	config := c.config
+
+	// Sending a queued message only conflicts with killing the sender, and delivering a message to a node that isn't
+	// alive only conflicts with restarting it. Once no more kills or restarts can happen, the order of these steps
+	// relative to other steps doesn't matter, so we only take one of them and skip the rest.
+	if c.kills >= config.MaxKills && c.restarts >= config.MaxRestarts {
+		for i, outbox := range c.outboxes {
+			if len(outbox) > 0 {
+				return []explorerStep{{STEP_SEND, NodeId(i), -1, ""}}
+			}
+		}
+		for _, msg := range c.inFlight {
+			if !c.nodes[msg.DstId].IsAlive() {
+				return []explorerStep{{STEP_DELIVER, msg.DstId, -1, msgKey(msg)}}
+			}
+		}
+	}
+
+	steps := make([]explorerStep, 0)
+
+	// Deliver any in-flight message, skipping duplicates
+	seen := make(map[string]bool)
+	for _, msg := range c.inFlight {
+		key := msgKey(msg)
+		if !seen[key] {
+			seen[key] = true
+			steps = append(steps, explorerStep{STEP_DELIVER, msg.DstId, -1, key})
+		}
+	}
+
+	quiescent := c.quiescent()
+	joinable := true // Only the lowest outside node may join, as AddNode adds nodes in order of ID
+	for i, node := range c.nodes {
+		id := NodeId(i)
+		switch c.members[i] {
+		case MEMBER_OUTSIDE:
+			if joinable {
+				joinable = false
+				for viaId := range c.nodes {
+					if c.live(NodeId(viaId)) {
+						steps = append(steps, explorerStep{STEP_JOIN, id, NodeId(viaId), ""})
+					}
+				}
+			}
+			continue
+		case MEMBER_JOINING:
+			if !c.joinPending(id) {
+				steps = append(steps, explorerStep{STEP_JOIN_TIMEOUT, id, -1, ""})
+			}
+		}
+
+		// An election goes on even if the node is killed or leaves, until it times out
+		if len(c.outboxes[i]) > 0 {
+			steps = append(steps, explorerStep{STEP_SEND, id, -1, ""})
+		} else if electing(node) && (len(node.vetoChan) > 0 || !c.awaitingVeto(id)) {
+			steps = append(steps, explorerStep{STEP_ELECTION_TIMEOUT, id, -1, ""})
+		}
+
+		if c.members[i] == MEMBER_LEFT {
+			continue
+		}
+		if !node.IsAlive() {
+			if c.restarts < config.MaxRestarts {
+				steps = append(steps, explorerStep{STEP_RESTART, id, -1, ""})
+			}
+			continue
+		}
+
+		if node.isCoordinator() && !c.syncPending(id) && (quiescent && c.syncChanges(id)) {
+			steps = append(steps, explorerStep{STEP_SYNC, id, -1, ""})
+		}
+		if quiescent && c.detectionDue(id) {
+			steps = append(steps, explorerStep{STEP_DETECTION_TIMEOUT, id, -1, ""})
+		}
+		if c.kills < config.MaxKills {
+			steps = append(steps, explorerStep{STEP_KILL, id, -1, ""})
+		}
+		if c.members[i] == MEMBER_JOINED && c.leaves < config.MaxLeaves {
+			steps = append(steps, explorerStep{STEP_LEAVE, id, -1, ""})
+		}
+	}
+	return steps
+}
+
+// Takes a step, running the handlers of the nodes involved.
+func (c *explorerCluster) apply(step explorerStep) {
+	c.trace = append(c.trace, step)
+	node := c.nodes[step.NodeId]
+
+	switch step.Type {
+	case STEP_DELIVER:
+		for i, msg := range c.inFlight {
+			if msgKey(msg) != step.Msg {
+				continue
+			}
+			c.inFlight = append(c.inFlight[:i], c.inFlight[i+1:]...)
+			if isDataMsg(msg.Type) {
+				node.handleDataMsg(msg)
+			} else {
+				node.handleControlMsg(msg)
+			}
+			break
+		}
+		// Join passes the response on from joinChan
+		if c.members[step.NodeId] == MEMBER_JOINING && len(node.joinChan) > 0 {
+			if err := node.completeJoin(<-node.joinChan); err != nil {
+				node.Leave()
+				c.members[step.NodeId] = MEMBER_LEFT
+			} else {
+				c.members[step.NodeId] = MEMBER_JOINED
+			}
+		}
+	case STEP_SEND:
+		c.inFlight = append(c.inFlight, c.outboxes[step.NodeId][0])
+		c.outboxes[step.NodeId] = c.outboxes[step.NodeId][1:]
+	case STEP_ELECTION_TIMEOUT:
+		node.endElection(len(node.vetoChan) > 0)
+	case STEP_DETECTION_TIMEOUT:
+		node.detectDeadCoordinator()
+	case STEP_SYNC:
+		node.broadcastSync()
+	case STEP_KILL:
+		node.Kill()
+		c.outboxes[step.NodeId] = nil
+		c.kills++
+	case STEP_RESTART:
+		node.Restart()
+		c.restarts++
+	case STEP_JOIN:
+		node.requestJoin(c.nodes[step.Via].Endpoint)
+		c.members[step.NodeId] = MEMBER_JOINING
+	case STEP_JOIN_TIMEOUT:
+		// AddNode removes a node that failed to join
+		node.Leave()
+		c.members[step.NodeId] = MEMBER_LEFT
+	case STEP_LEAVE:
+		node.Leave()
+		c.members[step.NodeId] = MEMBER_LEFT
+		c.leaves++
+	}
+}
+
+// Describes a step taken from the state, for traces.
+func (c *explorerCluster) describe(step explorerStep) string {
+	node := c.nodes[step.NodeId]
+	switch step.Type {
+	case STEP_DELIVER:
+		for _, msg := range c.inFlight {
+			if msgKey(msg) == step.Msg {
+				return "deliver " + msgString(msg)
+			}
+		}
+	case STEP_SEND:
+		return "send " + msgString(c.outboxes[step.NodeId][0])
+	case STEP_ELECTION_TIMEOUT:
+		if len(node.vetoChan) > 0 {
+			return fmt.Sprintf("N%d: election vetoed", step.NodeId)
+		}
+		return fmt.Sprintf("N%d: election timeout, won term %d", step.NodeId, nextTermFrom(node.Term(), step.NodeId))
+	case STEP_DETECTION_TIMEOUT:
+		return fmt.Sprintf("N%d: detected no coordinator", step.NodeId)
+	case STEP_SYNC:
+		return fmt.Sprintf("N%d: broadcasts SYNC", step.NodeId)
+	case STEP_KILL:
+		return fmt.Sprintf("kill N%d", step.NodeId)
+	case STEP_RESTART:
+		return fmt.Sprintf("restart N%d", step.NodeId)
+	case STEP_JOIN:
+		return fmt.Sprintf("N%d joins through N%d", step.NodeId, step.Via)
+	case STEP_JOIN_TIMEOUT:
+		return fmt.Sprintf("N%d: join timed out", step.NodeId)
+	case STEP_LEAVE:
+		return fmt.Sprintf("N%d leaves", step.NodeId)
+	}
+	return fmt.Sprintf("unknown step %d", step.Type)
+}
+
+/**
+  EXPLORATION
+*/
+
+// Replays the interleaving to describe each step.
+func newViolation(config ExplorerConfig, invariant string, trace []explorerStep) *Violation {
+	c := newExplorerCluster(config)
+	descriptions := make([]string, len(trace))
+	for i, step := range trace {
+		descriptions[i] = c.describe(step)
+		c.apply(step)
+	}
+	return &Violation{invariant, descriptions}
+}
+
+// Discards the logs of the nodes while exploring, as they handle messages in many copies of each state.
+// Returns a function to restore them.
+func silenceLogs() func() {
+	writer := log.Writer()
+	log.SetOutput(io.Discard)
+	return func() {
+		log.SetOutput(writer)
+	}
+}
+
+// Explores every interleaving of the configured cluster, depth-first, stopping at the first violation.
+// States reached by different interleavings are only explored once.
+func Explore(config ExplorerConfig) ExplorerResult {
+	defer silenceLogs()()
+	result := ExplorerResult{}
+	visited := make(map[string]bool)
+
+	var explore func(c *explorerCluster) bool
+	explore = func(c *explorerCluster) bool {
+		key := c.key()
+		if visited[key] {
+			return false
+		}
+		visited[key] = true
+		result.States++
+
+		steps := c.steps()
+		if invariant := c.check(steps); invariant != "" {
+			result.Violation = newViolation(config, invariant, c.trace)
+			return true
+		}
+		if len(steps) == 0 {
+			result.Terminal++
+			return false
+		}
+		if len(c.trace) >= config.MaxDepth {
+			result.Truncated++
+			return false
+		}
+
+		for _, step := range steps {
+			next := c.clone()
+			next.apply(step)
+			if explore(next) {
+				return true
+			}
+		}
+		return false
+	}
+
+	explore(newExplorerCluster(config))
+	return result
+}
+
+// Takes `walks` random interleavings of the configured cluster, stopping at the first violation.
+// The same seed always takes the same interleavings.
+func RandomWalk(config ExplorerConfig, walks int, seed int64) ExplorerResult {
+	defer silenceLogs()()
+	result := ExplorerResult{}
+	rng := rand.New(rand.NewSource(seed))
+	visited := make(map[string]bool)
+
+	for walk := 0; walk < walks; walk++ {
+		c := newExplorerCluster(config)
+		for {
+			if key := c.key(); !visited[key] {
+				visited[key] = true
+				result.States++
+			}
+
+			steps := c.steps()
+			if invariant := c.check(steps); invariant != "" {
+				result.Violation = newViolation(config, invariant, c.trace)
+				return result
+			}
+			if len(steps) == 0 {
+				result.Terminal++
+				break
+			}
+			if len(c.trace) >= config.MaxDepth {
+				result.Truncated++
+				break
+			}
+			c.apply(steps[rng.Intn(len(steps))])
+		}
+	}
+	return result
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"log"
+	"sync"
+)
+
+/**
+  FAULT INJECTION
+  Killing a node from outside happens at a wall-clock moment, so it can't reliably land in the middle of an announcement
+  or a broadcast. Instead, a crash can be armed at a named point in the protocol, and the node kills itself when it
+  reaches that point.
+  - Nodes announce their wins, and broadcast SYNCs, in order of node ID, so a crash midway reaches a known set of nodes.
+  - A crash is armed to skip a number of passes through its point first, e.g. skipping 1 pass of
+    FAULT_AFTER_ELECTION_WIN crashes right after the second ELECTION_WIN is sent.
+  - Each armed crash fires once.
+*/
+
+// A point in the protocol where a crash can be armed.
+type FaultPoint string
+
+const (
+	FAULT_BEFORE_ELECTION_WIN FaultPoint = "BEFORE_ELECTION_WIN" // Before sending each ELECTION_WIN of a won election
+	FAULT_AFTER_ELECTION_WIN  FaultPoint = "AFTER_ELECTION_WIN"  // After sending each ELECTION_WIN of a won election
+	FAULT_AFTER_VETO          FaultPoint = "AFTER_VETO"          // After an election receives a veto
+	FAULT_MID_SYNC            FaultPoint = "MID_SYNC"            // Between the SYNCs of a broadcast with keys written since the last one
+)
+
+// Crashes armed on a node.
+type faultState struct {
+	lock  *sync.Mutex
+	armed map[FaultPoint]int // Number of passes left to skip before crashing, for each armed point
+}
+
+func newFaultState() *faultState {
+	return &faultState{&sync.Mutex{}, make(map[FaultPoint]int)}
+}
+
+// Arms a crash at `point`, after skipping `skip` passes through it. Replaces any crash already armed there.
+func (node *Node) ArmCrash(point FaultPoint, skip int) {
+	node.faults.lock.Lock()
+	defer node.faults.lock.Unlock()
+	node.faults.armed[point] = skip
+}
+
+// Disarms the crash at `point`, if it hasn't fired yet.
+func (node *Node) DisarmCrash(point FaultPoint) {
+	node.faults.lock.Lock()
+	defer node.faults.lock.Unlock()
+	delete(node.faults.armed, point)
+}
+
+// Passes through a point in the protocol, crashing if a crash is armed there and has no passes left to skip.
+// Returns true if the node crashed, in which case the caller should stop.
+func (node *Node) reachFaultPoint(point FaultPoint) bool {
+	node.faults.lock.Lock()
+	skip, ok := node.faults.armed[point]
+	if !ok {
+		node.faults.lock.Unlock()
+		return false
+	}
+	if skip > 0 {
+		node.faults.armed[point] = skip - 1
+		node.faults.lock.Unlock()
+		return false
+	}
+	delete(node.faults.armed, point)
+	node.faults.lock.Unlock()
+
+	log.Printf("N%d: Crashing at %s.", node.Id, point)
+	node.Kill()
+	return true
+}
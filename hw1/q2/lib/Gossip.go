@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+  GOSSIP DISSEMINATION
+  By default, the coordinator sends its state to every other node every sendIntv, which is O(n) messages from one node.
+  With gossip enabled, the coordinator instead seeds its state to a few random nodes, and it spreads by anti-entropy:
+  - Every sendIntv, the coordinator bumps the version of its gossip, and sends it to `Fanout` random nodes.
+  - Every gossip `Interval`, each node sends its version and state to `Fanout` random nodes (push). A node that
+    receives an older version than its own replies with its own (pull), so both end up with the newer version.
+  - A version is the coordinator's term and a sequence number, so state from a later coordinator always wins.
+  - Gossip carries the full state rather than a delta, since a node can't know what a random peer already has.
+  - Since the coordinator bumps the sequence number every sendIntv, newer versions double as its heartbeat. If a node
+    hears of no newer version for long enough for a version to have spread, it assumes the coordinator is down.
+*/
+
+type GossipConfig struct {
+	Fanout   int           // Number of random nodes to send to in each round
+	Interval time.Duration // Time between the gossip rounds of each node
+}
+
+var DEFAULT_GOSSIP_CONFIG = GossipConfig{2, 500 * time.Millisecond}
+
+// Version of a node's gossip. Versions are ordered by term, then sequence number.
+type gossipVersion struct {
+	Term int
+	Seq  int
+}
+
+func (v gossipVersion) newerThan(other gossipVersion) bool {
+	return v.Term > other.Term || (v.Term == other.Term && v.Seq > other.Seq)
+}
+
+// Encodes a version and state into the Data of a MSG_TYPE_GOSSIP message.
+func encodeGossip(version gossipVersion, state replicatedState) string {
+	return fmt.Sprintf("%d|%d|%s", version.Term, version.Seq, encodeState(state))
+}
+
+func decodeGossip(msgData string) (gossipVersion, replicatedState, error) {
+	parts := strings.SplitN(msgData, "|", 3)
+	if len(parts) != 3 {
+		return gossipVersion{}, replicatedState{}, errors.New(fmt.Sprintf("Invalid gossip: %s", msgData))
+	}
+	term, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return gossipVersion{}, replicatedState{}, errors.New(fmt.Sprintf("Invalid gossip term: %s", parts[0]))
+	}
+	seq, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return gossipVersion{}, replicatedState{}, errors.New(fmt.Sprintf("Invalid gossip sequence number: %s", parts[1]))
+	}
+	state, err := decodeState(parts[2])
+	if err != nil {
+		return gossipVersion{}, replicatedState{}, err
+	}
+	return gossipVersion{term, seq}, state, nil
+}
+
+// State of a node's gossip dissemination. A nil state means gossip is disabled.
+type gossipState struct {
+	config  GossipConfig
+	lock    *sync.Mutex // Lock over the variables below
+	version gossipVersion
+	heard   time.Time // When this node last adopted a newer version, or seeded one as coordinator
+	rng     *rand.Rand
+}
+
+func newGossipState(config GossipConfig, id NodeId) *gossipState {
+	return &gossipState{config, &sync.Mutex{}, gossipVersion{}, time.Now(), rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))}
+}
+
+// Disseminates this node's state by gossip, instead of the coordinator sending it to every node.
+// Must be called before the node is initialised. Only supported by the Bully algorithm.
+func (node *Node) EnableGossip(config GossipConfig) error {
+	if node.algorithm != ALGORITHM_BULLY {
+		return errors.New(fmt.Sprintf("N%d: Gossip is only supported by the Bully algorithm.", node.Id))
+	}
+	if config.Fanout < 1 || config.Interval <= 0 {
+		return errors.New(fmt.Sprintf("N%d: Invalid gossip config: %+v", node.Id, config))
+	}
+	node.gossip = newGossipState(config, node.Id)
+	return nil
+}
+
+// Forgets the version of this node's gossip, so a restarted node takes the next version it hears of.
+// Its state may have been lost (with persistence), or be older than the version suggests.
+func (node *Node) resetGossip() {
+	g := node.gossip
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.version = gossipVersion{}
+	g.heard = time.Now()
+}
+
+// Gossips with random nodes every interval, and checks that the coordinator is still heard of.
+func (node *Node) RunGossip() {
+	for {
+		select {
+		case <-time.After(node.gossip.config.Interval):
+			if !node.IsAlive() {
+				continue
+			}
+			node.gossipRound()
+			node.checkGossipHeartbeat()
+		case <-node.quitChan:
+			return
+		}
+	}
+}
+
+// Picks up to `count` random endpoints.
+func (node *Node) randomEndpoints(count int) []NodeEndpoint {
+	endpoints := make([]NodeEndpoint, 0)
+	for _, endpoint := range node.getEndpoints() {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	g := node.gossip
+	g.lock.Lock()
+	g.rng.Shuffle(len(endpoints), func(i, j int) { endpoints[i], endpoints[j] = endpoints[j], endpoints[i] })
+	g.lock.Unlock()
+
+	if len(endpoints) > count {
+		endpoints = endpoints[:count]
+	}
+	return endpoints
+}
+
+// Sends this node's version and state to random nodes.
+func (node *Node) gossipRound() {
+	g := node.gossip
+	g.lock.Lock()
+	version := g.version
+	g.lock.Unlock()
+	if version.Term == 0 {
+		// Nothing heard from a coordinator yet
+		return
+	}
+
+	data := encodeGossip(version, node.stateSnapshot())
+	for _, endpoint := range node.randomEndpoints(g.config.Fanout) {
+		node.send(MSG_TYPE_GOSSIP, endpoint, data)
+	}
+}
+
+// Coordinator function to bump the version of its gossip, and send its state to random nodes. Called every sendIntv.
+func (node *Node) seedGossip() {
+	g := node.gossip
+	g.lock.Lock()
+	term := node.Term()
+	if term > g.version.Term {
+		g.version = gossipVersion{term, 0}
+	}
+	g.version.Seq++
+	g.heard = time.Now()
+	data := encodeGossip(g.version, node.stateSnapshot())
+	g.lock.Unlock()
+
+	for _, endpoint := range node.randomEndpoints(g.config.Fanout) {
+		node.send(MSG_TYPE_GOSSIP, endpoint, data)
+	}
+}
+
+// Handles a MSG_TYPE_GOSSIP message, adopting its state and coordinator if it is newer, or replying with ours if it is
+// older.
+func (node *Node) handleGossip(msg Message) {
+	g := node.gossip
+	if g == nil {
+		return
+	}
+	version, state, err := decodeGossip(msg.Data)
+	if err != nil {
+		log.Printf("N%d: %v", node.Id, err)
+		return
+	}
+
+	g.lock.Lock()
+	if g.version.newerThan(version) {
+		// Pull: the sender is behind, so send it ours
+		reply := encodeGossip(g.version, node.stateSnapshot())
+		g.lock.Unlock()
+		if srcEndpoint, ok := node.getEndpoint(msg.SrcId); ok {
+			node.send(MSG_TYPE_GOSSIP, srcEndpoint, reply)
+		}
+		return
+	}
+	if !version.newerThan(g.version) {
+		g.lock.Unlock()
+		return
+	}
+
+	if termWinner(version.Term) < node.Id {
+		// State from a lower coordinator, the same as a SYNC from a lower node
+		g.lock.Unlock()
+		log.Printf("N%d: Received gossip from lower coordinator N%d, start election", node.Id, termWinner(version.Term))
+		node.StartElection()
+		return
+	}
+	g.version = version
+	g.heard = time.Now()
+	g.lock.Unlock()
+
+	// The version was made by the coordinator that won its term, so follow it, e.g. if we missed its ELECTION_WIN.
+	// Our own term may be from before a restart, so we don't take it as the coordinator.
+	if coordId := termWinner(version.Term); coordId != node.Id {
+		node.observeTerm(version.Term)
+		node.setCoordinatorId(coordId)
+	}
+	node.replaceState(state)
+}
+
+// Number of gossip rounds that a version should take to reach all nodes.
+func (node *Node) gossipSpreadRounds() int {
+	nodeCount := len(node.getEndpoints()) + 1
+	return 2 * int(math.Ceil(math.Log2(float64(nodeCount)+1)))
+}
+
+// Starts an election if no newer version has been heard of for a sendIntv, plus the time for it to spread.
+// This replaces the detection in HandleData, since gossip from other nodes doesn't mean the coordinator is alive.
+func (node *Node) checkGossipHeartbeat() {
+	if node.detectDeadCoordDisabled() || node.isCoordinator() {
+		return
+	}
+
+	g := node.gossip
+	detectionTimeout := node.sendIntv + node.timeout/2 + time.Duration(node.gossipSpreadRounds())*g.config.Interval
+	g.lock.Lock()
+	if time.Since(g.heard) < detectionTimeout {
+		g.lock.Unlock()
+		return
+	}
+	g.heard = time.Now() // Give the election time to finish before checking again
+	g.lock.Unlock()
+
+	log.Printf("N%d: Heard of no new gossip from coordinator, detected coordinator is down.", node.Id)
+	node.StartElection()
+}
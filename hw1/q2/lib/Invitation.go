@@ -0,0 +1,486 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Election algorithm used by a node.
+type ElectionAlgorithm int
+
+const (
+	ALGORITHM_BULLY      ElectionAlgorithm = iota // Bully algorithm, which assumes a fully connected network
+	ALGORITHM_INVITATION                          // Garcia-Molina's invitation algorithm, which forms a group per partition
+	ALGORITHM_QUORUM                              // Bully algorithm, where a win must be acknowledged by a majority (see Quorum.go)
+)
+
+/**
+  INVITATION ALGORITHM
+  Nodes are organised into groups, each with a coordinator.
+  - Every sendIntv, a coordinator asks all other nodes if they are coordinators. If it finds other coordinators,
+    and it has the highest ID among them, it invites them (and its own members) to a new group it coordinates.
+    Invited coordinators forward the invitation to their own members.
+  - Every sendIntv, a member asks its coordinator if it is still in the group. If not (or there is no response),
+    it forms a new group with only itself.
+  Under a partition, each side ends up as its own group. Once the partition heals, the coordinators find each other
+  and the groups merge.
+
+  When groups merge, the state of the largest old group is kept, with ties going to the old group of the higher
+  coordinator ID. Every group formed starts a new term for its coordinator, so the versions of its state are its own.
+*/
+
+// Identifies a group, by the coordinator that formed it and a counter of groups formed by that coordinator.
+type groupId struct {
+	Coord NodeId
+	Count int
+}
+
+func (g groupId) String() string {
+	return fmt.Sprintf("%d.%d", g.Coord, g.Count)
+}
+
+func parseGroupId(s string) (groupId, error) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return groupId{-1, 0}, errors.New(fmt.Sprintf("Invalid group ID: %s", s))
+	}
+	coord, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return groupId{-1, 0}, err
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return groupId{-1, 0}, err
+	}
+	return groupId{NodeId(coord), count}, nil
+}
+
+type invitationStatus int
+
+const (
+	INVITATION_NORMAL       invitationStatus = iota // In a group
+	INVITATION_REORGANISING                         // Forming or joining a new group
+)
+
+// Sent by a node accepting an invitation, used to reconcile state when groups merge.
+type acceptance struct {
+	oldCoordId NodeId // Coordinator of the node's old group
+	state      replicatedState
+}
+
+// State of a node running the invitation algorithm.
+type invitationState struct {
+	lock           *sync.Mutex
+	status         invitationStatus
+	group          groupId               // The node's group, or the group being formed/joined while reorganising
+	groupCount     int                   // Used to generate group IDs
+	members        map[NodeId]bool       // Other members of the group, if this node is the coordinator
+	acceptances    map[NodeId]acceptance // Acceptances received while forming a group
+	reorganiseTime time.Time             // When the node started reorganising
+	coordResps     chan NodeId           // Coordinators that responded to MSG_TYPE_ARE_YOU_COORDINATOR
+	thereResps     chan Message          // Responses to MSG_TYPE_ARE_YOU_THERE
+}
+
+func newInvitationState(nodeCount int) *invitationState {
+	return &invitationState{
+		&sync.Mutex{},
+		INVITATION_NORMAL, groupId{-1, 0}, 0,
+		make(map[NodeId]bool), make(map[NodeId]acceptance), time.Time{},
+		make(chan NodeId, nodeCount), make(chan Message, nodeCount),
+	}
+}
+
+// Periodically checks on the group, merging or leaving it as necessary.
+func (node *Node) RunInvitation() {
+	for {
+		select {
+		case <-time.After(node.sendIntv):
+			node.checkGroup()
+		case <-node.quitChan:
+			return
+		}
+	}
+}
+
+// Returns the group of this node.
+func (node *Node) Group() groupId {
+	node.invitation.lock.Lock()
+	defer node.invitation.lock.Unlock()
+	return node.invitation.group
+}
+
+func (node *Node) checkGroup() {
+	if !node.IsAlive() {
+		return
+	}
+
+	inv := node.invitation
+	inv.lock.Lock()
+	status, reorganiseTime := inv.status, inv.reorganiseTime
+	inv.lock.Unlock()
+
+	if status == INVITATION_REORGANISING {
+		// The group we were joining never became ready, give up on it
+		if time.Since(reorganiseTime) > 2*node.timeout {
+			log.Printf("N%d: Group never became ready.", node.Id)
+			node.formSingletonGroup()
+		}
+		return
+	}
+
+	if node.isCoordinator() {
+		node.findCoordinators()
+	} else {
+		node.checkCoordinator()
+	}
+}
+
+// Forms a group with only this node, as its coordinator.
+func (node *Node) formSingletonGroup() {
+	node.publish(EVENT_ELECTION_START, node.CoordinatorId())
+
+	inv := node.invitation
+	inv.lock.Lock()
+	inv.groupCount++
+	inv.group = groupId{node.Id, inv.groupCount}
+	inv.status = INVITATION_NORMAL
+	inv.members = make(map[NodeId]bool)
+	group := inv.group
+	inv.lock.Unlock()
+
+	log.Printf("N%d: Formed group %v.", node.Id, group)
+	node.nextTerm()
+	node.setCoordinatorId(node.Id)
+	node.publish(EVENT_ELECTION_WON, node.CoordinatorId())
+}
+
+// Asks all other nodes if they are coordinators, and merges with them if this node has the highest ID.
+func (node *Node) findCoordinators() {
+	inv := node.invitation
+	for len(inv.coordResps) > 0 {
+		<-inv.coordResps
+	}
+
+	for _, endpoint := range node.getEndpoints() {
+		node.send(MSG_TYPE_ARE_YOU_COORDINATOR, endpoint, "")
+	}
+
+	coordIds := make([]NodeId, 0)
+	expiry := time.After(node.timeout)
+	for waiting := true; waiting; {
+		select {
+		case coordId := <-inv.coordResps:
+			coordIds = append(coordIds, coordId)
+		case <-expiry:
+			waiting = false
+		case <-node.quitChan:
+			return
+		}
+	}
+
+	if len(coordIds) == 0 {
+		return
+	}
+	for _, coordId := range coordIds {
+		if coordId > node.Id {
+			// Leave the merge to the higher coordinator, which will find us too
+			log.Printf("N%d: Found coordinator N%d, waiting for its invitation.", node.Id, coordId)
+			return
+		}
+	}
+	node.mergeGroups(coordIds)
+}
+
+// Invites the given coordinators and this node's members to a new group, with this node as coordinator.
+func (node *Node) mergeGroups(coordIds []NodeId) {
+	node.publish(EVENT_ELECTION_START, node.CoordinatorId())
+
+	inv := node.invitation
+	inv.lock.Lock()
+	inv.groupCount++
+	group := groupId{node.Id, inv.groupCount}
+	inv.group = group
+	inv.status = INVITATION_REORGANISING
+	inv.reorganiseTime = time.Now()
+	inv.acceptances = make(map[NodeId]acceptance)
+	invitees := make(map[NodeId]bool, len(coordIds)+len(inv.members))
+	for memberId := range inv.members {
+		invitees[memberId] = true
+	}
+	inv.lock.Unlock()
+	for _, coordId := range coordIds {
+		invitees[coordId] = true
+	}
+
+	log.Printf("N%d: Merging with coordinators %v into group %v.", node.Id, coordIds, group)
+	for inviteeId := range invitees {
+		if endpoint, ok := node.getEndpoint(inviteeId); ok {
+			node.send(MSG_TYPE_INVITATION, endpoint, group.String())
+		}
+	}
+
+	// Wait for acceptances
+	select {
+	case <-time.After(node.timeout):
+	case <-node.quitChan:
+		return
+	}
+
+	inv.lock.Lock()
+	if inv.status != INVITATION_REORGANISING || inv.group != group {
+		// We joined another group in the meantime
+		inv.lock.Unlock()
+		node.publish(EVENT_ELECTION_VETOED, node.CoordinatorId())
+		return
+	}
+	inv.status = INVITATION_NORMAL
+	inv.members = make(map[NodeId]bool, len(inv.acceptances))
+	for memberId := range inv.acceptances {
+		inv.members[memberId] = true
+	}
+	state := reconcileState(node.Id, node.stateSnapshot(), inv.acceptances)
+	members := make([]NodeId, 0, len(inv.members))
+	for memberId := range inv.members {
+		members = append(members, memberId)
+	}
+	inv.lock.Unlock()
+
+	log.Printf("N%d: Group %v ready with %d members, values %v.", node.Id, group, len(members)+1, state.values())
+	node.replaceState(state)
+	node.nextTerm()
+	node.setCoordinatorId(node.Id)
+	node.publish(EVENT_ELECTION_WON, node.CoordinatorId())
+	data := encodeState(state)
+	for _, memberId := range members {
+		if endpoint, ok := node.getEndpoint(memberId); ok {
+			node.send(MSG_TYPE_READY, endpoint, group.String()+"|"+data)
+		}
+	}
+}
+
+// Picks the state of a merged group: the state of the largest old group, with ties going to the higher old coordinator ID.
+// The state reported by the old coordinator itself is used if it accepted, since members may lag behind it.
+func reconcileState(coordId NodeId, coordState replicatedState, acceptances map[NodeId]acceptance) replicatedState {
+	all := make(map[NodeId]acceptance, len(acceptances)+1)
+	for nodeId, acc := range acceptances {
+		all[nodeId] = acc
+	}
+	all[coordId] = acceptance{coordId, coordState}
+
+	groupSizes := make(map[NodeId]int)
+	for _, acc := range all {
+		groupSizes[acc.oldCoordId]++
+	}
+	chosen := NodeId(-1)
+	for oldCoordId, size := range groupSizes {
+		if chosen == -1 || size > groupSizes[chosen] || (size == groupSizes[chosen] && oldCoordId > chosen) {
+			chosen = oldCoordId
+		}
+	}
+
+	if acc, ok := all[chosen]; ok && acc.oldCoordId == chosen {
+		return acc.state
+	}
+
+	// The old coordinator did not accept, use its lowest member's state
+	nodeIds := make([]NodeId, 0, len(all))
+	for nodeId, acc := range all {
+		if acc.oldCoordId == chosen {
+			nodeIds = append(nodeIds, nodeId)
+		}
+	}
+	sort.Slice(nodeIds, func(i, j int) bool { return nodeIds[i] < nodeIds[j] })
+	return all[nodeIds[0]].state
+}
+
+// Asks the coordinator if this node is still in its group, forming a new group if not.
+func (node *Node) checkCoordinator() {
+	inv := node.invitation
+	for len(inv.thereResps) > 0 {
+		<-inv.thereResps
+	}
+
+	coordId := node.CoordinatorId()
+	coordEndpoint, ok := node.getEndpoint(coordId)
+	if ok {
+		node.send(MSG_TYPE_ARE_YOU_THERE, coordEndpoint, node.Group().String())
+
+		expiry := time.After(node.timeout)
+		for waiting := true; waiting; {
+			select {
+			case resp := <-inv.thereResps:
+				if resp.SrcId != coordId {
+					continue
+				}
+				if resp.Data == "true" {
+					return
+				}
+				waiting = false
+			case <-expiry:
+				waiting = false
+			case <-node.quitChan:
+				return
+			}
+		}
+	}
+
+	log.Printf("N%d: Lost coordinator N%d.", node.Id, coordId)
+	node.formSingletonGroup()
+}
+
+// Handles a control message of the invitation algorithm.
+func (node *Node) handleInvitationMsg(msg Message) {
+	inv := node.invitation
+	srcEndpoint, _ := node.getEndpoint(msg.SrcId)
+
+	switch msg.Type {
+	case MSG_TYPE_ARE_YOU_COORDINATOR:
+		inv.lock.Lock()
+		normal := inv.status == INVITATION_NORMAL
+		inv.lock.Unlock()
+		if normal && node.isCoordinator() {
+			node.send(MSG_TYPE_ARE_YOU_COORDINATOR_RESP, srcEndpoint, "")
+		}
+	case MSG_TYPE_ARE_YOU_COORDINATOR_RESP:
+		select {
+		case inv.coordResps <- msg.SrcId:
+		default:
+		}
+	case MSG_TYPE_ARE_YOU_THERE:
+		group, _ := parseGroupId(msg.Data)
+		inv.lock.Lock()
+		there := inv.status == INVITATION_NORMAL && inv.group == group && inv.members[msg.SrcId]
+		inv.lock.Unlock()
+		node.send(MSG_TYPE_ARE_YOU_THERE_RESP, srcEndpoint, strconv.FormatBool(there && node.isCoordinator()))
+	case MSG_TYPE_ARE_YOU_THERE_RESP:
+		select {
+		case inv.thereResps <- msg:
+		default:
+		}
+	case MSG_TYPE_INVITATION:
+		group, err := parseGroupId(msg.Data)
+		if err != nil {
+			log.Printf("N%d: Dropped INVITATION from N%d: %v", node.Id, msg.SrcId, err)
+			return
+		}
+		node.acceptInvitation(group)
+	case MSG_TYPE_ACCEPT:
+		parts := strings.SplitN(msg.Data, "|", 3)
+		if len(parts) != 3 {
+			return
+		}
+		group, err := parseGroupId(parts[0])
+		oldCoordId, err2 := strconv.Atoi(parts[1])
+		if err != nil || err2 != nil || group.Coord != node.Id {
+			return
+		}
+
+		inv.lock.Lock()
+		if inv.group != group {
+			inv.lock.Unlock()
+			return
+		}
+		if inv.status == INVITATION_REORGANISING {
+			state, err := decodeState(parts[2])
+			if err != nil {
+				inv.lock.Unlock()
+				log.Printf("N%d: Dropped ACCEPT from N%d: %v", node.Id, msg.SrcId, err)
+				return
+			}
+			inv.acceptances[msg.SrcId] = acceptance{NodeId(oldCoordId), state}
+			inv.lock.Unlock()
+			return
+		}
+		// Accepted after the group was ready, add it to the group directly
+		inv.members[msg.SrcId] = true
+		inv.lock.Unlock()
+		node.send(MSG_TYPE_READY, srcEndpoint, group.String()+"|"+encodeState(node.stateSnapshot()))
+	case MSG_TYPE_READY:
+		parts := strings.SplitN(msg.Data, "|", 2)
+		if len(parts) != 2 {
+			return
+		}
+		group, err := parseGroupId(parts[0])
+		if err != nil {
+			return
+		}
+		state, err := decodeState(parts[1])
+		if err != nil {
+			log.Printf("N%d: Dropped READY from N%d: %v", node.Id, msg.SrcId, err)
+			return
+		}
+
+		inv.lock.Lock()
+		if inv.status != INVITATION_REORGANISING || inv.group != group {
+			inv.lock.Unlock()
+			return
+		}
+		inv.status = INVITATION_NORMAL
+		inv.lock.Unlock()
+
+		log.Printf("N%d: Joined group %v.", node.Id, group)
+		node.setCoordinatorId(group.Coord)
+		node.replaceState(state)
+	}
+}
+
+// Leaves the current group to join the given group, forwarding the invitation to our members if we are the coordinator.
+func (node *Node) acceptInvitation(group groupId) {
+	inv := node.invitation
+	inv.lock.Lock()
+	if inv.status == INVITATION_REORGANISING {
+		// Already forming or joining a group, the inviter will retry later
+		inv.lock.Unlock()
+		return
+	}
+	oldCoordId := node.CoordinatorId()
+	members := inv.members
+	inv.status = INVITATION_REORGANISING
+	inv.group = group
+	inv.reorganiseTime = time.Now()
+	inv.members = make(map[NodeId]bool)
+	inv.lock.Unlock()
+
+	log.Printf("N%d: Accepted invitation to group %v.", node.Id, group)
+	if oldCoordId == node.Id {
+		for memberId := range members {
+			if memberId == group.Coord {
+				continue
+			}
+			if endpoint, ok := node.getEndpoint(memberId); ok {
+				node.send(MSG_TYPE_INVITATION, endpoint, group.String())
+			}
+		}
+	}
+
+	data := encodeState(node.stateSnapshot())
+	node.setCoordinatorId(-1) // No coordinator until the group is ready
+	if endpoint, ok := node.getEndpoint(group.Coord); ok {
+		node.send(MSG_TYPE_ACCEPT, endpoint, fmt.Sprintf("%v|%d|%s", group, oldCoordId, data))
+	}
+}
+
+// Returns the endpoints that the coordinator sends data to.
+func (node *Node) syncEndpoints() map[NodeId]NodeEndpoint {
+	endpoints := node.getEndpoints()
+	if node.algorithm != ALGORITHM_INVITATION {
+		return endpoints
+	}
+
+	// Only send to our group
+	inv := node.invitation
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	for nodeId := range endpoints {
+		if !inv.members[nodeId] {
+			delete(endpoints, nodeId)
+		}
+	}
+	return endpoints
+}
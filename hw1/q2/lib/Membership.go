@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+  MEMBERSHIP
+  Nodes can join a running cluster, and leave it gracefully.
+  - A joining node sends MSG_TYPE_JOIN to any node in the cluster, which responds with the endpoints it knows,
+    its coordinator and its state, and tells the rest of the cluster about the new node with MSG_TYPE_MEMBER_ADDED.
+    The joining node starts an election if it outranks the coordinator (or there is none), otherwise it
+    waits for the coordinator's SYNC.
+  - A leaving node sends MSG_TYPE_LEAVE to the cluster. If it is the coordinator, it first sends its full state to
+    everyone, and hands off to the highest remaining node with MSG_TYPE_HANDOFF, which starts an election
+    instead of waiting to detect the coordinator is gone.
+*/
+
+// Joins a running cluster through the node at `via`, which may be any node in the cluster.
+// Returns an error if the node at `via` does not respond within the RTT. The node should be exited in that case.
+func (node *Node) Join(via NodeEndpoint) error {
+	for len(node.joinChan) > 0 {
+		<-node.joinChan
+	}
+
+	node.startHandlers()
+	node.requestJoin(via)
+
+	var resp Message
+	select {
+	case resp = <-node.joinChan:
+	case <-time.After(node.timeout):
+		return errors.New(fmt.Sprintf("N%d: No response to join from N%d.", node.Id, via.Id))
+	}
+	return node.completeJoin(resp)
+}
+
+// Asks the node at `via` to let this node join. The response is passed on to joinChan.
+func (node *Node) requestJoin(via NodeEndpoint) {
+	node.setEndpoints([]NodeEndpoint{via})
+	node.sendWithEndpoints(MSG_TYPE_JOIN, via, "", []NodeEndpoint{node.Endpoint})
+}
+
+// Joins the cluster given the response to a join, adopting its endpoints, coordinator and state.
+func (node *Node) completeJoin(resp Message) error {
+	// Adopt the state of the cluster, in case we become the coordinator
+	node.setEndpoints(resp.Endpoints)
+	parts := strings.SplitN(resp.Data, "|", 2)
+	if len(parts) != 2 {
+		return errors.New(fmt.Sprintf("N%d: Invalid response to join: %s", node.Id, resp.Data))
+	}
+	coordId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return errors.New(fmt.Sprintf("N%d: Invalid response to join: %s", node.Id, resp.Data))
+	}
+	state, err := decodeState(parts[1])
+	if err != nil {
+		return errors.New(fmt.Sprintf("N%d: Invalid response to join: %v", node.Id, err))
+	}
+	node.replaceState(state)
+	log.Printf("N%d: Joined through N%d, with %d other nodes and coordinator N%d.", node.Id, resp.SrcId, len(resp.Endpoints), coordId)
+
+	if NodeId(coordId) > node.Id {
+		node.setCoordinatorId(NodeId(coordId))
+	} else {
+		// We outrank the coordinator, or there is none (e.g. an election is ongoing)
+		node.StartElection()
+	}
+	return nil
+}
+
+// Leaves the cluster gracefully, then exits. If this node is the coordinator, it hands off to the highest remaining node.
+// A dead node cannot send anything, so it simply exits, and the other nodes keep it as a (dead) member.
+func (node *Node) Leave() {
+	endpoints := node.getEndpoints()
+
+	if node.isCoordinator() {
+		// Make sure everyone has the latest state before we go
+		data := encodeSync(node.fullSync())
+		successorId := NodeId(-1)
+		for _, endpoint := range sortEndpoints(endpoints) {
+			node.send(MSG_TYPE_SYNC, endpoint, data)
+			successorId = endpoint.Id
+		}
+
+		if successor, ok := endpoints[successorId]; ok {
+			log.Printf("N%d: Handing off to N%d.", node.Id, successorId)
+			node.send(MSG_TYPE_HANDOFF, successor, "")
+			delete(endpoints, successorId)
+		}
+	}
+
+	for _, endpoint := range sortEndpoints(endpoints) {
+		node.send(MSG_TYPE_LEAVE, endpoint, "")
+	}
+	log.Printf("N%d: Left the cluster.", node.Id)
+	node.Exit()
+}
+
+// Handles a membership control message.
+func (node *Node) handleMembershipMsg(msg Message) {
+	switch msg.Type {
+	case MSG_TYPE_JOIN:
+		if len(msg.Endpoints) != 1 {
+			return
+		}
+		joiner := msg.Endpoints[0]
+
+		// Tell everyone else about the joining node, then the joining node about everyone
+		endpoints := make([]NodeEndpoint, 0)
+		for _, endpoint := range sortEndpoints(node.getEndpoints()) {
+			if endpoint.Id == joiner.Id {
+				continue
+			}
+			node.sendWithEndpoints(MSG_TYPE_MEMBER_ADDED, endpoint, "", []NodeEndpoint{joiner})
+			endpoints = append(endpoints, endpoint)
+		}
+		endpoints = append(endpoints, node.Endpoint)
+		node.setEndpoints([]NodeEndpoint{joiner})
+
+		log.Printf("N%d: N%d joined.", node.Id, joiner.Id)
+		node.sendWithEndpoints(MSG_TYPE_JOIN_RESP, joiner, fmt.Sprintf("%d|%s", node.CoordinatorId(), encodeState(node.stateSnapshot())), endpoints)
+	case MSG_TYPE_JOIN_RESP:
+		select {
+		case node.joinChan <- msg:
+		default:
+		}
+	case MSG_TYPE_MEMBER_ADDED:
+		node.setEndpoints(msg.Endpoints)
+	case MSG_TYPE_LEAVE:
+		log.Printf("N%d: N%d left.", node.Id, msg.SrcId)
+		node.removeEndpoint(msg.SrcId)
+		if node.CoordinatorId() == msg.SrcId {
+			// Wait for the successor to win its election
+			node.setCoordinatorId(-1)
+		}
+	case MSG_TYPE_HANDOFF:
+		log.Printf("N%d: Received HANDOFF from N%d.", node.Id, msg.SrcId)
+		node.removeEndpoint(msg.SrcId)
+		node.setCoordinatorId(-1)
+		node.StartElection()
+	}
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Counts of messages sent, by type.
+type MessageCounts map[msgType]int
+
+// Number of election messages (ELECTION_START, ELECTION_VETO and ELECTION_WIN) in the counts.
+func (counts MessageCounts) ElectionMessages() int {
+	return counts[MSG_TYPE_ELECTION_START] + counts[MSG_TYPE_ELECTION_VETO] + counts[MSG_TYPE_ELECTION_WIN]
+}
+
+// Total number of messages in the counts.
+func (counts MessageCounts) Total() int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+// Counts of messages sent through the network, including messages that are then lost.
+type messageCounter struct {
+	lock   *sync.Mutex
+	counts MessageCounts
+	bySrc  map[NodeId]MessageCounts // Counts of messages sent by each node
+}
+
+func newMessageCounter() *messageCounter {
+	return &messageCounter{&sync.Mutex{}, make(MessageCounts), make(map[NodeId]MessageCounts)}
+}
+
+func (c *messageCounter) count(msg Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[msg.Type]++
+	if _, ok := c.bySrc[msg.SrcId]; !ok {
+		c.bySrc[msg.SrcId] = make(MessageCounts)
+	}
+	c.bySrc[msg.SrcId][msg.Type]++
+}
+
+// Returns a copy of the current counts.
+func (c *messageCounter) snapshot() MessageCounts {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(MessageCounts, len(c.counts))
+	for mType, count := range c.counts {
+		counts[mType] = count
+	}
+	return counts
+}
+
+// Returns a copy of the current counts of each node.
+func (c *messageCounter) snapshotBySrc() map[NodeId]MessageCounts {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	bySrc := make(map[NodeId]MessageCounts, len(c.bySrc))
+	for nodeId, counts := range c.bySrc {
+		bySrc[nodeId] = make(MessageCounts, len(counts))
+		for mType, count := range counts {
+			bySrc[nodeId][mType] = count
+		}
+	}
+	return bySrc
+}
+
+// Cost of a single election, from the first node starting an election till all live nodes agree on a live coordinator.
+// Nodes that start an election while another is ongoing are part of the same election.
+type ElectionReport struct {
+	Start                  time.Time
+	Duration               time.Duration // Time from the first ELECTION_START to a consistent coordinator
+	CoordinatorId          NodeId        // The coordinator agreed on
+	Messages               MessageCounts // Messages sent during the election, by type
+	ElectionsStarted       int           // Number of nodes that started an election
+	MaxConcurrentElections int           // Highest number of elections ongoing at the same time
+}
+
+func (r ElectionReport) String() string {
+	return fmt.Sprintf(
+		"Election won by N%d in %v: %d ELECTION_START, %d ELECTION_VETO, %d ELECTION_WIN, %d elections started (max %d concurrent).",
+		r.CoordinatorId, r.Duration,
+		r.Messages[MSG_TYPE_ELECTION_START], r.Messages[MSG_TYPE_ELECTION_VETO], r.Messages[MSG_TYPE_ELECTION_WIN],
+		r.ElectionsStarted, r.MaxConcurrentElections,
+	)
+}
+
+// Tracks the cost of elections from node events, for the Orchestrator.
+type electionMetrics struct {
+	lock        *sync.Mutex
+	current     *ElectionReport // The ongoing election, if any
+	startCounts MessageCounts   // Message counts when the ongoing election started
+	reports     []ElectionReport
+}
+
+func newElectionMetrics() *electionMetrics {
+	return &electionMetrics{&sync.Mutex{}, nil, nil, make([]ElectionReport, 0)}
+}
+
+// Updates the metrics from an event. `ongoing` is the number of ongoing elections after the event.
+func (o *Orchestrator) recordEvent(event Event, ongoing int) {
+	m := o.metrics
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if event.Type == EVENT_ELECTION_START {
+		if m.current == nil {
+			m.current = &ElectionReport{event.Time, 0, -1, nil, 0, 0}
+			m.startCounts = o.network.counter.snapshot()
+		}
+		m.current.ElectionsStarted++
+		if ongoing > m.current.MaxConcurrentElections {
+			m.current.MaxConcurrentElections = ongoing
+		}
+	}
+
+	if m.current == nil {
+		return
+	}
+	coordId, consistent := o.getConsistentCoordinatorId()
+	if !consistent {
+		return
+	}
+
+	// Election is over, record the messages sent since it started
+	counts := o.network.counter.snapshot()
+	for mType, count := range m.startCounts {
+		counts[mType] -= count
+	}
+	m.current.Duration = event.Time.Sub(m.current.Start)
+	m.current.CoordinatorId = coordId
+	m.current.Messages = counts
+	m.reports = append(m.reports, *m.current)
+	m.current = nil
+}
+
+// Returns the reports of all completed elections, in order.
+func (o *Orchestrator) ElectionReports() []ElectionReport {
+	o.metrics.lock.Lock()
+	defer o.metrics.lock.Unlock()
+	reports := make([]ElectionReport, len(o.metrics.reports))
+	copy(reports, o.metrics.reports)
+	return reports
+}
+
+// Returns the report of the last completed election, or false if no election has completed.
+func (o *Orchestrator) LastElectionReport() (ElectionReport, bool) {
+	o.metrics.lock.Lock()
+	defer o.metrics.lock.Unlock()
+	if len(o.metrics.reports) == 0 {
+		return ElectionReport{}, false
+	}
+	return o.metrics.reports[len(o.metrics.reports)-1], true
+}
+
+// Returns the number of messages sent through the network so far, by type.
+func (o *Orchestrator) MessageCounts() MessageCounts {
+	return o.network.counter.snapshot()
+}
+
+// Returns the number of messages sent through the network so far by each node, by type.
+func (o *Orchestrator) MessageCountsByNode() map[NodeId]MessageCounts {
+	return o.network.counter.snapshotBySrc()
+}
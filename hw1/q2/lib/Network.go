@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Distribution of the one-way latency of a link.
+type LatencyDistribution interface {
+	Sample(rng *rand.Rand) time.Duration
+}
+
+// A fixed latency.
+type ConstantLatency time.Duration
+
+func (l ConstantLatency) Sample(rng *rand.Rand) time.Duration {
+	return time.Duration(l)
+}
+
+// A latency uniformly distributed in [Min, Max).
+type UniformLatency struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (l UniformLatency) Sample(rng *rand.Rand) time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+	return l.Min + time.Duration(rng.Int63n(int64(l.Max-l.Min)))
+}
+
+// A normally distributed latency, clamped to be non-negative.
+type NormalLatency struct {
+	Mean   time.Duration
+	StdDev time.Duration
+}
+
+func (l NormalLatency) Sample(rng *rand.Rand) time.Duration {
+	latency := l.Mean + time.Duration(rng.NormFloat64()*float64(l.StdDev))
+	if latency < 0 {
+		return 0
+	}
+	return latency
+}
+
+// Behaviour of messages sent over a link.
+type LinkConfig struct {
+	Latency  LatencyDistribution
+	LossRate float64 // Probability in [0, 1] that a message is dropped
+}
+
+// A named configuration of all links in the network.
+type NetworkProfile struct {
+	Name string
+	Link LinkConfig
+}
+
+// Network profiles that can be used by name.
+// Note that the Bully algorithm assumes reliable delivery within the RTT, so profiles with loss (or latency
+// close to the RTT) can cause a node to miss a veto or an announcement, until the next election fixes it.
+var NETWORK_PROFILES = map[string]NetworkProfile{
+	"ideal": {"ideal", LinkConfig{ConstantLatency(0), 0}},
+	"lan":   {"lan", LinkConfig{UniformLatency{time.Millisecond, 10 * time.Millisecond}, 0}},
+	"wan":   {"wan", LinkConfig{NormalLatency{100 * time.Millisecond, 30 * time.Millisecond}, 0}},
+	"lossy": {"lossy", LinkConfig{UniformLatency{10 * time.Millisecond, 50 * time.Millisecond}, 0.05}},
+}
+
+// Returns the names of all network profiles, sorted.
+func NetworkProfileNames() []string {
+	names := make([]string, 0, len(NETWORK_PROFILES))
+	for name := range NETWORK_PROFILES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type link struct {
+	Src NodeId
+	Dst NodeId
+}
+
+// A simulated network between node endpoints, shared by all nodes of an Orchestrator.
+// Every message is delayed according to the latency of its link, and may be dropped due to loss or a partition.
+type network struct {
+	lock        *sync.Mutex
+	rng         *rand.Rand
+	defaultLink LinkConfig
+	links       map[link]LinkConfig // Overrides of the default for specific links
+	partitions  *partitionTable
+	counter     *messageCounter // Counts every message sent, whether or not it is delivered
+}
+
+// Creates an ideal network, where messages are never delayed or lost.
+func newNetwork() *network {
+	return &network{
+		&sync.Mutex{},
+		rand.New(rand.NewSource(time.Now().UnixNano())),
+		NETWORK_PROFILES["ideal"].Link,
+		make(map[link]LinkConfig),
+		newPartitionTable(),
+		newMessageCounter(),
+	}
+}
+
+// Seeds the network's random source, so the delays and losses are reproducible.
+func (n *network) seed(seed int64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.rng = rand.New(rand.NewSource(seed))
+}
+
+// Applies a profile to all links, clearing any link overrides.
+func (n *network) useProfile(name string) error {
+	profile, ok := NETWORK_PROFILES[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown network profile: %s", name))
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.defaultLink = profile.Link
+	n.links = make(map[link]LinkConfig)
+	return nil
+}
+
+func (n *network) setDefaultLink(config LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.defaultLink = config
+}
+
+func (n *network) setLink(src, dst NodeId, config LinkConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.links[link{src, dst}] = config
+}
+
+// Decides the fate of a message: whether it is delivered, and if so, after how long.
+func (n *network) route(src, dst NodeId) (time.Duration, bool) {
+	if !n.partitions.connected(src, dst) {
+		return 0, false
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	config, ok := n.links[link{src, dst}]
+	if !ok {
+		config = n.defaultLink
+	}
+	if config.LossRate > 0 && n.rng.Float64() < config.LossRate {
+		return 0, false
+	}
+	if config.Latency == nil {
+		return 0, true
+	}
+	return config.Latency.Sample(n.rng), true
+}
+
+// Sends a message to the ControlChan or DataChan of the destination through the network, without blocking the sender.
+func (n *network) Deliver(msg Message, dst NodeEndpoint) {
+	if isDataMsg(msg.Type) {
+		n.deliver(msg, dst.DataChan)
+	} else {
+		n.deliver(msg, dst.ControlChan)
+	}
+}
+
+// The network is shared by all nodes of an Orchestrator, so it is never closed.
+func (n *network) Close() {}
+
+// Sends a message to the destination channel through the network, without blocking the sender.
+func (n *network) deliver(msg Message, dstChan chan Message) {
+	n.counter.count(msg)
+	delay, ok := n.route(msg.SrcId, msg.DstId)
+	if !ok {
+		//log.Printf("N%d: %s to N%d lost in the network.", msg.SrcId, msg.Type, msg.DstId)
+		return
+	}
+
+	go func() {
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		dstChan <- msg
+	}()
+}
@@ -3,6 +3,7 @@ package lib
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -10,19 +11,55 @@ import (
 type msgType string
 
 const (
-	MSG_TYPE_SYNC           msgType = "SYNC"           // Sent by coordinator, containing data
+	MSG_TYPE_SYNC           msgType = "SYNC"           // Sent by coordinator, containing a delta or the full state
+	MSG_TYPE_SYNC_REQUEST           = "SYNC_REQUEST"   // Sent to the coordinator by a node that can't apply its delta, for the full state
 	MSG_TYPE_ELECTION_START         = "ELECTION_START" // Sent by a node to start an election
 	MSG_TYPE_ELECTION_VETO          = "ELECTION_VETO"  // Sent by a higher ID node to reject an election
 	MSG_TYPE_ELECTION_WIN           = "ELECTION_WIN"   // Sent by a node to declare self as coordinator
+	MSG_TYPE_CLIENT_WRITE           = "CLIENT_WRITE"   // Sent by a node to forward a client write to the coordinator
+	MSG_TYPE_CLIENT_READ            = "CLIENT_READ"    // Sent by a node to forward a client read to the coordinator
+	MSG_TYPE_CLIENT_RESP            = "CLIENT_RESP"    // Sent by the coordinator to acknowledge a client request
+
+	// Invitation algorithm messages (see Invitation.go)
+	MSG_TYPE_ARE_YOU_COORDINATOR      = "ARE_YOU_COORDINATOR"      // Sent by a coordinator to find other coordinators
+	MSG_TYPE_ARE_YOU_COORDINATOR_RESP = "ARE_YOU_COORDINATOR_RESP" // Sent by a coordinator in response
+	MSG_TYPE_ARE_YOU_THERE            = "ARE_YOU_THERE"            // Sent by a member to check it is still in its coordinator's group
+	MSG_TYPE_ARE_YOU_THERE_RESP       = "ARE_YOU_THERE_RESP"       // Sent by a coordinator in response, "true" if the member is in its group
+	MSG_TYPE_INVITATION               = "INVITATION"               // Sent by a coordinator to invite a node to its new group
+	MSG_TYPE_ACCEPT                   = "ACCEPT"                   // Sent by a node to accept an invitation, with its old coordinator and data
+	MSG_TYPE_READY                    = "READY"                    // Sent by a coordinator once its new group is formed, with the group's data
+
+	// Membership messages (see Membership.go)
+	MSG_TYPE_JOIN         = "JOIN"         // Sent by a joining node to any node in the cluster, with its endpoint
+	MSG_TYPE_JOIN_RESP    = "JOIN_RESP"    // Sent in response to a join, with the endpoints of the cluster, the coordinator ID and data
+	MSG_TYPE_MEMBER_ADDED = "MEMBER_ADDED" // Sent to the cluster when a node joins, with its endpoint
+	MSG_TYPE_LEAVE        = "LEAVE"        // Sent by a node leaving the cluster
+	MSG_TYPE_HANDOFF      = "HANDOFF"      // Sent by a leaving coordinator to the node that should succeed it
+
+	// Gossip messages (see Gossip.go)
+	MSG_TYPE_GOSSIP = "GOSSIP" // Sent on DataChan by any node, with the version and data it has
+
+	// Quorum election messages (see Quorum.go)
+	MSG_TYPE_QUORUM_REQUEST = "QUORUM_REQUEST" // Sent by a node with no vetoes, to ask the others to acknowledge its win
+	MSG_TYPE_QUORUM_ACK     = "QUORUM_ACK"     // Sent in response if the node acknowledges the win, with how long to wait and its state
+	MSG_TYPE_SYNC_ACK       = "SYNC_ACK"       // Sent to the coordinator for each SYNC, so it knows it still has a majority
 )
 
 // A standard message sent between nodes.
-// The `Data` field contains either the data to be exchanged in a `MSG_TYPE_SYNC` message
+// The `Data` field contains either the delta or state to be exchanged in a `MSG_TYPE_SYNC` message, the version and state in a
+// `MSG_TYPE_GOSSIP` message, the winner's term in a `MSG_TYPE_ELECTION_WIN` message, the key and value carried by a client
+// request/response, the group ID (and state) of an invitation algorithm message, the coordinator ID and state in a `MSG_TYPE_JOIN_RESP`,
+// or the time to wait and state in a `MSG_TYPE_QUORUM_ACK`.
+// The `ReqId` field matches a `MSG_TYPE_CLIENT_RESP` to the client request that caused it, and a `MSG_TYPE_SYNC_ACK` to its SYNC broadcast.
+// The `Endpoints` field carries the endpoints of nodes in membership messages. Between processes, only their IDs and
+// addresses are carried, as the channels can't be (see Transport.go).
 type Message struct {
-	Type  msgType
-	SrcId NodeId
-	DstId NodeId
-	Data  string
+	Type      msgType
+	SrcId     NodeId
+	DstId     NodeId
+	Data      string
+	ReqId     int
+	Endpoints []NodeEndpoint
 }
 
 type NodeId int
@@ -32,58 +69,96 @@ type NodeId int
 // share other data between goroutines. This is the only thing that
 // other nodes have access to -- forcing us to pass all data through these
 // channels.
+// With the TCP transport, other nodes send to the address instead, and the node passes what it receives on to its channels.
 type NodeEndpoint struct {
 	Id          NodeId
-	ControlChan chan Message // Channel for control messages
-	DataChan    chan Message // Channel for actual data
+	ControlChan chan Message `json:"-"` // Channel for control messages
+	DataChan    chan Message `json:"-"` // Channel for actual data
+	Addr        string       // Address the node listens on, if it uses the TCP transport
 }
 
 // A node in the system.
+// Fields that are modified after creation live in `state` (see NodeState.go), and are accessed through its methods.
 type Node struct {
-	Id, CoordinatorId      NodeId
-	Data                   string                  // The data structure to be synchronised.
-	IsAlive                bool                    // Simulated liveness to simulate a fault.
-	Endpoint               NodeEndpoint            // This node's endpoint
-	endpoints              map[NodeId]NodeEndpoint // Maps a node ID to their endpoint
-	sendIntv               time.Duration           // How often data is to be sent from the coordinator
-	timeout                time.Duration           // Estimated RTT for messages
-	vetoChan               chan Message            // Internal channel to monitor for vetoes during an election
-	quitChan               chan bool               // Internal channels to kill goroutines
-	disableDetectDeadCoord bool
-	electionLock           *sync.Mutex
+	Id             NodeId
+	Endpoint       NodeEndpoint  // This node's endpoint
+	state          *nodeState    // Liveness, coordinator ID, replicated state and endpoints of other nodes
+	sendIntv       time.Duration // How often data is to be sent from the coordinator
+	timeout        time.Duration // Estimated RTT for messages
+	vetoChan       chan Message  // Internal channel to monitor for vetoes during an election
+	quitChan       chan bool     // Internal channel to kill goroutines, closed on exit
+	electionLock   *sync.Mutex
+	clientLock     *sync.Mutex          // Lock over the client request variables below
+	clientReqCount int                  // Used to generate IDs for client requests
+	clientReqs     map[int]chan Message // Maps a pending client request ID to the channel awaiting its response
+	events         *EventBus            // Events of this node are published here
+	algorithm      ElectionAlgorithm
+	invitation     *invitationState // State of the invitation algorithm, unused by the Bully algorithm
+	joinChan       chan Message     // Internal channel to pass the response to a join
+	transport      Transport        // Messages are sent through this, the simulated network by default (see Transport.go)
+	gossip         *gossipState     // State of gossip dissemination, nil if the coordinator sends data to every node
+	faults         *faultState      // Crashes armed at points in the protocol (see FaultInjection.go)
+	quorum         *quorumState     // State of the quorum election, unused by the other algorithms
+	stepped        bool             // If set, elections don't time out on their own, but are ended by the explorer (see Explorer.go)
 }
 
-// Creates a new node.
+// Creates a new node, using the Bully algorithm.
 func NewNode(id NodeId, sendInterval, timeout time.Duration, disableDetectDeadCoord bool, nodeCount int) *Node {
+	return NewNodeWithAlgorithm(id, sendInterval, timeout, disableDetectDeadCoord, nodeCount, ALGORITHM_BULLY)
+}
+
+// Creates a new node, using the given election algorithm.
+// Panics if the ID can't be encoded in a term (see TERM_ROUND_SIZE).
+func NewNodeWithAlgorithm(id NodeId, sendInterval, timeout time.Duration, disableDetectDeadCoord bool, nodeCount int, algorithm ElectionAlgorithm) *Node {
+	if id < 0 || id > MAX_NODE_ID {
+		panic(fmt.Sprintf("N%d: Node IDs must be between 0 and %d.", id, MAX_NODE_ID))
+	}
 	return &Node{
-		id, -1, "", true,
-		NodeEndpoint{id, make(chan Message), make(chan Message)},
-		make(map[NodeId]NodeEndpoint, nodeCount),
+		id,
+		NodeEndpoint{id, make(chan Message), make(chan Message), ""},
+		newNodeState(disableDetectDeadCoord, nodeCount),
 		sendInterval, timeout,
 		make(chan Message, nodeCount), make(chan bool),
-		disableDetectDeadCoord,
 		&sync.Mutex{},
+		&sync.Mutex{}, 0, make(map[int]chan Message),
+		NewEventBus(),
+		algorithm, newInvitationState(nodeCount),
+		make(chan Message, 1),
+		newNetwork(),
+		nil,
+		newFaultState(),
+		newQuorumState(nodeCount),
+		false,
 	}
 }
 
+// Subscribes a handler to this node's events. Returns a function to unsubscribe the handler.
+func (node *Node) Subscribe(handler EventHandler) func() {
+	return node.events.Subscribe(handler)
+}
+
+func (node *Node) publish(eventType EventType, coordId NodeId) {
+	node.events.Publish(Event{eventType, node.Id, coordId, time.Now()})
+}
+
 // Given a list of endpoints of nodes, initialise the Node.
 func (node *Node) Initialise(endpoints []NodeEndpoint) {
-	for _, other := range endpoints {
-		if other.Id == node.Id {
-			continue
-		}
-		node.endpoints[other.Id] = other
-	}
+	node.setEndpoints(endpoints)
+	node.startHandlers()
+	node.StartElection() // Start election upon initialisation
+}
 
-	// Start up goroutines to handle necessary incoming messages
+// Start up goroutines to handle necessary incoming messages
+func (node *Node) startHandlers() {
 	go node.HandleControl()
 	go node.HandleData()
 	go node.SyncData()
-
-	if !node.IsAlive {
-		return
+	if node.algorithm == ALGORITHM_INVITATION {
+		go node.RunInvitation()
+	}
+	if node.gossip != nil {
+		go node.RunGossip()
 	}
-	node.StartElection() // Start election upon initialisation
 }
 
 // Coordinator function to send data, if this node is the coordinator.
@@ -91,20 +166,7 @@ func (node *Node) SyncData() {
 	for {
 		select {
 		case <-time.After(node.sendIntv):
-			// Don't send if you're not the coordinator
-			if node.Id != node.CoordinatorId {
-				continue
-			}
-
-			// Don't broadcast if you're dead
-			if !node.IsAlive {
-				continue
-			}
-
-			// Broadcast this node's data
-			for nodeId := range node.endpoints {
-				node.send(MSG_TYPE_SYNC, node.endpoints[nodeId], node.Data)
-			}
+			node.broadcastSync()
 		case <-node.quitChan:
 			// log.Printf("N%d: Shutting down SyncData.", node.Id)
 			return
@@ -112,6 +174,41 @@ func (node *Node) SyncData() {
 	}
 }
 
+// Sends a SYNC to every node, if this node is the coordinator.
+func (node *Node) broadcastSync() {
+	// Don't send if you're not the coordinator, or if you're dead
+	if !node.isCoordinator() {
+		return
+	}
+
+	// With the quorum election, only keep coordinating while we hold a lease
+	round := 0
+	if node.algorithm == ALGORITHM_QUORUM {
+		if !node.acceptsUpdates() {
+			node.stepDown("lease lapsed")
+			return
+		}
+		round = node.startSyncRound()
+	}
+
+	// With gossip, only seed a few nodes, and let them spread it
+	if node.gossip != nil {
+		node.seedGossip()
+		return
+	}
+
+	// Broadcast the keys written since the last SYNC. An empty delta still serves as a heartbeat
+	delta := node.takeDelta()
+	data := encodeSync(delta)
+	endpoints := sortEndpoints(node.syncEndpoints())
+	for i, endpoint := range endpoints {
+		node.sendWithReqId(MSG_TYPE_SYNC, endpoint, data, round)
+		if len(delta.Entries) > 0 && i < len(endpoints)-1 && node.reachFaultPoint(FAULT_MID_SYNC) {
+			break
+		}
+	}
+}
+
 // Handle control messages
 func (node *Node) HandleControl() {
 	for {
@@ -121,65 +218,100 @@ func (node *Node) HandleControl() {
 				// log.Printf("N%d: ControlChan closed, shutting down HandleControl", node.Id)
 				return
 			}
+			node.handleControlMsg(msg)
+		case <-node.quitChan:
+			// log.Printf("N%d: Shutting down HandleControl.", node.Id)
+			return
+		}
+	}
+}
 
-			if msg.SrcId == node.Id {
-				panic(fmt.Sprintf("N%d: Received a message from itself", node.Id))
-			}
+// Handles a message received on ControlChan.
+func (node *Node) handleControlMsg(msg Message) {
+	if msg.SrcId == node.Id {
+		panic(fmt.Sprintf("N%d: Received a message from itself", node.Id))
+	}
 
-			if msg.DstId != node.Id {
-				panic(fmt.Sprintf("N%d: Received message bound for N%d.", node.Id, msg.DstId))
-			}
+	if msg.DstId != node.Id {
+		panic(fmt.Sprintf("N%d: Received message bound for N%d.", node.Id, msg.DstId))
+	}
 
-			// Drop message if dead
-			if !node.IsAlive {
-				// log.Printf("N%d: Dropped incoming message from %d, node is dead.", node.Id, msg.SrcId)
-				continue
-			}
+	// Drop message if dead
+	if !node.IsAlive() {
+		// log.Printf("N%d: Dropped incoming message from %d, node is dead.", node.Id, msg.SrcId)
+		return
+	}
 
-			// Handle message
-			switch msg.Type {
-			case MSG_TYPE_SYNC:
-				panic(fmt.Sprintf("N%d: Received MSG_TYPE_SYNC on ControlChan", node.Id))
-			case MSG_TYPE_ELECTION_START:
-				// If another node is starting an election, reject if ID lower and start an election
-				// log.Printf("N%d: Received ELECTION_START from N%d.", node.Id, msg.SrcId)
-				if msg.SrcId < node.Id {
-					node.send(
-						MSG_TYPE_ELECTION_VETO,
-						node.endpoints[msg.SrcId],
-						msg.Data, // Note we use the same election ID.
-					)
-					node.StartElection()
-				}
-			case MSG_TYPE_ELECTION_VETO:
-				// If we receive a veto:
-				// pass it along to the StartElection if we have an ongoing election
-
-				if node.electionLock.TryLock() {
-					// Here, managed to acquire lock -- so we don't have an election going on
-					node.electionLock.Unlock()
-					continue
-				}
-
-				// Otherwise, we DO have an election going on
-
-				log.Printf("N%d: Received ELECTION_VETO from N%d.", node.Id, msg.SrcId)
-				node.vetoChan <- msg
-			case MSG_TYPE_ELECTION_WIN:
-				// If another node declares it has won...
-				log.Printf("N%d: Received ELECTION_WIN from N%d.", node.Id, msg.SrcId)
-				if msg.SrcId < node.Id {
-					// (politely) remind everyone who the boss is
-					node.StartElection()
-				} else {
-					// ok you win
-					node.CoordinatorId = msg.SrcId
-				}
+	// Handle message
+	switch msg.Type {
+	case MSG_TYPE_SYNC:
+		panic(fmt.Sprintf("N%d: Received MSG_TYPE_SYNC on ControlChan", node.Id))
+	case MSG_TYPE_SYNC_REQUEST:
+		// Only the coordinator's state is worth transferring
+		if !node.isCoordinator() {
+			return
+		}
+		log.Printf("N%d: Sending full state to N%d.", node.Id, msg.SrcId)
+		srcEndpoint, _ := node.getEndpoint(msg.SrcId)
+		node.send(MSG_TYPE_SYNC, srcEndpoint, encodeSync(node.fullSync()))
+	case MSG_TYPE_ELECTION_START:
+		// If another node is starting an election, reject if ID lower and start an election
+		// log.Printf("N%d: Received ELECTION_START from N%d.", node.Id, msg.SrcId)
+		if msg.SrcId < node.Id {
+			srcEndpoint, _ := node.getEndpoint(msg.SrcId)
+			node.send(
+				MSG_TYPE_ELECTION_VETO,
+				srcEndpoint,
+				msg.Data, // Note we use the same election ID.
+			)
+			node.StartElection()
+		}
+	case MSG_TYPE_ELECTION_VETO:
+		// If we receive a veto:
+		// pass it along to the StartElection if we have an ongoing election
+
+		if node.electionLock.TryLock() {
+			// Here, managed to acquire lock -- so we don't have an election going on
+			node.electionLock.Unlock()
+			return
+		}
+
+		// Otherwise, we DO have an election going on
+
+		log.Printf("N%d: Received ELECTION_VETO from N%d.", node.Id, msg.SrcId)
+		node.vetoChan <- msg
+	case MSG_TYPE_ELECTION_WIN:
+		// If another node declares it has won...
+		log.Printf("N%d: Received ELECTION_WIN from N%d.", node.Id, msg.SrcId)
+		if msg.SrcId < node.Id {
+			// (politely) remind everyone who the boss is
+			node.StartElection()
+		} else {
+			// ok you win
+			if term, err := strconv.Atoi(msg.Data); err == nil {
+				node.observeTerm(term)
 			}
-		case <-node.quitChan:
-			// log.Printf("N%d: Shutting down HandleControl.", node.Id)
+			node.setCoordinatorId(msg.SrcId)
+		}
+	case MSG_TYPE_CLIENT_WRITE, MSG_TYPE_CLIENT_READ:
+		// Only the coordinator serves client requests.
+		// Otherwise, we drop the request, and the requesting node retries after the next election.
+		if !node.acceptsUpdates() {
+			log.Printf("N%d: Dropped %s from N%d, not the coordinator.", node.Id, msg.Type, msg.SrcId)
 			return
 		}
+		value := node.applyClientRequest(msg.Type, msg.Data)
+		srcEndpoint, _ := node.getEndpoint(msg.SrcId)
+		node.sendWithReqId(MSG_TYPE_CLIENT_RESP, srcEndpoint, value, msg.ReqId)
+	case MSG_TYPE_CLIENT_RESP:
+		node.handleClientResp(msg)
+	case MSG_TYPE_JOIN, MSG_TYPE_JOIN_RESP, MSG_TYPE_MEMBER_ADDED, MSG_TYPE_LEAVE, MSG_TYPE_HANDOFF:
+		node.handleMembershipMsg(msg)
+	case MSG_TYPE_ARE_YOU_COORDINATOR, MSG_TYPE_ARE_YOU_COORDINATOR_RESP, MSG_TYPE_ARE_YOU_THERE, MSG_TYPE_ARE_YOU_THERE_RESP,
+		MSG_TYPE_INVITATION, MSG_TYPE_ACCEPT, MSG_TYPE_READY:
+		node.handleInvitationMsg(msg)
+	case MSG_TYPE_QUORUM_REQUEST, MSG_TYPE_QUORUM_ACK, MSG_TYPE_SYNC_ACK:
+		node.handleQuorumMsg(msg)
 	}
 }
 
@@ -198,43 +330,89 @@ func (node *Node) HandleData() {
 				// log.Printf("N%d: DataChan closed, shutting down HandleData", node.Id)
 				return
 			}
+			node.handleDataMsg(msg)
+		case <-time.After(node.sendIntv + (node.timeout / 2)):
+			node.detectDeadCoordinator()
+		case <-node.quitChan:
+			// log.Printf("N%d: Shutting down HandleData", node.Id)
+			return
+		}
+	}
+}
 
-			// Drop message if dead
-			if !node.IsAlive {
-				continue
-			}
-
-			if msg.SrcId == node.Id {
-				panic(fmt.Sprintf("N%d: Received a message from itself", node.Id))
-			}
+// Handles a message received on DataChan.
+func (node *Node) handleDataMsg(msg Message) {
+	// Drop message if dead
+	if !node.IsAlive() {
+		return
+	}
 
-			// Received message from ID lower than self
-			if msg.SrcId < node.Id {
-				log.Printf("N%d: Received message from lower ID, start election", node.Id)
-				// I don't take orders from you!!!
-				node.StartElection()
-				continue
-			}
+	if msg.SrcId == node.Id {
+		panic(fmt.Sprintf("N%d: Received a message from itself", node.Id))
+	}
 
-			log.Printf("N%d: Received SYNC from N%d: %v", node.Id, msg.SrcId, msg.Data)
-			node.Data = msg.Data
-		case <-time.After(node.sendIntv + (node.timeout / 2)):
-			if node.disableDetectDeadCoord || node.Id == node.CoordinatorId || !node.IsAlive {
-				continue
-			}
+	// Gossip may come from any node, and carries the coordinator's term instead
+	if msg.Type == MSG_TYPE_GOSSIP {
+		node.handleGossip(msg)
+		return
+	}
 
-			// Assume coordinator is down.
-			log.Printf("N%d: Detected coordinator is down.", node.Id)
-			node.StartElection()
-		case <-node.quitChan:
-			// log.Printf("N%d: Shutting down HandleData", node.Id)
+	// With the invitation algorithm, only take data from our own coordinator
+	if node.algorithm == ALGORITHM_INVITATION {
+		if msg.SrcId != node.CoordinatorId() {
+			log.Printf("N%d: Dropped SYNC from N%d, not our coordinator.", node.Id, msg.SrcId)
 			return
 		}
+	} else if msg.SrcId < node.Id {
+		// Received message from ID lower than self
+		log.Printf("N%d: Received message from lower ID, start election", node.Id)
+		// I don't take orders from you!!!
+		node.StartElection()
+		return
+	} else if msg.SrcId > node.CoordinatorId() {
+		// A higher node is acting as coordinator, so we missed its ELECTION_WIN
+		// (e.g. it joined while another node was winning an election, and both won)
+		log.Printf("N%d: Received SYNC from N%d, higher than coordinator N%d.", node.Id, msg.SrcId, node.CoordinatorId())
+		node.setCoordinatorId(msg.SrcId)
+	} else if msg.SrcId < node.CoordinatorId() {
+		// A lower node is acting as coordinator, so either our coordinator is down (e.g. a stale ELECTION_WIN
+		// made us follow it after it died), or the sender missed its ELECTION_WIN
+		log.Printf("N%d: Received SYNC from N%d, lower than coordinator N%d, start election", node.Id, msg.SrcId, node.CoordinatorId())
+		node.StartElection()
+		return
+	}
+
+	node.handleSync(msg)
+	if node.algorithm == ALGORITHM_QUORUM {
+		node.ackSync(msg)
+	}
+}
+
+// Called when no data message arrived within the expected time. Starts an election, as the coordinator is down.
+func (node *Node) detectDeadCoordinator() {
+	// With the invitation algorithm or gossip, nodes check on their coordinator in RunInvitation or RunGossip instead
+	if node.algorithm == ALGORITHM_INVITATION || node.gossip != nil || node.detectDeadCoordDisabled() || !node.IsAlive() || node.isCoordinator() {
+		return
 	}
+
+	// Assume coordinator is down.
+	log.Printf("N%d: Detected coordinator is down.", node.Id)
+	node.StartElection()
 }
 
 // Initiate an election
 func (node *Node) StartElection() {
+	// Dead nodes don't start elections
+	if !node.IsAlive() {
+		return
+	}
+
+	// With the invitation algorithm, start in a group of our own, to be merged with others later
+	if node.algorithm == ALGORITHM_INVITATION {
+		node.formSingletonGroup()
+		return
+	}
+
 	// Prevent a node from starting an election if it has already started one.
 	// We use TryLock here because we really don't have to re-acquire the lock to start an election if we already started an election
 	if !node.electionLock.TryLock() {
@@ -242,117 +420,163 @@ func (node *Node) StartElection() {
 	}
 
 	// Acquired the lock, start a goroutine to manage the election while we continue on
-	go func() {
+	// The start is published before the goroutine, so the election is visible once StartElection returns
+	node.publish(EVENT_ELECTION_START, node.CoordinatorId())
+	if node.stepped {
+		// The explorer delivers the vetoes, and decides when the election times out (see Explorer.go)
 		log.Printf("N%d: Starting election", node.Id)
+		node.sendElectionStarts()
+		return
+	}
+	go node.runElection()
+}
 
-		defer func() {
-			// Election is over, clear election veto channel
-			for len(node.vetoChan) > 0 {
-				<-node.vetoChan
-			}
-			node.electionLock.Unlock()
-		}()
+// Manages an election started by StartElection, until it is won or vetoed.
+func (node *Node) runElection() {
+	log.Printf("N%d: Starting election", node.Id)
+	node.sendElectionStarts()
+
+	// Watch for timeout or vetoes
+	veto := false
+	select {
+	case <-node.vetoChan:
+		// Veto from ANY higher node considered as veto
+		veto = true
+		node.reachFaultPoint(FAULT_AFTER_VETO)
+	case <-time.After(node.timeout):
+		// No responses received from any node
+	}
 
-		veto := false
+	node.endElection(veto)
+}
 
-		for nodeId := range node.endpoints {
-			nodeId := nodeId
-			if nodeId <= node.Id {
-				continue
-			}
-			node.send(MSG_TYPE_ELECTION_START, node.endpoints[nodeId], "")
+// Sends ELECTION_START to every higher node, in order of node ID.
+func (node *Node) sendElectionStarts() {
+	for _, endpoint := range sortEndpoints(node.getEndpoints()) {
+		if endpoint.Id <= node.Id {
+			continue
 		}
+		node.send(MSG_TYPE_ELECTION_START, endpoint, "")
+	}
+}
 
-		// Watch for timeout or vetoes
-		select {
-		case <-node.vetoChan:
-			// Veto from ANY higher node considered as veto
-			veto = true
-		case <-time.After(node.timeout):
-			// No responses received from any node
+// Announcement stage of an election: announces the win unless it was vetoed, then releases the election lock.
+func (node *Node) endElection(veto bool) {
+	defer func() {
+		// Election is over, clear election veto channel
+		for len(node.vetoChan) > 0 {
+			<-node.vetoChan
 		}
+		node.electionLock.Unlock()
+	}()
 
-		// Announcement Stage
-		if veto {
-			log.Printf("N%d: Lost election.", node.Id)
-		} else {
-			log.Printf("N%d: Won election.", node.Id)
-
-			node.CoordinatorId = node.Id
-			for nodeId := range node.endpoints {
-				if nodeId >= node.Id {
-					continue
-				}
-				node.send(
-					MSG_TYPE_ELECTION_WIN,
-					node.endpoints[nodeId],
-					"",
-				)
+	if veto {
+		log.Printf("N%d: Lost election.", node.Id)
+		node.publish(EVENT_ELECTION_VETOED, node.CoordinatorId())
+	} else if node.algorithm == ALGORITHM_QUORUM && !node.gatherQuorum() {
+		log.Printf("N%d: Lost election, no quorum.", node.Id)
+		node.publish(EVENT_ELECTION_NO_QUORUM, node.CoordinatorId())
+	} else {
+		log.Printf("N%d: Won election.", node.Id)
+
+		term := node.nextTerm()
+		node.setCoordinatorId(node.Id)
+		node.publish(EVENT_ELECTION_WON, node.CoordinatorId())
+		// Announce to the endpoints we know now, since nodes may have joined (or this node may have been
+		// initialised) since the election started
+		for _, endpoint := range sortEndpoints(node.getEndpoints()) {
+			if endpoint.Id >= node.Id {
+				continue
+			}
+			if node.reachFaultPoint(FAULT_BEFORE_ELECTION_WIN) {
+				break
+			}
+			node.send(
+				MSG_TYPE_ELECTION_WIN,
+				endpoint,
+				strconv.Itoa(term),
+			)
+			if node.reachFaultPoint(FAULT_AFTER_ELECTION_WIN) {
+				break
 			}
 		}
-	}()
+	}
 }
 
 func (node *Node) DisableDeadCoordDetection() {
-	node.disableDetectDeadCoord = true
+	node.setDetectDeadCoordDisabled(true)
 	log.Printf("N%d: Disabled detection of dead coordinator.", node.Id)
 }
 
 func (node *Node) EnableElections() {
-	node.disableDetectDeadCoord = false
+	node.setDetectDeadCoordDisabled(false)
 	log.Printf("N%d: Enabled detection of dead coordinator.", node.Id)
 }
 
-// Manual update of data
-func (node *Node) PushUpdate(data string) {
-	if node.Id != node.CoordinatorId {
+// Manual update of a key
+func (node *Node) PushUpdate(key, value string) {
+	if !node.acceptsUpdates() {
 		panic(fmt.Sprintf("PushUpdate error: N%d is not the coordinator.", node.Id))
 	}
 
-	node.Data = data
+	node.writeValue(key, value)
 }
 
 func (node *Node) send(mType msgType, dstEndpoint NodeEndpoint, data string) {
-	if !node.IsAlive {
+	node.sendWithReqId(mType, dstEndpoint, data, 0)
+}
+
+func (node *Node) sendWithReqId(mType msgType, dstEndpoint NodeEndpoint, data string, reqId int) {
+	node.sendMessage(dstEndpoint, Message{mType, node.Id, dstEndpoint.Id, data, reqId, nil})
+}
+
+func (node *Node) sendWithEndpoints(mType msgType, dstEndpoint NodeEndpoint, data string, endpoints []NodeEndpoint) {
+	node.sendMessage(dstEndpoint, Message{mType, node.Id, dstEndpoint.Id, data, 0, endpoints})
+}
+
+func (node *Node) sendMessage(dstEndpoint NodeEndpoint, msg Message) {
+	if !node.IsAlive() {
 		return
 	}
 
 	if dstEndpoint.Id == node.Id {
-		panic(fmt.Sprintf("N%d: Tried to send data to itself: %s", node.Id, data))
+		panic(fmt.Sprintf("N%d: Tried to send data to itself: %s", node.Id, msg.Data))
 	}
 
-	msg := Message{mType, node.Id, dstEndpoint.Id, data}
-	//log.Printf("N%d: Sent %s to N%d: %s", msg.SrcId, mType, msg.DstId, data)
+	//log.Printf("N%d: Sent %s to N%d: %s", msg.SrcId, msg.Type, msg.DstId, msg.Data)
 
-	if mType == MSG_TYPE_SYNC {
-		go func() { dstEndpoint.DataChan <- msg }()
-	} else {
-		go func() { dstEndpoint.ControlChan <- msg }()
-	}
+	node.transport.Deliver(msg, dstEndpoint)
 }
 
 // Simulate this node going down.
 // To simulate a node going down in a network, we simply stop
-// sending messages.
+// sending messages. Does nothing if the node is not alive.
 func (node *Node) Kill() {
+	if !node.transitionToDead() {
+		return
+	}
 	log.Printf("N%d: Killed.", node.Id)
-	node.CoordinatorId = -1
-	node.IsAlive = false
 }
 
+// Brings a dead node back up, starting an election. Does nothing if the node is not dead.
 func (node *Node) Restart() {
-	node.IsAlive = true
-	go node.StartElection()
+	if !node.transitionToAlive() {
+		return
+	}
+	if node.gossip != nil {
+		node.resetGossip()
+	}
+	node.StartElection()
 }
 
-// Actual teardown of this node.
+// Actual teardown of this node. Does nothing if the node has already exited.
 func (node *Node) Exit() {
-	// Since the above goroutines don't check for quit if they're 'not alive', make them alive
-	node.IsAlive = true
+	if !node.transitionToExited() {
+		return
+	}
 
 	// Kill all existing goroutines
-	for i := 0; i < 3; i++ {
-		node.quitChan <- true
-	}
+	close(node.quitChan)
+	node.transport.Close()
 	log.Printf("N%d: EXIT", node.Id)
 }
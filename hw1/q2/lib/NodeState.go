@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lifecycle status of a node.
+// A node starts ALIVE, and can be killed (DEAD) and restarted (ALIVE) any number of times.
+// Once EXITED, the node's goroutines are torn down and it can no longer change status.
+type nodeStatus int
+
+const (
+	NODE_ALIVE nodeStatus = iota
+	NODE_DEAD
+	NODE_EXITED
+)
+
+func (status nodeStatus) String() string {
+	switch status {
+	case NODE_ALIVE:
+		return "ALIVE"
+	case NODE_DEAD:
+		return "DEAD"
+	case NODE_EXITED:
+		return "EXITED"
+	}
+	return "UNKNOWN"
+}
+
+// Terms are ballot numbers: the round of the election times TERM_ROUND_SIZE, plus the ID of the winner.
+// So two nodes can never win the same term, even if neither knew of the other's win (e.g. a coordinator dying
+// mid-broadcast of its ELECTION_WIN). So node IDs must be below TERM_ROUND_SIZE, which is checked on creating a node.
+const TERM_ROUND_SIZE = 1000
+const MAX_NODE_ID = TERM_ROUND_SIZE - 1
+
+// State of a node that is shared between its goroutines (and the Orchestrator).
+// All access goes through the lock, so the node's methods below are safe to call from any goroutine.
+type nodeState struct {
+	lock                   *sync.RWMutex
+	status                 nodeStatus
+	coordinatorId          NodeId
+	term                   int                     // Increases with every election won, so later coordinators have higher terms
+	kv                     replicatedState         // The state to be synchronised (see ReplicatedState.go)
+	syncedVersion          stateVersion            // Version of the state in the last SYNC, if this node is the coordinator
+	dirtyKeys              map[string]bool         // Keys written since the last SYNC, if this node is the coordinator
+	endpoints              map[NodeId]NodeEndpoint // Maps a node ID to their endpoint
+	disableDetectDeadCoord bool
+	storage                *nodeStorage  // If set, the term and state are persisted, and are lost on a kill (see Storage.go)
+	recoveryTime           time.Duration // Time taken by the last recovery from storage
+}
+
+func newNodeState(disableDetectDeadCoord bool, nodeCount int) *nodeState {
+	return &nodeState{
+		&sync.RWMutex{},
+		NODE_ALIVE, -1, 0,
+		newReplicatedState(), stateVersion{}, make(map[string]bool),
+		make(map[NodeId]NodeEndpoint, nodeCount),
+		disableDetectDeadCoord,
+		nil, 0,
+	}
+}
+
+/**
+  STATE ACCESSORS
+*/
+
+// Simulated liveness to simulate a fault.
+func (node *Node) IsAlive() bool {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.status == NODE_ALIVE
+}
+
+func (node *Node) CoordinatorId() NodeId {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.coordinatorId
+}
+
+func (node *Node) Term() int {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.term
+}
+
+// Returns true if this node is alive and considers itself the coordinator.
+func (node *Node) isCoordinator() bool {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.status == NODE_ALIVE && node.state.coordinatorId == node.Id
+}
+
+func (node *Node) getEndpoint(id NodeId) (NodeEndpoint, bool) {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	endpoint, ok := node.state.endpoints[id]
+	return endpoint, ok
+}
+
+// Returns a copy of the endpoints of the other nodes, so they can be iterated over without the lock.
+func (node *Node) getEndpoints() map[NodeId]NodeEndpoint {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	endpoints := make(map[NodeId]NodeEndpoint, len(node.state.endpoints))
+	for nodeId, endpoint := range node.state.endpoints {
+		endpoints[nodeId] = endpoint
+	}
+	return endpoints
+}
+
+// Returns the endpoints in order of node ID, so messages to all of them are sent in a known order.
+func sortEndpoints(endpoints map[NodeId]NodeEndpoint) []NodeEndpoint {
+	sorted := make([]NodeEndpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		sorted = append(sorted, endpoint)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+	return sorted
+}
+
+func (node *Node) setEndpoints(endpoints []NodeEndpoint) {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	for _, other := range endpoints {
+		if other.Id == node.Id {
+			continue
+		}
+		node.state.endpoints[other.Id] = other
+	}
+}
+
+func (node *Node) removeEndpoint(id NodeId) {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	delete(node.state.endpoints, id)
+}
+
+func (node *Node) detectDeadCoordDisabled() bool {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.disableDetectDeadCoord
+}
+
+func (node *Node) setDetectDeadCoordDisabled(disabled bool) {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	node.state.disableDetectDeadCoord = disabled
+}
+
+/**
+  STATE TRANSITIONS
+  Each transition is done atomically under the lock, and events are published after the lock is released.
+*/
+
+// Sets the coordinator ID, publishing an event if it changed.
+// Ignored if the node is not alive, since a dead node cannot learn of a new coordinator.
+func (node *Node) setCoordinatorId(coordId NodeId) {
+	node.state.lock.Lock()
+	if node.state.status != NODE_ALIVE || node.state.coordinatorId == coordId {
+		node.state.lock.Unlock()
+		return
+	}
+	node.state.coordinatorId = coordId
+	node.state.lock.Unlock()
+
+	node.publish(EVENT_COORDINATOR_CHANGED, coordId)
+}
+
+// Starts a new term, as this node has won an election. Returns the new term.
+func (node *Node) nextTerm() int {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	node.state.term = nextTermFrom(node.state.term, node.Id)
+	node.persistLocked(walRecord{WAL_RECORD_TERM, node.state.term, nil, stateVersion{}})
+	return node.state.term
+}
+
+// Returns the term won by the node `nodeId` after `term`, in the next round.
+func nextTermFrom(term int, nodeId NodeId) int {
+	return (term/TERM_ROUND_SIZE+1)*TERM_ROUND_SIZE + int(nodeId)
+}
+
+// Returns the node that won the term.
+func termWinner(term int) NodeId {
+	return NodeId(term % TERM_ROUND_SIZE)
+}
+
+// Adopts the term of another node, if it is later than ours.
+func (node *Node) observeTerm(term int) {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	if term <= node.state.term {
+		return
+	}
+	node.state.term = term
+	node.persistLocked(walRecord{WAL_RECORD_TERM, term, nil, stateVersion{}})
+}
+
+// Appends a record to storage if persistence is enabled, compacting the WAL when due.
+// Must be called with the state lock held, so records are written in the order the state changed.
+func (node *Node) persistLocked(record walRecord) {
+	if node.state.storage == nil {
+		return
+	}
+
+	snapshotDue, err := node.state.storage.appendRecord(record)
+	if err != nil {
+		log.Printf("N%d: Failed to persist %s: %v", node.Id, record.Type, err)
+		return
+	}
+	if snapshotDue {
+		err = node.state.storage.snapshot(persistentState{node.state.term, node.state.kv})
+		if err != nil {
+			log.Printf("N%d: Failed to snapshot: %v", node.Id, err)
+		}
+	}
+}
+
+// Transitions ALIVE -> DEAD, resetting the coordinator ID. Returns false if the node was not alive.
+// If persistence is enabled, all volatile state (the term and state) is lost as well.
+func (node *Node) transitionToDead() bool {
+	node.state.lock.Lock()
+	if node.state.status != NODE_ALIVE {
+		node.state.lock.Unlock()
+		return false
+	}
+	node.state.status = NODE_DEAD
+	coordChanged := node.state.coordinatorId != -1
+	node.state.coordinatorId = -1
+	if node.state.storage != nil {
+		node.state.term = 0
+		node.state.kv = newReplicatedState()
+	}
+	node.state.lock.Unlock()
+
+	if coordChanged {
+		node.publish(EVENT_COORDINATOR_CHANGED, -1)
+	}
+	node.publish(EVENT_NODE_KILLED, -1)
+	return true
+}
+
+// Transitions DEAD -> ALIVE. Returns false if the node was not dead.
+// If persistence is enabled, the term and state are recovered from storage first.
+// Either way, the node may have missed SYNCs while dead, so it takes a full transfer of the coordinator's state.
+func (node *Node) transitionToAlive() bool {
+	node.state.lock.Lock()
+	if node.state.status != NODE_DEAD {
+		node.state.lock.Unlock()
+		return false
+	}
+	if node.state.storage != nil {
+		node.recoverLocked()
+	}
+	node.state.kv.Version = UNSYNCED_VERSION
+	node.state.status = NODE_ALIVE
+	coordId := node.state.coordinatorId
+	node.state.lock.Unlock()
+
+	node.publish(EVENT_NODE_RESTARTED, coordId)
+	return true
+}
+
+// Transitions to EXITED from any other status. Returns false if the node had already exited.
+func (node *Node) transitionToExited() bool {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	if node.state.status == NODE_EXITED {
+		return false
+	}
+	node.state.status = NODE_EXITED
+	if node.state.storage != nil {
+		node.state.storage.close()
+	}
+	return true
+}
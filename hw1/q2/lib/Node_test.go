@@ -1,26 +1,40 @@
 package lib
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 const DEFAULT_SEND_INTV = 5 * time.Second
 const DEFAULT_TIMEOUT = 2 * time.Second
+const ELECTION_WAIT = 3 * (DEFAULT_SEND_INTV + DEFAULT_TIMEOUT) // Max time for a dead coordinator to be detected and replaced
 
 // Simple struct to contain contents of log
+// Nodes may still be logging while the log is dumped, hence the lock.
 type tempLog struct {
+	lock     *sync.Mutex
 	contents []string
 }
 
 func (tl *tempLog) Write(p []byte) (int, error) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
 	tl.contents = append(tl.contents, strings.TrimSpace(string(p)))
 	return len(p), nil
 }
 
 func (tl *tempLog) Dump(t *testing.T) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
 	for _, line := range tl.contents {
 		t.Log(line)
 	}
@@ -28,7 +42,7 @@ func (tl *tempLog) Dump(t *testing.T) {
 
 // Makes log use a temporary log that is returned
 func useTempLog() *tempLog {
-	tempLog := tempLog{make([]string, 0)}
+	tempLog := tempLog{&sync.Mutex{}, make([]string, 0)}
 	log.SetPrefix("")
 	log.SetFlags(log.Ltime)
 	log.SetOutput(&tempLog)
@@ -36,11 +50,59 @@ func useTempLog() *tempLog {
 	return &tempLog
 }
 
+// Network profile the system tests run under (see NETWORK_PROFILES), e.g. `go test ./lib -profile=wan`.
+var networkProfile = flag.String("profile", "ideal", "network profile to run the system tests under")
+
 /** HELPER FUNCTIONS */
 
+// Applies the network profile of this test run to the orchestrator.
+func useTestNetworkProfile(t *testing.T, o *Orchestrator) {
+	if err := o.UseNetworkProfile(*networkProfile); err != nil {
+		t.Fatalf("Test failed: %v (expected one of %v)", err, NetworkProfileNames())
+	}
+}
+
+// Creates an orchestrator with the default send interval and timeout, under the network profile of this test run.
+func newTestOrchestrator(t *testing.T, nodeCount int) *Orchestrator {
+	o := NewOrchestrator(nodeCount, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	useTestNetworkProfile(t, o)
+	return o
+}
+
+// Blocks until an election has started, or `timeout` passes.
+func blockTillElectionStart(o *Orchestrator, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return o.BlockTillElectionStart(ctx)
+}
+
+// Blocks until no elections are ongoing, or `timeout` passes.
+func blockTillElectionDone(o *Orchestrator, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return o.BlockTillElectionDone(ctx)
+}
+
+// Blocks until an election has started and completed, or `timeout` passes.
+func waitForElection(o *Orchestrator, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := o.BlockTillElectionStart(ctx); err != nil {
+		return err
+	}
+	return o.BlockTillElectionDone(ctx)
+}
+
+// Blocks until all live nodes agree on a live coordinator, or `timeout` passes.
+func blockUntilCoordinatorConsistent(o *Orchestrator, timeout time.Duration) (NodeId, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return o.BlockUntilCoordinatorConsistent(ctx)
+}
+
 // Throws a fatal error if the coordinator ID doesn't match the expected ID.
 func assertCoordinatorId(t *testing.T, o *Orchestrator, tLog *tempLog, expectedId NodeId) {
-	coordId, err := o.BlockUntilCoordinatorConsistent(10, time.Second)
+	coordId, err := blockUntilCoordinatorConsistent(o, ELECTION_WAIT)
 	if err != nil {
 		tLog.Dump(t)
 		t.Fatalf("Test failed: %v", err)
@@ -52,16 +114,16 @@ func assertCoordinatorId(t *testing.T, o *Orchestrator, tLog *tempLog, expectedI
 	}
 }
 
-// Throws a fatal error if the value stored in the system doesn't match the expected value.
-func assertOverallValue(t *testing.T, o *Orchestrator, tLog *tempLog, expectedValue string) {
-	value, err := o.GetValue()
+// Throws a fatal error if the state stored in the system doesn't match the expected state.
+func assertOverallState(t *testing.T, o *Orchestrator, tLog *tempLog, expectedState map[string]string) {
+	state, err := o.GetState()
 	if err != nil {
 		tLog.Dump(t)
 		t.Fatalf("Test failed: %v", err)
 	} else {
-		if value != expectedValue {
+		if !valuesEqual(state, expectedState) {
 			tLog.Dump(t)
-			t.Fatalf("Test failed: Value is %s, expected %s", value, expectedValue)
+			t.Fatalf("Test failed: State is %v, expected %v", state, expectedState)
 		}
 	}
 }
@@ -76,10 +138,9 @@ func assertOverallValue(t *testing.T, o *Orchestrator, tLog *tempLog, expectedVa
 func Test_BasicInit_1Node(t *testing.T) {
 	// Test with 1 node
 	tLog := useTempLog()
-	o := NewOrchestrator(1, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 1)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 0)
 
@@ -89,10 +150,9 @@ func Test_BasicInit_1Node(t *testing.T) {
 func Test_BasicInit_2Nodes(t *testing.T) {
 	// Test with 2 node
 	tLog := useTempLog()
-	o := NewOrchestrator(2, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 2)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 1)
 
@@ -102,10 +162,9 @@ func Test_BasicInit_2Nodes(t *testing.T) {
 func Test_BasicInit_5Nodes(t *testing.T) {
 	// Test with 5 nodes
 	tLog := useTempLog()
-	o := NewOrchestrator(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 5)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 4)
 
@@ -115,10 +174,9 @@ func Test_BasicInit_5Nodes(t *testing.T) {
 func Test_BasicInit_10Nodes(t *testing.T) {
 	// Test with 10 nodes
 	tLog := useTempLog()
-	o := NewOrchestrator(10, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 10)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 9)
 
@@ -136,10 +194,9 @@ func Test_BasicInit_50Nodes(t *testing.T) {
 		}
 	}(tLog, t)
 
-	o := NewOrchestrator(50, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 50)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 49)
 
@@ -158,33 +215,32 @@ func Test_BasicInit_50Nodes(t *testing.T) {
 func Test_ComplexInit(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 	assertCoordinatorId(t, o, tLog, 24)
 
 	// Here, we modify the coordinator IDs.
 	tLog = useTempLog() // Clear previous tempLog
 	log.Println("Orchestrator: Manually modifying coordinator IDs.")
-	o.Nodes[0].CoordinatorId = o.Nodes[0].Id
-	o.Nodes[4].CoordinatorId = o.Nodes[4].Id
-	o.Nodes[7].CoordinatorId = o.Nodes[7].Id
-	o.Nodes[13].CoordinatorId = o.Nodes[13].Id
-	o.Nodes[19].CoordinatorId = o.Nodes[19].Id
-	o.Nodes[20].CoordinatorId = o.Nodes[20].Id
-	o.Nodes[22].CoordinatorId = o.Nodes[22].Id
-	o.Nodes[23].CoordinatorId = o.Nodes[23].Id
-
-	coordId, err := o.GetCoordinatorId(0, time.Second)
+	o.Nodes[0].setCoordinatorId(o.Nodes[0].Id)
+	o.Nodes[4].setCoordinatorId(o.Nodes[4].Id)
+	o.Nodes[7].setCoordinatorId(o.Nodes[7].Id)
+	o.Nodes[13].setCoordinatorId(o.Nodes[13].Id)
+	o.Nodes[19].setCoordinatorId(o.Nodes[19].Id)
+	o.Nodes[20].setCoordinatorId(o.Nodes[20].Id)
+	o.Nodes[22].setCoordinatorId(o.Nodes[22].Id)
+	o.Nodes[23].setCoordinatorId(o.Nodes[23].Id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	coordId, err := o.GetCoordinatorId(ctx)
 	if err == nil {
 		tLog.Dump(t)
 		t.Fatalf("Failed to mess up the coordinators, coordinator ID is %d", coordId)
 	}
 
-	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT) // Max time for propagation of messages
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	// Coordinator ID should be resolved.
 	assertCoordinatorId(t, o, tLog, 24)
@@ -201,19 +257,18 @@ func Test_ComplexInit(t *testing.T) {
 func Test_BasicSync_5Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 5)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 4)
 
 	// Update values
-	o.UpdateNodeValue(4, "testing", true)
+	o.UpdateNodeValue(4, "x", "testing", true)
 	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
 
 	// Check values
-	assertOverallValue(t, o, tLog, "testing")
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
 
 	o.Exit()
 }
@@ -221,19 +276,18 @@ func Test_BasicSync_5Nodes(t *testing.T) {
 func Test_BasicSync_25Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 
 	// Update values
-	o.UpdateNodeValue(24, "testing", true)
+	o.UpdateNodeValue(24, "x", "testing", true)
 	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
 
 	// Check values
-	assertOverallValue(t, o, tLog, "testing")
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
 
 	o.Exit()
 }
@@ -242,24 +296,205 @@ func Test_BasicSync_25Nodes(t *testing.T) {
 func Test_BasicSync_25Nodes_Corrupted(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 
 	// Update values
-	o.UpdateNodeValue(5, "test", true)
-	o.UpdateNodeValue(8, "testi", true)
-	o.UpdateNodeValue(12, "TEST", true)
-	o.UpdateNodeValue(15, "asdf", true)
-	o.UpdateNodeValue(20, "abcde", true)
-	o.UpdateNodeValue(24, "testing", true)
+	o.UpdateNodeValue(5, "x", "test", true)
+	o.UpdateNodeValue(8, "x", "testi", true)
+	o.UpdateNodeValue(12, "x", "TEST", true)
+	o.UpdateNodeValue(15, "x", "asdf", true)
+	o.UpdateNodeValue(20, "x", "abcde", true)
+	o.UpdateNodeValue(24, "x", "testing", true)
 	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
 
 	// Check values
-	assertOverallValue(t, o, tLog, "testing")
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
+
+	o.Exit()
+}
+
+/**
+  ---REPLICATED STATE---
+  Tests that the coordinator replicates its keys by delta, and transfers its full state to nodes that need it.
+  1. Start up N nodes, wait for election to complete, and write several keys.
+  2. Ensure every node has the same state, without any node asking for a full transfer.
+  3. Kill a non-coordinator, write to a key while it is dead, and restart it.
+  4. Ensure the restarted node asks for a full transfer, and ends up with the same state.
+*/
+
+func Test_DeltaSync_5Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, 4)
+
+	expected := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for key, value := range expected {
+		if err := o.WriteValue(0, key, value, DEFAULT_TIMEOUT*2); err != nil {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: %v", err)
+		}
+	}
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	assertOverallState(t, o, tLog, expected)
+	if requests := o.MessageCounts()[MSG_TYPE_SYNC_REQUEST]; requests != 0 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %d full transfers requested, expected deltas only", requests)
+	}
+
+	// The restarted node missed a delta, so it needs the full state
+	o.KillNode(2)
+	if err := o.WriteValue(0, "b", "changed", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2)
+	o.RestartNode(2)
+	assertCoordinatorId(t, o, tLog, 4)
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2)
+
+	expected["b"] = "changed"
+	assertOverallState(t, o, tLog, expected)
+	if requests := o.MessageCountsByNode()[2][MSG_TYPE_SYNC_REQUEST]; requests == 0 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Restarted N2 did not request a full transfer")
+	}
+
+	o.Exit()
+}
+
+// Deltas only carry the keys written since the last one, and only apply to nodes with the state at their base.
+func Test_DeltaSync_Versions(t *testing.T) {
+	coord := NewNode(1, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 2)
+	follower := NewNode(0, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 2)
+	coord.nextTerm()
+
+	coord.writeValue("a", "1")
+	coord.writeValue("b", "2")
+	first := coord.takeDelta()
+	if len(first.Entries) != 2 || !follower.applySync(first) {
+		t.Fatalf("Test failed: First delta %+v not applied", first)
+	}
+
+	coord.writeValue("b", "3")
+	second := coord.takeDelta()
+	if len(second.Entries) != 1 || second.Entries["b"].Value != "3" {
+		t.Fatalf("Test failed: Second delta has %v, expected only b", second.Entries)
+	}
+
+	// A node that missed the first delta can't apply the second
+	other := NewNode(0, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 2)
+	if other.applySync(second) {
+		t.Fatalf("Test failed: Applied a delta from %v to a state at %v", second.Base, other.stateSnapshot().Version)
+	}
+	if !other.applySync(coord.fullSync()) || !follower.applySync(second) {
+		t.Fatalf("Test failed: Full state or second delta not applied")
+	}
+	if !valuesEqual(other.Values(), coord.Values()) || !valuesEqual(follower.Values(), coord.Values()) {
+		t.Fatalf("Test failed: States %v and %v, expected %v", other.Values(), follower.Values(), coord.Values())
+	}
+}
+
+/**
+  ---CLIENT WRITES AND READS---
+  Tests the client API, which can be called on any node.
+  1. Start up N nodes, wait for election to complete.
+  2. Write a value through a non-coordinator, which forwards it to the coordinator.
+  3. Ensure the coordinator-confirmed read returns the value immediately, and that the value is propagated.
+*/
+
+func Test_ClientWrite_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+
+	// Write through a non-coordinator
+	if err := o.WriteValue(0, "x", "testing", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+
+	// Coordinator-confirmed read should see the write immediately
+	value, err := o.ReadValue(1, "x", READ_COORDINATOR, DEFAULT_TIMEOUT*2)
+	if err != nil || value != "testing" {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Read \"%s\" (err: %v), expected \"testing\"", value, err)
+	}
+
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+
+	// Local read should now see the propagated value
+	value, err = o.ReadValue(2, "x", READ_LOCAL, 0)
+	if err != nil || value != "testing" {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Read \"%s\" (err: %v), expected \"testing\"", value, err)
+	}
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
+
+	o.Exit()
+}
+
+// Here, the coordinator dies right before the write, so the write has to be retried with the next coordinator.
+func Test_ClientWriteDuringElection_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+	tLog = useTempLog() // Clear log before killing the node
+
+	// Killing of coordinator, then writing before nodes detect it
+	o.KillNode(4)
+	deadline := 3 * (DEFAULT_SEND_INTV + DEFAULT_TIMEOUT)
+	if err := o.WriteValue(0, "x", "testing", deadline); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+
+	assertCoordinatorId(t, o, tLog, 3)
+	value, err := o.ReadValue(0, "x", READ_COORDINATOR, DEFAULT_TIMEOUT*2)
+	if err != nil || value != "testing" {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Read \"%s\" (err: %v), expected \"testing\"", value, err)
+	}
+
+	o.Exit()
+}
+
+// Writes through a dead node, or with no live coordinator, should fail.
+func Test_ClientWriteFailure_3Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 3)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 2)
+
+	// Write through a dead node
+	o.KillNode(0)
+	if err := o.WriteValue(0, "x", "testing", DEFAULT_TIMEOUT); err == nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Write through dead node succeeded")
+	}
+
+	// Write with a dead coordinator that has yet to be detected
+	o.KillNode(2)
+	if err := o.WriteValue(1, "x", "testing", DEFAULT_TIMEOUT); err == nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Write with dead coordinator succeeded")
+	}
 
 	o.Exit()
 }
@@ -274,19 +509,16 @@ func Test_BasicSync_25Nodes_Corrupted(t *testing.T) {
 func Test_BasicCrash_3Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(3, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 3)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 2)
 	tLog = useTempLog() // Clear log before killing the node
 
 	// Killing of coordinator
 	o.KillNode(2)
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 1)
 
@@ -296,19 +528,16 @@ func Test_BasicCrash_3Nodes(t *testing.T) {
 func Test_BasicCrash_5Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 5)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 4)
 	tLog = useTempLog() // Clear log before killing the node
 
 	// Killing of coordinator
 	o.KillNode(4)
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 3)
 
@@ -318,19 +547,16 @@ func Test_BasicCrash_5Nodes(t *testing.T) {
 func Test_BasicCrash_25Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 	tLog = useTempLog() // Clear log before killing the node
 
 	// Killing of coordinator
 	o.KillNode(24)
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 23)
 
@@ -341,7 +567,7 @@ func Test_PartialAnnouncement_25Nodes(t *testing.T) {
 	// Initialise with 25 nodes
 	tLog := useTempLog()
 	nodecount := 25
-	o := NewOrchestrator(nodecount, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, nodecount)
 
 	// Killing of coordinator and second coordinator
 	o.KillNode(NodeId(nodecount - 1))
@@ -350,22 +576,1136 @@ func Test_PartialAnnouncement_25Nodes(t *testing.T) {
 	// Manually set node coordinators to simulate partial announcement
 	halfId := (nodecount - 2) / 2
 	for i := 0; i < halfId; i++ {
-		o.Nodes[NodeId(i)].CoordinatorId = NodeId(nodecount - 2)
+		o.Nodes[NodeId(i)].setCoordinatorId(NodeId(nodecount - 2))
 	}
 
 	for i := halfId; i < DEMO_NODECOUNT-2; i++ {
-		o.Nodes[NodeId(i)].CoordinatorId = NodeId(nodecount - 1)
+		o.Nodes[NodeId(i)].setCoordinatorId(NodeId(nodecount - 1))
 	}
 
 	// Initialise the messed-up system
 	o.Initiate()
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, NodeId(nodecount-3))
 }
 
+/**
+  ---CONCURRENT CRASH AND REBOOT---
+  Kills and restarts nodes from several goroutines at once, while elections are ongoing.
+  Once every node is restarted, the highest ID should be elected. This is most useful under `go test -race`.
+*/
+
+func Test_ConcurrentKillRestart_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+
+	// Kill and restart nodes concurrently with the initial election
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				node := o.Nodes[NodeId(round%5)]
+				node.Kill()
+				node.Restart()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Restart any node left dead, then the system should settle
+	for nodeId := range o.Nodes {
+		o.Nodes[nodeId].Restart()
+	}
+	assertCoordinatorId(t, o, tLog, 4)
+
+	// Exit should be safe to call concurrently, and more than once
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.Exit()
+		}()
+	}
+	wg.Wait()
+}
+
+/**
+  ---CRASH INJECTION---
+  Tests that crash nodes at exact points in the protocol, with crashes armed through the orchestrator.
+  Nodes send announcements and SYNCs in order of node ID, so each test knows which nodes were reached.
+  1. Start up N nodes, wait for election to complete.
+  2. Arm a crash on a node, and kill the coordinator (or write a value) to make the node reach it.
+  3. Ensure exactly the expected nodes were reached before the crash, and that the system settles afterwards.
+*/
+
+// Records the nodes, other than `coordId` itself, that adopted `coordId` as their coordinator.
+// Returns a function that stops recording and returns those nodes.
+func recordAdopters(o *Orchestrator, coordId NodeId) func() map[NodeId]bool {
+	lock := &sync.Mutex{}
+	adopters := make(map[NodeId]bool)
+	unsubscribe := o.Subscribe(func(event Event) {
+		if event.Type != EVENT_COORDINATOR_CHANGED || event.CoordinatorId != coordId || event.NodeId == coordId {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		adopters[event.NodeId] = true
+	})
+
+	return func() map[NodeId]bool {
+		unsubscribe()
+		lock.Lock()
+		defer lock.Unlock()
+		return adopters
+	}
+}
+
+// Blocks until the node is dead, throwing a fatal error if that takes longer than an election.
+func assertCrashed(t *testing.T, o *Orchestrator, tLog *tempLog, id NodeId) {
+	ctx, cancel := context.WithTimeout(context.Background(), ELECTION_WAIT)
+	defer cancel()
+	if err := o.waitFor(ctx, func() bool { return !o.Nodes[id].IsAlive() }); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: N%d did not crash (%v)", id, err)
+	}
+}
+
+func assertAdopters(t *testing.T, tLog *tempLog, coordId NodeId, adopters map[NodeId]bool, expected ...NodeId) {
+	if len(adopters) != len(expected) {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: N%v adopted N%d as coordinator, expected N%v", adopters, coordId, expected)
+	}
+	for _, nodeId := range expected {
+		if !adopters[nodeId] {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: N%v adopted N%d as coordinator, expected N%v", adopters, coordId, expected)
+		}
+	}
+}
+
+// Crashes N3 while it announces its win over the killed N4, after `skip` passes through `point`.
+// Only `reached` should learn of N3's win, and N2 should then be elected. Once N3 is restarted, it should be re-elected.
+func simulatePartialAnnouncement(t *testing.T, point FaultPoint, skip int, reached ...NodeId) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+	tLog = useTempLog() // Clear log before killing the node
+
+	// Killing of coordinator, so N3 wins and crashes midway through its announcement
+	o.ArmCrash(3, point, skip)
+	stopRecording := recordAdopters(o, 3)
+	o.KillNode(4)
+	assertCrashed(t, o, tLog, 3)
+
+	assertCoordinatorId(t, o, tLog, 2)
+	assertAdopters(t, tLog, 3, stopRecording(), reached...)
+
+	// Reboot of crashed coordinator
+	o.RestartNode(3)
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 3)
+
+	o.Exit()
+}
+
+// Consideration 3a: the new coordinator crashes after announcing to some nodes (N0 and N1), but not others (N2).
+func Test_CrashAfterElectionWin_5Nodes(t *testing.T) {
+	simulatePartialAnnouncement(t, FAULT_AFTER_ELECTION_WIN, 1, 0, 1)
+}
+
+// Consideration 3a: the new coordinator crashes before announcing to any node.
+func Test_CrashBeforeElectionWin_5Nodes(t *testing.T) {
+	simulatePartialAnnouncement(t, FAULT_BEFORE_ELECTION_WIN, 0)
+}
+
+// Consideration 3b: a non-coordinator (N2) crashes during the election, after it is vetoed by N3.
+func Test_CrashAfterVeto_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+	tLog = useTempLog() // Clear log before killing the node
+
+	// Killing of coordinator, so N2 crashes once its election is vetoed
+	o.ArmCrash(2, FAULT_AFTER_VETO, 0)
+	stopRecording := recordAdopters(o, 3)
+	o.KillNode(4)
+	assertCrashed(t, o, tLog, 2)
+
+	assertCoordinatorId(t, o, tLog, 3)
+	assertAdopters(t, tLog, 3, stopRecording(), 0, 1)
+
+	// Reboot of crashed non-coordinator, which should get bullied into accepting N3
+	o.RestartNode(2)
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 3)
+
+	o.Exit()
+}
+
+// The coordinator crashes midway through broadcasting a write, after reaching N0 and N1 only.
+// The write is lost, and the new coordinator's state replaces it on the nodes that had it.
+func Test_CrashMidSync_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+
+	o.UpdateNodeValue(4, "x", "0", false)
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	assertOverallState(t, o, tLog, map[string]string{"x": "0"})
+	tLog = useTempLog() // Clear log before the crash
+
+	// Write, so N4 crashes after its SYNC to N1
+	o.ArmCrash(4, FAULT_MID_SYNC, 1)
+	o.UpdateNodeValue(4, "x", "1", false)
+	ctx, cancel := context.WithTimeout(context.Background(), ELECTION_WAIT)
+	defer cancel()
+	err := o.waitFor(ctx, func() bool {
+		values := o.GetValues("x")
+		return !o.Nodes[4].IsAlive() && values[0] == "1" && values[1] == "1"
+	})
+	if err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Write did not reach N0 and N1 before N4 crashed (%v): %v", err, o.GetValues("x"))
+	}
+	if values := o.GetValues("x"); values[2] != "0" || values[3] != "0" {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Write reached nodes after the crash: %v", values)
+	}
+
+	// N3 never had the write, so its state wins
+	assertCoordinatorId(t, o, tLog, 3)
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2)
+	assertOverallState(t, o, tLog, map[string]string{"x": "0"})
+
+	o.Exit()
+}
+
+/**
+  ---CRASH RECOVERY---
+  With persistence enabled, a killed node loses its term and data, and recovers them from disk on restart.
+  1. Start up N nodes with persistence, wait for election to complete, and write a value.
+  2. Kill a non-coordinator, ensure its state is lost. Restart it, ensure its term and data are recovered.
+  3. Kill the coordinator, ensure the next coordinator has a later term.
+  4. Restart the original coordinator, ensure it recovers its term and data before being re-elected.
+*/
+
+// Max time expected for a node to recover from its snapshot and WAL.
+const MAX_RECOVERY_TIME = 500 * time.Millisecond
+
+func assertRecovered(t *testing.T, node *Node, tLog *tempLog, expectedTerm int, expectedState map[string]string) {
+	if node.Term() != expectedTerm || !valuesEqual(node.Values(), expectedState) {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: N%d recovered term %d and state %v, expected %d and %v", node.Id, node.Term(), node.Values(), expectedTerm, expectedState)
+	}
+	if node.RecoveryTime() > MAX_RECOVERY_TIME {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: N%d took %v to recover, expected at most %v", node.Id, node.RecoveryTime(), MAX_RECOVERY_TIME)
+	}
+}
+
+func Test_CrashRecovery_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	if err := o.EnablePersistence(t.TempDir()); err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+	if err := o.WriteValue(0, "x", "testing", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
+
+	// Kill and restart a non-coordinator
+	term := o.Nodes[2].Term()
+	o.KillNode(2)
+	if o.Nodes[2].Term() != 0 || len(o.Nodes[2].Values()) != 0 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: N2 kept term %d and state %v after being killed", o.Nodes[2].Term(), o.Nodes[2].Values())
+	}
+	o.RestartNode(2)
+	assertRecovered(t, o.Nodes[2], tLog, term, map[string]string{"x": "testing"})
+	assertCoordinatorId(t, o, tLog, 4)
+
+	// Kill the coordinator
+	term = o.Nodes[4].Term() // The coordinator may have been re-elected since, so take its term now
+	o.KillNode(4)
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, 3)
+	if o.Nodes[3].Term() <= term {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: New coordinator has term %d, expected later than %d", o.Nodes[3].Term(), term)
+	}
+
+	// Restart the original coordinator
+	o.RestartNode(4)
+	assertRecovered(t, o.Nodes[4], tLog, term, map[string]string{"x": "testing"})
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, 4)
+
+	o.Exit()
+}
+
+// Writes enough updates to compact the WAL, and ensures the latest state is recovered from the snapshot and WAL.
+func Test_CrashRecovery_Snapshot(t *testing.T) {
+	tLog := useTempLog()
+	dir := t.TempDir()
+	node := NewNode(0, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 1)
+	if err := node.EnablePersistence(dir); err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+
+	updates := DEFAULT_SNAPSHOT_INTV*2 + DEFAULT_SNAPSHOT_INTV/2
+	for i := 1; i <= updates; i++ {
+		node.writeValue("x", fmt.Sprintf("Msg%d", i))
+	}
+	term := node.nextTerm()
+
+	if _, err := os.Stat(filepath.Join(dir, "N0.snapshot")); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: No snapshot after %d updates: %v", updates, err)
+	}
+
+	// Simulate a torn write at the end of the WAL, which should be ignored
+	walFile, err := os.OpenFile(filepath.Join(dir, "N0.wal"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	walFile.WriteString(`{"Type":"DELTA","Te`)
+	walFile.Close()
+
+	node.Kill()
+	node.Restart()
+	assertRecovered(t, node, tLog, term, map[string]string{"x": fmt.Sprintf("Msg%d", updates)})
+
+	// Records appended after the torn write are recovered on the next crash
+	node.writeValue("y", "AfterTear")
+	term = node.nextTerm()
+	node.Kill()
+	node.Restart()
+	assertRecovered(t, node, tLog, term, map[string]string{"x": fmt.Sprintf("Msg%d", updates), "y": "AfterTear"})
+
+	// A new node using the same directory recovers the same state
+	node.Exit()
+	newNode := NewNode(0, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 1)
+	if err := newNode.EnablePersistence(dir); err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	assertRecovered(t, newNode, tLog, term, map[string]string{"x": fmt.Sprintf("Msg%d", updates), "y": "AfterTear"})
+}
+
+// Writes a value longer than a bufio.Scanner's line limit, and ensures it is replayed from the WAL.
+func Test_CrashRecovery_LargeRecord(t *testing.T) {
+	tLog := useTempLog()
+	node := NewNode(0, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 1)
+	if err := node.EnablePersistence(t.TempDir()); err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+
+	value := strings.Repeat("x", 128*1024)
+	node.writeValue("x", value)
+	term := node.nextTerm()
+
+	node.Kill()
+	node.Restart()
+	assertRecovered(t, node, tLog, term, map[string]string{"x": value})
+	node.Exit()
+}
+
+/**
+  ---INVITATION ALGORITHM---
+  With the invitation algorithm, each partition forms its own group, and the groups merge once the partition heals.
+  1. Start up N nodes, wait for them to merge into a single group under the highest ID.
+  2. Partition the network unevenly, ensure each side forms its own group under its highest ID.
+  3. Write a different value on each side.
+  4. Heal the partition, ensure the groups merge under the highest ID, keeping the value of the larger side.
+*/
+
+const INVITATION_WAIT = 2 * ELECTION_WAIT // Max time for groups to be formed or merged
+
+// Throws a fatal error if the coordinator of any live node doesn't match the expected coordinator of its partition.
+func assertPartitionCoordinatorIds(t *testing.T, o *Orchestrator, tLog *tempLog, expectedIds map[NodeId]NodeId) {
+	ctx, cancel := context.WithTimeout(context.Background(), INVITATION_WAIT)
+	defer cancel()
+	coordIds, err := o.BlockUntilPartitionsConsistent(ctx)
+	if err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	for nodeId, expectedId := range expectedIds {
+		if coordIds[nodeId] != expectedId {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: Coordinator of N%d is %d, expected %d", nodeId, coordIds[nodeId], expectedId)
+		}
+	}
+}
+
+func Test_Invitation_5Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := NewOrchestratorWithAlgorithm(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, ALGORITHM_INVITATION)
+	useTestNetworkProfile(t, o)
+	o.Initiate()
+
+	assertPartitionCoordinatorIds(t, o, tLog, map[NodeId]NodeId{0: 4, 1: 4, 2: 4, 3: 4, 4: 4})
+
+	o.Exit()
+}
+
+func Test_InvitationPartition_6Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := NewOrchestratorWithAlgorithm(6, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, ALGORITHM_INVITATION)
+	useTestNetworkProfile(t, o)
+	o.Initiate()
+	assertPartitionCoordinatorIds(t, o, tLog, map[NodeId]NodeId{0: 5, 1: 5, 2: 5, 3: 5, 4: 5, 5: 5})
+
+	// Partition the network
+	o.Partition([]NodeId{0, 1, 2, 3}, []NodeId{4, 5})
+	assertPartitionCoordinatorIds(t, o, tLog, map[NodeId]NodeId{0: 3, 1: 3, 2: 3, 3: 3, 4: 5, 5: 5})
+
+	// Write to both sides
+	if err := o.WriteValue(0, "x", "left", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	if err := o.WriteValue(4, "x", "right", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	values := o.GetValues("x")
+	for nodeId, value := range values {
+		if (nodeId < 4 && value != "left") || (nodeId >= 4 && value != "right") {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: Value of N%d is %s during partition", nodeId, value)
+		}
+	}
+
+	// Heal the partition
+	o.HealPartition()
+	assertPartitionCoordinatorIds(t, o, tLog, map[NodeId]NodeId{0: 5, 1: 5, 2: 5, 3: 5, 4: 5, 5: 5})
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2)
+	assertOverallState(t, o, tLog, map[string]string{"x": "left"}) // The larger side's value is kept
+
+	o.Exit()
+}
+
+func Test_InvitationReconcileState(t *testing.T) {
+	// States with a single key, told apart by its value
+	a, b, c := stateWithValue("a"), stateWithValue("b"), stateWithValue("c")
+
+	// Larger group wins
+	acceptances := map[NodeId]acceptance{
+		0: {1, a}, 1: {1, a}, 2: {3, b}, 3: {3, b}, 4: {3, b},
+	}
+	if state := reconcileState(5, c, acceptances); state.Entries["x"].Value != "b" {
+		t.Fatalf("Test failed: Reconciled to %v, expected b", state.values())
+	}
+
+	// Tie goes to the higher old coordinator, using the old coordinator's state over its members'
+	acceptances = map[NodeId]acceptance{
+		0: {1, a}, 1: {1, a}, 2: {3, stateWithValue("stale")}, 3: {3, b},
+	}
+	if state := reconcileState(5, c, acceptances); state.Entries["x"].Value != "b" {
+		t.Fatalf("Test failed: Reconciled to %v, expected b", state.values())
+	}
+
+	// Old coordinator missing, use its lowest member's state
+	acceptances = map[NodeId]acceptance{
+		0: {1, a}, 2: {3, b}, 4: {3, stateWithValue("b2")},
+	}
+	if state := reconcileState(5, c, acceptances); state.Entries["x"].Value != "b" {
+		t.Fatalf("Test failed: Reconciled to %v, expected b", state.values())
+	}
+}
+
+func stateWithValue(value string) replicatedState {
+	state := newReplicatedState()
+	state.Entries["x"] = versionedValue{value, stateVersion{}}
+	return state
+}
+
+/**
+  ---QUORUM ELECTION---
+  With the quorum election, only a side of a partition with a majority of the cluster can elect a coordinator.
+  1. Start up N nodes, wait for election to complete.
+  2. Partition the network into a majority without the coordinator, and a minority with it.
+  3. Ensure the coordinator steps down, and the majority elects its highest ID, which alone accepts writes.
+  4. Heal the partition, ensure the highest ID is re-elected with the majority's value.
+  Throughout, at most one node may accept updates at any time.
+*/
+
+// Checks the nodes accepting updates after every event, and every `interval`, until the returned function is called.
+// The returned function returns the first time more than one node accepted updates, if any.
+func checkSingleCoordinator(o *Orchestrator, interval time.Duration) func() error {
+	lock := &sync.Mutex{}
+	var violation error
+	check := func() {
+		accepting := make([]NodeId, 0)
+		for nodeId, node := range o.getNodes() {
+			if node.acceptsUpdates() {
+				accepting = append(accepting, nodeId)
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if len(accepting) > 1 && violation == nil {
+			violation = fmt.Errorf("N%v all accepted updates at once", accepting)
+		}
+	}
+
+	unsubscribe := o.Subscribe(func(event Event) { check() })
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+				check()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		unsubscribe()
+		close(done)
+		lock.Lock()
+		defer lock.Unlock()
+		return violation
+	}
+}
+
+func Test_QuorumPartition_5Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := NewOrchestratorWithAlgorithm(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, ALGORITHM_QUORUM)
+	useTestNetworkProfile(t, o)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+	stopChecking := checkSingleCoordinator(o, 50*time.Millisecond)
+
+	// Partition the network, the minority side can't elect a coordinator
+	o.Partition([]NodeId{0, 1, 2}, []NodeId{3, 4})
+	ctx, cancel := context.WithTimeout(context.Background(), ELECTION_WAIT)
+	defer cancel()
+	err := o.waitFor(ctx, func() bool {
+		coordIds := o.GetCoordinatorIds()
+		return coordIds[0] == 2 && coordIds[1] == 2 && coordIds[2] == 2 && !o.Nodes[4].isCoordinator() && !o.Nodes[3].isCoordinator()
+	})
+	if err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Majority did not elect N2 (%v): %v", err, o.GetCoordinatorIds())
+	}
+
+	// Only the majority accepts writes
+	if err := o.WriteValue(0, "x", "majority", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	if err := o.WriteValue(3, "x", "minority", DEFAULT_TIMEOUT*2); err == nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Write to the minority was accepted")
+	}
+
+	// Heal the partition
+	o.HealPartition()
+	assertCoordinatorId(t, o, tLog, 4)
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	assertOverallState(t, o, tLog, map[string]string{"x": "majority"})
+
+	if err := stopChecking(); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+
+	o.Exit()
+}
+
+/**
+  ---SIMULATED NETWORK---
+  Tests that messages are delayed and dropped according to the links of the simulated network.
+*/
+
+func Test_NetworkLatency(t *testing.T) {
+	n := newNetwork()
+	n.setDefaultLink(LinkConfig{ConstantLatency(200 * time.Millisecond), 0})
+	dstChan := make(chan Message, 1)
+
+	start := time.Now()
+	n.deliver(Message{MSG_TYPE_SYNC, 0, 1, "testing", 0, nil}, dstChan)
+	select {
+	case <-dstChan:
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("Test failed: Message delivered after %v, expected at least 200ms", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Test failed: Message not delivered")
+	}
+}
+
+func Test_NetworkLossAndPartition(t *testing.T) {
+	n := newNetwork()
+	n.seed(1)
+	n.setLink(0, 1, LinkConfig{ConstantLatency(0), 1}) // Lose everything from N0 to N1
+	dstChan := make(chan Message, 2)
+
+	n.deliver(Message{MSG_TYPE_SYNC, 0, 1, "lost", 0, nil}, dstChan)
+	n.deliver(Message{MSG_TYPE_SYNC, 1, 0, "delivered", 0, nil}, dstChan)
+	select {
+	case msg := <-dstChan:
+		if msg.Data != "delivered" {
+			t.Fatalf("Test failed: Received \"%s\", expected only \"delivered\"", msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Test failed: Message not delivered")
+	}
+
+	n.partitions.partition([][]NodeId{{0}, {1, 2}})
+	n.deliver(Message{MSG_TYPE_SYNC, 2, 0, "partitioned", 0, nil}, dstChan)
+	n.deliver(Message{MSG_TYPE_SYNC, 2, 1, "delivered", 0, nil}, dstChan)
+	select {
+	case msg := <-dstChan:
+		if msg.Data != "delivered" {
+			t.Fatalf("Test failed: Received \"%s\", expected only \"delivered\"", msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Test failed: Message not delivered")
+	}
+
+	select {
+	case msg := <-dstChan:
+		t.Fatalf("Test failed: Received unexpected \"%s\"", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+/**
+  ---TCP TRANSPORT---
+  Tests that nodes elect a coordinator and synchronise over TCP, within this process and as separate processes.
+  1. Start up N nodes over TCP, wait for election to complete, and write a value.
+  2. Kill the coordinator (with SIGKILL, for processes), ensure the next highest ID is elected.
+  3. Restart the coordinator, ensure it is re-elected.
+*/
+
+func Test_TCPTransport_3Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 3)
+	for _, node := range o.Nodes {
+		if err := node.EnableTCP("127.0.0.1:0"); err != nil {
+			t.Fatalf("Test failed: %v", err)
+		}
+	}
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 2)
+	if counts := o.MessageCounts(); counts.Total() != 0 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %d messages went through the simulated network, expected none", counts.Total())
+	}
+
+	o.UpdateNodeValue(2, "x", "tcp", false)
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	assertOverallState(t, o, tLog, map[string]string{"x": "tcp"})
+
+	// Killing of coordinator
+	o.KillNode(2)
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 1)
+
+	o.Exit()
+}
+
+// Builds the node binary into a temporary directory, returning its path.
+func buildNodeBinary(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "node")
+	build := exec.Command("go", "build", "-o", bin, "../cmd/node")
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Skipf("Could not build the node binary: %v\n%s", err, output)
+	}
+	return bin
+}
+
+func Test_Processes_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o, err := NewProcessOrchestrator(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, buildNodeBinary(t))
+	if err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	defer o.Exit()
+	o.Initiate()
+
+	assertCoordinatorId(t, o, tLog, 4)
+	tLog = useTempLog() // Clear log before killing the node
+
+	// Functions that need the node in this process fail, instead of acting on no node
+	if err := o.WriteValue(4, "x", "tcp", DEFAULT_TIMEOUT); err == nil {
+		t.Fatalf("Test failed: Wrote to a node process")
+	}
+	if err := o.ArmCrash(4, FAULT_AFTER_VETO, 0); err == nil {
+		t.Fatalf("Test failed: Armed a crash of a node process")
+	}
+
+	// Killing of coordinator's process
+	o.KillNode(4)
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 3)
+
+	// Relaunch of original coordinator's process
+	o.RestartNode(4)
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+}
+
+/**
+  ---ELECTION METRICS---
+  Compares the cost of the best and worst case re-elections, for varying node counts.
+  1. Start up N nodes, wait for election to complete.
+  2. Disable dead coordinator detection on all nodes except one, and kill the coordinator.
+  3. Ensure the cost of the re-election matches the case:
+    - Best case (N-2 detects): 1 ELECTION_START and N-2 ELECTION_WIN messages, i.e. O(N).
+    - Worst case (N0 detects): at least N(N-1)/2 ELECTION_START, (N-1)(N-2)/2 ELECTION_VETO and N-2 ELECTION_WIN messages,
+      i.e. O(N^2). There may be more, since a node whose election was vetoed starts another on a late ELECTION_START.
+*/
+
+// Kills the coordinator with only `detectorId` detecting it, and returns the report of the re-election.
+func simulateReelection(t *testing.T, nodeCount int, detectorId NodeId) ElectionReport {
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, nodeCount)
+	defer o.Exit()
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+	coordId := NodeId(nodeCount - 1)
+	assertCoordinatorId(t, o, tLog, coordId)
+
+	// Let any elections started by late ELECTION_STARTs from the initial election settle
+	time.Sleep(2 * DEFAULT_TIMEOUT)
+	assertCoordinatorId(t, o, tLog, coordId)
+
+	for nodeId := range o.Nodes {
+		if nodeId == coordId || nodeId == detectorId {
+			continue
+		}
+		o.Nodes[nodeId].DisableDeadCoordDetection()
+	}
+	electionCount := len(o.ElectionReports())
+
+	o.KillNode(coordId)
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, coordId-1)
+
+	reports := o.ElectionReports()
+	if len(reports) != electionCount+1 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %d elections reported after the kill, expected 1", len(reports)-electionCount)
+	}
+	return reports[len(reports)-1]
+}
+
+// Throws a fatal error if the election messages in the report don't match the expected counts.
+// If `exact` is false, the counts are only lower bounds.
+func assertElectionMessages(t *testing.T, report ElectionReport, starts, vetoes, wins int, exact bool) {
+	t.Log(report)
+	counts := []int{report.Messages[MSG_TYPE_ELECTION_START], report.Messages[MSG_TYPE_ELECTION_VETO], report.Messages[MSG_TYPE_ELECTION_WIN]}
+	for i, expected := range []int{starts, vetoes, wins} {
+		if counts[i] < expected || (exact && counts[i] != expected) {
+			t.Fatalf("Test failed: Expected %d ELECTION_START, %d ELECTION_VETO and %d ELECTION_WIN (exact: %v)", starts, vetoes, wins, exact)
+		}
+	}
+}
+
+func Test_ElectionMetrics_BestCase(t *testing.T) {
+	for _, n := range []int{5, 10, 20} {
+		report := simulateReelection(t, n, NodeId(n-2))
+		assertElectionMessages(t, report, 1, 0, n-2, true)
+		if report.ElectionsStarted != 1 || report.MaxConcurrentElections != 1 {
+			t.Fatalf("Test failed: %d elections started (max %d concurrent), expected only 1", report.ElectionsStarted, report.MaxConcurrentElections)
+		}
+	}
+}
+
+func Test_ElectionMetrics_WorstCase(t *testing.T) {
+	for _, n := range []int{5, 10, 20} {
+		report := simulateReelection(t, n, 0)
+		assertElectionMessages(t, report, n*(n-1)/2, (n-1)*(n-2)/2, n-2, false)
+		if report.ElectionsStarted < n-1 {
+			t.Fatalf("Test failed: %d elections started, expected at least %d", report.ElectionsStarted, n-1)
+		}
+	}
+}
+
+/**
+  ---MEMBERSHIP---
+  Nodes can join a running cluster through any node, and leave it gracefully.
+  1. Start up N nodes, wait for election to complete, and write a value.
+  2. Add a node through the lowest node. Ensure it outranks the coordinator, becoming the new coordinator with the same value.
+  3. Remove a non-coordinator. Ensure the other nodes forget it, and the coordinator is unchanged.
+  4. Remove the coordinator. Ensure it hands off to the next highest node, with the same value.
+*/
+
+func Test_JoinLeave_5Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, 4)
+	if err := o.WriteValue(0, "x", "testing", DEFAULT_TIMEOUT*2); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+
+	// Join
+	nodeId, err := o.AddNode(0)
+	if err != nil || nodeId != 5 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Added N%d with error %v, expected N5", nodeId, err)
+	}
+	assertCoordinatorId(t, o, tLog, 5)
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2)
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
+
+	// Non-coordinator leaves
+	o.RemoveNode(0)
+	time.Sleep(DEFAULT_TIMEOUT / 2)
+	for nodeId, node := range o.Nodes {
+		if _, ok := node.getEndpoint(0); ok {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: N%d still has N0 as a member", nodeId)
+		}
+	}
+	assertCoordinatorId(t, o, tLog, 5)
+
+	// Coordinator leaves
+	tLog = useTempLog()
+	o.RemoveNode(5)
+	assertCoordinatorId(t, o, tLog, 4)
+	assertOverallState(t, o, tLog, map[string]string{"x": "testing"})
+
+	o.Exit()
+}
+
+// Joins a node while an election is ongoing, ensuring it takes part and wins.
+func Test_JoinDuringElection_5Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, 4)
+
+	// Kill the coordinator, and join once its death is detected
+	o.KillNode(4)
+	if err := blockTillElectionStart(o, ELECTION_WAIT); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	nodeId, err := o.AddNode(1)
+	if err != nil || nodeId != 5 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Added N%d with error %v, expected N5", nodeId, err)
+	}
+	assertCoordinatorId(t, o, tLog, 5)
+
+	o.Exit()
+}
+
+/**
+  ---CONSOLE---
+  Tests that a console session can be recorded, and replayed as a script to reach the same state.
+  1. Start up N nodes, and drive them through a console while recording.
+  2. Replay the recording on a fresh set of nodes.
+  3. Ensure both end with the same coordinator and value.
+*/
+
+func Test_ConsoleRecordReplay_3Nodes(t *testing.T) {
+	session := []string{"wait", "kill 2", "wait", "update 0 x hello world", "sleep 200ms", "bogus", "kill 5", "status"}
+	tLog := useTempLog()
+
+	// Record
+	o := newTestOrchestrator(t, 3)
+	o.Initiate()
+	out := &strings.Builder{}
+	recording := &strings.Builder{}
+	console := NewConsole(o, out, ELECTION_WAIT)
+	console.Record(recording)
+	for _, line := range session {
+		err := console.Execute(line)
+		if (err != nil) != (line == "bogus" || line == "kill 5") {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: Unexpected result for `%s`: %v", line, err)
+		}
+	}
+	o.Exit()
+
+	expected := "wait\nkill 2\nwait\nupdate 0 x hello world\nsleep 200ms\nstatus\n"
+	if recording.String() != expected {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Recorded %q, expected %q", recording.String(), expected)
+	}
+
+	// Replay
+	o = newTestOrchestrator(t, 3)
+	o.Initiate()
+	console = NewConsole(o, out, ELECTION_WAIT)
+	if err := console.Run(strings.NewReader("# Replayed session\n"+recording.String()), false, true); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v", err)
+	}
+	time.Sleep(DEFAULT_SEND_INTV + DEFAULT_TIMEOUT/2) // Send Interval + RTT/2 is max time for propagation
+	assertCoordinatorId(t, o, tLog, 1)
+	assertOverallState(t, o, tLog, map[string]string{"x": "hello world"})
+
+	o.Exit()
+}
+
+/**
+  ---INTERLEAVING EXPLORER---
+  Tests the Bully algorithm against every interleaving of message deliveries, timeouts, kills, restarts, joins and
+  leaves, running the handlers of real nodes under a deterministic scheduler.
+  1. Explore all interleavings of small clusters, or random interleavings of larger ones.
+  2. Ensure no two live nodes believe they are coordinator once the cluster settles, and all live nodes eventually
+     agree on the highest live node.
+*/
+
+func assertNoViolation(t *testing.T, config ExplorerConfig, result ExplorerResult) {
+	if result.Violation != nil {
+		t.Fatalf("Test failed: %+v: %v", config, result.Violation)
+	}
+	if result.Truncated > 0 {
+		t.Fatalf("Test failed: %+v: %d interleavings cut off at depth %d", config, result.Truncated, config.MaxDepth)
+	}
+	if result.Terminal == 0 {
+		t.Fatalf("Test failed: %+v: No interleaving completed", config)
+	}
+	t.Logf("%+v: %d states, %d terminal", config, result.States, result.Terminal)
+}
+
+func Test_Explorer_Exhaustive(t *testing.T) {
+	configs := []ExplorerConfig{
+		{3, 0, 0, 0, 0, 100, false, false},
+		{3, 1, 0, 0, 0, 100, false, false}, // Includes killing the coordinator mid-broadcast of its ELECTION_WIN
+		{3, 1, 1, 0, 0, 100, true, false},
+		{4, 1, 0, 0, 0, 100, true, false},
+		{3, 0, 0, 1, 0, 100, true, false}, // Includes the coordinator handing off as it leaves
+		{2, 0, 0, 0, 1, 100, true, false}, // Includes a node joining while another wins an election
+	}
+	for _, config := range configs {
+		assertNoViolation(t, config, Explore(config))
+	}
+}
+
+func Test_Explorer_RandomWalk_5Nodes(t *testing.T) {
+	configs := []ExplorerConfig{
+		{5, 2, 1, 0, 0, 200, false, false},
+		{5, 2, 2, 0, 0, 200, true, false},
+		{4, 1, 1, 1, 1, 200, true, false},
+	}
+	for _, config := range configs {
+		assertNoViolation(t, config, RandomWalk(config, 2000, 1))
+	}
+}
+
+// Without detecting a dead coordinator, the other nodes keep following the coordinator once it is killed.
+func Test_Explorer_FindsViolation(t *testing.T) {
+	config := ExplorerConfig{3, 1, 0, 0, 0, 100, true, true}
+	result := Explore(config)
+	if result.Violation == nil || result.Violation.Invariant != INVARIANT_EVENTUAL_AGREEMENT {
+		t.Fatalf("Test failed: Expected a violation of \"%s\", got %v", INVARIANT_EVENTUAL_AGREEMENT, result.Violation)
+	}
+	t.Log(result.Violation)
+
+	// The same seed always takes the same interleavings
+	first := RandomWalk(config, 100, 42)
+	second := RandomWalk(config, 100, 42)
+	if first.Violation == nil || fmt.Sprint(first.Violation.Trace) != fmt.Sprint(second.Violation.Trace) {
+		t.Fatalf("Test failed: Random walks with the same seed differ: %v, %v", first.Violation, second.Violation)
+	}
+}
+
+/**
+  ---GOSSIP---
+  Tests that data is disseminated by gossip, instead of the coordinator sending it to every node.
+  1. Start up N nodes with gossip enabled, wait for election to complete.
+  2. Update the coordinator's value, and ensure it reaches every node within a send interval plus the time to spread.
+  3. Kill the coordinator, ensure the nodes detect it without any SYNC, and the new coordinator's value spreads.
+  4. Restart the old coordinator, ensure it takes over and its value spreads.
+*/
+
+// Blocks until all live nodes have the state, for at most a send interval plus the time for gossip to spread.
+// Returns the time taken.
+func assertGossipConverges(t *testing.T, o *Orchestrator, tLog *tempLog, state map[string]string) time.Duration {
+	wait := DEFAULT_SEND_INTV + DEFAULT_TIMEOUT + time.Duration(o.Nodes[0].gossipSpreadRounds())*DEFAULT_GOSSIP_CONFIG.Interval
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	start := time.Now()
+	if err := o.BlockUntilStateConsistent(ctx, state); err != nil {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: %v (states: %v)", err, o.GetStates())
+	}
+	return time.Since(start)
+}
+
+func Test_Gossip_10Nodes(t *testing.T) {
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 10)
+	if err := o.EnableGossip(DEFAULT_GOSSIP_CONFIG); err != nil {
+		t.Fatalf("Test failed: %v", err)
+	}
+	o.Initiate()
+	assertCoordinatorId(t, o, tLog, 9)
+
+	o.UpdateNodeValue(9, "x", "gossip", false)
+	t.Logf("Value converged in %v", assertGossipConverges(t, o, tLog, map[string]string{"x": "gossip"}))
+
+	counts := o.MessageCounts()
+	if counts[MSG_TYPE_SYNC] != 0 || counts[MSG_TYPE_GOSSIP] == 0 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Expected only gossip, got %d SYNC and %d GOSSIP messages", counts[MSG_TYPE_SYNC], counts[MSG_TYPE_GOSSIP])
+	}
+	for nodeId, nodeCounts := range o.MessageCountsByNode() {
+		t.Logf("N%d sent %d GOSSIP messages", nodeId, nodeCounts[MSG_TYPE_GOSSIP])
+	}
+
+	// Without SYNCs, the dead coordinator is detected from the lack of new versions
+	o.KillNode(9)
+	assertCoordinatorId(t, o, tLog, 8)
+	o.UpdateNodeValue(8, "x", "after crash", false)
+	assertGossipConverges(t, o, tLog, map[string]string{"x": "after crash"})
+
+	// The restarted coordinator takes over, with the value it had
+	o.RestartNode(9)
+	assertCoordinatorId(t, o, tLog, 9)
+	assertGossipConverges(t, o, tLog, o.Nodes[9].Values())
+
+	o.Exit()
+}
+
+// A newer version carries its coordinator, even when relayed by another node, so a node that missed the
+// coordinator's ELECTION_WIN follows it.
+func Test_Gossip_AdoptsCoordinator(t *testing.T) {
+	coord := NewNode(2, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 3)
+	follower := NewNode(0, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT, false, 3)
+	for _, node := range []*Node{coord, follower} {
+		if err := node.EnableGossip(DEFAULT_GOSSIP_CONFIG); err != nil {
+			t.Fatalf("Test failed: %v", err)
+		}
+	}
+	follower.setCoordinatorId(1)
+	coord.nextTerm()
+	coord.writeValue("x", "gossip")
+
+	data := encodeGossip(gossipVersion{coord.Term(), 1}, coord.stateSnapshot())
+	follower.handleGossip(Message{MSG_TYPE_GOSSIP, 1, 0, data, 0, nil})
+	if follower.CoordinatorId() != 2 || follower.Term() != coord.Term() {
+		t.Fatalf("Test failed: Follower has coordinator N%d in term %d, expected N2 in term %d", follower.CoordinatorId(), follower.Term(), coord.Term())
+	}
+	if value, _ := follower.Value("x"); value != "gossip" {
+		t.Fatalf("Test failed: Follower has x = %q, expected \"gossip\"", value)
+	}
+}
+
+/**
+  ---EVENTS---
+  Tests that nodes publish events for elections and crashes.
+  1. Start up N nodes, wait for election to complete.
+  2. Kill the coordinator, and wait for the re-election.
+  3. Ensure the kill, the new coordinator's win and the coordinator changes were published.
+*/
+
+func Test_Events_5Nodes(t *testing.T) {
+	// Initialisation
+	tLog := useTempLog()
+	o := newTestOrchestrator(t, 5)
+	o.Initiate()
+	waitForElection(o, ELECTION_WAIT)
+
+	assertCoordinatorId(t, o, tLog, 4)
+
+	// Record events from here on
+	eventLock := &sync.Mutex{}
+	events := make([]Event, 0)
+	unsubscribe := o.Subscribe(func(event Event) {
+		eventLock.Lock()
+		defer eventLock.Unlock()
+		events = append(events, event)
+	})
+
+	// Killing of coordinator
+	o.KillNode(4)
+	waitForElection(o, ELECTION_WAIT)
+	assertCoordinatorId(t, o, tLog, 3)
+	unsubscribe()
+
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if len(events) == 0 || events[0].Type != EVENT_COORDINATOR_CHANGED || events[0].NodeId != 4 {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Expected N4's coordinator to be reset first, got %v", events)
+	}
+
+	hasKilled := false
+	hasWon := false
+	coordChanges := make(map[NodeId]NodeId)
+	for _, event := range events {
+		switch event.Type {
+		case EVENT_NODE_KILLED:
+			hasKilled = hasKilled || event.NodeId == 4
+		case EVENT_ELECTION_WON:
+			if event.NodeId != 3 {
+				tLog.Dump(t)
+				t.Fatalf("Test failed: N%d won an election, expected only N3", event.NodeId)
+			}
+			hasWon = true
+		case EVENT_COORDINATOR_CHANGED:
+			coordChanges[event.NodeId] = event.CoordinatorId
+		}
+	}
+
+	if !hasKilled || !hasWon {
+		tLog.Dump(t)
+		t.Fatalf("Test failed: Missing events (killed: %v, won: %v)", hasKilled, hasWon)
+	}
+	for nodeId := NodeId(0); nodeId < 4; nodeId++ {
+		if coordChanges[nodeId] != 3 {
+			tLog.Dump(t)
+			t.Fatalf("Test failed: N%d's last coordinator change was to %d, expected 3", nodeId, coordChanges[nodeId])
+		}
+	}
+
+	o.Exit()
+}
+
 /**
   ---BASIC CRASH AND REBOOT---
   After the crash, system should elect a new coordinator. After reboot of original coordinator, system should elect the highest ID.
@@ -380,26 +1720,22 @@ func Test_PartialAnnouncement_25Nodes(t *testing.T) {
 func Test_BasicCrashAndReboot_5Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(5, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 5)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 4)
 	tLog = useTempLog() // Clear log before killing the node
 
 	// Killing of coordinator
 	o.KillNode(4)
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 3)
 
 	// Reboot of original coordinator
 	o.RestartNode(4)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 4)
 
@@ -409,26 +1745,22 @@ func Test_BasicCrashAndReboot_5Nodes(t *testing.T) {
 func Test_BasicCrashAndReboot_25Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 	tLog = useTempLog() // Clear log before killing the node
 
 	// Killing of coordinator
 	o.KillNode(24)
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 23)
 
 	// Reboot of original coordinator
 	o.RestartNode(24)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 
@@ -438,34 +1770,30 @@ func Test_BasicCrashAndReboot_25Nodes(t *testing.T) {
 func Test_NonCoordCrashDuringElection_25Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 	tLog = useTempLog() // Clear log before killing the node
 
 	// Killing of coordinator
 	o.KillNode(24)
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV) // Wait for nodes to detect
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 23)
 
 	// Reboot of original coordinator
 	o.RestartNode(24)
-	o.BlockTillElectionStart(5, time.Second)
+	blockTillElectionStart(o, ELECTION_WAIT)
 	o.KillNode(22)
-	o.BlockTillElectionDone(5, time.Second)
+	blockTillElectionDone(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 
 	// Reboot dead non coordinator
 	o.RestartNode(22)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 	assertCoordinatorId(t, o, tLog, 24)
 
 	o.Exit()
@@ -474,10 +1802,9 @@ func Test_NonCoordCrashDuringElection_25Nodes(t *testing.T) {
 func Test_Durability_CrashAndReboot_25Nodes(t *testing.T) {
 	// Initialisation
 	tLog := useTempLog()
-	o := NewOrchestrator(25, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o := newTestOrchestrator(t, 25)
 	o.Initiate()
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 24)
 	tLog = useTempLog() // Clear log before killing the node
@@ -494,9 +1821,7 @@ func Test_Durability_CrashAndReboot_25Nodes(t *testing.T) {
 	o.KillNode(7)
 	o.KillNode(5)
 
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 23)
 
@@ -504,16 +1829,13 @@ func Test_Durability_CrashAndReboot_25Nodes(t *testing.T) {
 	o.KillNode(23)
 	o.KillNode(20)
 
-	time.Sleep(DEFAULT_TIMEOUT/2 + DEFAULT_SEND_INTV)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 17)
 
 	// Reboot
 	o.RestartNode(22)
-	o.BlockTillElectionStart(5, time.Second)
-	o.BlockTillElectionDone(5, time.Second)
+	waitForElection(o, ELECTION_WAIT)
 
 	assertCoordinatorId(t, o, tLog, 22)
 
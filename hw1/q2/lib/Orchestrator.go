@@ -1,47 +1,396 @@
 package lib
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"sync"
 	"time"
 )
 
+// A node driven by the Orchestrator, either a *Node in this process, or a node process (see Process.go).
+type clusterNode interface {
+	IsAlive() bool
+	CoordinatorId() NodeId
+	Values() map[string]string
+	Value(key string) (string, bool)
+	Kill()
+	Restart()
+	Exit()
+}
+
 type Orchestrator struct {
-	Nodes map[NodeId](*Node)
+	Nodes            map[NodeId](*Node) // Nodes in the cluster. Changed by AddNode and RemoveNode, under nodesLock
+	nodesLock        *sync.RWMutex
+	sendIntv         time.Duration // Send interval and timeout of the nodes, used for nodes added later
+	timeout          time.Duration
+	algorithm        ElectionAlgorithm
+	events           *EventBus       // Events from all nodes are re-published here
+	stateLock        *sync.Mutex     // Lock over the election state below
+	ongoingElections map[NodeId]bool // Nodes with an ongoing election, tracked through their events
+	stateChanged     chan struct{}   // Closed (and replaced) on every event, to wake up blocking functions
+	network          *network        // Simulated network, shared by all nodes
+	metrics          *electionMetrics
+	gossip           *GossipConfig           // Gossip config of the nodes, used for nodes added later. Nil if gossip is disabled
+	processes        map[NodeId]*nodeProcess // Nodes running in their own processes, nil if they run in this process
+	reports          net.Listener            // Listens for the reports of node processes
 }
 
+// Creates an Orchestrator of nodes using the Bully algorithm.
 func NewOrchestrator(nodeCount int, sendIntv, timeout time.Duration) *Orchestrator {
+	return NewOrchestratorWithAlgorithm(nodeCount, sendIntv, timeout, ALGORITHM_BULLY)
+}
+
+// Creates an Orchestrator of nodes using the given election algorithm.
+func NewOrchestratorWithAlgorithm(nodeCount int, sendIntv, timeout time.Duration, algorithm ElectionAlgorithm) *Orchestrator {
 	nodes := make(map[NodeId](*Node))
+	network := newNetwork()
 
 	for nodeId := 0; nodeId < nodeCount; nodeId++ {
 		nodeId := NodeId(nodeId)
-		nodes[nodeId] = NewNode(nodeId, sendIntv, timeout, false, nodeCount)
+		nodes[nodeId] = NewNodeWithAlgorithm(nodeId, sendIntv, timeout, false, nodeCount, algorithm)
+		nodes[nodeId].transport = network
+	}
+
+	o := &Orchestrator{
+		nodes, &sync.RWMutex{},
+		sendIntv, timeout, algorithm,
+		NewEventBus(),
+		&sync.Mutex{}, make(map[NodeId]bool), make(chan struct{}),
+		network,
+		newElectionMetrics(),
+		nil,
+		nil, nil,
+	}
+
+	// Subscribe to nodes before they're initialised, so no election is missed
+	for nodeId := range o.Nodes {
+		o.Nodes[nodeId].Subscribe(o.handleEvent)
+	}
+
+	return o
+}
+
+// Subscribes a handler to the events of all nodes. Returns a function to unsubscribe the handler.
+func (o *Orchestrator) Subscribe(handler EventHandler) func() {
+	return o.events.Subscribe(handler)
+}
+
+// Tracks the state of elections from a node event, and wakes up any blocking functions.
+func (o *Orchestrator) handleEvent(event Event) {
+	o.stateLock.Lock()
+	switch event.Type {
+	case EVENT_ELECTION_START:
+		o.ongoingElections[event.NodeId] = true
+	case EVENT_ELECTION_VETOED, EVENT_ELECTION_WON, EVENT_ELECTION_NO_QUORUM:
+		delete(o.ongoingElections, event.NodeId)
+	}
+	ongoing := len(o.ongoingElections)
+	close(o.stateChanged)
+	o.stateChanged = make(chan struct{})
+	o.stateLock.Unlock()
+
+	o.recordEvent(event, ongoing)
+
+	o.events.Publish(event)
+}
+
+// Blocks until `cond` is true, re-checking it after every event.
+// Returns the context's error if `ctx` is done before that.
+func (o *Orchestrator) waitFor(ctx context.Context, cond func() bool) error {
+	for {
+		// Get the channel before checking, so we don't miss an event that happens during the check
+		o.stateLock.Lock()
+		changed := o.stateChanged
+		o.stateLock.Unlock()
+
+		if cond() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
-	return &Orchestrator{nodes}
+// Returns the node with the given ID, or nil if there is none.
+func (o *Orchestrator) getNode(id NodeId) *Node {
+	o.nodesLock.RLock()
+	defer o.nodesLock.RUnlock()
+	return o.Nodes[id]
+}
+
+// Returns a copy of the nodes, so they can be iterated over while nodes are added or removed.
+func (o *Orchestrator) getNodes() map[NodeId](*Node) {
+	o.nodesLock.RLock()
+	defer o.nodesLock.RUnlock()
+	nodes := make(map[NodeId](*Node), len(o.Nodes))
+	for nodeId, node := range o.Nodes {
+		nodes[nodeId] = node
+	}
+	return nodes
+}
+
+// Returns the node with the given ID, whether it runs in this process or its own, or nil if there is none.
+func (o *Orchestrator) member(id NodeId) clusterNode {
+	if o.processes != nil {
+		if p, ok := o.processes[id]; ok {
+			return processMember{p, o}
+		}
+		return nil
+	}
+	if node := o.getNode(id); node != nil {
+		return node
+	}
+	return nil
+}
+
+// Returns the node with the given ID if it runs in this process. Returns an error if there is none, or if the nodes
+// run in their own processes, which can only be observed, killed and restarted.
+func (o *Orchestrator) localNode(id NodeId) (*Node, error) {
+	if o.processes != nil {
+		return nil, errors.New(fmt.Sprintf("N%d runs in its own process, which can't be changed from here.", id))
+	}
+	node := o.getNode(id)
+	if node == nil {
+		return nil, errors.New(fmt.Sprintf("No node N%d.", id))
+	}
+	return node, nil
+}
+
+// Returns a copy of the nodes, whether they run in this process or their own.
+func (o *Orchestrator) members() map[NodeId]clusterNode {
+	members := make(map[NodeId]clusterNode)
+	if o.processes != nil {
+		for nodeId, p := range o.processes {
+			members[nodeId] = processMember{p, o}
+		}
+		return members
+	}
+	for nodeId, node := range o.getNodes() {
+		members[nodeId] = node
+	}
+	return members
 }
 
 func (o *Orchestrator) KillNode(id NodeId) {
-	o.Nodes[id].Kill()
+	o.member(id).Kill()
 }
 
 func (o *Orchestrator) RestartNode(id NodeId) {
-	if o.Nodes[id].IsAlive {
+	if o.member(id).IsAlive() {
 		panic("Tried to start an alive node")
 	}
-	o.Nodes[id].Restart()
+	o.member(id).Restart()
+}
+
+// Arms a crash of a node at a point in the protocol, after skipping `skip` passes through it (see FaultInjection.go).
+func (o *Orchestrator) ArmCrash(id NodeId, point FaultPoint, skip int) error {
+	node, err := o.localNode(id)
+	if err != nil {
+		return err
+	}
+	node.ArmCrash(point, skip)
+	return nil
+}
+
+func (o *Orchestrator) DisarmCrash(id NodeId, point FaultPoint) error {
+	node, err := o.localNode(id)
+	if err != nil {
+		return err
+	}
+	node.DisarmCrash(point)
+	return nil
+}
+
+/**
+  MEMBERSHIP FUNCTIONS
+  These change the nodes in a running cluster.
+*/
+
+// Adds a new node with the next highest ID to the running cluster, joining through the node `viaId`.
+// Returns the ID of the new node, or an error if it could not join.
+func (o *Orchestrator) AddNode(viaId NodeId) (NodeId, error) {
+	via, err := o.localNode(viaId)
+	if err != nil {
+		return -1, err
+	}
+
+	o.nodesLock.Lock()
+	nodeId := NodeId(0)
+	for id := range o.Nodes {
+		if id >= nodeId {
+			nodeId = id + 1
+		}
+	}
+	if nodeId > MAX_NODE_ID {
+		o.nodesLock.Unlock()
+		return -1, errors.New(fmt.Sprintf("Can't add N%d, node IDs must be at most %d.", nodeId, MAX_NODE_ID))
+	}
+	node := NewNodeWithAlgorithm(nodeId, o.sendIntv, o.timeout, false, len(o.Nodes)+1, o.algorithm)
+	node.transport = o.network
+	if o.gossip != nil {
+		node.EnableGossip(*o.gossip)
+	}
+	node.Subscribe(o.handleEvent)
+	o.Nodes[nodeId] = node
+	o.nodesLock.Unlock()
+
+	if err := node.Join(via.Endpoint); err != nil {
+		o.RemoveNode(nodeId)
+		return -1, err
+	}
+	return nodeId, nil
+}
+
+// Removes a node from the running cluster, which leaves gracefully.
+func (o *Orchestrator) RemoveNode(id NodeId) {
+	o.nodesLock.Lock()
+	node, ok := o.Nodes[id]
+	delete(o.Nodes, id)
+	o.nodesLock.Unlock()
+	if !ok {
+		return
+	}
+
+	node.Leave()
+
+	// The node can no longer finish an ongoing election
+	o.forgetElection(id)
+}
+
+// Stops tracking any ongoing election of a node, e.g. once it has left, and wakes up any blocking functions.
+func (o *Orchestrator) forgetElection(id NodeId) {
+	o.stateLock.Lock()
+	delete(o.ongoingElections, id)
+	close(o.stateChanged)
+	o.stateChanged = make(chan struct{})
+	o.stateLock.Unlock()
+}
+
+/**
+  NETWORK FUNCTIONS
+  These control the simulated network between nodes, and can be called at any time.
+*/
+
+// Applies a named network profile (see NETWORK_PROFILES) to all links, clearing any link overrides.
+func (o *Orchestrator) UseNetworkProfile(name string) error {
+	return o.network.useProfile(name)
+}
+
+// Sets the latency and loss of all links without an override.
+func (o *Orchestrator) SetDefaultLink(config LinkConfig) {
+	o.network.setDefaultLink(config)
+}
+
+// Sets the latency and loss of the link from `src` to `dst`. The link from `dst` to `src` is unaffected.
+func (o *Orchestrator) SetLink(src, dst NodeId, config LinkConfig) {
+	o.network.setLink(src, dst, config)
+}
+
+// Seeds the network's random source, so the delays and losses are reproducible.
+func (o *Orchestrator) SeedNetwork(seed int64) {
+	o.network.seed(seed)
+}
+
+// Partitions the network into the given groups of nodes. Nodes not in any group are isolated.
+func (o *Orchestrator) Partition(groups ...[]NodeId) {
+	o.network.partitions.partition(groups)
+}
+
+// Restores full connectivity between all nodes.
+func (o *Orchestrator) HealPartition() {
+	o.network.partitions.heal()
+}
+
+// Returns the coordinator ID of each live node if, within every partition, there are no ongoing elections
+// and all live nodes agree on a live coordinator in the same partition.
+func (o *Orchestrator) getConsistentPartitionCoordinatorIds() (map[NodeId]NodeId, bool) {
+	if o.HasOngoingElection() {
+		return nil, false
+	}
+
+	coordIds := o.GetCoordinatorIds()
+	liveIds := make([]NodeId, 0, len(coordIds))
+	for nodeId := range coordIds {
+		liveIds = append(liveIds, nodeId)
+	}
+
+	for _, component := range o.network.partitions.components(liveIds) {
+		coordId := coordIds[component[0]]
+		for _, nodeId := range component {
+			if coordIds[nodeId] != coordId {
+				return nil, false
+			}
+		}
+		coord := o.getNode(coordId)
+		if coord == nil || !coord.IsAlive() || !o.network.partitions.connected(component[0], coordId) {
+			return nil, false
+		}
+	}
+	return coordIds, true
+}
+
+// Blocks until the coordinator is the same throughout each partition, or `ctx` is done.
+// Returns the coordinator ID of each live node.
+func (o *Orchestrator) BlockUntilPartitionsConsistent(ctx context.Context) (map[NodeId]NodeId, error) {
+	var coordIds map[NodeId]NodeId
+	err := o.waitFor(ctx, func() bool {
+		var consistent bool
+		coordIds, consistent = o.getConsistentPartitionCoordinatorIds()
+		return consistent
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not resolve coordinators: %v", err))
+	}
+	return coordIds, nil
+}
+
+// Enables persistence for all nodes, storing their state in the given directory.
+// Killed nodes then lose their term and data, and recover them from the directory on restart.
+func (o *Orchestrator) EnablePersistence(dir string) error {
+	for _, node := range o.getNodes() {
+		if err := node.EnablePersistence(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Disseminates data by gossip for all nodes (see Gossip.go), including nodes added later.
+// Must be called before Initiate.
+func (o *Orchestrator) EnableGossip(config GossipConfig) error {
+	for _, node := range o.getNodes() {
+		if err := node.EnableGossip(config); err != nil {
+			return err
+		}
+	}
+	o.nodesLock.Lock()
+	o.gossip = &config
+	o.nodesLock.Unlock()
+	return nil
 }
 
 // Initialise system,
 func (o *Orchestrator) Initiate() {
+	if o.processes != nil {
+		o.launchProcesses()
+		return
+	}
+
+	nodes := o.getNodes()
 	endpoints := make([]NodeEndpoint, 0)
-	for nodeId := range o.Nodes {
-		endpoints = append(endpoints, o.Nodes[nodeId].Endpoint)
+	for _, node := range nodes {
+		endpoints = append(endpoints, node.Endpoint)
 	}
 
 	// Initialise nodes
-	for nodeId := range o.Nodes {
-		go o.Nodes[nodeId].Initialise(endpoints)
+	for _, node := range nodes {
+		go node.Initialise(endpoints)
 	}
 }
 
@@ -50,93 +399,130 @@ func (o *Orchestrator) Initiate() {
   These check for when an election has started/concluded.
 */
 
-// We try to acquire all the locks
+// Returns true if any node has an ongoing election.
 func (o *Orchestrator) HasOngoingElection() bool {
-	for nodeId := range o.Nodes {
-		if o.Nodes[nodeId].electionLock.TryLock() {
-			o.Nodes[nodeId].electionLock.Unlock()
-			return true
-		}
-	}
-	return false
+	o.stateLock.Lock()
+	defer o.stateLock.Unlock()
+	return len(o.ongoingElections) > 0
 }
 
-func (o *Orchestrator) BlockTillElectionStart(maxPolls int, pollTick time.Duration) error {
-	polls := 0
-	for polls < maxPolls {
-		if !o.HasOngoingElection() {
-			time.Sleep(pollTick)
-			polls++
-		} else {
-			return nil
-		}
+// Blocks until an election is ongoing, or `ctx` is done.
+func (o *Orchestrator) BlockTillElectionStart(ctx context.Context) error {
+	err := o.waitFor(ctx, o.HasOngoingElection)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Election not started: %v", err))
 	}
-
-	return errors.New(fmt.Sprintf("Election not settled after %d polls.", maxPolls))
+	return nil
 }
 
-func (o *Orchestrator) BlockTillElectionDone(maxPolls int, pollTick time.Duration) error {
-	polls := 0
-	for polls < maxPolls {
-		if o.HasOngoingElection() {
-			time.Sleep(pollTick)
-			polls++
-		} else {
-			return nil
-		}
+// Blocks until no elections are ongoing, or `ctx` is done.
+func (o *Orchestrator) BlockTillElectionDone(ctx context.Context) error {
+	err := o.waitFor(ctx, func() bool { return !o.HasOngoingElection() })
+	if err != nil {
+		return errors.New(fmt.Sprintf("Election not settled: %v", err))
 	}
-	return errors.New(fmt.Sprintf("Election not settled after %d polls.", maxPolls))
+	return nil
 }
 
 /**
   VALUE FUNCTIONS
-  These check the data of nodes, or update it.
+  These check the state of nodes, or update it.
 */
 
-func (o *Orchestrator) GetValues() map[NodeId]string {
+// Returns the value of a key on each live node. Nodes without a value for the key are left out.
+func (o *Orchestrator) GetValues(key string) map[NodeId]string {
 	coordValues := make(map[NodeId]string)
-	for nodeId := range o.Nodes {
+	for nodeId, node := range o.members() {
 		// Check first if the node is actually alive, since dead nodes won't be updated
-		if !o.Nodes[nodeId].IsAlive {
+		if !node.IsAlive() {
 			continue
 		}
-		coordValues[nodeId] = o.Nodes[nodeId].Data
+		if value, ok := node.Value(key); ok {
+			coordValues[nodeId] = value
+		}
 	}
 	return coordValues
 }
 
-// Returns the overall value. Throws an error if the values are not the same.
-func (o *Orchestrator) GetValue() (string, error) {
-	if len(o.Nodes) == 0 {
-		panic("No nodes to get value from")
+// Returns the values of all keys on each live node.
+func (o *Orchestrator) GetStates() map[NodeId]map[string]string {
+	states := make(map[NodeId]map[string]string)
+	for nodeId, node := range o.members() {
+		if !node.IsAlive() {
+			continue
+		}
+		states[nodeId] = node.Values()
 	}
+	return states
+}
 
-	value := ""
-	readFirstLiveNode := false
+// Returns the overall state. Throws an error if the states of live nodes are not the same.
+func (o *Orchestrator) GetState() (map[string]string, error) {
+	if len(o.members()) == 0 {
+		panic("No nodes to get state from")
+	}
 
-	for _, nodeValue := range o.GetValues() {
-		if value != nodeValue {
-			// either we're at the first live node, or value is different
-			if readFirstLiveNode {
-				// then value is different
-				return "", errors.New(fmt.Sprintf("No single value: Has \"%s\" and \"%s\".", nodeValue, value))
-			} else {
-				// we're at the first live node
-				value = nodeValue
-				readFirstLiveNode = true
-			}
+	var state map[string]string
+	for _, nodeState := range o.GetStates() {
+		if state == nil {
+			state = nodeState
+		} else if !valuesEqual(state, nodeState) {
+			return nil, errors.New(fmt.Sprintf("No single state: Has %v and %v.", nodeState, state))
 		}
 	}
+	if state == nil {
+		state = make(map[string]string)
+	}
+	return state, nil
+}
 
-	return value, nil
+// Blocks until all live nodes have the given state, or `ctx` is done.
+func (o *Orchestrator) BlockUntilStateConsistent(ctx context.Context, state map[string]string) error {
+	err := o.waitFor(ctx, func() bool {
+		for _, nodeState := range o.GetStates() {
+			if !valuesEqual(nodeState, state) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("State %v not consistent: %v", state, err))
+	}
+	return nil
 }
 
-func (o *Orchestrator) UpdateNodeValue(id NodeId, value string, force bool) {
-	if force {
-		o.Nodes[id].Data = value
+// Updates the value of a key on the given node. If `force` is false, the node must be the coordinator.
+// If `force` is true, only the node's own state is changed, as if it had diverged from the coordinator.
+func (o *Orchestrator) UpdateNodeValue(id NodeId, key, value string, force bool) error {
+	node, err := o.localNode(id)
+	if err != nil {
+		return err
+	}
+	if force && !node.isCoordinator() {
+		node.forceValue(key, value)
 	} else {
-		o.Nodes[id].PushUpdate(value)
+		node.PushUpdate(key, value)
+	}
+	return nil
+}
+
+// Writes the value of a key through the given node, which forwards it to the coordinator.
+func (o *Orchestrator) WriteValue(id NodeId, key, value string, deadline time.Duration) error {
+	node, err := o.localNode(id)
+	if err != nil {
+		return err
 	}
+	return node.Write(key, value, deadline)
+}
+
+// Reads the value of a key through the given node, with the given consistency.
+func (o *Orchestrator) ReadValue(id NodeId, key string, consistency ReadConsistency, deadline time.Duration) (string, error) {
+	node, err := o.localNode(id)
+	if err != nil {
+		return "", err
+	}
+	return node.Read(key, consistency, deadline)
 }
 
 /**
@@ -145,20 +531,20 @@ func (o *Orchestrator) UpdateNodeValue(id NodeId, value string, force bool) {
 
 func (o *Orchestrator) GetCoordinatorIds() map[NodeId]NodeId {
 	coordIds := make(map[NodeId]NodeId)
-	for nodeId := range o.Nodes {
+	for nodeId, node := range o.members() {
 		// Check first if the node is actually alive, since we set the coordinator ID of dead nodes to be -1
-		if !o.Nodes[nodeId].IsAlive {
+		if !node.IsAlive() {
 			continue
 		}
-		coordIds[nodeId] = o.Nodes[nodeId].CoordinatorId
+		coordIds[nodeId] = node.CoordinatorId()
 	}
 	return coordIds
 }
 
 // Returns the coordinator ID after election has settled.
-// Blocks if election has not been settled, gives error after (maxPolls * pollTick)
-func (o *Orchestrator) GetCoordinatorId(maxPolls int, pollTick time.Duration) (NodeId, error) {
-	err := o.BlockTillElectionDone(maxPolls, pollTick)
+// Blocks if election has not been settled, gives error if `ctx` is done before that.
+func (o *Orchestrator) GetCoordinatorId(ctx context.Context) (NodeId, error) {
+	err := o.BlockTillElectionDone(ctx)
 	if err != nil {
 		return -1, errors.New("Election not settled.")
 	}
@@ -180,40 +566,50 @@ func (o *Orchestrator) GetCoordinatorId(maxPolls int, pollTick time.Duration) (N
 	return coordId, nil
 }
 
-// Blocks until the coordinator is the same throughout.
-func (o *Orchestrator) BlockUntilCoordinatorConsistent(maxPolls int, pollTick time.Duration) (NodeId, error) {
-	polls := 0
-
-	for polls < maxPolls {
-		coordId := NodeId(-1)
-		coordConsistent := true
+// Returns the coordinator ID if there are no ongoing elections, and all live nodes agree on a live coordinator.
+func (o *Orchestrator) getConsistentCoordinatorId() (NodeId, bool) {
+	if o.HasOngoingElection() {
+		return NodeId(-1), false
+	}
 
-		for _, nodeId := range o.GetCoordinatorIds() {
-			if nodeId != coordId {
-				if coordId == -1 {
-					coordId = nodeId
-				} else {
-					coordConsistent = false
-					break
-				}
+	coordId := NodeId(-1)
+	for _, nodeId := range o.GetCoordinatorIds() {
+		if nodeId != coordId {
+			if coordId == -1 {
+				coordId = nodeId
+			} else {
+				return NodeId(-1), false
 			}
-
-		}
-		if coordConsistent && coordId != NodeId(-1) {
-			return coordId, nil
 		}
+	}
 
-		// Coordinator not consistent, poll again
-		polls++
-		time.Sleep(pollTick)
+	coord := o.member(coordId)
+	if coord == nil || !coord.IsAlive() {
+		return NodeId(-1), false
 	}
+	return coordId, true
+}
 
-	return NodeId(-1), errors.New("Could not resolve coordinator after polls.")
+// Blocks until the coordinator is the same throughout, or `ctx` is done.
+func (o *Orchestrator) BlockUntilCoordinatorConsistent(ctx context.Context) (NodeId, error) {
+	coordId := NodeId(-1)
+	err := o.waitFor(ctx, func() bool {
+		var consistent bool
+		coordId, consistent = o.getConsistentCoordinatorId()
+		return consistent
+	})
+	if err != nil {
+		return NodeId(-1), errors.New(fmt.Sprintf("Could not resolve coordinator: %v", err))
+	}
+	return coordId, nil
 }
 
 func (o *Orchestrator) Exit() {
-	for nodeId := range o.Nodes {
-		o.Nodes[nodeId].Exit()
+	for _, node := range o.members() {
+		node.Exit()
+	}
+	if o.reports != nil {
+		o.reports.Close()
 	}
 
 	recover()
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+)
+
+// Simulated network partitions, as part of the simulated network.
+// While partitioned, messages between nodes in different groups are dropped.
+type partitionTable struct {
+	lock   *sync.RWMutex
+	groups map[NodeId]int // Maps a node ID to its group. If nil, the network is fully connected.
+}
+
+func newPartitionTable() *partitionTable {
+	return &partitionTable{&sync.RWMutex{}, nil}
+}
+
+// Splits the network into the given groups. Nodes not in any group are isolated from all other nodes.
+func (p *partitionTable) partition(groups [][]NodeId) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.groups = make(map[NodeId]int)
+	for i, group := range groups {
+		for _, nodeId := range group {
+			p.groups[nodeId] = i
+		}
+	}
+}
+
+// Restores full connectivity.
+func (p *partitionTable) heal() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.groups = nil
+}
+
+// Returns true if a message from `src` can reach `dst`.
+func (p *partitionTable) connected(src, dst NodeId) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.groups == nil {
+		return true
+	}
+	srcGroup, srcOk := p.groups[src]
+	dstGroup, dstOk := p.groups[dst]
+	return srcOk && dstOk && srcGroup == dstGroup
+}
+
+// Splits the given nodes into the sets of nodes that can reach each other, each sorted by ID.
+func (p *partitionTable) components(nodeIds []NodeId) [][]NodeId {
+	components := make([][]NodeId, 0)
+	for _, nodeId := range nodeIds {
+		found := false
+		for i, component := range components {
+			if p.connected(component[0], nodeId) {
+				components[i] = append(component, nodeId)
+				found = true
+				break
+			}
+		}
+		if !found {
+			components = append(components, []NodeId{nodeId})
+		}
+	}
+	for _, component := range components {
+		sort.Slice(component, func(i, j int) bool { return component[i] < component[j] })
+	}
+	return components
+}
@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+  MULTI-PROCESS CLUSTERS
+  Each node can run as its own process of the node binary (see cmd/node), talking to its peers over TCP.
+  - A node process is given its ID and the address of every node in the cluster (its peers), and listens on its own.
+  - The Orchestrator launches the processes, kills them with SIGKILL and relaunches them to restart them.
+  - Each process reports its events (and its values) to the Orchestrator over TCP, so the Orchestrator can track
+    elections and coordinators as it does for nodes in its own process.
+  Only the Orchestrator functions that observe nodes, or kill and restart them, apply to processes. The rest
+  (e.g. the simulated network, membership, crash injection and writes) need the nodes to be in the same process, and
+  those that target a node return an error for processes.
+*/
+
+// Parses a list of peers, e.g. "0=127.0.0.1:7000,1=127.0.0.1:7001", into their endpoints.
+func ParsePeers(peers string) ([]NodeEndpoint, error) {
+	endpoints := make([]NodeEndpoint, 0)
+	for _, peer := range strings.Split(peers, ",") {
+		parts := strings.SplitN(strings.TrimSpace(peer), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid peer %q, expected id=host:port", peer))
+		}
+		nodeId, err := strconv.Atoi(parts[0])
+		if err != nil || nodeId < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid peer ID %q", parts[0]))
+		}
+		endpoints = append(endpoints, NodeEndpoint{NodeId(nodeId), nil, nil, parts[1]})
+	}
+	return endpoints, nil
+}
+
+// Formats endpoints as a list of peers, to be parsed by ParsePeers.
+func FormatPeers(endpoints []NodeEndpoint) string {
+	peers := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		peers = append(peers, fmt.Sprintf("%d=%s", endpoint.Id, endpoint.Addr))
+	}
+	return strings.Join(peers, ",")
+}
+
+// An event of a node process, sent to the Orchestrator with the values the node had at the time.
+type nodeReport struct {
+	Pid    int // Process that sent the report, so reports from before a restart can be told apart
+	Event  Event
+	Values map[string]string
+}
+
+const REPORT_QUEUE_SIZE = 1024
+
+// Reports this node's events to the Orchestrator listening on `addr`. Must be called before Initialise, so no
+// event is missed.
+func (node *Node) ReportTo(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, TCP_DIAL_TIMEOUT)
+	if err != nil {
+		return errors.New(fmt.Sprintf("N%d: Could not report to %s: %v", node.Id, addr, err))
+	}
+
+	// Handlers must not block, so reports are queued and sent from another goroutine.
+	// If the queue is full (e.g. the Orchestrator stopped reading, or the connection broke), reports are dropped.
+	reports := make(chan nodeReport, REPORT_QUEUE_SIZE)
+	droppedLock := &sync.Mutex{}
+	dropped := 0
+	node.Subscribe(func(event Event) {
+		select {
+		case reports <- nodeReport{os.Getpid(), event, node.Values()}:
+		default:
+			droppedLock.Lock()
+			dropped++
+			count := dropped
+			droppedLock.Unlock()
+			log.Printf("N%d: Dropped report of %s, %d dropped so far.", node.Id, event.Type, count)
+		}
+	})
+	go func() {
+		defer conn.Close()
+		encoder := json.NewEncoder(conn)
+		for {
+			select {
+			case report := <-reports:
+				if err := encoder.Encode(report); err != nil {
+					log.Printf("N%d: Failed to report %s: %v", node.Id, report.Event.Type, err)
+					return
+				}
+			case <-node.quitChan:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// A node running in a process of the node binary, as seen by the Orchestrator through its reports.
+type nodeProcess struct {
+	lock          *sync.Mutex
+	id            NodeId
+	args          []string  // Arguments to launch the node binary with
+	cmd           *exec.Cmd // The running process, or the last one if it was killed
+	alive         bool
+	exited        bool
+	coordinatorId NodeId
+	values        map[string]string
+}
+
+// Launches the process. Must be called with the lock held.
+func (p *nodeProcess) startLocked() error {
+	p.cmd = exec.Command(p.args[0], p.args[1:]...)
+	p.cmd.Stdout = log.Writer()
+	p.cmd.Stderr = log.Writer()
+	if err := p.cmd.Start(); err != nil {
+		return errors.New(fmt.Sprintf("N%d: Could not launch process: %v", p.id, err))
+	}
+	p.alive = true
+	p.coordinatorId = -1
+	p.values = make(map[string]string)
+	return nil
+}
+
+// Applies a report from the process. Returns false if it is stale, e.g. from before the process was killed.
+func (p *nodeProcess) apply(report nodeReport) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.alive || p.cmd.Process.Pid != report.Pid {
+		return false
+	}
+	if report.Event.Type == EVENT_COORDINATOR_CHANGED {
+		p.coordinatorId = report.Event.CoordinatorId
+	}
+	p.values = report.Values
+	return true
+}
+
+func (p *nodeProcess) IsAlive() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.alive
+}
+
+func (p *nodeProcess) CoordinatorId() NodeId {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.coordinatorId
+}
+
+func (p *nodeProcess) Values() map[string]string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	values := make(map[string]string, len(p.values))
+	for key, value := range p.values {
+		values[key] = value
+	}
+	return values
+}
+
+func (p *nodeProcess) Value(key string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	value, ok := p.values[key]
+	return value, ok
+}
+
+// Kills the process with SIGKILL. Returns false if it was not running.
+func (p *nodeProcess) kill() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.alive {
+		return false
+	}
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.alive = false
+	p.coordinatorId = -1
+	return true
+}
+
+// Launches the process again. Returns false if it was running, or has exited.
+func (p *nodeProcess) restart() (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.alive || p.exited {
+		return false, nil
+	}
+	return true, p.startLocked()
+}
+
+// Stops the process with SIGTERM, letting the node exit. Does nothing if the process has already exited.
+func (p *nodeProcess) exit() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.exited {
+		return
+	}
+	p.exited = true
+	if !p.alive {
+		return
+	}
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	p.cmd.Wait()
+	p.alive = false
+}
+
+// A node process, with the Orchestrator it reports to.
+// The process can't publish its own kill and restart, so they are published here instead.
+type processMember struct {
+	*nodeProcess
+	o *Orchestrator
+}
+
+func (m processMember) Kill() {
+	if !m.kill() {
+		return
+	}
+	log.Printf("N%d: Killed process.", m.id)
+	// The process can no longer finish an ongoing election
+	m.o.forgetElection(m.id)
+	m.o.handleEvent(Event{EVENT_NODE_KILLED, m.id, -1, time.Now()})
+}
+
+func (m processMember) Restart() {
+	restarted, err := m.restart()
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	if restarted {
+		m.o.handleEvent(Event{EVENT_NODE_RESTARTED, m.id, -1, time.Now()})
+	}
+}
+
+func (m processMember) Exit() {
+	m.exit()
+}
+
+// Creates an Orchestrator of nodes that each run in a process of the node binary at `binPath`, on local ports.
+// The processes are launched by Initiate.
+func NewProcessOrchestrator(nodeCount int, sendIntv, timeout time.Duration, binPath string) (*Orchestrator, error) {
+	o := NewOrchestrator(0, sendIntv, timeout)
+
+	reports, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not listen for reports: %v", err))
+	}
+	o.reports = reports
+
+	// Reserve a free port for each node. The ports are released so the nodes can listen on them
+	endpoints := make([]NodeEndpoint, 0, nodeCount)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			reports.Close()
+			return nil, errors.New(fmt.Sprintf("Could not reserve a port for N%d: %v", nodeId, err))
+		}
+		endpoints = append(endpoints, NodeEndpoint{NodeId(nodeId), nil, nil, listener.Addr().String()})
+		listener.Close()
+	}
+
+	o.processes = make(map[NodeId]*nodeProcess, nodeCount)
+	for _, endpoint := range endpoints {
+		args := []string{
+			binPath,
+			"-id", strconv.Itoa(int(endpoint.Id)),
+			"-peers", FormatPeers(endpoints),
+			"-report", reports.Addr().String(),
+			"-send-intv", sendIntv.String(),
+			"-timeout", timeout.String(),
+		}
+		o.processes[endpoint.Id] = &nodeProcess{&sync.Mutex{}, endpoint.Id, args, nil, false, false, -1, make(map[string]string)}
+	}
+
+	go o.acceptReports()
+	return o, nil
+}
+
+// Accepts connections from node processes, tracking their reports.
+func (o *Orchestrator) acceptReports() {
+	for {
+		conn, err := o.reports.Accept()
+		if err != nil {
+			// Listener closed on Exit
+			return
+		}
+		go func() {
+			defer conn.Close()
+			decoder := json.NewDecoder(conn)
+			for {
+				var report nodeReport
+				if err := decoder.Decode(&report); err != nil {
+					return
+				}
+				p, ok := o.processes[report.Event.NodeId]
+				if ok && p.apply(report) {
+					o.handleEvent(report.Event)
+				}
+			}
+		}()
+	}
+}
+
+// Launches the node processes.
+func (o *Orchestrator) launchProcesses() {
+	ids := make([]NodeId, 0, len(o.processes))
+	for nodeId := range o.processes {
+		ids = append(ids, nodeId)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, nodeId := range ids {
+		p := o.processes[nodeId]
+		p.lock.Lock()
+		if err := p.startLocked(); err != nil {
+			log.Printf("%v", err)
+		}
+		p.lock.Unlock()
+	}
+}
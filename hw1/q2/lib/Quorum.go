@@ -0,0 +1,282 @@
+package lib
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+  QUORUM ELECTION
+  With ALGORITHM_QUORUM, the Bully algorithm runs as usual, but a node that receives no vetoes has not won yet.
+  It first sends MSG_TYPE_QUORUM_REQUEST to every other node, and only wins if a majority of the cluster (including
+  itself) acknowledges it within the timeout. Otherwise, the election ends without a coordinator.
+  Each acknowledgement carries the node's state, and the winner takes the newest, so a node that was cut off from the
+  last coordinator doesn't wipe its writes on winning.
+  The cluster is every node this node knows of, dead or alive. So under a partition, only the side with a majority of
+  the cluster can elect a coordinator.
+
+  A coordinator only accepts updates while it holds a lease, which lasts quorumLease() from the last SYNC broadcast
+  acknowledged (with MSG_TYPE_SYNC_ACK) by a majority. Once the lease lapses, the coordinator steps down.
+  - A node that acknowledges a SYNC promises its coordinator to acknowledge no one else's SYNCs for quorumLease(). As
+    the lease is counted from when the SYNC was sent, it always ends before the promise does.
+  - A node acknowledging a candidate tells it how long its promise to another node has left, and the candidate waits
+    that long before winning. Any two majorities share a node, so the old coordinator's lease has lapsed by then.
+  So at most one coordinator accepts updates at any time, even while a partition forms or heals.
+*/
+
+// Acknowledgement of a candidate, with how long the node's promise to another node has left, and its state.
+type quorumAck struct {
+	nodeId NodeId
+	wait   time.Duration
+	state  replicatedState
+}
+
+// State of a node running the quorum election.
+type quorumState struct {
+	lock         *sync.Mutex
+	acks         chan quorumAck // Acknowledgements of the ongoing election's MSG_TYPE_QUORUM_REQUEST
+	promisedId   NodeId         // Node whose SYNCs (or win) this node last promised to acknowledge, -1 if none
+	promiseUntil time.Time
+	lastSync     time.Time // When this node last received a SYNC from its coordinator
+
+	// If this node is the coordinator
+	roundCount int
+	rounds     map[int]time.Time       // When each SYNC broadcast of the lease duration was sent, by round
+	roundAcks  map[int]map[NodeId]bool // Nodes that acknowledged each SYNC broadcast
+	leaseUntil time.Time
+}
+
+func newQuorumState(nodeCount int) *quorumState {
+	return &quorumState{
+		&sync.Mutex{},
+		make(chan quorumAck, nodeCount),
+		-1, time.Time{}, time.Time{},
+		0, make(map[int]time.Time), make(map[int]map[NodeId]bool), time.Time{},
+	}
+}
+
+// Returns the number of nodes that make up a majority of a cluster of `clusterSize` nodes.
+func quorumSize(clusterSize int) int {
+	return clusterSize/2 + 1
+}
+
+// Returns how long a lease lasts. The next SYNC broadcast is acknowledged within sendIntv and an RTT, renewing it.
+func (node *Node) quorumLease() time.Duration {
+	return node.sendIntv + node.timeout
+}
+
+// Returns true if this node is the coordinator and holds a lease, so it can accept updates.
+func (node *Node) acceptsUpdates() bool {
+	if !node.isCoordinator() {
+		return false
+	}
+	if node.algorithm != ALGORITHM_QUORUM {
+		return true
+	}
+	q := node.quorum
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return time.Now().Before(q.leaseUntil)
+}
+
+// Stops being the coordinator, e.g. once its lease lapses.
+func (node *Node) stepDown(reason string) {
+	if !node.isCoordinator() {
+		return
+	}
+	log.Printf("N%d: Stepping down, %s.", node.Id, reason)
+	node.setCoordinatorId(-1)
+}
+
+// Returns how long this node's promise to a node other than `nodeId` has left, or 0 if it has none.
+// Must be called with the quorum lock held.
+func (q *quorumState) promiseLeftLocked(nodeId NodeId) time.Duration {
+	if q.promisedId == -1 || q.promisedId == nodeId {
+		return 0
+	}
+	if left := time.Until(q.promiseUntil); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// Asks every other node to acknowledge this node as coordinator, and waits up to the timeout.
+// Returns true if a majority of the cluster (including this node) acknowledged it, once every promise they made to
+// another node has lapsed.
+func (node *Node) gatherQuorum() bool {
+	q := node.quorum
+	for len(q.acks) > 0 {
+		<-q.acks
+	}
+
+	endpoints := node.getEndpoints()
+	needed := quorumSize(len(endpoints) + 1)
+	for _, endpoint := range sortEndpoints(endpoints) {
+		node.send(MSG_TYPE_QUORUM_REQUEST, endpoint, "")
+	}
+
+	q.lock.Lock()
+	wait := q.promiseLeftLocked(node.Id)
+	q.lock.Unlock()
+	acked := map[NodeId]bool{node.Id: true}
+	newest := node.stateSnapshot()
+	newestId := node.Id
+	deadline := time.After(node.timeout)
+	for len(acked) < needed {
+		select {
+		case ack := <-q.acks:
+			acked[ack.nodeId] = true
+			if ack.wait > wait {
+				wait = ack.wait
+			}
+			if ack.state.Version.newerThan(newest.Version) {
+				newest, newestId = ack.state, ack.nodeId
+			}
+		case <-deadline:
+			log.Printf("N%d: Only %d of %d nodes acknowledged, %d needed.", node.Id, len(acked), len(endpoints)+1, needed)
+			return false
+		}
+	}
+
+	if wait > node.quorumLease() {
+		// Longer than any lease, so a node has promised another candidate, which may still win
+		log.Printf("N%d: A node promised another candidate for %v.", node.Id, wait)
+		return false
+	}
+	if wait > 0 {
+		log.Printf("N%d: Waiting %v for the last coordinator's lease to lapse.", node.Id, wait)
+		time.Sleep(wait)
+	}
+
+	if newestId != node.Id {
+		log.Printf("N%d: Taking the state at version %v from N%d.", node.Id, newest.Version, newestId)
+		node.replaceState(newest)
+	}
+
+	q.lock.Lock()
+	q.promisedId = -1
+	q.rounds = make(map[int]time.Time)
+	q.roundAcks = make(map[int]map[NodeId]bool)
+	q.leaseUntil = time.Now().Add(node.quorumLease())
+	q.lock.Unlock()
+	return node.IsAlive()
+}
+
+// Coordinator function to start a SYNC broadcast, returning its round to be sent as the ReqId of each SYNC.
+func (node *Node) startSyncRound() int {
+	alone := quorumSize(len(node.getEndpoints())+1) == 1
+	q := node.quorum
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.roundCount++
+	q.rounds[q.roundCount] = time.Now()
+	q.roundAcks[q.roundCount] = make(map[NodeId]bool)
+	if alone {
+		// This node is a majority by itself
+		q.leaseUntil = q.rounds[q.roundCount].Add(node.quorumLease())
+	}
+
+	// Rounds sent before the lease duration can't extend the lease
+	for round, sent := range q.rounds {
+		if time.Since(sent) > node.quorumLease() {
+			delete(q.rounds, round)
+			delete(q.roundAcks, round)
+		}
+	}
+	return q.roundCount
+}
+
+// Handles a MSG_TYPE_SYNC from the coordinator, acknowledging it unless this node has promised another node.
+func (node *Node) ackSync(msg Message) {
+	if msg.SrcId != node.CoordinatorId() || msg.ReqId == 0 {
+		return
+	}
+
+	q := node.quorum
+	q.lock.Lock()
+	if q.promiseLeftLocked(msg.SrcId) > 0 {
+		q.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	q.promisedId = msg.SrcId
+	if until := now.Add(node.quorumLease()); until.After(q.promiseUntil) {
+		q.promiseUntil = until
+	}
+	q.lastSync = now
+	q.lock.Unlock()
+
+	if srcEndpoint, ok := node.getEndpoint(msg.SrcId); ok {
+		node.sendWithReqId(MSG_TYPE_SYNC_ACK, srcEndpoint, "", msg.ReqId)
+	}
+}
+
+// Handles messages of the quorum election.
+func (node *Node) handleQuorumMsg(msg Message) {
+	q := node.quorum
+	switch msg.Type {
+	case MSG_TYPE_QUORUM_REQUEST:
+		if msg.SrcId < node.Id {
+			// The candidate should have been vetoed, we missed its ELECTION_START
+			node.StartElection()
+			return
+		}
+
+		// Refuse if we still hear from a coordinator higher than the candidate
+		coordId := node.CoordinatorId()
+		q.lock.Lock()
+		if coordId > msg.SrcId && coordId != node.Id && time.Since(q.lastSync) < node.sendIntv+node.timeout/2 {
+			q.lock.Unlock()
+			log.Printf("N%d: Refused QUORUM_REQUEST from N%d, following N%d.", node.Id, msg.SrcId, coordId)
+			return
+		}
+		// The candidate may wait out a lease (or fail) after the timeout, and hold a lease of its own after that
+		wait := q.promiseLeftLocked(msg.SrcId)
+		q.promisedId = msg.SrcId
+		q.promiseUntil = time.Now().Add(node.timeout + 2*node.quorumLease())
+		q.lock.Unlock()
+		node.stepDown("acknowledged a higher candidate")
+
+		if srcEndpoint, ok := node.getEndpoint(msg.SrcId); ok {
+			node.send(MSG_TYPE_QUORUM_ACK, srcEndpoint, wait.String()+"|"+encodeState(node.stateSnapshot()))
+		}
+	case MSG_TYPE_QUORUM_ACK:
+		parts := strings.SplitN(msg.Data, "|", 2)
+		if len(parts) != 2 {
+			log.Printf("N%d: Invalid QUORUM_ACK from N%d: %s", node.Id, msg.SrcId, msg.Data)
+			return
+		}
+		wait, err := time.ParseDuration(parts[0])
+		if err != nil {
+			log.Printf("N%d: Invalid QUORUM_ACK from N%d: %v", node.Id, msg.SrcId, err)
+			return
+		}
+		state, err := decodeState(parts[1])
+		if err != nil {
+			log.Printf("N%d: %v", node.Id, err)
+			return
+		}
+		select {
+		case q.acks <- quorumAck{msg.SrcId, wait, state}:
+		default:
+			// No election is waiting on acknowledgements
+		}
+	case MSG_TYPE_SYNC_ACK:
+		needed := quorumSize(len(node.getEndpoints()) + 1)
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		acks, ok := q.roundAcks[msg.ReqId]
+		if !ok {
+			return
+		}
+		acks[msg.SrcId] = true
+		if len(acks)+1 < needed {
+			return
+		}
+		if until := q.rounds[msg.ReqId].Add(node.quorumLease()); until.After(q.leaseUntil) {
+			q.leaseUntil = until
+		}
+	}
+}
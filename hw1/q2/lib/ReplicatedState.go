@@ -0,0 +1,308 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+/**
+  REPLICATED STATE
+  Each node holds a map of keys to values, which the coordinator replicates to the other nodes.
+  - Every write on the coordinator bumps the version of its state, and tags the key written with that version.
+    A version is the coordinator's term and a sequence number, so only the coordinator that won a term makes
+    versions in it, and two nodes with the same version have the same state.
+  - Every sendIntv, the coordinator sends only the keys written since its last SYNC (a delta), along with the
+    versions the delta goes from (its base) and to (its head).
+  - A node applies a delta only if it has the state at the delta's base. Otherwise (e.g. it was restarted, missed a
+    SYNC, or followed another coordinator), it asks the coordinator for its full state with MSG_TYPE_SYNC_REQUEST.
+*/
+
+// Version of a node's state. Versions are ordered by term, then sequence number.
+type stateVersion struct {
+	Term int
+	Seq  int
+}
+
+func (v stateVersion) newerThan(other stateVersion) bool {
+	return v.Term > other.Term || (v.Term == other.Term && v.Seq > other.Seq)
+}
+
+// Version of a state that isn't known to match any coordinator's, e.g. after a restart. No delta applies to it.
+var UNSYNCED_VERSION = stateVersion{-1, 0}
+
+// A value, with the version of the state it was written in.
+type versionedValue struct {
+	Value   string
+	Version stateVersion
+}
+
+// The state replicated by the coordinator.
+type replicatedState struct {
+	Entries map[string]versionedValue
+	Version stateVersion
+}
+
+func newReplicatedState() replicatedState {
+	return replicatedState{make(map[string]versionedValue), stateVersion{}}
+}
+
+func (s replicatedState) copy() replicatedState {
+	entries := make(map[string]versionedValue, len(s.Entries))
+	for key, entry := range s.Entries {
+		entries[key] = entry
+	}
+	return replicatedState{entries, s.Version}
+}
+
+func (s replicatedState) values() map[string]string {
+	values := make(map[string]string, len(s.Entries))
+	for key, entry := range s.Entries {
+		values[key] = entry.Value
+	}
+	return values
+}
+
+// Encodes a state into the Data of a message.
+func encodeState(state replicatedState) string {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to encode state: %v", err))
+	}
+	return string(contents)
+}
+
+func decodeState(data string) (replicatedState, error) {
+	state := newReplicatedState()
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return state, errors.New(fmt.Sprintf("Invalid state: %v", err))
+	}
+	if state.Entries == nil {
+		state.Entries = make(map[string]versionedValue)
+	}
+	return state, nil
+}
+
+// The Data of a MSG_TYPE_SYNC message: either a delta from Base to Head, or the full state at Head.
+type syncPayload struct {
+	Full    bool
+	Base    stateVersion
+	Head    stateVersion
+	Entries map[string]versionedValue
+}
+
+func encodeSync(payload syncPayload) string {
+	contents, err := json.Marshal(payload)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to encode SYNC: %v", err))
+	}
+	return string(contents)
+}
+
+func decodeSync(data string) (syncPayload, error) {
+	var payload syncPayload
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return payload, errors.New(fmt.Sprintf("Invalid SYNC: %v", err))
+	}
+	return payload, nil
+}
+
+// Returns true if a delta from `base` to `head` brings a state at `version` to `head`.
+// Besides the base itself, this holds for any version between them in the same term, since the delta has every key
+// written after the base.
+func deltaApplies(version, base, head stateVersion) bool {
+	if version == base {
+		return true
+	}
+	return base.Term == head.Term && version.Term == head.Term && !base.newerThan(version) && !version.newerThan(head)
+}
+
+/**
+  STATE ACCESSORS
+*/
+
+// Returns a copy of the values of this node's state.
+func (node *Node) Values() map[string]string {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.kv.values()
+}
+
+// Returns the value of a key, or false if this node has no value for it.
+func (node *Node) Value(key string) (string, bool) {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	entry, ok := node.state.kv.Entries[key]
+	return entry.Value, ok
+}
+
+// Returns a copy of this node's state, including versions.
+func (node *Node) stateSnapshot() replicatedState {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.kv.copy()
+}
+
+/**
+  STATE TRANSITIONS
+  As in NodeState.go, each transition is done under the lock, and is ignored if the node is not alive.
+*/
+
+// Continues the state in this node's own term, if it isn't already. Must be called with the state lock held.
+// The state at the version it had is the base of the first delta, so nodes that have it don't need a full transfer.
+func (node *Node) claimStateLocked() {
+	if node.state.kv.Version.Term == node.state.term {
+		return
+	}
+	node.state.syncedVersion = node.state.kv.Version
+	node.state.kv.Version = stateVersion{node.state.term, 0}
+	node.state.dirtyKeys = make(map[string]bool)
+}
+
+// Coordinator function to write a value, bumping the version of the state.
+func (node *Node) writeValue(key, value string) {
+	node.state.lock.Lock()
+	if node.state.status != NODE_ALIVE {
+		node.state.lock.Unlock()
+		return
+	}
+	node.claimStateLocked()
+	node.state.kv.Version.Seq++
+	entry := versionedValue{value, node.state.kv.Version}
+	node.state.kv.Entries[key] = entry
+	node.state.dirtyKeys[key] = true
+	node.persistLocked(walRecord{WAL_RECORD_DELTA, 0, map[string]versionedValue{key: entry}, node.state.kv.Version})
+	coordId := node.state.coordinatorId
+	node.state.lock.Unlock()
+
+	node.publish(EVENT_DATA_CHANGED, coordId)
+}
+
+// Writes a value to this node only, as if it had diverged from the coordinator.
+// The state no longer matches any version, so the node takes a full transfer on the next SYNC.
+func (node *Node) forceValue(key, value string) {
+	node.state.lock.Lock()
+	if node.state.status != NODE_ALIVE {
+		node.state.lock.Unlock()
+		return
+	}
+	entry := versionedValue{value, UNSYNCED_VERSION}
+	node.state.kv.Entries[key] = entry
+	node.state.kv.Version = UNSYNCED_VERSION
+	node.persistLocked(walRecord{WAL_RECORD_DELTA, 0, map[string]versionedValue{key: entry}, UNSYNCED_VERSION})
+	coordId := node.state.coordinatorId
+	node.state.lock.Unlock()
+
+	node.publish(EVENT_DATA_CHANGED, coordId)
+}
+
+// Coordinator function to take the keys written since the last SYNC, as a delta from the last SYNC's version.
+func (node *Node) takeDelta() syncPayload {
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	node.claimStateLocked()
+
+	entries := make(map[string]versionedValue, len(node.state.dirtyKeys))
+	for key := range node.state.dirtyKeys {
+		entries[key] = node.state.kv.Entries[key]
+	}
+	payload := syncPayload{false, node.state.syncedVersion, node.state.kv.Version, entries}
+	node.state.syncedVersion = node.state.kv.Version
+	node.state.dirtyKeys = make(map[string]bool)
+	return payload
+}
+
+// Returns the full state, to be sent to a node that can't apply deltas.
+func (node *Node) fullSync() syncPayload {
+	state := node.stateSnapshot()
+	return syncPayload{true, UNSYNCED_VERSION, state.Version, state.Entries}
+}
+
+// Applies a SYNC from the coordinator. Returns false if it is a delta that doesn't apply to this node's state.
+func (node *Node) applySync(payload syncPayload) bool {
+	if payload.Full {
+		node.replaceState(replicatedState{payload.Entries, payload.Head})
+		return true
+	}
+
+	node.state.lock.Lock()
+	if node.state.status != NODE_ALIVE {
+		node.state.lock.Unlock()
+		return true
+	}
+	if node.state.kv.Version == payload.Head {
+		// Already at the head, e.g. from a full transfer
+		node.state.lock.Unlock()
+		return true
+	}
+	if !deltaApplies(node.state.kv.Version, payload.Base, payload.Head) {
+		node.state.lock.Unlock()
+		return false
+	}
+	changed := false
+	for key, entry := range payload.Entries {
+		if old, ok := node.state.kv.Entries[key]; !ok || old.Value != entry.Value {
+			changed = true
+		}
+		node.state.kv.Entries[key] = entry
+	}
+	node.state.kv.Version = payload.Head
+	node.persistLocked(walRecord{WAL_RECORD_DELTA, 0, payload.Entries, payload.Head})
+	coordId := node.state.coordinatorId
+	node.state.lock.Unlock()
+
+	if changed {
+		node.publish(EVENT_DATA_CHANGED, coordId)
+	}
+	return true
+}
+
+// Replaces this node's state with another's, e.g. from a full transfer or a merge of groups.
+func (node *Node) replaceState(state replicatedState) {
+	state = state.copy()
+	node.state.lock.Lock()
+	if node.state.status != NODE_ALIVE {
+		node.state.lock.Unlock()
+		return
+	}
+	changed := !valuesEqual(node.state.kv.values(), state.values())
+	node.state.kv = state
+	node.persistLocked(walRecord{WAL_RECORD_STATE, 0, state.Entries, state.Version})
+	coordId := node.state.coordinatorId
+	node.state.lock.Unlock()
+
+	if changed {
+		node.publish(EVENT_DATA_CHANGED, coordId)
+	}
+}
+
+func valuesEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Handles a MSG_TYPE_SYNC message from the coordinator, asking it for the full state if the delta doesn't apply.
+func (node *Node) handleSync(msg Message) {
+	payload, err := decodeSync(msg.Data)
+	if err != nil {
+		log.Printf("N%d: %v", node.Id, err)
+		return
+	}
+	log.Printf("N%d: Received SYNC from N%d with %d keys at version %v.", node.Id, msg.SrcId, len(payload.Entries), payload.Head)
+	if node.applySync(payload) {
+		return
+	}
+
+	log.Printf("N%d: SYNC from N%d doesn't apply to version %v, requesting full state.", node.Id, msg.SrcId, node.stateSnapshot().Version)
+	if srcEndpoint, ok := node.getEndpoint(msg.SrcId); ok {
+		node.send(MSG_TYPE_SYNC_REQUEST, srcEndpoint, "")
+	}
+}
@@ -0,0 +1,295 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Number of WAL records written before the WAL is compacted into a snapshot.
+const DEFAULT_SNAPSHOT_INTV = 50
+
+type walRecordType string
+
+const (
+	WAL_RECORD_TERM  walRecordType = "TERM"  // The node learnt of a new term
+	WAL_RECORD_DELTA               = "DELTA" // Some keys of the node's state were written
+	WAL_RECORD_STATE               = "STATE" // The node's state was replaced
+)
+
+// A single entry in the write-ahead log.
+// Records of the state have the entries written (all entries for WAL_RECORD_STATE), and the version of the state after.
+type walRecord struct {
+	Type    walRecordType
+	Term    int
+	Entries map[string]versionedValue
+	Version stateVersion
+}
+
+// The state of a node that survives a crash.
+type persistentState struct {
+	Term  int
+	State replicatedState
+}
+
+// Persists a node's state to a local directory, as a snapshot followed by a write-ahead log (WAL).
+// - Every change to the persistent state is appended to the WAL before it is considered done.
+// - Every `snapshotIntv` records, the current state is written to the snapshot and the WAL is cleared.
+// Recovery loads the snapshot, then replays the WAL over it.
+type nodeStorage struct {
+	lock         *sync.Mutex
+	walPath      string
+	snapshotPath string
+	walFile      *os.File
+	walRecords   int // Number of records in the WAL since the last snapshot
+	snapshotIntv int
+}
+
+// Opens (or creates) the storage for a node in the given directory.
+func openNodeStorage(dir string, nodeId NodeId, snapshotIntv int) (*nodeStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	storage := &nodeStorage{
+		&sync.Mutex{},
+		filepath.Join(dir, fmt.Sprintf("N%d.wal", nodeId)),
+		filepath.Join(dir, fmt.Sprintf("N%d.snapshot", nodeId)),
+		nil, 0, snapshotIntv,
+	}
+
+	walFile, err := os.OpenFile(storage.walPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	storage.walFile = walFile
+	return storage, nil
+}
+
+// Appends a record to the WAL, syncing it to disk.
+// Returns true if the WAL is due to be compacted into a snapshot.
+func (s *nodeStorage) appendRecord(record walRecord) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.walFile == nil {
+		return false, errors.New("Storage is closed.")
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.walFile.Write(append(line, '\n')); err != nil {
+		return false, err
+	}
+	if err := s.walFile.Sync(); err != nil {
+		return false, err
+	}
+
+	s.walRecords++
+	return s.walRecords >= s.snapshotIntv, nil
+}
+
+// Writes the state to the snapshot, and clears the WAL.
+// The snapshot is written to a temporary file first, so a crash midway leaves the old snapshot intact. It is synced to
+// disk, along with the directory entry from the rename, before the WAL is cleared, so a power loss leaves at least one
+// of the two.
+func (s *nodeStorage) snapshot(state persistentState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.walFile == nil {
+		return errors.New("Storage is closed.")
+	}
+
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.snapshotPath + ".tmp"
+	if err := writeFileSync(tmpPath, contents); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.snapshotPath); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(s.snapshotPath)); err != nil {
+		return err
+	}
+
+	// Only clear the WAL once the snapshot is in place
+	if err := s.walFile.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.walFile.Sync(); err != nil {
+		return err
+	}
+	s.walRecords = 0
+	return nil
+}
+
+// Recovers the persistent state, by loading the snapshot and replaying the WAL over it.
+func (s *nodeStorage) recover() (persistentState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := persistentState{0, newReplicatedState()}
+
+	contents, err := os.ReadFile(s.snapshotPath)
+	if err == nil {
+		if err := json.Unmarshal(contents, &state); err != nil {
+			return state, errors.New(fmt.Sprintf("Corrupted snapshot: %v", err))
+		}
+	} else if !os.IsNotExist(err) {
+		return state, err
+	}
+
+	walFile, err := os.Open(s.walPath)
+	if err != nil {
+		return state, err
+	}
+	defer walFile.Close()
+
+	// Records are read with a bufio.Reader rather than a bufio.Scanner, as a STATE record holds the whole state, which
+	// may be longer than a Scanner's line limit
+	records := 0
+	goodOffset := int64(0) // End of the last whole record
+	torn := false
+	reader := bufio.NewReader(walFile)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			s.walRecords = records
+			return state, readErr
+		}
+		if len(line) == 0 {
+			break
+		}
+		var record walRecord
+		if line[len(line)-1] != '\n' || json.Unmarshal(line, &record) != nil {
+			// A torn write at the end of the WAL, from a crash midway through appending
+			torn = true
+			break
+		}
+		switch record.Type {
+		case WAL_RECORD_TERM:
+			state.Term = record.Term
+		case WAL_RECORD_DELTA:
+			for key, entry := range record.Entries {
+				state.State.Entries[key] = entry
+			}
+			state.State.Version = record.Version
+		case WAL_RECORD_STATE:
+			state.State = replicatedState{record.Entries, record.Version}
+			if state.State.Entries == nil {
+				state.State.Entries = make(map[string]versionedValue)
+			}
+		}
+		records++
+		goodOffset += int64(len(line))
+	}
+	s.walRecords = records
+
+	// Cut off the torn write, or the next record would be appended onto the same line, and lost along with it
+	if torn {
+		if err := os.Truncate(s.walPath, goodOffset); err != nil {
+			return state, err
+		}
+	}
+
+	return state, nil
+}
+
+// Writes `contents` to a new file at `path`, and syncs it to disk.
+func writeFileSync(path string, contents []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Syncs a directory to disk, so a file renamed into it survives a power loss.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (s *nodeStorage) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.walFile == nil {
+		return nil
+	}
+	err := s.walFile.Close()
+	s.walFile = nil
+	return err
+}
+
+/**
+  NODE PERSISTENCE
+*/
+
+// Enables persistence of this node's term and state to the given directory.
+// Any state already in the directory (e.g. from a previous run) is recovered.
+// From here on, killing the node loses its term and state, and restarting it recovers them from storage.
+func (node *Node) EnablePersistence(dir string) error {
+	storage, err := openNodeStorage(dir, node.Id, DEFAULT_SNAPSHOT_INTV)
+	if err != nil {
+		return err
+	}
+
+	node.state.lock.Lock()
+	defer node.state.lock.Unlock()
+	if node.state.storage != nil {
+		storage.close()
+		return errors.New(fmt.Sprintf("N%d: Persistence already enabled.", node.Id))
+	}
+	node.state.storage = storage
+	node.recoverLocked()
+	return nil
+}
+
+// Time taken by the most recent recovery from storage.
+func (node *Node) RecoveryTime() time.Duration {
+	node.state.lock.RLock()
+	defer node.state.lock.RUnlock()
+	return node.state.recoveryTime
+}
+
+// Replaces the term and state with those in storage. Must be called with the state lock held.
+// The recovered state may be behind the coordinator's, so it is unsynced until a full transfer.
+func (node *Node) recoverLocked() {
+	start := time.Now()
+	state, err := node.state.storage.recover()
+	if err != nil {
+		// Keep whatever was recovered before the error
+		log.Printf("N%d: Error during recovery: %v", node.Id, err)
+	}
+	node.state.term = state.Term
+	node.state.kv = state.State
+	node.state.kv.Version = UNSYNCED_VERSION
+	node.state.recoveryTime = time.Since(start)
+	log.Printf("N%d: Recovered term %d and values %v in %v.", node.Id, state.Term, state.State.values(), node.state.recoveryTime)
+}
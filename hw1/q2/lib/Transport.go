@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+  TRANSPORT
+  Nodes send messages through a Transport, which delivers them to the ControlChan or DataChan of the destination.
+  - The simulated network (see Network.go) delivers between nodes in one process, straight to the channels of the
+    destination's endpoint.
+  - The TCP transport delivers between nodes in separate processes, to the address of the destination's endpoint.
+    Each node listens on its own address, and passes the messages it receives on to its own channels.
+  Either way, a message to a node that can't be reached is dropped, as if the node were dead.
+*/
+
+// Delivers messages from a node to other nodes, without blocking the sender.
+type Transport interface {
+	Deliver(msg Message, dst NodeEndpoint)
+	Close()
+}
+
+// Returns true if the message goes on DataChan, rather than ControlChan.
+func isDataMsg(mType msgType) bool {
+	return mType == MSG_TYPE_SYNC || mType == MSG_TYPE_GOSSIP
+}
+
+const TCP_DIAL_TIMEOUT = time.Second
+const TCP_OUTBOX_SIZE = 64 // Messages queued for an address before further messages are dropped
+
+// Transport over TCP, with a connection (and a goroutine writing to it) for each address sent to.
+// Messages are sent as JSON, one after another, so messages to the same node arrive in order.
+type tcpTransport struct {
+	lock     *sync.Mutex
+	nodeId   NodeId
+	listener net.Listener
+	outboxes map[string]chan Message // Messages waiting to be written, by address
+	quitChan chan bool               // Closed on Close, to stop the goroutines of this transport
+	closed   bool
+}
+
+// Listens on `addr` for messages to `endpoint`, returning a transport to send messages to other nodes.
+func listenTCP(endpoint NodeEndpoint, addr string) (*tcpTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("N%d: Could not listen on %s: %v", endpoint.Id, addr, err))
+	}
+
+	t := &tcpTransport{&sync.Mutex{}, endpoint.Id, listener, make(map[string]chan Message), make(chan bool), false}
+	go t.accept(endpoint)
+	return t, nil
+}
+
+func (t *tcpTransport) addr() string {
+	return t.listener.Addr().String()
+}
+
+func (t *tcpTransport) Deliver(msg Message, dst NodeEndpoint) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	outbox, ok := t.outboxes[dst.Addr]
+	if !ok {
+		outbox = make(chan Message, TCP_OUTBOX_SIZE)
+		t.outboxes[dst.Addr] = outbox
+		go t.send(dst.Addr, outbox)
+	}
+	t.lock.Unlock()
+
+	select {
+	case outbox <- msg:
+	default:
+		log.Printf("N%d: Dropped %s to N%d, too many messages queued.", t.nodeId, msg.Type, msg.DstId)
+	}
+}
+
+// Writes the messages of an outbox to an address, connecting again whenever the connection fails.
+// A message that can't be written is dropped.
+func (t *tcpTransport) send(addr string, outbox chan Message) {
+	var conn net.Conn
+	var encoder *json.Encoder
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-outbox:
+			if conn == nil {
+				var err error
+				conn, err = net.DialTimeout("tcp", addr, TCP_DIAL_TIMEOUT)
+				if err != nil {
+					// The node is down (or not up yet)
+					conn = nil
+					continue
+				}
+				encoder = json.NewEncoder(conn)
+			}
+			if err := encoder.Encode(msg); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		case <-t.quitChan:
+			return
+		}
+	}
+}
+
+// Accepts connections from other nodes, passing their messages on to the endpoint's channels.
+func (t *tcpTransport) accept(endpoint NodeEndpoint) {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			// Listener closed
+			return
+		}
+		go t.receive(conn, endpoint)
+	}
+}
+
+func (t *tcpTransport) receive(conn net.Conn, endpoint NodeEndpoint) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	for {
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+
+		dstChan := endpoint.ControlChan
+		if isDataMsg(msg.Type) {
+			dstChan = endpoint.DataChan
+		}
+		select {
+		case dstChan <- msg:
+		case <-t.quitChan:
+			return
+		}
+	}
+}
+
+func (t *tcpTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.listener.Close()
+	close(t.quitChan)
+}
+
+// Sends and receives this node's messages over TCP, listening on `addr` (e.g. "127.0.0.1:7000").
+// The endpoints of other nodes must then have their addresses set. Must be called before Initialise.
+func (node *Node) EnableTCP(addr string) error {
+	t, err := listenTCP(node.Endpoint, addr)
+	if err != nil {
+		return err
+	}
+	node.Endpoint.Addr = t.addr()
+	node.transport = t
+	return nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"sync"
 	"time"
 	"1005129_RYAN_TOH/hw1/q2/lib"
@@ -11,6 +13,12 @@ import (
 
 const DEFAULT_SEND_INTV = 5 * time.Second
 const DEFAULT_TIMEOUT = 1 * time.Second
+const CONSOLE_TIMEOUT = 3 * (DEFAULT_SEND_INTV + DEFAULT_TIMEOUT) // Max time for console commands to wait on elections and writes
+
+var nodeCount = flag.Int("nodes", 10, "number of nodes")
+var repl = flag.Bool("repl", false, "drive the nodes from an interactive console, instead of random actions")
+var record = flag.String("record", "", "record the console session to this file, to be replayed later")
+var replay = flag.String("replay", "", "replay a recorded console session (or script) from this file")
 
 func InitNodes(nodeCount int) [](*lib.Node) {
 	log.Printf("SYSTEM: Initialising with %d nodes", nodeCount)
@@ -48,8 +56,51 @@ func CleanupNodes(nodes [](*lib.Node)) {
 	log.Printf("SYSTEM: Node cleanup complete.")
 }
 
+// Runs the console over an Orchestrator, replaying a script first if given.
+func RunConsole() {
+	o := lib.NewOrchestrator(*nodeCount, DEFAULT_SEND_INTV, DEFAULT_TIMEOUT)
+	o.Initiate()
+	defer o.Exit()
+	console := lib.NewConsole(o, os.Stdout, CONSOLE_TIMEOUT)
+
+	if *record != "" {
+		recordFile, err := os.Create(*record)
+		if err != nil {
+			log.Fatalf("SYSTEM: Could not record session: %v", err)
+		}
+		defer recordFile.Close()
+		console.Record(recordFile)
+	}
+
+	if *replay != "" {
+		replayFile, err := os.Open(*replay)
+		if err != nil {
+			log.Fatalf("SYSTEM: Could not replay session: %v", err)
+		}
+		err = console.Run(replayFile, false, true)
+		replayFile.Close()
+		if err != nil {
+			log.Printf("SYSTEM: Replay stopped: %v", err)
+			return
+		}
+	}
+
+	if *repl {
+		fmt.Println("SYSTEM: Type `help` for a list of commands.")
+		if err := console.Run(os.Stdin, true, false); err != nil {
+			log.Printf("SYSTEM: Console stopped: %v", err)
+		}
+	}
+}
+
 func main() {
-	nodes := InitNodes(10)
+	flag.Parse()
+	if *repl || *replay != "" {
+		RunConsole()
+		return
+	}
+
+	nodes := InitNodes(*nodeCount)
 	defer CleanupNodes(nodes)
 	counter := 0
 
@@ -59,20 +110,22 @@ func main() {
 		fmt.Printf("\n---\n\n")
 		switch randInt {
 		case 0:
-			// Update node value
-			for i := len(nodes) - 1; i > 0; i-- {
-				if nodes[i].IsAlive {
-					value := fmt.Sprintf("Msg%d", counter)
-					counter++
-					fmt.Printf("SYSTEM: Updating N%d with value %v\n", nodes[i].Id, value)
-					nodes[i].PushUpdate(value)
-					break
-				}
+			// Update a random key through a random live node
+			randNodeId := lib.NodeId(rand.Int31n(int32(len(nodes))))
+			if !nodes[randNodeId].IsAlive() {
+				break
+			}
+			key := fmt.Sprintf("key%d", rand.Int31n(3))
+			value := fmt.Sprintf("Msg%d", counter)
+			counter++
+			fmt.Printf("SYSTEM: Writing %s=%v through N%d\n", key, value, randNodeId)
+			if err := nodes[randNodeId].Write(key, value, DEFAULT_SEND_INTV); err != nil {
+				fmt.Printf("SYSTEM: Write failed: %v\n", err)
 			}
 		case 1, 2:
 			// Kill or reboot random node
 			randNodeId := lib.NodeId(rand.Int31n(int32(len(nodes))))
-			if nodes[randNodeId].IsAlive {
+			if nodes[randNodeId].IsAlive() {
 				fmt.Printf("SYSTEM: Killing N%d.\n", randNodeId)
 				nodes[randNodeId].Kill()
 			} else {
@@ -82,7 +135,7 @@ func main() {
 		case 3:
 			// Kill coordinator
 			for i := len(nodes) - 1; i > 0; i-- {
-				if nodes[i].IsAlive {
+				if nodes[i].IsAlive() {
 					fmt.Printf("SYSTEM: Killing N%d.\n", nodes[i].Id)
 					nodes[i].Kill()
 					break
@@ -0,0 +1,170 @@
+/**
+  CANCELLATION_TEST
+  System tests for cancelling AcquireLock with a context. This doesn't print logs unless the test fails.
+
+  Half the nodes give up after a random timeout, while the other half wait as usual.
+  - Every node that doesn't give up must still enter and exit the CS, so a withdrawn request can't hold anyone up.
+  - Afterwards, every node enters and exits the CS once more, so a withdrawn request can't be left behind in a queue.
+*/
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+	"1005129_RYAN_TOH/hw2/nodetypes"
+)
+
+// How many nodes to use
+const TEST_CANCEL_NODE_COUNT = TEST_NODE_COUNT
+
+// How long each round may take before the test fails
+const TEST_CANCEL_TIMEOUT = time.Minute
+
+// Longest a node waits before giving up. Roughly half the nodes get to enter within this time.
+const TEST_CANCEL_MAX_WAIT = TEST_CANCEL_NODE_COUNT * TEST_CS_DELAY / 2
+
+// Result of a node's attempt to enter the CS
+type cancelResult struct {
+	nodeId int
+	err error
+}
+
+func testCancellation(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory) *Orchestrator) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := newOrchestrator(TEST_CANCEL_NODE_COUNT, sm)
+	o.Init()
+
+	// ROUND 1: Odd nodes give up after a random timeout
+	resultChan := make(chan cancelResult, TEST_CANCEL_NODE_COUNT + 10)
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			ctx := context.Background()
+			if id % 2 == 1 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(rand.Int63n(int64(TEST_CANCEL_MAX_WAIT))))
+				defer cancel()
+			}
+			err := o.NodeEnterWithContext(ctx, id)
+			if err == nil {
+				time.Sleep(TEST_CS_DELAY)
+				err = o.NodeExit(id)
+			}
+			resultChan <- cancelResult{id, err}
+		}(nodeId)
+	}
+
+	cancelled := 0
+	timeout := time.After(TEST_CANCEL_TIMEOUT)
+	for i := 0; i < TEST_CANCEL_NODE_COUNT; i++ {
+		select {
+		case res := <-resultChan:
+			if res.err == context.DeadlineExceeded && res.nodeId % 2 == 1 {
+				cancelled++
+			} else if res.err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: N%d: %v", res.nodeId, res.err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Only %d of %d nodes entered the CS or gave up.", i, TEST_CANCEL_NODE_COUNT)
+		}
+	}
+	t.Logf("%d of %d nodes gave up.", cancelled, TEST_CANCEL_NODE_COUNT)
+
+	// ROUND 2: Every node enters again
+	errChan := make(chan error, (TEST_CANCEL_NODE_COUNT + 10) * 2)
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := TEST_CANCEL_NODE_COUNT * 2
+	timeout = time.After(TEST_CANCEL_TIMEOUT)
+	for curCount := 0; curCount < routineCount; {
+		select {
+		case err := <-errChan:
+			curCount++
+			if err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Only %d of %d nodes entered and exited the CS after cancelling.", curCount/2, TEST_CANCEL_NODE_COUNT)
+		}
+	}
+
+	// TRYACQUIRE: Fails while another node holds the lock, and succeeds once it is released
+	if err := o.NodeEnter(0); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	if _, ok := o.nodes[1].TryAcquire(TEST_CS_DELAY); ok {
+		tLog.Dump()
+		t.Fatalf("ERROR: N1 acquired the lock while N0 held it.")
+	}
+	if err := o.NodeExit(0); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	if _, ok := o.nodes[1].TryAcquire(10 * time.Second); !ok {
+		tLog.Dump()
+		t.Fatalf("ERROR: N1 could not acquire the lock after N0 released it.")
+	}
+	if err := o.NodeExit(1); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func TestCancellation_Lamport(t *testing.T) {
+	testCancellation(t, NewOrchestratorWithNLamportNodes)
+}
+
+func TestCancellation_Ricart(t *testing.T) {
+	testCancellation(t, NewOrchestratorWithNRicartNodes)
+}
+
+func TestCancellation_Voting(t *testing.T) {
+	testCancellation(t, NewOrchestratorWithNVoterNodes)
+}
+
+func TestCancellation_Maekawa(t *testing.T) {
+	testCancellation(t, NewOrchestratorWithNMaekawaNodes)
+}
+
+func TestCancellation_SuzukiKasami(t *testing.T) {
+	testCancellation(t, NewOrchestratorWithNSuzukiKasamiNodes)
+}
+
+func TestCancellation_Raymond(t *testing.T) {
+	for _, topology := range TEST_TREE_TOPOLOGIES {
+		topology := topology
+		t.Run(topology.String(), func(t *testing.T) {
+			testCancellation(t, func(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+				return NewOrchestratorWithNRaymondNodes(nodeCount, sm, topology)
+			})
+		})
+	}
+}
+
+func TestCancellation_Central(t *testing.T) {
+	testCancellation(t, func(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+		return NewOrchestratorWithNCentralNodes(nodeCount, sm, false)
+	})
+}
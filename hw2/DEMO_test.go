@@ -129,4 +129,142 @@ func TestVoting_DEMO(t *testing.T) {
 	}
 }
 
+func TestMaekawa_DEMO(t *testing.T) {
+	if testing.Short() {t.Skip("TestMaekawa_DEMO skipped (Short Mode).")}
+	fmt.Printf("TestMaekawa_DEMO initialised with %d nodes and CS delay %v.\n", DEMO_NODE_COUNT, DEMO_CS_DELAY)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNMaekawaNodes(DEMO_NODE_COUNT, sm)
+	o.Init()
+
+	errChan := make(chan error, (DEMO_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(DEMO_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := DEMO_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+func TestSuzukiKasami_DEMO(t *testing.T) {
+	if testing.Short() {t.Skip("TestSuzukiKasami_DEMO skipped (Short Mode).")}
+	fmt.Printf("TestSuzukiKasami_DEMO initialised with %d nodes and CS delay %v.\n", DEMO_NODE_COUNT, DEMO_CS_DELAY)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNSuzukiKasamiNodes(DEMO_NODE_COUNT, sm)
+	o.Init()
+
+	errChan := make(chan error, (DEMO_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(DEMO_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := DEMO_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
 
+func TestRaymond_DEMO(t *testing.T) {
+	if testing.Short() {t.Skip("TestRaymond_DEMO skipped (Short Mode).")}
+	fmt.Printf("TestRaymond_DEMO initialised with %d nodes in a binary tree and CS delay %v.\n", DEMO_NODE_COUNT, DEMO_CS_DELAY)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNRaymondNodes(DEMO_NODE_COUNT, sm, nodetypes.TreeBinary)
+	o.Init()
+
+	errChan := make(chan error, (DEMO_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(DEMO_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := DEMO_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+func TestCentral_DEMO(t *testing.T) {
+	if testing.Short() {t.Skip("TestCentral_DEMO skipped (Short Mode).")}
+	fmt.Printf("TestCentral_DEMO initialised with %d nodes and CS delay %v.\n", DEMO_NODE_COUNT, DEMO_CS_DELAY)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNCentralNodes(DEMO_NODE_COUNT, sm, false)
+	o.Init()
+
+	errChan := make(chan error, (DEMO_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(DEMO_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := DEMO_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
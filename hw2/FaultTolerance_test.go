@@ -0,0 +1,300 @@
+/**
+  FAULTTOLERANCE_TEST
+  System tests for nodes with a lease (see nodetypes/FailureDetector.go). This doesn't print logs unless the test fails.
+
+  - CRASH IN CS: N0 enters the CS and crashes without exiting. The other nodes must presume it crashed, expire its
+    lease and still enter and exit the CS.
+  - LEASE EXPIRY: N0 enters the CS and overstays its lease. The other nodes must enter and exit the CS while N0 is
+    still inside, and N0's late exit must do nothing. When N0 then uses its fencing token, SharedMemory must reject it
+    as stale, rather than panic because N1 is inside.
+  - PAUSED HOLDER: N0 is granted the lock, but is paused before entering the CS until its lease expires and N1 takes
+    over. When N0 then enters, SharedMemory must reject its token, and N0's AcquireLock must return ErrStaleToken
+    without holding anyone up.
+  - FENCING TOKENS: For every node type, nodes take turns entering the CS, and each token must be later than the last.
+
+  In the first two, SharedMemory panics if a node enters the CS before an earlier holder exits or has its lease expired,
+  in logical time, so no two holders overlap.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"1005129_RYAN_TOH/hw2/nodetypes"
+)
+
+const TEST_FAULT_NODE_COUNT = 10
+
+// How long each round may take before the test fails
+const TEST_FAULT_TIMEOUT = 30 * time.Second
+
+// Lease for the CRASH IN CS tests. It's long enough that N0 is presumed crashed before its lease expires.
+const TEST_FAULT_LONG_LEASE = 10 * time.Second
+
+// Lease for the LEASE EXPIRY tests. It's longer than TEST_CS_DELAY, so only N0 overstays it.
+const TEST_FAULT_SHORT_LEASE = 200 * time.Millisecond
+
+// Every node in `nodeIds` enters and exits the CS once, concurrently.
+func enterAndExitAll(t *testing.T, tLog *tempLog, o *Orchestrator, nodeIds []int) {
+	errChan := make(chan error, (len(nodeIds) + 10) * 2)
+	for _, nodeId := range nodeIds {
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := len(nodeIds) * 2
+	timeout := time.After(TEST_FAULT_TIMEOUT)
+	for curCount := 0; curCount < routineCount; {
+		select {
+		case err := <-errChan:
+			curCount++
+			if err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Only %d of %d nodes entered and exited the CS.", curCount/2, len(nodeIds))
+		}
+	}
+}
+
+// Fails unless N0's lease, and only N0's, expired.
+func assertOnlyN0Expired(t *testing.T, tLog *tempLog, sm *nodetypes.SharedMemory) {
+	expired := sm.ExpiredLeases()
+	if len(expired) != 1 || expired[0] != 0 {
+		tLog.Dump()
+		t.Fatalf("ERROR: Expected only N0's lease to expire, but these expired: %v. History: %v", expired, sm.DumpHistory())
+	}
+}
+
+func testCrashInCS(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory, time.Duration) *Orchestrator) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := newOrchestrator(TEST_FAULT_NODE_COUNT, sm, TEST_FAULT_LONG_LEASE)
+	o.Init()
+
+	if err := o.NodeEnter(0); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	if err := o.NodeShutdown(0); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+
+	others := make([]int, 0)
+	for nodeId := 1; nodeId < TEST_FAULT_NODE_COUNT; nodeId++ {
+		others = append(others, nodeId)
+	}
+	enterAndExitAll(t, tLog, o, others)
+	assertOnlyN0Expired(t, tLog, sm)
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func testLeaseExpiry(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory, time.Duration) *Orchestrator) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := newOrchestrator(TEST_FAULT_NODE_COUNT, sm, TEST_FAULT_SHORT_LEASE)
+	o.Init()
+
+	staleToken, err := o.NodeEnterWithToken(context.Background(), 0)
+	if err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+
+	// N0 stays in the CS while every other node but N1 enters and exits
+	others := make([]int, 0)
+	for nodeId := 2; nodeId < TEST_FAULT_NODE_COUNT; nodeId++ {
+		others = append(others, nodeId)
+	}
+	enterAndExitAll(t, tLog, o, others)
+
+	// N0 wakes up and uses its token while N1 is inside
+	token, err := o.NodeEnterWithToken(context.Background(), 1)
+	if err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	if token <= staleToken {
+		tLog.Dump()
+		t.Fatalf("ERROR: N1 has token %d, but N0 had token %d before it.", token, staleToken)
+	}
+	if err := sm.EnterCS(0, staleToken); err != nodetypes.ErrStaleToken {
+		tLog.Dump()
+		t.Fatalf("ERROR: Expected N0's token %d to be rejected, got %v. History: %v", staleToken, err, sm.DumpHistory())
+	}
+	if err := o.NodeExit(1); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	if err := o.NodeExit(0); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	assertOnlyN0Expired(t, tLog, sm)
+
+	// N0 can still use the lock afterwards
+	enterAndExitAll(t, tLog, o, []int{0})
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func TestCrashInCS_Lamport(t *testing.T) {
+	testCrashInCS(t, NewOrchestratorWithNLeasedLamportNodes)
+}
+
+func TestCrashInCS_Ricart(t *testing.T) {
+	testCrashInCS(t, NewOrchestratorWithNLeasedRicartNodes)
+}
+
+func TestCrashInCS_Voting(t *testing.T) {
+	testCrashInCS(t, NewOrchestratorWithNLeasedVoterNodes)
+}
+
+func TestLeaseExpiry_Lamport(t *testing.T) {
+	testLeaseExpiry(t, NewOrchestratorWithNLeasedLamportNodes)
+}
+
+func TestLeaseExpiry_Ricart(t *testing.T) {
+	testLeaseExpiry(t, NewOrchestratorWithNLeasedRicartNodes)
+}
+
+func TestLeaseExpiry_Voting(t *testing.T) {
+	testLeaseExpiry(t, NewOrchestratorWithNLeasedVoterNodes)
+}
+
+func testPausedHolder(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory, time.Duration) *Orchestrator) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := newOrchestrator(TEST_FAULT_NODE_COUNT, sm, TEST_FAULT_SHORT_LEASE)
+	o.Init()
+
+	// N0 is granted the lock, but is paused before it enters
+	paused, resume := sm.PauseEntry(0)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := o.NodeEnterWithToken(context.Background(), 0)
+		errChan <- err
+	}()
+	select {
+	case <-paused:
+	case <-time.After(TEST_FAULT_TIMEOUT):
+		tLog.Dump()
+		t.Fatalf("ERROR: N0 was never granted the lock.")
+	}
+
+	// N1 takes over once N0's lease expires
+	if err := o.NodeEnter(1); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+
+	// N0 wakes up and tries to enter while N1 is inside
+	resume()
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, nodetypes.ErrStaleToken) {
+			tLog.Dump()
+			t.Fatalf("ERROR: Expected N0's token to be rejected, got %v. History: %v", err, sm.DumpHistory())
+		}
+	case <-time.After(TEST_FAULT_TIMEOUT):
+		tLog.Dump()
+		t.Fatalf("ERROR: N0's AcquireLock didn't return after it was resumed.")
+	}
+	if err := o.NodeExit(1); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+
+	// N0 can still use the lock afterwards, and didn't hold up anyone else
+	enterAndExitAll(t, tLog, o, []int{0, 1, 2})
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func TestPausedHolder_Lamport(t *testing.T) {
+	testPausedHolder(t, NewOrchestratorWithNLeasedLamportNodes)
+}
+
+func TestPausedHolder_Ricart(t *testing.T) {
+	testPausedHolder(t, NewOrchestratorWithNLeasedRicartNodes)
+}
+
+func TestPausedHolder_Voting(t *testing.T) {
+	testPausedHolder(t, NewOrchestratorWithNLeasedVoterNodes)
+}
+
+// Rounds of FENCING TOKENS tests
+const TEST_FENCING_ROUNDS = 3
+
+func TestFencingTokens(t *testing.T) {
+	nodeTypes := map[string]func(int, *nodetypes.SharedMemory) *Orchestrator{
+		"Lamport": NewOrchestratorWithNLamportNodes,
+		"Ricart": NewOrchestratorWithNRicartNodes,
+		"Voting": NewOrchestratorWithNVoterNodes,
+		"Maekawa": NewOrchestratorWithNMaekawaNodes,
+		"SuzukiKasami": NewOrchestratorWithNSuzukiKasamiNodes,
+		"Raymond": func(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+			return NewOrchestratorWithNRaymondNodes(nodeCount, sm, nodetypes.TreeBinary)
+		},
+		"Central": func(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+			return NewOrchestratorWithNCentralNodes(nodeCount, sm, false)
+		},
+	}
+	for name, newOrchestrator := range nodeTypes {
+		newOrchestrator := newOrchestrator
+		t.Run(name, func(t *testing.T) {
+			tLog := useTempLog(t)
+			sm := nodetypes.NewSharedMemory()
+			o := newOrchestrator(TEST_FAULT_NODE_COUNT, sm)
+			o.Init()
+
+			lastToken := nodetypes.FencingToken(-1)
+			for round := 0; round < TEST_FENCING_ROUNDS; round++ {
+				for nodeId := 0; nodeId < TEST_FAULT_NODE_COUNT; nodeId++ {
+					token, err := o.NodeEnterWithToken(context.Background(), nodeId)
+					if err != nil {
+						tLog.Dump()
+						t.Fatalf("ERROR: %v", err)
+					}
+					if token <= lastToken {
+						tLog.Dump()
+						t.Fatalf("ERROR: N%d has token %d, but the last holder had token %d.", nodeId, token, lastToken)
+					}
+					lastToken = token
+					if err := o.NodeExit(nodeId); err != nil {
+						tLog.Dump()
+						t.Fatalf("ERROR: %v", err)
+					}
+				}
+			}
+
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 /**
   IMPLEMENTATIONS_TEST
-  System tests for all three protocols. This doesn't print logs unless the test fails.
+  System tests for all seven protocols. This doesn't print logs unless the test fails.
 
   We test using nodetypes.SharedMemory. This is a **non-threadsafe** piece of memory used to represent an unsafe critical section, where users of the critical section must implement their own functions for mutual exclusion.
   - The EnterCS panics the moment a node calls it when another node is still in the critical section.
@@ -252,3 +252,388 @@ func TestHalfConcurrent_Voting(t *testing.T) {
 	}
 }
 
+func TestStandard_Maekawa(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNMaekawaNodes(TEST_NODE_COUNT, sm)
+	o.Init()
+
+	errChan := make(chan error, (TEST_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := TEST_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+
+func TestHalfConcurrent_Maekawa(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNMaekawaNodes(TEST_NODE_COUNT, sm)
+	o.Init()
+
+	nodesToEnter := TEST_NODE_COUNT/2
+	errChan := make(chan error, (nodesToEnter + 10) * 2)
+
+	count := 0
+	for nodeId := range o.nodes {
+		if count == nodesToEnter {
+			break
+		}
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+		count++
+	}
+
+	routineCount := nodesToEnter * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+func TestStandard_SuzukiKasami(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNSuzukiKasamiNodes(TEST_NODE_COUNT, sm)
+	o.Init()
+
+	errChan := make(chan error, (TEST_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := TEST_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+
+func TestHalfConcurrent_SuzukiKasami(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNSuzukiKasamiNodes(TEST_NODE_COUNT, sm)
+	o.Init()
+
+	nodesToEnter := TEST_NODE_COUNT/2
+	errChan := make(chan error, (nodesToEnter + 10) * 2)
+
+	count := 0
+	for nodeId := range o.nodes {
+		if count == nodesToEnter {
+			break
+		}
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+		count++
+	}
+
+	routineCount := nodesToEnter * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+var TEST_TREE_TOPOLOGIES = []nodetypes.TreeTopology{nodetypes.TreeLine, nodetypes.TreeStar, nodetypes.TreeBinary}
+
+func TestStandard_Raymond(t *testing.T) {
+	for _, topology := range TEST_TREE_TOPOLOGIES {
+		topology := topology
+		t.Run(topology.String(), func(t *testing.T) {
+			tLog := useTempLog(t)
+			sm := nodetypes.NewSharedMemory()
+			o := NewOrchestratorWithNRaymondNodes(TEST_NODE_COUNT, sm, topology)
+			o.Init()
+
+			errChan := make(chan error, (TEST_NODE_COUNT + 10) * 2)
+
+			for nodeId := range o.nodes {
+				nodeId := nodeId
+				go func(id int) {
+					errChan <- o.NodeEnter(id)
+					time.Sleep(TEST_CS_DELAY)
+					errChan <- o.NodeExit(id)
+				}(nodeId)
+			}
+
+			routineCount := TEST_NODE_COUNT * 2
+			curCount := 0
+			for err := range errChan {
+				curCount++
+				if err != nil {
+					t.Fatalf("ERROR: %v", err)
+				}
+				if curCount == routineCount {
+					shutdownErr := o.Shutdown()
+					if shutdownErr != nil {
+						tLog.Dump()
+						t.Fatalf("ERROR: %v", shutdownErr)
+					}
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestHalfConcurrent_Raymond(t *testing.T) {
+	for _, topology := range TEST_TREE_TOPOLOGIES {
+		topology := topology
+		t.Run(topology.String(), func(t *testing.T) {
+			tLog := useTempLog(t)
+			sm := nodetypes.NewSharedMemory()
+			o := NewOrchestratorWithNRaymondNodes(TEST_NODE_COUNT, sm, topology)
+			o.Init()
+
+			nodesToEnter := TEST_NODE_COUNT/2
+			errChan := make(chan error, (nodesToEnter + 10) * 2)
+
+			count := 0
+			for nodeId := range o.nodes {
+				if count == nodesToEnter {
+					break
+				}
+				nodeId := nodeId
+				go func(id int) {
+					errChan <- o.NodeEnter(id)
+					time.Sleep(TEST_CS_DELAY)
+					errChan <- o.NodeExit(id)
+				}(nodeId)
+				count++
+			}
+
+			routineCount := nodesToEnter * 2
+			curCount := 0
+			for err := range errChan {
+				curCount++
+				if err != nil {
+					t.Fatalf("ERROR: %v", err)
+				}
+				if curCount == routineCount {
+					shutdownErr := o.Shutdown()
+					if shutdownErr != nil {
+						tLog.Dump()
+						t.Fatalf("ERROR: %v", shutdownErr)
+					}
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestStandard_Central(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNCentralNodes(TEST_NODE_COUNT, sm, false)
+	o.Init()
+
+	errChan := make(chan error, (TEST_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := TEST_NODE_COUNT * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+
+func TestHalfConcurrent_Central(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNCentralNodes(TEST_NODE_COUNT, sm, false)
+	o.Init()
+
+	nodesToEnter := TEST_NODE_COUNT/2
+	errChan := make(chan error, (nodesToEnter + 10) * 2)
+
+	count := 0
+	for nodeId := range o.nodes {
+		if count == nodesToEnter {
+			break
+		}
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+		count++
+	}
+
+	routineCount := nodesToEnter * 2
+	curCount := 0
+	for err := range errChan {
+		curCount++
+		if err != nil {
+			t.Fatalf("ERROR: %v", err)
+		}
+		if curCount == routineCount {
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+			break
+		}
+	}
+}
+
+// The coordinator dies while the other nodes are waiting for the lock, so they must elect a new one.
+func TestCoordinatorFailure_Central(t *testing.T) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewSharedMemory()
+	o := NewOrchestratorWithNCentralNodes(TEST_NODE_COUNT, sm, true)
+	o.Init()
+
+	errChan := make(chan error, (TEST_NODE_COUNT + 10) * 2)
+
+	for nodeId := range o.nodes {
+		if nodeId == 0 {
+			continue
+		}
+		nodeId := nodeId
+		go func(id int) {
+			errChan <- o.NodeEnter(id)
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+	time.Sleep(TEST_NODE_COUNT * TEST_CS_DELAY / 4)
+	o.NodeShutdown(0)
+
+	routineCount := (TEST_NODE_COUNT - 1) * 2
+	curCount := 0
+	timeout := time.After(TEST_NODE_COUNT * TEST_CS_DELAY * 4 + 10 * time.Second)
+	for curCount < routineCount {
+		select {
+		case err := <-errChan:
+			curCount++
+			if err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Only %d of %d nodes entered and exited the CS.", curCount/2, TEST_NODE_COUNT - 1)
+		}
+	}
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+// Shutting down a node that was already shut down (e.g. by a test crashing it) must do nothing.
+func TestShutdownTwice(t *testing.T) {
+	newOrchestrators := map[string]func() *Orchestrator{
+		"Maekawa": func() *Orchestrator { return NewOrchestratorWithNMaekawaNodes(TEST_NODE_COUNT / 10, nodetypes.NewSharedMemory()) },
+		"SuzukiKasami": func() *Orchestrator { return NewOrchestratorWithNSuzukiKasamiNodes(TEST_NODE_COUNT / 10, nodetypes.NewSharedMemory()) },
+		"Raymond": func() *Orchestrator {
+			return NewOrchestratorWithNRaymondNodes(TEST_NODE_COUNT / 10, nodetypes.NewSharedMemory(), nodetypes.TreeBinary)
+		},
+	}
+	for name, newOrchestrator := range newOrchestrators {
+		tLog := useTempLog(t)
+		o := newOrchestrator()
+		o.Init()
+		o.NodeShutdown(0)
+		if err := o.Shutdown(); err != nil {
+			tLog.Dump()
+			t.Fatalf("ERROR: %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/**
+  KMUTEX_TEST
+  System tests for k-mutual exclusion, where up to k nodes may be in the CS at once. This doesn't print logs unless the
+  test fails.
+
+  - K MUTEX: Every node enters and exits the CS at once, twice. SharedMemory panics if more than k nodes are inside, and
+    more than one node must have been inside at some point.
+  - K SHARED MEMORY: k nodes enter the CS, and the (k+1)th must panic.
+  - K FENCING: Holders may enter with tokens older than other holders', but a node must be rejected if its token is no
+    later than its last one, or than the expiry of its lease.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"1005129_RYAN_TOH/hw2/nodetypes"
+)
+
+const TEST_K_NODE_COUNT = 10
+const TEST_K = 3
+
+// Rounds of K MUTEX tests
+const TEST_K_ROUNDS = 2
+
+// How long each round may take before the test fails
+const TEST_K_TIMEOUT = 30 * time.Second
+
+func testKMutex(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory) *Orchestrator) {
+	tLog := useTempLog(t)
+	sm := nodetypes.NewKSharedMemory(TEST_K)
+	o := newOrchestrator(TEST_K_NODE_COUNT, sm)
+	o.Init()
+
+	for round := 0; round < TEST_K_ROUNDS; round++ {
+		errChan := make(chan error, (TEST_K_NODE_COUNT + 10) * 2)
+		for nodeId := range o.nodes {
+			go func(id int) {
+				errChan <- o.NodeEnter(id)
+				time.Sleep(TEST_CS_DELAY)
+				errChan <- o.NodeExit(id)
+			}(nodeId)
+		}
+
+		timeout := time.After(TEST_K_TIMEOUT)
+		for curCount := 0; curCount < TEST_K_NODE_COUNT * 2; {
+			select {
+			case err := <-errChan:
+				curCount++
+				if err != nil {
+					tLog.Dump()
+					t.Fatalf("ERROR: Round %d: %v", round, err)
+				}
+			case <-timeout:
+				tLog.Dump()
+				t.Fatalf("ERROR: Round %d: Only %d of %d nodes entered and exited the CS.", round, curCount/2, TEST_K_NODE_COUNT)
+			}
+		}
+	}
+	if sm.MaxHolders() < 2 {
+		tLog.Dump()
+		t.Fatalf("ERROR: Nodes never shared the CS. History: %v", sm.DumpHistory())
+	}
+	t.Logf("Up to %d nodes were in the CS at once, with k = %d.", sm.MaxHolders(), TEST_K)
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func TestKMutex_Ricart(t *testing.T) {
+	testKMutex(t, NewOrchestratorWithNKRicartNodes)
+}
+
+func TestKMutex_SuzukiKasami(t *testing.T) {
+	testKMutex(t, NewOrchestratorWithNKSuzukiKasamiNodes)
+}
+
+func TestKSharedMemory(t *testing.T) {
+	sm := nodetypes.NewKSharedMemory(TEST_K)
+	for nodeId := 0; nodeId < TEST_K; nodeId++ {
+		if err := sm.EnterCS(nodeId, nodetypes.FencingToken(nodeId)); err != nil {
+			t.Fatalf("ERROR: N%d: %v", nodeId, err)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("ERROR: N%d entered the CS with %d nodes inside. History: %v", TEST_K, TEST_K, sm.DumpHistory())
+		}
+	}()
+	sm.EnterCS(TEST_K, nodetypes.FencingToken(TEST_K))
+}
+
+func TestKFencing(t *testing.T) {
+	sm := nodetypes.NewKSharedMemory(TEST_K)
+	enter := func(nodeId int, token int, wantStale bool) {
+		err := sm.EnterCS(nodeId, nodetypes.FencingToken(token))
+		if wantStale && !errors.Is(err, nodetypes.ErrStaleToken) {
+			t.Fatalf("ERROR: N%d entered with stale token %d (err: %v). History: %v", nodeId, token, err, sm.DumpHistory())
+		} else if !wantStale && err != nil {
+			t.Fatalf("ERROR: N%d: %v. History: %v", nodeId, err, sm.DumpHistory())
+		}
+	}
+
+	enter(0, 5, false)
+	enter(1, 3, false) // Older than N0's, but holders may enter in any order
+	sm.ExitCS(0)
+	enter(0, 5, true) // Same token as its last entry
+
+	// Lease expires while inside
+	sm.ExpireLease(1, 10)
+	enter(1, 8, true)
+	enter(1, 11, false)
+
+	// Lease expires while paused before entering
+	sm.ExpireLease(2, 12)
+	enter(2, 9, true)
+	enter(2, 13, false)
+}
@@ -0,0 +1,188 @@
+/**
+  LOCKMANAGER_TEST
+  System tests for named locks (see nodetypes/LockManager.go). This doesn't print logs unless the test fails.
+
+  - NAMED LOCKS: Every node enters and exits the CS of every resource, at once. A node holding one resource mustn't
+    hold up a node asking for another.
+  - DEADLOCK: N0 holds A and asks for B, while N1 holds B and asks for A. At least one of them must give up with
+    ErrDeadlock, after which both must be able to finish.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"1005129_RYAN_TOH/hw2/nodetypes"
+)
+
+const TEST_LOCK_NODE_COUNT = 10
+
+// How long each round may take before the test fails
+const TEST_LOCK_TIMEOUT = 30 * time.Second
+
+var testLockResources = []string{"accounts/1", "accounts/2", "accounts/3"}
+
+func testNamedLocks(t *testing.T, newOrchestrator func(int, *nodetypes.ResourceMemory) *ResourceOrchestrator) {
+	tLog := useTempLog(t)
+	rm := nodetypes.NewResourceMemory()
+	o := newOrchestrator(TEST_LOCK_NODE_COUNT, rm)
+	o.Init()
+
+	// ROUND 1: Every node takes every lock, at once
+	errChan := make(chan error, TEST_LOCK_NODE_COUNT * len(testLockResources) * 2 + 10)
+	for nodeId := 0; nodeId < TEST_LOCK_NODE_COUNT; nodeId++ {
+		for _, name := range testLockResources {
+			go func(id int, name string) {
+				err := o.NodeEnter(id, name)
+				if err == nil {
+					time.Sleep(TEST_CS_DELAY)
+					err = o.NodeExit(id, name)
+				}
+				errChan <- err
+			}(nodeId, name)
+		}
+	}
+	timeout := time.After(TEST_LOCK_TIMEOUT)
+	for i := 0; i < TEST_LOCK_NODE_COUNT * len(testLockResources); i++ {
+		select {
+		case err := <-errChan:
+			if err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Only %d of %d locks were taken and released.", i, TEST_LOCK_NODE_COUNT * len(testLockResources))
+		}
+	}
+
+	// ROUND 2: N1 takes a lock while N0 holds another, and can't take N0's
+	if err := o.NodeEnter(0, testLockResources[0]); err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_LOCK_TIMEOUT)
+	err := o.NodeEnterWithContext(ctx, 1, testLockResources[1])
+	cancel()
+	if err != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: N1 couldn't take %q while N0 held %q: %v", testLockResources[1], testLockResources[0], err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10 * TEST_CS_DELAY)
+	err = o.NodeEnterWithContext(ctx, 1, testLockResources[0])
+	cancel()
+	if err != context.DeadlineExceeded {
+		tLog.Dump()
+		t.Fatalf("ERROR: Expected N1 to wait for N0's %q, got %v", testLockResources[0], err)
+	}
+	if err := o.NodeEnter(0, testLockResources[0]); err != nodetypes.ErrAlreadyRequested {
+		tLog.Dump()
+		t.Fatalf("ERROR: Expected N0 to be refused %q again, got %v", testLockResources[0], err)
+	}
+	for nodeId, name := range testLockResources[:2] {
+		if err := o.NodeExit(nodeId, name); err != nil {
+			tLog.Dump()
+			t.Fatalf("ERROR: %v", err)
+		}
+	}
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func TestNamedLocks_Ricart(t *testing.T) {
+	testNamedLocks(t, NewResourceOrchestratorWithNRicartNodes)
+}
+
+func TestNamedLocks_Lamport(t *testing.T) {
+	testNamedLocks(t, NewResourceOrchestratorWithNLamportNodes)
+}
+
+// Result of a node's attempt to take its second lock in the DEADLOCK test
+type lockResult struct {
+	nodeId int
+	err error
+}
+
+func testDeadlock(t *testing.T, newOrchestrator func(int, *nodetypes.ResourceMemory) *ResourceOrchestrator) {
+	tLog := useTempLog(t)
+	rm := nodetypes.NewResourceMemory()
+	o := newOrchestrator(TEST_LOCK_NODE_COUNT, rm)
+	o.Init()
+
+	// N0 holds A and N1 holds B. Each then asks for the other's.
+	held := map[int]string{0: "A", 1: "B"}
+	wanted := map[int]string{0: "B", 1: "A"}
+	for nodeId, name := range held {
+		if err := o.NodeEnter(nodeId, name); err != nil {
+			tLog.Dump()
+			t.Fatalf("ERROR: %v", err)
+		}
+	}
+	resultChan := make(chan lockResult, 2)
+	for nodeId, name := range wanted {
+		go func(id int, name string) {
+			resultChan <- lockResult{id, o.NodeEnter(id, name)}
+		}(nodeId, name)
+	}
+
+	// Neither can enter until the other gives up, so the first result must be a deadlock. Each node releases what it
+	// holds once it's done.
+	deadlocks := 0
+	timeout := time.After(TEST_LOCK_TIMEOUT)
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-resultChan:
+			if res.err == nodetypes.ErrDeadlock {
+				deadlocks++
+			} else if res.err != nil || i == 0 {
+				tLog.Dump()
+				t.Fatalf("ERROR: N%d: Expected a deadlock, got %v", res.nodeId, res.err)
+			} else if err := o.NodeExit(res.nodeId, wanted[res.nodeId]); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+			if err := o.NodeExit(res.nodeId, held[res.nodeId]); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Deadlock wasn't detected. Waiting on %d of 2 nodes.", 2 - i)
+		}
+	}
+	t.Logf("%d of 2 nodes gave up.", deadlocks)
+
+	// Both locks are free again
+	for nodeId := 0; nodeId < 2; nodeId++ {
+		for _, name := range held {
+			if err := o.NodeEnter(nodeId, name); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+			if err := o.NodeExit(nodeId, name); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: N%d: %v", nodeId, err)
+			}
+		}
+	}
+
+	shutdownErr := o.Shutdown()
+	if shutdownErr != nil {
+		tLog.Dump()
+		t.Fatalf("ERROR: %v", shutdownErr)
+	}
+}
+
+func TestDeadlock_Ricart(t *testing.T) {
+	testDeadlock(t, NewResourceOrchestratorWithNRicartNodes)
+}
+
+func TestDeadlock_Lamport(t *testing.T) {
+	testDeadlock(t, NewResourceOrchestratorWithNLamportNodes)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"1005129_RYAN_TOH/hw2/nodetypes"
+	"context"
 	"log"
 	"fmt"
 	"errors"
@@ -53,15 +54,44 @@ func (o *Orchestrator) NodeShutdown(nodeId int) (err error) {
 }
 
 func (o *Orchestrator) NodeEnter(nodeId int) (err error) {
+	return o.NodeEnterWithContext(context.Background(), nodeId)
+}
+
+// Like NodeEnter, but gives up when `ctx` is done, returning ctx.Err() without entering the CS.
+func (o *Orchestrator) NodeEnterWithContext(ctx context.Context, nodeId int) (err error) {
+	_, err = o.NodeEnterWithToken(ctx, nodeId)
+	return err
+}
+
+// Like NodeEnterWithContext, but also returns the node's fencing token.
+func (o *Orchestrator) NodeEnterWithToken(ctx context.Context, nodeId int) (token nodetypes.FencingToken, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New(fmt.Sprintf("%v", r))
 		}
 	}()
 	//log.Printf("N%d: Request to enter CS", nodeId)
-	o.nodes[nodeId].AcquireLock()
-	//log.Printf("N%d: Entered CS", nodeId)
-	return nil
+	return o.nodes[nodeId].AcquireLock(ctx)
+}
+
+func (o *Orchestrator) NodeEnterShared(nodeId int) (err error) {
+	return o.NodeEnterSharedWithContext(context.Background(), nodeId)
+}
+
+// Like NodeEnterWithContext, but the node takes the lock in shared mode, alongside other readers. Returns an error if
+// the node type has no shared mode. The node exits with NodeExit as usual.
+func (o *Orchestrator) NodeEnterSharedWithContext(ctx context.Context, nodeId int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+	}()
+	n, ok := o.nodes[nodeId].(nodetypes.RWNode)
+	if !ok {
+		return errors.New(fmt.Sprintf("N%d: Node type has no shared mode.", nodeId))
+	}
+	_, err = n.AcquireSharedLock(ctx)
+	return err
 }
 
 func (o *Orchestrator) NodeExit(nodeId int) (err error) {
@@ -74,3 +104,65 @@ func (o *Orchestrator) NodeExit(nodeId int) (err error) {
 	o.nodes[nodeId].ReleaseLock()
 	return nil
 }
+
+
+// Like Orchestrator, but manages nodes that take named locks (see nodetypes/LockManager.go).
+type ResourceOrchestrator struct {
+	nodes map[int](nodetypes.LockManager)
+	rm *nodetypes.ResourceMemory
+}
+
+func NewResourceOrchestrator(nodes map[int](nodetypes.LockManager), rm *nodetypes.ResourceMemory) *ResourceOrchestrator {
+	return &ResourceOrchestrator{
+		nodes,
+		rm,
+	}
+}
+
+func (o *ResourceOrchestrator) Init() (err error) {
+	log.Printf("ResourceOrchestrator: Initialised")
+	for _, n := range o.nodes {
+		err = n.Init()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *ResourceOrchestrator) Shutdown() (err error) {
+	log.Printf("ResourceOrchestrator: Shutdown")
+	for _, n := range o.nodes {
+		shutdownErr := n.Shutdown()
+		if shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+func (o *ResourceOrchestrator) NodeEnter(nodeId int, name string) (err error) {
+	return o.NodeEnterWithContext(context.Background(), nodeId, name)
+}
+
+// Like NodeEnter, but gives up when `ctx` is done. Returns nodetypes.ErrDeadlock if the node gave up to break a
+// deadlock, in which case it should release the locks it holds.
+func (o *ResourceOrchestrator) NodeEnterWithContext(ctx context.Context, nodeId int, name string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+	}()
+	_, err = o.nodes[nodeId].AcquireLock(ctx, name)
+	return err
+}
+
+func (o *ResourceOrchestrator) NodeExit(nodeId int, name string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("%v", r))
+		}
+	}()
+	o.nodes[nodeId].ReleaseLock(name)
+	return nil
+}
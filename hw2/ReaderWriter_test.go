@@ -0,0 +1,177 @@
+/**
+  READERWRITER_TEST
+  System tests for taking the lock in shared mode (see nodetypes/ReaderWriter.go), under every RWPolicy. This doesn't
+  print logs unless the test fails.
+
+  - READER WRITER: Every node enters and exits the CS in shared mode at once, and they must overlap. Then even nodes
+    read and odd nodes write, at once. SharedMemory panics if a writer overlaps anyone.
+  - PREFERENCE: N0 reads while N1 waits to write. N2 then asks to read, which must get in past N1 under
+    RWPreferReaders only.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"1005129_RYAN_TOH/hw2/nodetypes"
+)
+
+const TEST_RW_NODE_COUNT = 10
+
+// How long each round may take before the test fails
+const TEST_RW_TIMEOUT = 30 * time.Second
+
+// How long to wait for a REQUEST to reach every node, and how long N2 waits to read in the PREFERENCE tests
+const TEST_RW_SETTLE = 200 * time.Millisecond
+
+var testRWPolicies = []nodetypes.RWPolicy{nodetypes.RWFair, nodetypes.RWPreferReaders, nodetypes.RWPreferWriters}
+
+// Every node in `nodeIds` enters and exits the CS once, concurrently. Nodes for which `shared` returns true read.
+func enterAndExitAllRW(t *testing.T, tLog *tempLog, o *Orchestrator, nodeIds []int, shared func(int) bool) {
+	errChan := make(chan error, (len(nodeIds) + 10) * 2)
+	for _, nodeId := range nodeIds {
+		go func(id int) {
+			if shared(id) {
+				errChan <- o.NodeEnterShared(id)
+			} else {
+				errChan <- o.NodeEnter(id)
+			}
+			time.Sleep(TEST_CS_DELAY)
+			errChan <- o.NodeExit(id)
+		}(nodeId)
+	}
+
+	routineCount := len(nodeIds) * 2
+	timeout := time.After(TEST_RW_TIMEOUT)
+	for curCount := 0; curCount < routineCount; {
+		select {
+		case err := <-errChan:
+			curCount++
+			if err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+		case <-timeout:
+			tLog.Dump()
+			t.Fatalf("ERROR: Only %d of %d nodes entered and exited the CS.", curCount/2, len(nodeIds))
+		}
+	}
+}
+
+func testReaderWriter(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory, nodetypes.RWPolicy) *Orchestrator) {
+	for _, policy := range testRWPolicies {
+		policy := policy
+		t.Run(policy.String(), func(t *testing.T) {
+			tLog := useTempLog(t)
+			sm := nodetypes.NewSharedMemory()
+			o := newOrchestrator(TEST_RW_NODE_COUNT, sm, policy)
+			o.Init()
+
+			nodeIds := make([]int, 0)
+			for nodeId := 0; nodeId < TEST_RW_NODE_COUNT; nodeId++ {
+				nodeIds = append(nodeIds, nodeId)
+			}
+
+			// ROUND 1: Only readers
+			enterAndExitAllRW(t, tLog, o, nodeIds, func(int) bool { return true })
+			if sm.MaxReaders() < 2 {
+				tLog.Dump()
+				t.Fatalf("ERROR: Readers never shared the CS. History: %v", sm.DumpHistory())
+			}
+
+			// ROUND 2: Readers and writers
+			enterAndExitAllRW(t, tLog, o, nodeIds, func(id int) bool { return id % 2 == 0 })
+
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+		})
+	}
+}
+
+func testReaderPreference(t *testing.T, newOrchestrator func(int, *nodetypes.SharedMemory, nodetypes.RWPolicy) *Orchestrator) {
+	for _, policy := range testRWPolicies {
+		policy := policy
+		t.Run(policy.String(), func(t *testing.T) {
+			tLog := useTempLog(t)
+			sm := nodetypes.NewSharedMemory()
+			o := newOrchestrator(TEST_RW_NODE_COUNT, sm, policy)
+			o.Init()
+
+			// N0 reads, and N1 waits to write
+			if err := o.NodeEnterShared(0); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+			writerErr := make(chan error, 1)
+			go func() {
+				writerErr <- o.NodeEnter(1)
+			}()
+			time.Sleep(TEST_RW_SETTLE)
+
+			// N2 asks to read
+			ctx, cancel := context.WithTimeout(context.Background(), TEST_RW_SETTLE)
+			readerErr := o.NodeEnterSharedWithContext(ctx, 2)
+			cancel()
+			if policy == nodetypes.RWPreferReaders {
+				if readerErr != nil {
+					tLog.Dump()
+					t.Fatalf("ERROR: N2 didn't get in past N1: %v. History: %v", readerErr, sm.DumpHistory())
+				}
+				if err := o.NodeExit(2); err != nil {
+					tLog.Dump()
+					t.Fatalf("ERROR: %v", err)
+				}
+			} else if readerErr != context.DeadlineExceeded {
+				tLog.Dump()
+				t.Fatalf("ERROR: Expected N2 to wait for N1, got %v. History: %v", readerErr, sm.DumpHistory())
+			}
+
+			// N1 writes once N0 is done
+			if err := o.NodeExit(0); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+			select {
+			case err := <-writerErr:
+				if err != nil {
+					tLog.Dump()
+					t.Fatalf("ERROR: %v", err)
+				}
+			case <-time.After(TEST_RW_TIMEOUT):
+				tLog.Dump()
+				t.Fatalf("ERROR: N1 never entered the CS.")
+			}
+			if err := o.NodeExit(1); err != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", err)
+			}
+
+			shutdownErr := o.Shutdown()
+			if shutdownErr != nil {
+				tLog.Dump()
+				t.Fatalf("ERROR: %v", shutdownErr)
+			}
+		})
+	}
+}
+
+func TestReaderWriter_Lamport(t *testing.T) {
+	testReaderWriter(t, NewOrchestratorWithNRWLamportNodes)
+}
+
+func TestReaderWriter_Ricart(t *testing.T) {
+	testReaderWriter(t, NewOrchestratorWithNRWRicartNodes)
+}
+
+func TestReaderPreference_Lamport(t *testing.T) {
+	testReaderPreference(t, NewOrchestratorWithNRWLamportNodes)
+}
+
+func TestReaderPreference_Ricart(t *testing.T) {
+	testReaderPreference(t, NewOrchestratorWithNRWRicartNodes)
+}
@@ -20,68 +20,32 @@ func main() {
 	csDelay := 100 * time.Millisecond
 	useLogBuf() // Disable logging
 
-	// Lamport's Shared Priority Queue
-	fmt.Printf("\n---LAMPORT'S SHARED PRIORITY QUEUE---\n")
-	fmt.Printf("Progress: ")
-	sysTimes := make(map[int]time.Duration)
-	sysTimesChan := make(chan sysTimingRecord, nodeCount + 10)
-	//// Initialise goroutines
-	for i := 1; i <= nodeCount; i++ {
-		i := i
-		sm := nodetypes.NewSharedMemory()
-		o := NewOrchestratorWithNLamportNodes(nodeCount, sm)
-		record := TimeSystem(o, csDelay, i)
-		if record.err != nil {
-			fmt.Printf("Error with %d nodes entering CS: %v\n", record.nodesEnteringCS, record.err)
-		}
-		fmt.Printf("|")
-		sysTimes[record.nodesEnteringCS] = record.timing
+	PrintTimingTable("LAMPORT'S SHARED PRIORITY QUEUE", NewOrchestratorWithNLamportNodes, nodeCount, csDelay)
+	PrintTimingTable("RICART AND AGRAWALA'S OPTIMISATION", NewOrchestratorWithNRicartNodes, nodeCount, csDelay)
+	PrintTimingTable("VOTING PROTOCOL", NewOrchestratorWithNVoterNodes, nodeCount, csDelay)
+	PrintTimingTable("MAEKAWA'S ALGORITHM", NewOrchestratorWithNMaekawaNodes, nodeCount, csDelay)
+	PrintTimingTable("SUZUKI-KASAMI BROADCAST", NewOrchestratorWithNSuzukiKasamiNodes, nodeCount, csDelay)
+	PrintTimingTable("CENTRAL LOCK SERVER", func(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+		return NewOrchestratorWithNCentralNodes(nodeCount, sm, false)
+	}, nodeCount, csDelay)
+	for _, topology := range []nodetypes.TreeTopology{nodetypes.TreeLine, nodetypes.TreeStar, nodetypes.TreeBinary} {
+		topology := topology
+		PrintTimingTable(fmt.Sprintf("RAYMOND'S TREE (%v)", topology), func(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+			return NewOrchestratorWithNRaymondNodes(nodeCount, sm, topology)
+		}, nodeCount, csDelay)
 	}
-	fmt.Println()
-	//// Provide output
-	fmt.Printf("NODES ENTERING | TIME TAKEN\n")
-	for i := 1; i <= nodeCount; i++ {
-		fmt.Printf("%14d | %s\n", i, sysTimes[i].Round(time.Millisecond).String())
-	}
-	close(sysTimesChan)
-	
-	
-	// Ricart and Agrawala
-	fmt.Printf("\n---RICART AND AGRAWALA'S OPTIMISATION---\n")
-	fmt.Printf("Progress: ")
-	sysTimes = make(map[int]time.Duration)
-	sysTimesChan = make(chan sysTimingRecord, nodeCount + 10)
-	//// Initialise goroutines
-	for i := 1; i <= nodeCount; i++ {
-		i := i
-		sm := nodetypes.NewSharedMemory()
-		o := NewOrchestratorWithNRicartNodes(nodeCount, sm)
-		record := TimeSystem(o, csDelay, i)
-		if record.err != nil {
-			fmt.Printf("Error with %d nodes entering CS: %v\n", record.nodesEnteringCS, record.err)
-		}
-		fmt.Printf("|")
-		sysTimes[record.nodesEnteringCS] = record.timing
-	}
-	fmt.Println()
-	//// Provide output
-	fmt.Printf("NODES ENTERING | TIME TAKEN\n")
-	for i := 1; i <= nodeCount; i++ {
-		fmt.Printf("%14d | %s\n", i, sysTimes[i].Round(time.Millisecond).String())
-	}
-	close(sysTimesChan)
-	
-	
-	// Voting Protocol
-	fmt.Printf("\n---VOTING PROTOCOL---\n")
+}
+
+// Prints the time taken for x nodes to enter the CS, out of `nodeCount` nodes, for x from 1 to `nodeCount`.
+// Each run uses a fresh system from `newOrchestrator`.
+func PrintTimingTable(title string, newOrchestrator func(int, *nodetypes.SharedMemory) *Orchestrator, nodeCount int, csDelay time.Duration) {
+	fmt.Printf("\n---%s---\n", title)
 	fmt.Printf("Progress: ")
-	sysTimes = make(map[int]time.Duration)
-	sysTimesChan = make(chan sysTimingRecord, nodeCount + 10)
+	sysTimes := make(map[int]time.Duration)
 	//// Initialise goroutines
 	for i := 1; i <= nodeCount; i++ {
-		i := i
 		sm := nodetypes.NewSharedMemory()
-		o := NewOrchestratorWithNVoterNodes(nodeCount, sm)
+		o := newOrchestrator(nodeCount, sm)
 		record := TimeSystem(o, csDelay, i)
 		if record.err != nil {
 			fmt.Printf("Error with %d nodes entering CS: %v\n", record.nodesEnteringCS, record.err)
@@ -95,8 +59,6 @@ func main() {
 	for i := 1; i <= nodeCount; i++ {
 		fmt.Printf("%14d | %s\n", i, sysTimes[i].Round(time.Millisecond).String())
 	}
-	close(sysTimesChan)
-	
 }
 
 // Returns time taken for the entire system, when `nodesToEnter` nodes enter the CS simultaneously.
@@ -149,6 +111,27 @@ func TimeSystem(o *Orchestrator, CSDelay time.Duration, nodesToEnter int) sysTim
 }
 
 func NewOrchestratorWithNLamportNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+	return NewOrchestratorWithNLeasedLamportNodes(nodeCount, sm, 0)
+}
+
+// Nodes give up the lock after holding it for `lease`, and recover from other nodes crashing. A lease of 0 disables both.
+func NewOrchestratorWithNLeasedLamportNodes(nodeCount int, sm *nodetypes.SharedMemory, lease time.Duration) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.LamportNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewLamportNodeEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewLamportNodeWithLease(nodeId, endpoints, sm, lease)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+// Nodes can also take the lock in shared mode, and conflicting requests go in the order set by `policy`.
+func NewOrchestratorWithNRWLamportNodes(nodeCount int, sm *nodetypes.SharedMemory, policy nodetypes.RWPolicy) *Orchestrator {
 	nodes := make(map[int](nodetypes.Node))
 	nodeIds := make([]int, 0)
 	endpoints := make([]nodetypes.LamportNodeEndpoint, 0)
@@ -157,13 +140,50 @@ func NewOrchestratorWithNLamportNodes(nodeCount int, sm *nodetypes.SharedMemory)
 		endpoints = append(endpoints, nodetypes.NewLamportNodeEndpoint(nodeId))
 	}
 	for _, nodeId := range(nodeIds) {
-		nodes[nodeId] = nodetypes.NewLamportNode(nodeId, endpoints, sm)
+		nodes[nodeId] = nodetypes.NewLamportNodeWithPolicy(nodeId, endpoints, sm, policy, 0)
 	}
 
 	return NewOrchestrator(nodes, sm)
 }
 
 func NewOrchestratorWithNRicartNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+	return NewOrchestratorWithNLeasedRicartNodes(nodeCount, sm, 0)
+}
+
+// Nodes give up the lock after holding it for `lease`, and recover from other nodes crashing. A lease of 0 disables both.
+func NewOrchestratorWithNLeasedRicartNodes(nodeCount int, sm *nodetypes.SharedMemory, lease time.Duration) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.RicartNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewRicartNodeEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewRicartNodeWithLease(nodeId, endpoints, sm, lease)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+// Nodes can also take the lock in shared mode, and conflicting requests go in the order set by `policy`.
+func NewOrchestratorWithNRWRicartNodes(nodeCount int, sm *nodetypes.SharedMemory, policy nodetypes.RWPolicy) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.RicartNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewRicartNodeEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewRicartNodeWithPolicy(nodeId, endpoints, sm, policy, 0)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+// Up to k nodes may be in the CS at once, where `sm` came from nodetypes.NewKSharedMemory(k).
+func NewOrchestratorWithNKRicartNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
 	nodes := make(map[int](nodetypes.Node))
 	nodeIds := make([]int, 0)
 	endpoints := make([]nodetypes.RicartNodeEndpoint, 0)
@@ -172,13 +192,50 @@ func NewOrchestratorWithNRicartNodes(nodeCount int, sm *nodetypes.SharedMemory)
 		endpoints = append(endpoints, nodetypes.NewRicartNodeEndpoint(nodeId))
 	}
 	for _, nodeId := range(nodeIds) {
-		nodes[nodeId] = nodetypes.NewRicartNode(nodeId, endpoints, sm)
+		nodes[nodeId] = nodetypes.NewKRicartNode(nodeId, endpoints, sm)
 	}
 
 	return NewOrchestrator(nodes, sm)
 }
 
+// Nodes take named locks, running Ricart and Agrawala's Optimisation separately for each resource.
+func NewResourceOrchestratorWithNRicartNodes(nodeCount int, rm *nodetypes.ResourceMemory) *ResourceOrchestrator {
+	nodes := make(map[int](nodetypes.LockManager))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.RicartLockManagerEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewRicartLockManagerEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewRicartLockManager(nodeId, endpoints, rm)
+	}
+
+	return NewResourceOrchestrator(nodes, rm)
+}
+
+// Nodes take named locks, running Lamport's Shared Priority Queue separately for each resource.
+func NewResourceOrchestratorWithNLamportNodes(nodeCount int, rm *nodetypes.ResourceMemory) *ResourceOrchestrator {
+	nodes := make(map[int](nodetypes.LockManager))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.LamportLockManagerEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewLamportLockManagerEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewLamportLockManager(nodeId, endpoints, rm)
+	}
+
+	return NewResourceOrchestrator(nodes, rm)
+}
+
 func NewOrchestratorWithNVoterNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+	return NewOrchestratorWithNLeasedVoterNodes(nodeCount, sm, 0)
+}
+
+// Nodes give up the lock after holding it for `lease`, and recover from other nodes crashing. A lease of 0 disables both.
+func NewOrchestratorWithNLeasedVoterNodes(nodeCount int, sm *nodetypes.SharedMemory, lease time.Duration) *Orchestrator {
 	nodes := make(map[int](nodetypes.Node))
 	nodeIds := make([]int, 0)
 	endpoints := make([]nodetypes.VoterNodeEndpoint, 0)
@@ -187,7 +244,75 @@ func NewOrchestratorWithNVoterNodes(nodeCount int, sm *nodetypes.SharedMemory) *
 		endpoints = append(endpoints, nodetypes.NewVoterNodeEndpoint(nodeId))
 	}
 	for _, nodeId := range(nodeIds) {
-		nodes[nodeId] = nodetypes.NewVoterNode(nodeId, endpoints, sm)
+		nodes[nodeId] = nodetypes.NewVoterNodeWithLease(nodeId, endpoints, sm, lease)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+func NewOrchestratorWithNMaekawaNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.MaekawaNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewMaekawaNodeEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewMaekawaNode(nodeId, endpoints, sm)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+func NewOrchestratorWithNSuzukiKasamiNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+	return NewOrchestratorWithNKSuzukiKasamiNodes(nodeCount, sm)
+}
+
+// There are k tokens, so up to k nodes may be in the CS at once, where `sm` came from nodetypes.NewKSharedMemory(k).
+func NewOrchestratorWithNKSuzukiKasamiNodes(nodeCount int, sm *nodetypes.SharedMemory) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.SuzukiKasamiNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewSuzukiKasamiNodeEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewKSuzukiKasamiNode(nodeId, endpoints, sm)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+// Raymond's nodes are arranged in a spanning tree with the given topology, rooted at node 0, which starts with the token.
+func NewOrchestratorWithNRaymondNodes(nodeCount int, sm *nodetypes.SharedMemory, topology nodetypes.TreeTopology) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.RaymondNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewRaymondNodeEndpoint(nodeId))
+	}
+	parents := nodetypes.TreeParents(topology, nodeIds)
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewRaymondNode(nodeId, parents[nodeId], endpoints, sm)
+	}
+
+	return NewOrchestrator(nodes, sm)
+}
+
+// The node with the lowest ID runs the lock server. With `reelect`, the nodes elect a new one if it dies.
+func NewOrchestratorWithNCentralNodes(nodeCount int, sm *nodetypes.SharedMemory, reelect bool) *Orchestrator {
+	nodes := make(map[int](nodetypes.Node))
+	nodeIds := make([]int, 0)
+	endpoints := make([]nodetypes.CentralNodeEndpoint, 0)
+	for nodeId := 0; nodeId < nodeCount; nodeId++ {
+		nodeIds = append(nodeIds, nodeId)
+		endpoints = append(endpoints, nodetypes.NewCentralNodeEndpoint(nodeId))
+	}
+	for _, nodeId := range(nodeIds) {
+		nodes[nodeId] = nodetypes.NewCentralNode(nodeId, endpoints, sm, reelect)
 	}
 
 	return NewOrchestrator(nodes, sm)
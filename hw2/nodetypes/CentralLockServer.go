@@ -0,0 +1,520 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+  CENTRAL LOCK SERVER
+  One node (the coordinator, initially the node with the lowest ID) runs a lock server with a FIFO queue. Every node,
+  including the coordinator, sends it a REQUEST, waits for a GRANT and sends a RELEASE when it leaves the CS. A node
+  that gives up waiting sends a WITHDRAW instead, which releases the lock if it was granted in the meantime.
+
+  With re-election, the coordinator also sends a HEARTBEAT every CENTRAL_HEARTBEAT_INTV. A node that hears nothing
+  from its coordinator for CENTRAL_COORD_TIMEOUT presumes it dead, and takes the lowest ID it doesn't presume dead as
+  its coordinator. Every node picks the same one, so no election messages are needed.
+  - The new coordinator announces itself with COORDINATOR, and every node replies with a STATE: whether it holds the
+    lock, is waiting for it (with the timestamp of its request), or neither.
+  - The new coordinator only grants the lock once every node has replied (or CENTRAL_COORD_TIMEOUT has passed, in
+    case other nodes died too), so it knows of any holder granted by the dead coordinator. Waiting requests are
+    queued in timestamp order.
+*/
+
+const CENTRAL_HEARTBEAT_INTV = 50 * time.Millisecond
+const CENTRAL_COORD_TIMEOUT = 500 * time.Millisecond
+
+// Communication endpoint for each node -- this is the only thing shared between nodes
+type CentralNodeEndpoint struct {
+	nodeId int
+	recvChan chan CLMsg // Incoming messages for this node are sent here
+}
+
+func NewCentralNodeEndpoint(nodeId int) CentralNodeEndpoint {
+	return CentralNodeEndpoint{nodeId, make(chan CLMsg, 10000)}
+}
+
+// Node that uses a central lock server.
+type CentralNode struct {
+	// Basic Setup
+	nodeId int
+	clock ClockVal
+	smPtr *SharedMemory
+	endpoint CentralNodeEndpoint
+	allEndpoints map[int]CentralNodeEndpoint
+	nodeIds []int // Sorted, so every node picks the same coordinator
+	reelect bool
+
+	// Exit details
+	exit chan bool // Closed on Shutdown
+
+	// Variables for node's own request
+	ongoingReqLock *sync.Mutex // Locked while the node is REQUESTING
+	lock *sync.Mutex // Lock for all variables below
+	coordId int
+	dead map[int]bool // Nodes presumed dead, which can't be the coordinator again
+	lastHeartbeat time.Time
+	requesting bool
+	inCS bool
+	req_ts ClockVal
+	acquired chan bool
+
+	// Variables for the lock server, if this node is the coordinator
+	holder pqueueElem // Request that holds the lock, with nodeId -1 if none
+	queue []pqueueElem // Requests waiting for the lock, first come first served
+	recovering bool // True while collecting STATEs after taking over from a dead coordinator
+	reported map[int]bool
+	recoveryDeadline time.Time
+}
+
+// Initialise a new CentralNode. With `reelect`, the nodes elect a new coordinator when the coordinator dies.
+func NewCentralNode(nodeId int, endpoints []CentralNodeEndpoint, sm *SharedMemory, reelect bool) *CentralNode {
+	if len(endpoints) == 0 {
+		panic("No endpoints given.")
+	}
+
+	nodeIds := make([]int, 0)
+	endpointMap := make(map[int]CentralNodeEndpoint, 0)
+	myEndpoint := endpoints[0]
+	for _, endpoint := range(endpoints) {
+		if endpoint.nodeId == nodeId {
+			myEndpoint = endpoint
+		}
+		nodeIds = append(nodeIds, endpoint.nodeId)
+		endpointMap[endpoint.nodeId] = endpoint
+	}
+	sort.Ints(nodeIds)
+
+	return &CentralNode{
+		nodeId, ClockVal(0), sm, myEndpoint, endpointMap, nodeIds, reelect,
+		make(chan bool),
+		&sync.Mutex{}, &sync.Mutex{}, nodeIds[0], make(map[int]bool), time.Now(), false, false, ClockVal(-1), make(chan bool, 1),
+		pqueueElem{-1, ClockVal(-1)}, make([]pqueueElem, 0), false, make(map[int]bool), time.Time{},
+	}
+}
+
+func (n *CentralNode) Init() error {
+	n.lock.Lock()
+	n.lastHeartbeat = time.Now()
+	n.lock.Unlock()
+
+	go n.handleMsg()
+	if n.reelect {
+		go n.monitor()
+	}
+	return nil
+}
+
+// Shutdown may be called again by the Orchestrator after the node was shut down on its own (e.g. to kill the
+// coordinator), so it does nothing the second time.
+func (n *CentralNode) Shutdown() error {
+	select {
+	case <-n.exit:
+	default:
+		close(n.exit)
+	}
+	return nil
+}
+
+// Handle incoming messages one at a time.
+func (n *CentralNode) handleMsg() {
+	for {
+		select {
+		case rcvd_msg, ok := <-n.endpoint.recvChan:
+			if !ok {
+				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
+			}
+
+			n.lock.Lock()
+			// Update local clock to be elementwise max + 1
+			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
+			switch rcvd_msg.action {
+			case CLRequest:
+				n.serverHandleRequest(rcvd_msg)
+			case CLRelease:
+				n.serverHandleRelease(rcvd_msg)
+			case CLWithdraw:
+				n.serverHandleWithdraw(rcvd_msg)
+			case CLState:
+				n.serverHandleState(rcvd_msg)
+			case CLGrant:
+				n.handleGrant(rcvd_msg)
+			case CLHeartbeat:
+				if rcvd_msg.nodeId == n.coordId {
+					n.lastHeartbeat = time.Now()
+				}
+			case CLCoordinator:
+				n.handleCoordinator(rcvd_msg)
+			}
+			n.lock.Unlock()
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+// -----
+// LOCK SERVER -- only used while this node is the coordinator. Must be called with the lock held.
+// -----
+
+// Grant the lock to the next request, if the lock is free.
+func (n *CentralNode) grantNext() {
+	if n.holder.nodeId != -1 || n.recovering || len(n.queue) == 0 {
+		return
+	}
+
+	n.holder = n.queue[0]
+	n.queue = n.queue[1:]
+	n.send(n.holder.nodeId, CLGrant, n.holder.timestamp, CLIdle)
+	log.Printf("[%d] - N%d: GRANT to N%d. Queue: %v", n.clock, n.nodeId, n.holder.nodeId, n.queue)
+}
+
+// Queue a request, unless it is already queued (e.g. in a STATE and a REQUEST to a new coordinator).
+func (n *CentralNode) enqueue(req pqueueElem) {
+	if n.holder == req {
+		return
+	}
+	for _, queued := range n.queue {
+		if queued == req {
+			return
+		}
+	}
+	n.queue = append(n.queue, req)
+}
+
+func (n *CentralNode) serverHandleRequest(msg CLMsg) {
+	if n.coordId != n.nodeId {
+		// The requester will send its request again in its STATE, once we announce ourselves
+		log.Printf("[%d] - N%d: Dropped REQUEST from N%d, not the coordinator.", n.clock, n.nodeId, msg.nodeId)
+		return
+	}
+
+	log.Printf("[%d] - N%d: Received REQUEST from N%d.", n.clock, n.nodeId, msg.nodeId)
+	n.enqueue(pqueueElem{msg.nodeId, msg.reqTimestamp})
+	n.grantNext()
+}
+
+func (n *CentralNode) serverHandleRelease(msg CLMsg) {
+	if n.coordId != n.nodeId || n.holder != (pqueueElem{msg.nodeId, msg.reqTimestamp}) {
+		log.Printf("[%d] - N%d: Received late RELEASE from N%d.", n.clock, n.nodeId, msg.nodeId)
+		return
+	}
+
+	log.Printf("[%d] - N%d: Received RELEASE from N%d.", n.clock, n.nodeId, msg.nodeId)
+	n.holder = pqueueElem{-1, ClockVal(-1)}
+	n.grantNext()
+}
+
+func (n *CentralNode) serverHandleWithdraw(msg CLMsg) {
+	req := pqueueElem{msg.nodeId, msg.reqTimestamp}
+	if n.coordId == n.nodeId && n.holder == req {
+		// The request was granted before it was withdrawn
+		n.serverHandleRelease(msg)
+		return
+	}
+
+	for i, queued := range n.queue {
+		if queued == req {
+			n.queue = append(n.queue[:i], n.queue[i+1:]...)
+			log.Printf("[%d] - N%d: Received WITHDRAW from N%d. Queue: %v", n.clock, n.nodeId, msg.nodeId, n.queue)
+			return
+		}
+	}
+}
+
+func (n *CentralNode) serverHandleState(msg CLMsg) {
+	if n.coordId != n.nodeId || !n.recovering {
+		return
+	}
+
+	log.Printf("[%d] - N%d: Received STATE %v from N%d.", n.clock, n.nodeId, getCLStatus(msg.status), msg.nodeId)
+	n.applyState(msg.nodeId, msg.status, msg.reqTimestamp)
+	n.reported[msg.nodeId] = true
+	for _, nodeId := range n.nodeIds {
+		if !n.dead[nodeId] && !n.reported[nodeId] {
+			return
+		}
+	}
+	n.finishRecovery()
+}
+
+func (n *CentralNode) applyState(nodeId int, status CLStatus, reqTimestamp ClockVal) {
+	switch status {
+	case CLHolding:
+		if n.holder.nodeId != -1 {
+			panic(fmt.Sprintf("N%d: N%d and N%d both hold the lock.", n.nodeId, n.holder.nodeId, nodeId))
+		}
+		n.holder = pqueueElem{nodeId, reqTimestamp}
+	case CLWaiting:
+		n.enqueue(pqueueElem{nodeId, reqTimestamp})
+	}
+}
+
+// Stop collecting STATEs, and start granting the lock.
+func (n *CentralNode) finishRecovery() {
+	n.recovering = false
+	sort.Slice(n.queue, func(i, j int) bool { return compareElems(n.queue[i], n.queue[j]) == -1 })
+	log.Printf("[%d] - N%d: Took over as coordinator. Holder: N%d, Queue: %v", n.clock, n.nodeId, n.holder.nodeId, n.queue)
+	n.grantNext()
+}
+
+// Take over from a dead coordinator, collecting every node's STATE.
+func (n *CentralNode) becomeCoordinator() {
+	n.holder = pqueueElem{-1, ClockVal(-1)}
+	n.queue = make([]pqueueElem, 0)
+	n.recovering = true
+	n.reported = make(map[int]bool)
+	n.recoveryDeadline = time.Now().Add(CENTRAL_COORD_TIMEOUT)
+
+	for _, nodeId := range n.nodeIds {
+		if nodeId != n.nodeId && !n.dead[nodeId] {
+			n.send(nodeId, CLCoordinator, ClockVal(-1), CLIdle)
+		}
+	}
+	log.Printf("[%d] - N%d: Announced itself as coordinator.", n.clock, n.nodeId)
+	status, reqTimestamp := n.status()
+	n.serverHandleState(CLMsg{n.nodeId, n.clock, reqTimestamp, CLState, status})
+}
+
+// -----
+// CLIENT
+// -----
+
+// Returns whether this node holds the lock or is waiting for it, with the timestamp of its request.
+// Must be called with the lock held.
+func (n *CentralNode) status() (CLStatus, ClockVal) {
+	if n.inCS {
+		return CLHolding, n.req_ts
+	} else if n.requesting {
+		return CLWaiting, n.req_ts
+	}
+	return CLIdle, ClockVal(-1)
+}
+
+func (n *CentralNode) handleGrant(msg CLMsg) {
+	if !n.requesting || msg.reqTimestamp != n.req_ts {
+		// Late GRANT for a withdrawn request -- the coordinator releases it when it receives our WITHDRAW
+		log.Printf("[%d] - N%d: Received late GRANT from N%d.", n.clock, n.nodeId, msg.nodeId)
+		return
+	}
+
+	n.requesting = false
+	n.inCS = true
+	n.acquired <- true
+}
+
+func (n *CentralNode) handleCoordinator(msg CLMsg) {
+	if msg.nodeId < n.coordId {
+		// Announcement from a coordinator we've already moved on from
+		return
+	}
+
+	for _, nodeId := range n.nodeIds {
+		if nodeId < msg.nodeId {
+			n.dead[nodeId] = true
+		}
+	}
+	n.coordId = msg.nodeId
+	n.lastHeartbeat = time.Now()
+	status, reqTimestamp := n.status()
+	n.send(msg.nodeId, CLState, reqTimestamp, status)
+	log.Printf("[%d] - N%d: N%d is the new coordinator. Sent STATE %v.", n.clock, n.nodeId, msg.nodeId, getCLStatus(status))
+}
+
+// Sends heartbeats while this node is the coordinator, and otherwise watches for the coordinator's heartbeats.
+func (n *CentralNode) monitor() {
+	ticker := time.NewTicker(CENTRAL_HEARTBEAT_INTV)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.lock.Lock()
+			if n.coordId == n.nodeId {
+				n.sendHeartbeats()
+				if n.recovering && time.Now().After(n.recoveryDeadline) {
+					n.finishRecovery()
+				}
+			} else if time.Since(n.lastHeartbeat) > CENTRAL_COORD_TIMEOUT {
+				log.Printf("[%d] - N%d: No HEARTBEAT from N%d, presumed dead.", n.clock, n.nodeId, n.coordId)
+				n.dead[n.coordId] = true
+				for _, nodeId := range n.nodeIds {
+					if !n.dead[nodeId] {
+						n.coordId = nodeId
+						break
+					}
+				}
+				n.lastHeartbeat = time.Now()
+				if n.coordId == n.nodeId {
+					n.becomeCoordinator()
+				}
+			}
+			n.lock.Unlock()
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+// Sends a heartbeat to every node. Heartbeats are dropped rather than block on a node that has stopped receiving.
+func (n *CentralNode) sendHeartbeats() {
+	n.clock++
+	for _, nodeId := range n.nodeIds {
+		if nodeId == n.nodeId || n.dead[nodeId] {
+			continue
+		}
+		select {
+		case n.allEndpoints[nodeId].recvChan <- CLMsg{n.nodeId, n.clock, ClockVal(-1), CLHeartbeat, CLIdle}:
+		default:
+		}
+	}
+}
+
+// Attempt to acquire the lock
+func (n *CentralNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	// Block until we can start an ongoing request
+	n.ongoingReqLock.Lock()
+
+	n.lock.Lock()
+	n.clock++
+	n.req_ts = n.clock
+	n.requesting = true
+	n.send(n.coordId, CLRequest, n.req_ts, CLIdle)
+	log.Printf("[%d] - N%d: Sent REQUEST to N%d.", n.clock, n.nodeId, n.coordId)
+	n.lock.Unlock()
+
+	// BLOCK until the coordinator grants the request
+	select {
+	case <-n.acquired:
+	case <-n.exit:
+		return 0, ErrShutdown // node was shut down
+	case <-ctx.Done():
+		n.withdraw()
+		return 0, ctx.Err()
+	}
+
+	n.lock.Lock()
+	n.clock++; token := FencingToken(n.clock)
+	log.Printf("[%d] - N%d: Lock acquired. Entering CS.", n.clock, n.nodeId)
+	n.lock.Unlock()
+	if err := n.smPtr.EnterCS(n.nodeId, token); err != nil { // (Simulated method of entering unsafe CS)
+		// Our token is later than the last holder's, unless mutual exclusion was already broken. Give up the lock, so the
+		// other nodes aren't held up.
+		n.release()
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+func (n *CentralNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+// Withdraw a request that was cancelled before entering the CS.
+func (n *CentralNode) withdraw() {
+	n.lock.Lock()
+	if n.inCS {
+		// The GRANT arrived as we were cancelled
+		<-n.acquired
+	}
+	n.requesting = false
+	n.inCS = false
+	n.send(n.coordId, CLWithdraw, n.req_ts, CLIdle)
+	log.Printf("[%d] - N%d: Request cancelled. Sent WITHDRAW to N%d.", n.clock, n.nodeId, n.coordId)
+	n.lock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Attempt to release the lock
+func (n *CentralNode) ReleaseLock() {
+	n.smPtr.ExitCS(n.nodeId) // (Simulated method of exiting unsafe CS)
+	n.release()
+}
+
+// Give up the lock, after exiting the CS or failing to enter it.
+func (n *CentralNode) release() {
+	n.lock.Lock()
+	n.inCS = false
+	n.send(n.coordId, CLRelease, n.req_ts, CLIdle)
+	log.Printf("[%d] - N%d: Lock released. Sent RELEASE to N%d.", n.clock, n.nodeId, n.coordId)
+	n.lock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Send a message about the request made at `reqTimestamp`. Must be called with the lock held.
+func (n *CentralNode) send(dstId int, action CLMsgAction, reqTimestamp ClockVal, status CLStatus) {
+	if _, ok := n.allEndpoints[dstId]; !ok {
+		panic(fmt.Sprintf("N%d: Tried to send %v to unknown endpoint with ID %d.", n.nodeId, getCLMsgAction(action), dstId))
+	}
+	n.clock++
+	n.allEndpoints[dstId].recvChan <- CLMsg{n.nodeId, n.clock, reqTimestamp, action, status}
+}
+
+// -----
+// HELPER STRUCTS
+// -----
+
+// Message used for inter-CentralNode communication.
+type CLMsg struct {
+	nodeId int
+	timestamp ClockVal
+	reqTimestamp ClockVal // Timestamp of the request the message is about
+	action CLMsgAction
+	status CLStatus // For a STATE
+}
+
+type CLMsgAction int
+const (
+	CLRequest CLMsgAction = iota
+	CLGrant
+	CLRelease
+	CLHeartbeat
+	CLCoordinator // Announces a new coordinator
+	CLState // Reply to a COORDINATOR
+	CLWithdraw // Cancels a REQUEST, releasing the lock if it was granted
+)
+
+func getCLMsgAction(action CLMsgAction) string {
+	switch action {
+	case CLRequest:
+		return "REQUEST"
+	case CLGrant:
+		return "GRANT"
+	case CLRelease:
+		return "RELEASE"
+	case CLHeartbeat:
+		return "HEARTBEAT"
+	case CLCoordinator:
+		return "COORDINATOR"
+	case CLState:
+		return "STATE"
+	case CLWithdraw:
+		return "WITHDRAW"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", action)
+	}
+}
+
+// What a node reports to a new coordinator in its STATE.
+type CLStatus int
+const (
+	CLIdle CLStatus = iota
+	CLWaiting
+	CLHolding
+)
+
+func getCLStatus(status CLStatus) string {
+	switch status {
+	case CLIdle:
+		return "IDLE"
+	case CLWaiting:
+		return "WAITING"
+	case CLHolding:
+		return "HOLDING"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", status)
+	}
+}
@@ -0,0 +1,79 @@
+package nodetypes
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+  FAILURE DETECTOR
+  Used by nodes created with a lease (e.g. NewLamportNodeWithLease). Each such node sends a HEARTBEAT to every other
+  node every LEASE_HEARTBEAT_INTV. A node that hears nothing from another node for LEASE_SUSPECT_TIMEOUT presumes it
+  crashed, removes it from its queues and vote sets, and ignores any message from it afterwards.
+  - Nodes don't recover, so a node presumed crashed stays that way.
+  - The timeout must be long enough that a live node is never presumed crashed, as it would then be shut out.
+
+  Leases cover holders that are alive: a node that stays in the CS for longer than its lease gives up the lock on its
+  own, and records the expiry in SharedMemory (see SharedMemory.ExpireLease).
+*/
+
+const LEASE_HEARTBEAT_INTV = 50 * time.Millisecond
+const LEASE_SUSPECT_TIMEOUT = 500 * time.Millisecond
+
+type failureDetector struct {
+	lock *sync.Mutex
+	lastHeard map[int]time.Time
+	crashed map[int]bool
+}
+
+// Returns a failureDetector watching `nodeIds`, except `selfId`.
+func newFailureDetector(nodeIds []int, selfId int) *failureDetector {
+	lastHeard := make(map[int]time.Time)
+	for _, nodeId := range nodeIds {
+		if nodeId != selfId {
+			lastHeard[nodeId] = time.Now()
+		}
+	}
+	return &failureDetector{&sync.Mutex{}, lastHeard, make(map[int]bool)}
+}
+
+// Restarts every timeout, e.g. when the node starts.
+func (d *failureDetector) Reset() {
+	d.lock.Lock(); defer d.lock.Unlock()
+	for nodeId := range d.lastHeard {
+		d.lastHeard[nodeId] = time.Now()
+	}
+}
+
+// Records that we've heard from `nodeId`.
+func (d *failureDetector) Heard(nodeId int) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock(); defer d.lock.Unlock()
+	if _, ok := d.lastHeard[nodeId]; ok {
+		d.lastHeard[nodeId] = time.Now()
+	}
+}
+
+// Returns true if `nodeId` is presumed crashed. A nil failureDetector (i.e. a node without a lease) presumes nothing.
+func (d *failureDetector) Crashed(nodeId int) bool {
+	if d == nil {
+		return false
+	}
+	d.lock.Lock(); defer d.lock.Unlock()
+	return d.crashed[nodeId]
+}
+
+// Returns the nodes that have timed out since the last call, and presumes them crashed.
+func (d *failureDetector) Check() []int {
+	d.lock.Lock(); defer d.lock.Unlock()
+	ret := make([]int, 0)
+	for nodeId, lastHeard := range d.lastHeard {
+		if !d.crashed[nodeId] && time.Since(lastHeard) > LEASE_SUSPECT_TIMEOUT {
+			d.crashed[nodeId] = true
+			ret = append(ret, nodeId)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,427 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Lamport's Shared Priority Queue, run separately for every named resource (see LockManager.go)
+type LamportLockManager struct {
+	// Basic Setup
+	nodeId int
+	rmPtr *ResourceMemory
+	endpoint LamportLockManagerEndpoint
+	allEndpoints map[int]LamportLockManagerEndpoint
+
+	// Exit Details
+	exit chan bool // Closed on Shutdown
+
+	// Variables for tracking resources
+	resourcesLock *sync.Mutex // Lock to modify resources, waiting, probeSeq and probed
+	resources map[string]*llmResource
+	waiting int // Number of our requests waiting to enter the CS
+	probeSeq int // Sequence number of the last PROBE we started
+	probed map[llmProbe]bool // PROBEs we've already passed on while waiting, so we don't pass them on again
+}
+
+// A resource's Lamport state, like a LamportNode's
+type llmResource struct {
+	name string
+	lock *sync.Mutex // Lock to modify everything below
+	clock ClockVal
+	hasOngoingReq bool
+	lastReqTimestamp ClockVal // timestamp of this node's most recent request
+	inCS bool
+	deadlocked bool // True once a PROBE for our ongoing request comes back
+	req_acks map[int]bool // Nodes that acknowledged our request. Reset when a new request starts
+	queue *pqueue // Every node's requests, including ours
+	wake chan bool // Signalled when our request may be able to enter the CS, or is deadlocked, see signalEntry
+}
+
+// Identifies a PROBE, and the request it was started for
+type llmProbe struct {
+	initiator int
+	seq int
+	resource string
+	reqTimestamp ClockVal
+}
+
+func NewLamportLockManager(nodeId int, endpoints []LamportLockManagerEndpoint, rm *ResourceMemory) *LamportLockManager {
+	// Loop through endpoints and get self endpoint
+	if len(endpoints) == 0 {
+		panic("No endpoints given.")
+	}
+
+	endpointMap := make(map[int]LamportLockManagerEndpoint, 0)
+	myEndpoint := endpoints[0]
+	for _, endpoint := range(endpoints) {
+		if endpoint.nodeId == nodeId {
+			myEndpoint = endpoint
+		}
+		endpointMap[endpoint.nodeId] = endpoint
+	}
+	return &LamportLockManager{
+		nodeId, rm, myEndpoint, endpointMap,
+		make(chan bool),
+		&sync.Mutex{}, make(map[string]*llmResource), 0, 0, make(map[llmProbe]bool),
+	}
+}
+
+func (n *LamportLockManager) Init() error {
+	go n.handleMsg()
+	return nil
+}
+
+func (n *LamportLockManager) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	n.resourcesLock.Lock(); defer n.resourcesLock.Unlock()
+	select {
+	case <-n.exit:
+	default:
+		close(n.exit)
+	}
+	return nil
+}
+
+// Returns resource `name`'s state, creating it when first used.
+func (n *LamportLockManager) getResource(name string) *llmResource {
+	n.resourcesLock.Lock(); defer n.resourcesLock.Unlock()
+	r, ok := n.resources[name]
+	if !ok {
+		r = &llmResource{name, &sync.Mutex{}, ClockVal(0), false, ClockVal(-1), false, false, make(map[int]bool), newPQueue(), make(chan bool, 1)}
+		n.resources[name] = r
+	}
+	return r
+}
+
+// Send a message about the request for `resource` made at `reqTimestamp`. Responsibility for updating clock is on the
+// caller.
+func (n *LamportLockManager) send(dstId int, resource string, action LLMMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
+	n.deliver(dstId, LLMMsg{n.nodeId, resource, timestamp, reqTimestamp, action, llmProbe{}})
+}
+
+// Send a PROBE, saying our request for `resource` made at `reqTimestamp` is waiting on `dstId`'s.
+func (n *LamportLockManager) sendProbe(dstId int, resource string, timestamp ClockVal, reqTimestamp ClockVal, probe llmProbe) {
+	n.deliver(dstId, LLMMsg{n.nodeId, resource, timestamp, reqTimestamp, LLMProbe, probe})
+}
+
+func (n *LamportLockManager) deliver(dstId int, msg LLMMsg) {
+	if dstId == n.nodeId {
+		panic("Attempted to send message to self")
+	} else if _, ok := n.allEndpoints[dstId]; !ok {
+		panic(fmt.Sprintf("N%d: Unknown endpoint with ID %d.", n.nodeId, dstId))
+	}
+	n.allEndpoints[dstId].recvChan <- msg
+}
+
+func (n *LamportLockManager) broadcast(resource string, action LLMMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
+	for dstId := range(n.allEndpoints) {
+		if dstId != n.nodeId {
+			n.send(dstId, resource, action, timestamp, reqTimestamp)
+		}
+	}
+}
+
+func (n *LamportLockManager) handleMsg() {
+	for {
+		select {
+		case rcvd_msg, ok := <-n.endpoint.recvChan:
+			if !ok {
+				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
+			}
+			r := n.getResource(rcvd_msg.resource)
+
+			// The queue is updated here, so a REQ_ACK can't be handled before an earlier REQUEST from the same node, and
+			// a RELEASE or WITHDRAW can't be handled before the REQUEST it removes. Only PROBEs, which may have to wait
+			// on other resources, go to a separate goroutine.
+			switch rcvd_msg.action {
+			case LLMRequest: // REQUEST
+				n.handleRequest(r, rcvd_msg)
+			case LLMReqAck: // REQ_ACK
+				n.handleReqAck(r, rcvd_msg)
+			case LLMRelease, LLMWithdraw: // RELEASE or WITHDRAW
+				n.handleRelease(r, rcvd_msg)
+			case LLMProbe: // PROBE
+				go n.handleProbe(r, rcvd_msg)
+			}
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+func (n *LamportLockManager) handleRequest(r *llmResource, rcvd_msg LLMMsg) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+
+	// Queue the request and acknowledge it straight away. It only goes first if it is at the head of every queue.
+	r.queue.Insert(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+	r.clock++
+	n.send(rcvd_msg.nodeId, r.name, LLMReqAck, r.clock, rcvd_msg.reqTimestamp)
+}
+
+func (n *LamportLockManager) handleReqAck(r *llmResource, rcvd_msg LLMMsg) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+
+	// Only handle REQ_ACK if it is for our ongoing request
+	if !r.hasOngoingReq || rcvd_msg.reqTimestamp != r.lastReqTimestamp {
+		log.Printf("N%d: Received late REQ_ACK for %q from %d", n.nodeId, r.name, rcvd_msg.nodeId)
+		return
+	}
+	if r.req_acks[rcvd_msg.nodeId] {
+		panic(fmt.Sprintf("N%d: Received a second REQ_ACK for %q from %d", n.nodeId, r.name, rcvd_msg.nodeId))
+	}
+	r.req_acks[rcvd_msg.nodeId] = true
+	r.signalEntry()
+}
+
+// Handle a released or withdrawn request, which no longer holds up the requests behind it.
+func (n *LamportLockManager) handleRelease(r *llmResource, rcvd_msg LLMMsg) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+	r.queue.Remove(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+	r.signalEntry()
+}
+
+// Handle a PROBE from a node whose request for `r` is queued behind ours.
+func (n *LamportLockManager) handleProbe(r *llmResource, rcvd_msg LLMMsg) {
+	// Only pass it on if we're why the sender is waiting, i.e. our ongoing request goes first. Otherwise our request
+	// was released or withdrawn, and the sender will hear of it.
+	r.lock.Lock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+	ours := pqueueElem{n.nodeId, r.lastReqTimestamp}
+	theirs := pqueueElem{rcvd_msg.nodeId, rcvd_msg.reqTimestamp}
+	ahead := r.hasOngoingReq && compareElems(ours, theirs) == -1
+	r.lock.Unlock()
+	if !ahead {
+		return
+	}
+
+	probe := rcvd_msg.probe
+	if probe.initiator == n.nodeId {
+		// The PROBE came back. If we're still waiting on the request we started it for, we're deadlocked.
+		initR := n.getResource(probe.resource)
+		initR.lock.Lock(); defer initR.lock.Unlock()
+		if initR.hasOngoingReq && !initR.inCS && initR.lastReqTimestamp == probe.reqTimestamp {
+			initR.deadlocked = true
+			initR.signalEntry()
+			log.Printf("N%d: %d: Deadlock detected on %q. Via: N%d", n.nodeId, initR.clock, initR.name, rcvd_msg.nodeId)
+		}
+		return
+	}
+
+	n.resourcesLock.Lock()
+	if n.waiting == 0 || n.probed[probe] {
+		// Not waiting on anything to pass it on along, or passed on already
+		n.resourcesLock.Unlock()
+		return
+	}
+	n.probed[probe] = true
+	resources := make([]*llmResource, 0, len(n.resources))
+	for _, res := range n.resources {
+		resources = append(resources, res)
+	}
+	n.resourcesLock.Unlock()
+
+	// Pass it on along every request we're waiting on
+	for _, res := range resources {
+		n.probeWaitingOn(res, probe)
+	}
+}
+
+// Send `probe` to every node whose request for `r` is queued ahead of ours, if we're waiting on one.
+func (n *LamportLockManager) probeWaitingOn(r *llmResource, probe llmProbe) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	if !r.hasOngoingReq || r.inCS {
+		return
+	}
+	r.clock++
+	for _, elem := range r.queue.Elems() {
+		if elem.nodeId == n.nodeId {
+			break
+		}
+		n.sendProbe(elem.nodeId, r.name, r.clock, r.lastReqTimestamp, probe)
+	}
+}
+
+// Start a PROBE for our request for `r` (see LockManager.go).
+func (n *LamportLockManager) startProbe(r *llmResource) {
+	r.lock.Lock()
+	reqTimestamp := r.lastReqTimestamp
+	r.lock.Unlock()
+
+	n.resourcesLock.Lock()
+	n.probeSeq++
+	probe := llmProbe{n.nodeId, n.probeSeq, r.name, reqTimestamp}
+	n.probed[probe] = true
+	n.resourcesLock.Unlock()
+	n.probeWaitingOn(r, probe)
+}
+
+func (n *LamportLockManager) AcquireLock(ctx context.Context, name string) (FencingToken, error) {
+	r := n.getResource(name)
+
+	// Make a request with timestamp, add it to the queue and broadcast it
+	r.lock.Lock()
+	if r.hasOngoingReq {
+		r.lock.Unlock()
+		return 0, ErrAlreadyRequested
+	}
+	r.hasOngoingReq = true
+	r.deadlocked = false
+	r.clock++
+	req_timestamp := r.clock
+	r.lastReqTimestamp = req_timestamp
+	r.req_acks = map[int]bool{n.nodeId: true} // We acknowledge ourselves <3
+	r.queue.Insert(n.nodeId, req_timestamp)
+	n.broadcast(name, LLMRequest, req_timestamp, req_timestamp)
+	r.lock.Unlock()
+	n.resourcesLock.Lock(); n.waiting++; n.resourcesLock.Unlock()
+
+	// Block until every node acknowledged our request AND it is at the head of the queue, probing for deadlocks while
+	// we wait
+	probeTimer := time.NewTimer(DEADLOCK_PROBE_INTV)
+	defer probeTimer.Stop()
+	for {
+		entered, deadlocked := n.tryEnter(r)
+		if entered {
+			n.stopWaiting(r, req_timestamp)
+			break
+		} else if deadlocked {
+			n.withdraw(r)
+			n.stopWaiting(r, req_timestamp)
+			return 0, ErrDeadlock
+		}
+		select {
+		case <-r.wake:
+		case <-probeTimer.C:
+			n.startProbe(r)
+			probeTimer.Reset(DEADLOCK_PROBE_INTV)
+		case <-n.exit:
+			return 0, ErrShutdown // node was shut down
+		case <-ctx.Done():
+			n.withdraw(r)
+			n.stopWaiting(r, req_timestamp)
+			return 0, ctx.Err()
+		}
+	}
+
+	// Enter the CS, using the resource's current time rather than the request's as our fencing token
+	r.lock.Lock(); r.clock++; token := FencingToken(r.clock); r.lock.Unlock()
+	log.Printf("N%d: %d: Lock %q acquired. Entering CS. Queue: %v", n.nodeId, token, name, r.queue.contents)
+	if err := n.rmPtr.Get(name).EnterCS(n.nodeId, token); err != nil {
+		// Our token is later than the last holder's, unless mutual exclusion was already broken. Give up the lock, so
+		// the other nodes aren't held up.
+		n.release(r)
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+// Wake up AcquireLock to check whether our request for `r` can enter the CS, or is deadlocked. Never blocks: a signal
+// that isn't waited on yet is kept for the next check.
+func (r *llmResource) signalEntry() {
+	select {
+	case r.wake <- true:
+	default:
+	}
+}
+
+// Stop waiting on our request for `r` made at `reqTimestamp`, once it is granted or withdrawn. Forgets the PROBEs we
+// started for it, and once we aren't waiting on any request, the PROBEs we passed on too.
+func (n *LamportLockManager) stopWaiting(r *llmResource, reqTimestamp ClockVal) {
+	n.resourcesLock.Lock(); defer n.resourcesLock.Unlock()
+	n.waiting--
+	for probe := range n.probed {
+		if n.waiting == 0 || (probe.initiator == n.nodeId && probe.resource == r.name && probe.reqTimestamp == reqTimestamp) {
+			delete(n.probed, probe)
+		}
+	}
+}
+
+// Marks our request for `r` as in the CS if every node acknowledged it and it is at the head of the queue. Otherwise,
+// returns whether it is deadlocked.
+func (n *LamportLockManager) tryEnter(r *llmResource) (entered bool, deadlocked bool) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	if r.deadlocked {
+		return false, true
+	}
+	if len(r.req_acks) < len(n.allEndpoints) {
+		return false, false
+	}
+	elems := r.queue.Elems()
+	if len(elems) == 0 || elems[0] != (pqueueElem{n.nodeId, r.lastReqTimestamp}) {
+		return false, false
+	}
+	r.inCS = true
+	return true, false
+}
+
+func (n *LamportLockManager) ReleaseLock(name string) {
+	r := n.getResource(name)
+
+	// Exit the CS
+	n.rmPtr.Get(name).ExitCS(n.nodeId)
+	n.release(r)
+}
+
+// Give up the lock on `r`, after exiting the CS or failing to enter it.
+func (n *LamportLockManager) release(r *llmResource) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	log.Printf("N%d: %d: Exiting CS. Lock %q Released. Queue: %v", n.nodeId, r.clock, r.name, r.queue.contents)
+	n.completeRequest(r, LLMRelease)
+}
+
+// Withdraw a request that was cancelled, or deadlocked, before entering the CS.
+func (n *LamportLockManager) withdraw(r *llmResource) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	log.Printf("N%d: %d: Withdrew request %d for %q. Queue: %v", n.nodeId, r.clock, r.lastReqTimestamp, r.name, r.queue.contents)
+	n.completeRequest(r, LLMWithdraw)
+}
+
+// Remove our request from every queue with `action` (RELEASE or WITHDRAW), and mark it as completed. Must be called
+// with r.lock held.
+func (n *LamportLockManager) completeRequest(r *llmResource, action LLMMsgAction) {
+	r.queue.Remove(n.nodeId, r.lastReqTimestamp)
+	r.clock++
+	n.broadcast(r.name, action, r.clock, r.lastReqTimestamp)
+
+	// Request is completed
+	r.hasOngoingReq = false
+	r.inCS = false
+}
+
+
+type LLMMsgAction int
+const (
+	LLMRequest LLMMsgAction = iota
+	LLMRelease
+	LLMReqAck
+	LLMWithdraw // Removes a cancelled request from the queue
+	LLMProbe // Deadlock detection, see LockManager.go
+)
+
+type LLMMsg struct {
+	nodeId int
+	resource string // Name of the lock this message is about
+	timestamp ClockVal // Sender's clock for `resource`
+	reqTimestamp ClockVal // Timestamp of the request being acknowledged, released, withdrawn or probed
+	action LLMMsgAction
+	probe llmProbe // Only set for PROBE
+}
+
+type LamportLockManagerEndpoint struct {
+	nodeId int
+	recvChan chan LLMMsg
+}
+
+func NewLamportLockManagerEndpoint(nodeId int) LamportLockManagerEndpoint {
+	return LamportLockManagerEndpoint{
+		nodeId,
+		make(chan LLMMsg, 10000),
+	}
+}
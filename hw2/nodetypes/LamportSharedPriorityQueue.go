@@ -1,9 +1,11 @@
 package nodetypes
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 type LSPQMsgAction int
@@ -11,12 +13,16 @@ const (
 	LSPQRequest LSPQMsgAction = iota
 	LSPQRelease
 	LSPQReqAck
+	LSPQWithdraw // Removes a cancelled request from the queue
+	LSPQHeartbeat // Only sent by nodes with a lease, see FailureDetector.go
 )
 
 type LSPQMsg struct {
 	nodeId int
 	timestamp ClockVal
+	reqTimestamp ClockVal // Timestamp of the request being released, acknowledged or withdrawn
 	action LSPQMsgAction
+	mode LockMode // Mode of the sender's latest request, which only matters for REQUEST
 }
 
 type LamportNodeEndpoint struct {
@@ -40,16 +46,46 @@ type LamportNode struct {
 	endpoint LamportNodeEndpoint
 	allEndpoints map[int]LamportNodeEndpoint
 	nodeCount int
-	req_ack_lock *sync.Mutex // Lock to modify req_ack_count
-	req_ack_count int // Reset to 0 when a new request starts
+	req_ack_lock *sync.Mutex // Lock to modify req_acks
+	req_acks map[int]bool // Nodes that acknowledged our request. Reset when a new request starts
+	pending bool // True while pendingReq is locked. Protected by req_ack_lock
 	lastReqTimestamp ClockVal
 	ongoingReq *sync.Mutex // Locked while the request is ONGOING, i.e. not complete
 	pendingReq *sync.Mutex // Locked while the request is PENDING, i.e. not fully responded to
 	exit chan bool
 	exited bool
+	wake chan bool // Signalled when our request may be able to enter the CS, see signalEntry
+
+	// Fault tolerance, only used by nodes with a lease
+	lease time.Duration // How long the node may stay in the CS. 0 if the node has no lease
+	detector *failureDetector // nil if the node has no lease
+	crashed chan int // Nodes presumed crashed, handled by handleMsg
+	monitorExit chan bool
+	leaseLock *sync.Mutex // Lock to modify holding and leaseTimer
+	holding bool // True while in the CS with a lease that hasn't expired
+	leaseTimer *time.Timer
+
+	// Reader-writer locking, see ReaderWriter.go
+	policy RWPolicy
+	reqMode LockMode // Mode of our latest request
+	entryLock *sync.Mutex // Lock to decide whether to enter the CS, or to hold back a REQ_ACK because we're in it
+	modes map[int]LockMode // Mode of each node's queued request. Protected by entryLock
+	inCS bool // Protected by entryLock
+	deferred []LSPQMsg // REQUESTs to acknowledge once we leave the CS. Protected by entryLock
 }
 
 func NewLamportNode(nodeId int, endpoints []LamportNodeEndpoint, sm *SharedMemory) *LamportNode {
+	return NewLamportNodeWithLease(nodeId, endpoints, sm, 0)
+}
+
+// Like NewLamportNode, but the node gives up the lock if it stays in the CS for longer than `lease`, and recovers from
+// other nodes crashing (see FailureDetector.go). A lease of 0 disables both.
+func NewLamportNodeWithLease(nodeId int, endpoints []LamportNodeEndpoint, sm *SharedMemory, lease time.Duration) *LamportNode {
+	return NewLamportNodeWithPolicy(nodeId, endpoints, sm, RWFair, lease)
+}
+
+// Like NewLamportNodeWithLease, but conflicting shared and exclusive requests go in the order set by `policy`.
+func NewLamportNodeWithPolicy(nodeId int, endpoints []LamportNodeEndpoint, sm *SharedMemory, policy RWPolicy, lease time.Duration) *LamportNode {
 	// Loop through endpoints and get self endpoint
 	if len(endpoints) == 0 {
 		panic("No endpoints given.")
@@ -65,33 +101,60 @@ func NewLamportNode(nodeId int, endpoints []LamportNodeEndpoint, sm *SharedMemor
 		nodeIds = append(nodeIds, endpoint.nodeId)
 		endpointMap[endpoint.nodeId] = endpoint
 	}
+	var detector *failureDetector
+	if lease > 0 {
+		detector = newFailureDetector(nodeIds, nodeId)
+	}
 	return &LamportNode{
 		nodeId, ClockVal(0), &sync.Mutex{}, sm, newPQueue(),
 		myEndpoint, endpointMap, len(endpoints),
-		&sync.Mutex{}, 0, ClockVal(0),
+		&sync.Mutex{}, make(map[int]bool), false, ClockVal(0),
 		&sync.Mutex{}, &sync.Mutex{},
-		make(chan bool), false}
+		make(chan bool), false, make(chan bool, 1),
+		lease, detector, make(chan int, len(endpoints)), make(chan bool), &sync.Mutex{}, false, nil,
+		policy, Exclusive, &sync.Mutex{}, make(map[int]LockMode), false, make([]LSPQMsg, 0)}
 }
 
 func (n *LamportNode) Init() error {
 	//log.Printf("N%d: Initialised.", n.nodeId)
 	go n.handleMsg()
+	if n.detector != nil {
+		n.detector.Reset()
+		go n.monitor()
+	}
 	return nil
 }
 
 func (n *LamportNode) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	if n.exited {
+		return nil
+	}
 	n.exit <- true
 	n.exited = true
+	n.signalEntry() // Wake up any AcquireLock, so it returns ErrShutdown
+	if n.detector != nil {
+		n.monitorExit <- true
+	}
+
+	// A crashed node can't give up its lease. The other nodes expire it once they presume it crashed.
+	n.leaseLock.Lock()
+	if n.leaseTimer != nil {
+		n.leaseTimer.Stop()
+	}
+	n.leaseLock.Unlock()
 	return nil
 }
 
-// Send a message. Responsibility for updating clock is on the caller.
-func (n *LamportNode) send(dstId int, action LSPQMsgAction, timestamp ClockVal) {
+// Send a message about the request made at `reqTimestamp`. Responsibility for updating clock is on the caller.
+func (n *LamportNode) send(dstId int, action LSPQMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
 	// Build message
 	msg := LSPQMsg{
 		n.nodeId,
 		timestamp,
+		reqTimestamp,
 		action,
+		n.reqMode,
 	}
 
 	// Send the message
@@ -110,6 +173,12 @@ func (n *LamportNode) handleMsg() {
 			if !ok {
 				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
 			}
+			// Ignore nodes presumed crashed, as we've already removed their requests
+			if n.detector.Crashed(rcvd_msg.nodeId) {
+				continue
+			}
+			n.detector.Heard(rcvd_msg.nodeId)
+
 			// Update local clock to be elementwise max + 1
 			n.clockLock.Lock()
 			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
@@ -117,14 +186,25 @@ func (n *LamportNode) handleMsg() {
 			
 			// We want to throw these messages to separate goroutines ASAP so we don't block the next send if any
 			// WARNING: This would cause race conditions if the variables being modified don't have locks.
+			// The queue is updated here though, so a WITHDRAW can't be handled before the REQUEST it withdraws.
 			switch rcvd_msg.action {
-			case 0: // REQUEST
+			case LSPQRequest:
+				n.entryLock.Lock()
+				n.modes[rcvd_msg.nodeId] = rcvd_msg.mode
+				n.queue.Insert(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+				n.entryLock.Unlock()
 				go n.handleRequest(rcvd_msg)
-			case 1: // RELEASE
-				go n.handleRelease(rcvd_msg)
-			case 2: // REQ_ACK
+			case LSPQRelease:
+				n.handleRelease(rcvd_msg)
+			case LSPQReqAck:
 				go n.handleReqAck(rcvd_msg)
+			case LSPQWithdraw:
+				n.queue.Remove(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+				n.signalEntry()
 			}
+		case nodeId := <-n.crashed:
+			// Handled here, so a REQUEST from the crashed node can't be queued after its requests are removed
+			n.handleCrash(nodeId)
 		case <-n.exit:
 			return
 		}
@@ -132,81 +212,150 @@ func (n *LamportNode) handleMsg() {
 }
 
 func (n *LamportNode) handleRequest(rcvd_msg LSPQMsg) {
-	// Add request to queue
-	n.queue.Insert(rcvd_msg.nodeId, rcvd_msg.timestamp)
+	// Unless requests go in timestamp order, a later request may go before ours after we've entered the CS, as we
+	// didn't know of it. We hold back its REQ_ACK until we leave, so it can't enter while we're inside.
+	if n.policy != RWFair {
+		n.entryLock.Lock()
+		if n.inCS && conflicts(n.reqMode, rcvd_msg.mode) {
+			n.deferred = append(n.deferred, rcvd_msg)
+			n.entryLock.Unlock()
+			return
+		}
+		n.entryLock.Unlock()
+	}
 
-	// Respond if we have no EARLIER outstanding requests
+	// Respond if we have no outstanding requests that go FIRST
 	// 1. Check for ongoing requests by obtaining the lock.
 	if !n.ongoingReq.TryLock() {
 		// Didn't get the lock -- we HAVE an ongoing request
-		if n.lastReqTimestamp > rcvd_msg.timestamp {
-			// OUR request is LATER, ACK the req and return
+		ours := rwRequest{n.nodeId, n.lastReqTimestamp, n.reqMode}
+		theirs := rwRequest{rcvd_msg.nodeId, rcvd_msg.reqTimestamp, rcvd_msg.mode}
+		if !conflicts(ours.mode, theirs.mode) || !n.policy.precedes(ours, theirs) {
+			// OUR request doesn't conflict, or goes LATER (see ReaderWriter.go). ACK the req and return
 			n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
-			n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock)
+			n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
 			return
-		} else if n.lastReqTimestamp == rcvd_msg.timestamp {
-			// Requests are CONCURRENT
-			// Break tie with nodeId, LOWER ID is prioritised
-			if n.nodeId > rcvd_msg.nodeId {
-				n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
-				n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock)
-				return
-			}
 		}
 
-		// Our request is EARLIER. Block until it is no longer PENDING.
+		// Our request goes FIRST. Block until it is no longer PENDING.
 		n.pendingReq.Lock()
 		// Respond with REQ_ACK AFTER it's no longer PENDING
 		n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
-		n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock)
+		n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
 		n.pendingReq.Unlock()
 	} else {
 		// We DON'T have an ongoing request at all
 		// Respond with REQ_ACK
 		n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
-		n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock)
+		n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
 		n.ongoingReq.Unlock()
 	}
 }
 
 func (n *LamportNode) handleRelease(rcvd_msg LSPQMsg) {
-	// Pop head of queue.
-	n.queue.Extract()
+	// Remove the released request. It is the head of the queue, unless a withdrawn request ahead of it hasn't been
+	// removed yet.
+	n.queue.Remove(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+	n.signalEntry()
 }
 
 func (n *LamportNode) handleReqAck(rcvd_msg LSPQMsg) {
-	// Only handle REQ_ACK if we have an ongoing request
-	if n.ongoingReq.TryLock() {
+	n.req_ack_lock.Lock(); defer n.req_ack_lock.Unlock() // Need to lock, otherwise we might have a race condition when two REQ_ACKs come in.
+
+	// Only handle REQ_ACK if it is for our pending request
+	if !n.pending || rcvd_msg.reqTimestamp != n.lastReqTimestamp {
 		log.Printf("N%d: Received late REQ_ACK from %d", n.nodeId, rcvd_msg.nodeId)
-		n.ongoingReq.Unlock()
 		return
 	}
+	if n.req_acks[rcvd_msg.nodeId] {
+		panic(fmt.Sprintf("N%d: Received a second REQ_ACK from %d", n.nodeId, rcvd_msg.nodeId))
+	}
+	n.req_acks[rcvd_msg.nodeId] = true
+	n.checkReqAcks()
+}
 
-	n.req_ack_lock.Lock(); defer n.req_ack_lock.Unlock() // Need to lock, otherwise we might have a race condition when two REQ_ACKs come in.
-	n.req_ack_count += 1
+// If every node that hasn't crashed acknowledged our request, we recognise the request as no longer pending.
+// The only blocker is now if the request is at the HEAD. Must be called with req_ack_lock held.
+func (n *LamportNode) checkReqAcks() {
+	if !n.pending {
+		return
+	}
+	for nodeId := range n.allEndpoints {
+		if !n.req_acks[nodeId] && !n.detector.Crashed(nodeId) {
+			return
+		}
+	}
+	log.Printf("N%d: %d: Request no longer PENDING.", n.nodeId, n.clock)
+	n.pending = false
+	n.pendingReq.Unlock()
+	n.signalEntry()
+}
 
-	// If request has required number, we recognise the request as no longer pending
-	// The only blocker is now if the request is at the HEAD
-	if n.req_ack_count == n.nodeCount {
-		log.Printf("N%d: %d: Request no longer PENDING.", n.nodeId, n.clock)
-		n.pendingReq.Unlock()
-	} else if n.req_ack_count > n.nodeCount {
-		panic(fmt.Sprintf("N%d: Has %d REQ_ACKs, expected %d", n.nodeId, n.req_ack_count, n.nodeCount))
+// Handle a node presumed crashed: remove its requests, and stop waiting for it to acknowledge ours. If it crashed in
+// the CS, its lease is expired, which we merge into our clock like a message's timestamp.
+func (n *LamportNode) handleCrash(nodeId int) {
+	n.queue.RemoveNode(nodeId)
+	n.signalEntry()
+	n.clockLock.Lock()
+	n.clock = MaxClockVal(n.clock, n.smPtr.ExpireLease(nodeId, n.clock)) + 1
+	n.clockLock.Unlock()
+	log.Printf("N%d: %d: N%d presumed crashed. Queue: %v", n.nodeId, n.clock, nodeId, n.queue.contents)
+
+	n.req_ack_lock.Lock()
+	n.checkReqAcks()
+	n.req_ack_lock.Unlock()
+}
+
+// Send a HEARTBEAT to every node not presumed crashed, and report the nodes we've stopped hearing from to handleMsg.
+func (n *LamportNode) monitor() {
+	ticker := time.NewTicker(LEASE_HEARTBEAT_INTV)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.clockLock.Lock(); timestamp := n.clock; n.clockLock.Unlock()
+			for dstId, endpoint := range n.allEndpoints {
+				if dstId == n.nodeId || n.detector.Crashed(dstId) {
+					continue
+				}
+				select {
+				case endpoint.recvChan <- LSPQMsg{n.nodeId, timestamp, ClockVal(-1), LSPQHeartbeat, Exclusive}:
+				default: // Don't block on a node that has stopped receiving
+				}
+			}
+			for _, nodeId := range n.detector.Check() {
+				n.crashed <- nodeId
+			}
+		case <-n.monitorExit:
+			return
+		}
 	}
 }
 
 
 
-func (n *LamportNode) broadcast(action LSPQMsgAction, timestamp ClockVal) {
+func (n *LamportNode) broadcast(action LSPQMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
 	for dstId := range(n.allEndpoints) {
-		if dstId != n.nodeId {
-			n.send(dstId, action, timestamp)
+		if dstId != n.nodeId && !n.detector.Crashed(dstId) {
+			n.send(dstId, action, timestamp, reqTimestamp)
 		}
 	}
 }	
 
 
-func (n *LamportNode) AcquireLock() {
+func (n *LamportNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	return n.acquire(ctx, Exclusive)
+}
+
+func (n *LamportNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+func (n *LamportNode) AcquireSharedLock(ctx context.Context) (FencingToken, error) {
+	return n.acquire(ctx, Shared)
+}
+
+func (n *LamportNode) acquire(ctx context.Context, mode LockMode) (FencingToken, error) {
 	// Block until we can obtain an ongoing request lock.
 	n.ongoingReq.Lock()
 	//log.Printf("N%d: %d: Proceeding with request.", n.nodeId, n.clock)
@@ -214,46 +363,188 @@ func (n *LamportNode) AcquireLock() {
 	// Make a request with timestamp, and add req to queue
 	n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
 	req_timestamp := n.clock
+	n.entryLock.Lock()
+	n.reqMode = mode
 	n.lastReqTimestamp = req_timestamp
+	n.modes[n.nodeId] = mode
 	n.queue.Insert(n.nodeId, req_timestamp)
+	n.entryLock.Unlock()
 	
 	n.pendingReq.Lock()
 
 	// Reset value of REQ_ACKs for current request
 	n.req_ack_lock.Lock()
-	n.req_ack_count = 1 // We acknowledge ourselves <3
+	n.req_acks = map[int]bool{n.nodeId: true} // We acknowledge ourselves <3
+	n.pending = true
 	n.req_ack_lock.Unlock();
 
 	// BROADCAST REQUEST
-	n.broadcast(LSPQRequest, req_timestamp)
+	n.broadcast(LSPQRequest, req_timestamp, req_timestamp)
 
 	// Indicate that the request is now PENDING
 	//log.Printf("N%d: %d: Broadcasted request to enter", n.nodeId, req_timestamp)
 
-	// Block until we've received responses from all nodes AND request is at head of queue
-	for (n.req_ack_count < n.nodeCount || n.queue.Peek() != n.nodeId) {
+	// Block until we've received responses from all nodes AND no conflicting request in the queue goes first
+	for !n.tryEnter() {
 		if n.exited {
-			return
+			return 0, ErrShutdown
+		}
+		select {
+		case <-n.wake:
+		case <-ctx.Done():
+			n.withdraw(req_timestamp)
+			return 0, ctx.Err()
 		}
 	}
 	log.Printf("N%d: %d: Lock acquired. Entering CS. Queue: %v", n.nodeId, n.clock, n.queue.contents)
 
-	// Enter the CS
-	n.smPtr.EnterCS(n.nodeId, req_timestamp)
+	// Enter the CS, using the current time rather than the request's as our fencing token
+	n.clockLock.Lock(); n.clock++; token := FencingToken(n.clock); n.clockLock.Unlock()
+	// The lease runs from when we're granted the lock, so it also expires if we're paused before entering
+	n.startLease()
+	enterCS := n.smPtr.EnterCS
+	if mode == Shared {
+		enterCS = n.smPtr.EnterCSShared
+	}
+	if err := enterCS(n.nodeId, token); err != nil {
+		// Our token is later than the last holder's, unless our lease expired before we could enter (e.g. we were
+		// paused) and the lock has moved on. Give up the lock, unless the expiry already has.
+		if n.stopLease() {
+			n.release()
+		}
+		n.ongoingReq.Unlock()
+		return 0, enterError(n.nodeId, token, err)
+	}
 
 	// Request is completed
 	n.ongoingReq.Unlock()
+	return token, nil
+}
+
+func (n *LamportNode) isPending() bool {
+	n.req_ack_lock.Lock(); defer n.req_ack_lock.Unlock()
+	return n.pending
+}
+
+// Marks our request as in the CS if it's no longer PENDING, and no conflicting request in the queue goes first.
+// Deciding this under entryLock means any REQUEST not yet queued is handled after we're marked as in the CS.
+func (n *LamportNode) tryEnter() bool {
+	if n.isPending() {
+		return false
+	}
+	n.entryLock.Lock(); defer n.entryLock.Unlock()
+	ours := rwRequest{n.nodeId, n.lastReqTimestamp, n.reqMode}
+	for _, elem := range n.queue.Elems() {
+		theirs := rwRequest{elem.nodeId, elem.timestamp, n.modes[elem.nodeId]}
+		if elem.nodeId != n.nodeId && conflicts(ours.mode, theirs.mode) && n.policy.precedes(theirs, ours) {
+			return false
+		}
+	}
+	n.inCS = true
+	return true
+}
+
+// Wake up AcquireLock to check whether our request can enter the CS, e.g. once it is acknowledged or a request ahead of
+// it is removed. Never blocks: a signal that isn't waited on yet is kept for the next check.
+func (n *LamportNode) signalEntry() {
+	select {
+	case n.wake <- true:
+	default:
+	}
+}
+
+// Withdraw a request that was cancelled before entering the CS.
+func (n *LamportNode) withdraw(req_timestamp ClockVal) {
+	n.queue.Remove(n.nodeId, req_timestamp)
+
+	// Let handlers waiting on our request acknowledge later requests
+	n.req_ack_lock.Lock()
+	if n.pending {
+		n.pending = false
+		n.pendingReq.Unlock()
+	}
+	n.req_ack_lock.Unlock()
+
+	n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
+	n.broadcast(LSPQWithdraw, n.clock, req_timestamp)
+	log.Printf("N%d: %d: Request cancelled. Withdrew request %d. Queue: %v", n.nodeId, n.clock, req_timestamp, n.queue.contents)
+	n.ongoingReq.Unlock()
 }
 
 func (n *LamportNode) ReleaseLock() {
+	if !n.stopLease() {
+		log.Printf("N%d: %d: Exiting CS. Lease already expired.", n.nodeId, n.clock)
+		return
+	}
+
 	// Exit the CS
-	n.smPtr.ExitCS(n.nodeId)
-	
-	// Pop head of queue
-	n.queue.Extract()
+	if n.reqMode == Shared {
+		n.smPtr.ExitCSShared(n.nodeId)
+	} else {
+		n.smPtr.ExitCS(n.nodeId)
+	}
+	log.Printf("N%d: %d: Exiting CS. Lock Released. Queue: %v", n.nodeId, n.clock, n.queue.contents)
+	n.release()
+}
+
+func (n *LamportNode) release() {
+	// Remove our request. It is the head of the queue, unless readers ahead of it are still inside.
+	n.queue.Remove(n.nodeId, n.lastReqTimestamp)
+	n.entryLock.Lock()
+	n.inCS = false
+	deferred := n.deferred
+	n.deferred = make([]LSPQMsg, 0)
+	n.entryLock.Unlock()
 
 	// Broadcast request with timestamp: RELEASE
-	log.Printf("N%d: %d: Exiting CS. Lock Released. Queue: %v", n.nodeId, n.clock, n.queue.contents)
 	n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
-	n.broadcast(LSPQRelease, n.clock)
+	n.broadcast(LSPQRelease, n.clock, n.lastReqTimestamp)
+
+	// Acknowledge the requests we held back in the CS
+	for _, rcvd_msg := range deferred {
+		n.clockLock.Lock(); n.clock++; n.clockLock.Unlock()
+		n.send(rcvd_msg.nodeId, LSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
+	}
+}
+
+// Start the lease on being granted the lock, if the node has one.
+func (n *LamportNode) startLease() {
+	if n.lease == 0 {
+		return
+	}
+	n.leaseLock.Lock(); defer n.leaseLock.Unlock()
+	n.holding = true
+	n.leaseTimer = time.AfterFunc(n.lease, n.expireLease)
+}
+
+// Stop the lease on leaving the CS. Returns false if it has already expired, in which case the lock was released.
+func (n *LamportNode) stopLease() bool {
+	if n.lease == 0 {
+		return true
+	}
+	n.leaseLock.Lock(); defer n.leaseLock.Unlock()
+	if !n.holding {
+		return false
+	}
+	n.holding = false
+	n.leaseTimer.Stop()
+	return true
+}
+
+// Give up the lock when the lease expires, recording the expiry in SharedMemory instead of exiting the CS.
+func (n *LamportNode) expireLease() {
+	n.leaseLock.Lock()
+	if !n.holding || n.exited {
+		n.leaseLock.Unlock()
+		return
+	}
+	n.holding = false
+	n.leaseLock.Unlock()
+
+	n.clockLock.Lock()
+	n.clock++
+	n.clock = MaxClockVal(n.clock, n.smPtr.ExpireLease(n.nodeId, n.clock)) + 1
+	n.clockLock.Unlock()
+	log.Printf("N%d: %d: Lease expired. Lock Released. Queue: %v", n.nodeId, n.clock, n.queue.contents)
+	n.release()
 }
@@ -0,0 +1,48 @@
+package nodetypes
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/**
+  LOCK MANAGER
+  A LockManager multiplexes many named locks over one set of endpoints, so a request for "accounts/42" only contends
+  with other requests for "accounts/42". Each resource has its own queue, logical clock and SharedMemory (see
+  ResourceMemory), so its fencing tokens only increase relative to other holders of the same resource.
+
+  A node may hold several locks at once, so nodes can deadlock: N0 holds A and waits for B, while N1 holds B and waits
+  for A. Neither gives up what it holds, so both wait forever. A node that has waited for DEADLOCK_PROBE_INTV sends a
+  PROBE to every node holding its request up (Chandy-Misra-Haas edge chasing): with Ricart-Agrawala, every node that
+  hasn't acknowledged it, and with Lamport, every node whose request is queued ahead of it.
+  - A node that receives a PROBE only passes it on if it is why the sender is waiting, i.e. it deferred the sender's
+    request (Ricart-Agrawala) or its own request goes first (Lamport), and it is waiting on a request of its own. It
+    then passes it on to every node holding that request up.
+  - If the PROBE comes back to the node that sent it, every node it passed through waits on the next, so none of them
+    can ever enter. The sender withdraws its request, and AcquireLock returns ErrDeadlock. It should then release the
+    locks it holds, and may try again.
+  Every node in a cycle may detect it, so more than one of them may give up.
+
+  Ricart and Agrawala's Optimisation (RicartLockManager.go) and Lamport's Shared Priority Queue (LamportLockManager.go)
+  implement LockManager. In both, a waiting node knows exactly which nodes hold it up, which the PROBEs need. The
+  voting, token and tree-based algorithms would need a quorum, token or tree for every resource, and don't support
+  named locks.
+*/
+
+const DEADLOCK_PROBE_INTV = 200 * time.Millisecond
+
+// Returned by AcquireLock if the request was withdrawn to break a deadlock.
+var ErrDeadlock = errors.New("Request was withdrawn to break a deadlock.")
+
+// Returned by AcquireLock if the node already holds or is requesting the lock.
+var ErrAlreadyRequested = errors.New("Lock is already held or requested by this node.")
+
+// Interface for a node that takes named locks, each guarded by its own SharedMemory (see ResourceMemory)
+type LockManager interface {
+	Init() error
+	// Like Node.AcquireLock, but only for the lock on resource `name`.
+	AcquireLock(ctx context.Context, name string) (FencingToken, error)
+	ReleaseLock(name string)
+	Shutdown() error
+}
@@ -0,0 +1,438 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Communication endpoint for each node -- this is the only thing shared between nodes
+type MaekawaNodeEndpoint struct {
+	nodeId int
+	recvChan chan MaekawaMsg // Incoming messages for this node are sent here
+}
+
+func NewMaekawaNodeEndpoint(nodeId int) MaekawaNodeEndpoint {
+	return MaekawaNodeEndpoint{nodeId, make(chan MaekawaMsg, 10000)}
+}
+
+// Node that follows Maekawa's Algorithm.
+// Each node only asks its quorum -- its row and column when nodes are laid out in a √N by √N grid -- for permission.
+// Any two quorums share a node, and each node only grants one request at a time, so no two nodes can hold the lock.
+type MaekawaNode struct {
+	// Basic Setup
+	nodeId int
+	clock ClockVal
+	clockLock *sync.Mutex
+	smPtr *SharedMemory
+	endpoint MaekawaNodeEndpoint
+	allEndpoints map[int]MaekawaNodeEndpoint
+	quorum []int
+
+	// Exit details
+	exit chan bool // Closed on Shutdown
+
+	// Variables for node's own request
+	ongoingReqLock *sync.Mutex // Locked while the node is REQUESTING
+	reqLock *sync.Mutex // Lock for all variables below, including the node's vote
+	hasOngoingReq bool
+	inCS bool
+	req_ts ClockVal
+	granted map[int]bool // Quorum members that have granted the current request
+	failed bool // True if a quorum member has replied FAILED to the current request
+	yielded bool // True if this node has yielded a grant for the current request
+	inquirers map[int]bool // Quorum members that inquired while we could not yield yet
+	acquired chan bool
+
+	// Variables to handle node's vote
+	lockedFor pqueueElem // Request that we've granted, with nodeId -1 if none
+	inquired bool // True if we've sent INQUIRE to the node we've granted
+	waiting *pqueue // Requests waiting for our grant
+}
+
+// Initialise a new MaekawaNode. This connects the node to SharedMemory, and to the other nodes' endpoints.
+func NewMaekawaNode(nodeId int, endpoints []MaekawaNodeEndpoint, sm *SharedMemory) *MaekawaNode {
+	if len(endpoints) == 0 {
+		panic("No endpoints given.")
+	}
+
+	nodeIds := make([]int, 0)
+	endpointMap := make(map[int]MaekawaNodeEndpoint, 0)
+	myEndpoint := endpoints[0]
+	for _, endpoint := range(endpoints) {
+		if endpoint.nodeId == nodeId {
+			myEndpoint = endpoint
+		}
+		nodeIds = append(nodeIds, endpoint.nodeId)
+		endpointMap[endpoint.nodeId] = endpoint
+	}
+	return &MaekawaNode{
+		nodeId, ClockVal(0), &sync.Mutex{}, sm, myEndpoint, endpointMap, GridQuorum(nodeId, nodeIds),
+		make(chan bool),
+		&sync.Mutex{}, &sync.Mutex{}, false, false, ClockVal(-1), make(map[int]bool), false, false, make(map[int]bool), make(chan bool, 1),
+		pqueueElem{-1, ClockVal(-1)}, false, newPQueue(),
+	}
+}
+
+// Returns the quorum of `nodeId`: the nodes in its row and column when `nodeIds` are laid out row by row in a grid
+// of ceil(√N) columns.
+// - If the last row is incomplete, two nodes in different rows still share a node: the one in the complete row's
+//   row and the other node's column.
+func GridQuorum(nodeId int, nodeIds []int) []int {
+	sorted := append([]int{}, nodeIds...)
+	sort.Ints(sorted)
+	width := int(math.Ceil(math.Sqrt(float64(len(sorted)))))
+
+	pos := sort.SearchInts(sorted, nodeId)
+	if pos == len(sorted) || sorted[pos] != nodeId {
+		panic(fmt.Sprintf("N%d: Not in the list of nodes %v.", nodeId, nodeIds))
+	}
+	row, col := pos/width, pos%width
+
+	quorum := make([]int, 0)
+	for i, id := range sorted {
+		if i/width == row || i%width == col {
+			quorum = append(quorum, id)
+		}
+	}
+	return quorum
+}
+
+func (n *MaekawaNode) Init() error {
+	go n.handleMsg()
+	return nil
+}
+
+func (n *MaekawaNode) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	select {
+	case <-n.exit:
+	default:
+		close(n.exit)
+	}
+	return nil
+}
+
+// Handle incoming messages one at a time, in the order they were sent.
+// Unlike the other nodes, we can't hand messages over to separate goroutines: an INQUIRE must not overtake the
+// LOCKED before it, and a YIELD must not overtake the REQUEST before it.
+func (n *MaekawaNode) handleMsg() {
+	for {
+		select {
+		case rcvd_msg, ok := <-n.endpoint.recvChan:
+			if !ok {
+				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
+			}
+			// Update local clock to be elementwise max + 1
+			n.clockLock.Lock()
+			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
+			n.clockLock.Unlock()
+
+			n.reqLock.Lock()
+			switch rcvd_msg.action {
+			case MKRequest:
+				n.handleRequest(rcvd_msg)
+			case MKRelease:
+				n.handleRelease(rcvd_msg)
+			case MKWithdraw:
+				n.handleWithdraw(rcvd_msg)
+			case MKYield:
+				n.handleYield(rcvd_msg)
+			case MKLocked:
+				n.handleLocked(rcvd_msg)
+			case MKFailed:
+				n.handleFailed(rcvd_msg)
+			case MKInquire:
+				n.handleInquire(rcvd_msg)
+			}
+			n.reqLock.Unlock()
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+// -----
+// VOTER -- handles requests from nodes that have this node in their quorum
+// -----
+
+// Grant our vote to a request
+func (n *MaekawaNode) grant(req pqueueElem) {
+	n.lockedFor = req
+	n.inquired = false
+	n.send(req.nodeId, MKLocked, req.timestamp)
+	log.Printf("[%d] - N%d: LOCKED for N%d.", n.clock, n.nodeId, req.nodeId)
+}
+
+// Handle an incoming request.
+func (n *MaekawaNode) handleRequest(msg MaekawaMsg) {
+	req := pqueueElem{msg.nodeId, msg.reqTimestamp}
+	if n.lockedFor.nodeId == -1 {
+		n.grant(req)
+		return
+	}
+
+	// We've granted another request already, so the request waits
+	var prevHead *pqueueElem
+	if n.waiting.Length() > 0 {
+		prevHead = &pqueueElem{n.waiting.contents[0].nodeId, n.waiting.contents[0].timestamp}
+	}
+	n.waiting.Insert(req.nodeId, req.timestamp)
+	if prevHead != nil && n.waiting.contents[0] == req && compareElems(*prevHead, n.lockedFor) == -1 {
+		// The request overtook the earliest waiting request, which can't be granted next anymore.
+		// (If it was later than the granted request, it has been sent FAILED already.)
+		n.send(prevHead.nodeId, MKFailed, prevHead.timestamp)
+		log.Printf("[%d] - N%d: FAILED N%d.", n.clock, n.nodeId, prevHead.nodeId)
+	}
+	if compareElems(req, n.lockedFor) == 1 || n.waiting.contents[0] != req {
+		// An earlier request is granted or waiting, so this request can't be granted next
+		n.send(req.nodeId, MKFailed, req.timestamp)
+		log.Printf("[%d] - N%d: FAILED N%d.", n.clock, n.nodeId, req.nodeId)
+	} else if !n.inquired {
+		// The request is the earliest, ask the granted node to yield to it
+		n.inquired = true
+		n.send(n.lockedFor.nodeId, MKInquire, n.lockedFor.timestamp)
+		log.Printf("[%d] - N%d: INQUIRE N%d.", n.clock, n.nodeId, n.lockedFor.nodeId)
+	}
+}
+
+// Handle an incoming release, granting the next request if any
+func (n *MaekawaNode) handleRelease(msg MaekawaMsg) {
+	if msg.nodeId != n.lockedFor.nodeId || msg.reqTimestamp != n.lockedFor.timestamp {
+		panic(fmt.Sprintf("N%d: Received INVALID RELEASE from N%d: Expected N%d-TS%d, received N%d-TS%d", n.nodeId, msg.nodeId, n.lockedFor.nodeId, n.lockedFor.timestamp, msg.nodeId, msg.reqTimestamp))
+	}
+
+	n.lockedFor = pqueueElem{-1, ClockVal(-1)}
+	n.inquired = false
+	if n.waiting.Length() == 0 {
+		log.Printf("[%d] - N%d: Received RELEASE from N%d. Current backlog: []", n.clock, n.nodeId, msg.nodeId)
+		return
+	}
+	log.Printf("[%d] - N%d: Received RELEASE from N%d.", n.clock, n.nodeId, msg.nodeId)
+	n.grant(n.waiting.ExtractElem())
+}
+
+// Handle a cancelled request. If we've granted it, the grant is released, otherwise it stops waiting.
+func (n *MaekawaNode) handleWithdraw(msg MaekawaMsg) {
+	if msg.nodeId == n.lockedFor.nodeId && msg.reqTimestamp == n.lockedFor.timestamp {
+		n.handleRelease(msg)
+		return
+	}
+	if n.waiting.Remove(msg.nodeId, msg.reqTimestamp) {
+		log.Printf("[%d] - N%d: Received WITHDRAW from N%d. Removed from backlog.", n.clock, n.nodeId, msg.nodeId)
+	}
+}
+
+// Handle an incoming yield, granting the earliest request instead
+func (n *MaekawaNode) handleYield(msg MaekawaMsg) {
+	if msg.nodeId != n.lockedFor.nodeId || msg.reqTimestamp != n.lockedFor.timestamp {
+		panic(fmt.Sprintf("N%d: Received INVALID YIELD from N%d: Expected N%d-TS%d, received N%d-TS%d", n.nodeId, msg.nodeId, n.lockedFor.nodeId, n.lockedFor.timestamp, msg.nodeId, msg.reqTimestamp))
+	}
+
+	log.Printf("[%d] - N%d: Received YIELD from N%d.", n.clock, n.nodeId, msg.nodeId)
+	n.waiting.Insert(n.lockedFor.nodeId, n.lockedFor.timestamp)
+	n.grant(n.waiting.ExtractElem())
+}
+
+// -----
+// REQUESTER -- handles replies from this node's quorum
+// -----
+
+// Returns true if the message is about the node's current request
+func (n *MaekawaNode) isCurrentReq(msg MaekawaMsg) bool {
+	return n.hasOngoingReq && msg.reqTimestamp == n.req_ts
+}
+
+// Give up a grant, so the quorum member can grant an earlier request
+func (n *MaekawaNode) yield(voterId int) {
+	delete(n.granted, voterId)
+	n.yielded = true
+	n.send(voterId, MKYield, n.req_ts)
+	log.Printf("[%d] - N%d: YIELD to N%d.", n.clock, n.nodeId, voterId)
+}
+
+func (n *MaekawaNode) handleLocked(msg MaekawaMsg) {
+	if !n.isCurrentReq(msg) {
+		// Late LOCKED for a withdrawn request -- the quorum member releases it when it receives our WITHDRAW
+		log.Printf("[%d] - N%d: Received late LOCKED from N%d.", n.clock, n.nodeId, msg.nodeId)
+		return
+	} else if n.inCS {
+		panic(fmt.Sprintf("N%d: Received LOCKED from N%d while in the CS: TS%d", n.nodeId, msg.nodeId, msg.reqTimestamp))
+	}
+
+	n.granted[msg.nodeId] = true
+	log.Printf("[%d] - N%d: Received LOCKED from N%d. Granted: %d/%d", n.clock, n.nodeId, msg.nodeId, len(n.granted), len(n.quorum))
+	if len(n.granted) == len(n.quorum) {
+		n.inCS = true
+		n.inquirers = make(map[int]bool)
+		n.acquired <- true
+	}
+}
+
+func (n *MaekawaNode) handleFailed(msg MaekawaMsg) {
+	if !n.isCurrentReq(msg) {
+		return
+	}
+
+	log.Printf("[%d] - N%d: Received FAILED from N%d.", n.clock, n.nodeId, msg.nodeId)
+	n.failed = true
+	// We can't win, so yield to everyone that asked
+	for voterId := range n.inquirers {
+		if n.granted[voterId] {
+			n.yield(voterId)
+		}
+	}
+	n.inquirers = make(map[int]bool)
+}
+
+func (n *MaekawaNode) handleInquire(msg MaekawaMsg) {
+	if !n.isCurrentReq(msg) || n.inCS || !n.granted[msg.nodeId] {
+		// Late INQUIRE -- we've released (or are about to release) the grant anyway
+		return
+	}
+
+	if n.failed || n.yielded {
+		n.yield(msg.nodeId)
+	} else {
+		// We may still win, so hold on to the grant until we know otherwise
+		n.inquirers[msg.nodeId] = true
+	}
+}
+
+// Attempt to acquire the lock
+func (n *MaekawaNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	// Block until we can start an ongoing request
+	n.ongoingReqLock.Lock()
+
+	n.reqLock.Lock()
+	n.clockLock.Lock(); n.clock++; req_ts := n.clock; n.clockLock.Unlock()
+	n.hasOngoingReq = true; n.inCS = false; n.req_ts = req_ts
+	n.granted = make(map[int]bool); n.failed = false; n.yielded = false; n.inquirers = make(map[int]bool)
+	for _, voterId := range n.quorum {
+		n.send(voterId, MKRequest, req_ts)
+	}
+	log.Printf("[%d] - N%d: Start request. Quorum: %v", req_ts, n.nodeId, n.quorum)
+	n.reqLock.Unlock()
+
+	// BLOCK until the whole quorum has granted the request
+	select {
+	case <-n.acquired:
+	case <-n.exit:
+		return 0, ErrShutdown // node was shut down
+	case <-ctx.Done():
+		n.withdraw()
+		return 0, ctx.Err()
+	}
+
+	n.clockLock.Lock(); n.clock++; token := FencingToken(n.clock); n.clockLock.Unlock()
+	log.Printf("[%d] - N%d: Lock acquired. Entering CS.", token, n.nodeId)
+	if err := n.smPtr.EnterCS(n.nodeId, token); err != nil { // (Simulated method of entering unsafe CS)
+		// Our token is later than the last holder's, unless mutual exclusion was already broken. Give up the lock, so the
+		// other nodes aren't held up.
+		n.release()
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+func (n *MaekawaNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+// Withdraw a request that was cancelled before entering the CS, releasing any grants we hold.
+func (n *MaekawaNode) withdraw() {
+	n.reqLock.Lock()
+	if n.inCS {
+		// The last grant arrived as we were cancelled
+		<-n.acquired
+	}
+	log.Printf("[%d] - N%d: Request cancelled. Granted: %d/%d", n.clock, n.nodeId, len(n.granted), len(n.quorum))
+	for _, voterId := range n.quorum {
+		n.send(voterId, MKWithdraw, n.req_ts)
+	}
+	n.hasOngoingReq = false; n.inCS = false
+	n.reqLock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Attempt to release the lock
+func (n *MaekawaNode) ReleaseLock() {
+	n.smPtr.ExitCS(n.nodeId) // (Simulated method of exiting unsafe CS)
+	n.release()
+}
+
+// Give up the lock, after exiting the CS or failing to enter it.
+func (n *MaekawaNode) release() {
+	n.reqLock.Lock()
+	log.Printf("[%d] - N%d: Lock released", n.clock, n.nodeId)
+	for _, voterId := range n.quorum {
+		n.send(voterId, MKRelease, n.req_ts)
+	}
+	n.hasOngoingReq = false; n.inCS = false
+	n.reqLock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Send a message about the request made at `reqTimestamp`.
+func (n *MaekawaNode) send(dstId int, action MaekawaMsgAction, reqTimestamp ClockVal) {
+	n.clockLock.Lock(); n.clock++; timestamp := n.clock; n.clockLock.Unlock()
+	msg := MaekawaMsg{
+		n.nodeId,
+		timestamp,
+		reqTimestamp,
+		action,
+	}
+
+	if _, ok := n.allEndpoints[dstId]; !ok {
+		panic(fmt.Sprintf("N%d: Tried to send %v to unknown endpoint with ID %d.", n.nodeId, getMaekawaMsgAction(action), dstId))
+	}
+	n.allEndpoints[dstId].recvChan <- msg
+}
+
+// -----
+// HELPER STRUCTS
+// -----
+
+// Message used for inter-MaekawaNode communication.
+type MaekawaMsg struct {
+	nodeId int
+	timestamp ClockVal
+	reqTimestamp ClockVal // Timestamp of the request the message is about, which identifies it along with the requester
+	action MaekawaMsgAction
+}
+
+type MaekawaMsgAction int
+const (
+	MKRequest MaekawaMsgAction = iota
+	MKLocked // Grant of a request
+	MKFailed // The request can't be granted yet, as an earlier one is granted or waiting
+	MKInquire // Asks the granted node whether it can yield to an earlier request
+	MKYield // Gives up a grant so an earlier request can be granted
+	MKRelease
+	MKWithdraw // Cancels a request, releasing its grant if it has one
+)
+
+func getMaekawaMsgAction(action MaekawaMsgAction) string {
+	switch action {
+	case MKRequest:
+		return "REQUEST"
+	case MKLocked:
+		return "LOCKED"
+	case MKFailed:
+		return "FAILED"
+	case MKInquire:
+		return "INQUIRE"
+	case MKYield:
+		return "YIELD"
+	case MKRelease:
+		return "RELEASE"
+	case MKWithdraw:
+		return "WITHDRAW"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", action)
+	}
+}
@@ -1,5 +1,14 @@
 package nodetypes
 
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Naive nodes don't talk to each other, so they draw fencing tokens from a counter that every NaiveNode shares.
+var naiveTokens int64
+
 type NaiveNode struct {
 	nodeId int
 	clock ClockVal
@@ -14,9 +23,20 @@ func (n *NaiveNode) Init() (err error) { return nil }
 
 func (n *NaiveNode) Shutdown() (err error) { return nil }
 
-func (n *NaiveNode) AcquireLock() {
+func (n *NaiveNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	n.clock++
-	n.smPtr.EnterCS(n.nodeId, n.clock)
+	token := FencingToken(atomic.AddInt64(&naiveTokens, 1))
+	if err := n.smPtr.EnterCS(n.nodeId, token); err != nil {
+		return 0, err
+	}
+	return token, nil
+}
+
+func (n *NaiveNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
 }
 
 func (n *NaiveNode) ReleaseLock() {
@@ -1,5 +1,12 @@
 package nodetypes
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
 type ClockVal int
 func MaxClockVal(c1, c2 ClockVal) ClockVal {
 	if c1 > c2 {
@@ -8,10 +15,38 @@ func MaxClockVal(c1, c2 ClockVal) ClockVal {
 	return c2
 }
 
+// Handed out with every lock grant, and increases with every grant. SharedMemory rejects a holder whose token is older
+// than the latest one it has seen, e.g. a holder whose lease expired while it was paused.
+// Nodes use their logical clock on entering the CS as the token. Every holder hears (indirectly) from the previous one
+// before entering, so this increases without any extra messages.
+type FencingToken int
+
 // Interface for a node that uses SharedMemory (see SharedMemory.go)
 type Node interface {
 	Init() error
-	AcquireLock()
+	// Blocks until the node enters the CS, returning its fencing token. If `ctx` is done first, the node withdraws its
+	// request so it doesn't hold up other nodes, and returns ctx.Err() without entering. If SharedMemory rejects the
+	// token (see SharedMemory.EnterCS), the node gives up the lock and returns an error wrapping ErrStaleToken.
+	AcquireLock(ctx context.Context) (FencingToken, error)
+	// Attempts to acquire the lock within `timeout`, returning the fencing token and true if the node entered the CS.
+	TryAcquire(timeout time.Duration) (FencingToken, bool)
 	ReleaseLock()
 	Shutdown() error
 }
+
+// Returned by AcquireLock if the node was shut down before entering the CS.
+var ErrShutdown = errors.New("Node was shut down.")
+
+// Wraps the error from SharedMemory.EnterCS (e.g. ErrStaleToken) for AcquireLock to return, once the node has given up
+// the lock. Callers can still match it with errors.Is.
+func enterError(nodeId int, token FencingToken, err error) error {
+	return fmt.Errorf("N%d: Could not enter the CS with token %d: %w", nodeId, token, err)
+}
+
+// Implements Node.TryAcquire with the node's AcquireLock.
+func tryAcquire(n Node, timeout time.Duration) (FencingToken, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	token, err := n.AcquireLock(ctx)
+	return token, err == nil
+}
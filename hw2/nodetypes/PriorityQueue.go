@@ -73,6 +73,49 @@ func (q *pqueue) ExtractElem() pqueueElem {
 	return elem
 }
 
+// Removes an element from anywhere in the queue (e.g. a withdrawn request), returning false if it isn't queued
+func (q *pqueue) Remove(nodeId int, timestamp ClockVal) bool {
+	q.accessLock.Lock(); defer q.accessLock.Unlock()
+	for i, elem := range q.contents {
+		if elem.nodeId == nodeId && elem.timestamp == timestamp {
+			q.contents = append(q.contents[:i], q.contents[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the element is in the queue
+func (q *pqueue) Contains(nodeId int, timestamp ClockVal) bool {
+	q.accessLock.Lock(); defer q.accessLock.Unlock()
+	for _, elem := range q.contents {
+		if elem.nodeId == nodeId && elem.timestamp == timestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the queue's elements, in order
+func (q *pqueue) Elems() []pqueueElem {
+	q.accessLock.Lock(); defer q.accessLock.Unlock()
+	return append([]pqueueElem(nil), q.contents...)
+}
+
+// Removes every element of `nodeId` (e.g. a crashed node), returning how many were removed
+func (q *pqueue) RemoveNode(nodeId int) int {
+	q.accessLock.Lock(); defer q.accessLock.Unlock()
+	kept := make([]pqueueElem, 0, len(q.contents))
+	for _, elem := range q.contents {
+		if elem.nodeId != nodeId {
+			kept = append(kept, elem)
+		}
+	}
+	removed := len(q.contents) - len(kept)
+	q.contents = kept
+	return removed
+}
+
 // Peek at the head of a queue, returning the nodeId without popping it
 func (q *pqueue) Peek() int {
 	q.accessLock.Lock(); defer q.accessLock.Unlock()
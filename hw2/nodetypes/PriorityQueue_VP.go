@@ -75,6 +75,32 @@ func (q *pqueueVP) ExtractElem() pqueueVPElem {
 	return elem
 }
 
+// Removes an element from anywhere in the queue (e.g. a withdrawn request), returning false if it isn't queued
+func (q *pqueueVP) Remove(nodeId int, electionId string) bool {
+	q.accessLock.Lock(); defer q.accessLock.Unlock()
+	for i, elem := range q.contents {
+		if elem.nodeId == nodeId && elem.electionId == electionId {
+			q.contents = append(q.contents[:i], q.contents[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Removes every element of `nodeId` (e.g. a crashed node), returning how many were removed
+func (q *pqueueVP) RemoveNode(nodeId int) int {
+	q.accessLock.Lock(); defer q.accessLock.Unlock()
+	kept := make([]pqueueVPElem, 0, len(q.contents))
+	for _, elem := range q.contents {
+		if elem.nodeId != nodeId {
+			kept = append(kept, elem)
+		}
+	}
+	removed := len(q.contents) - len(kept)
+	q.contents = kept
+	return removed
+}
+
 // Peek at the head of a queue, returning the nodeId without popping it
 func (q *pqueueVP) Peek() int {
 	q.accessLock.Lock(); defer q.accessLock.Unlock()
@@ -0,0 +1,307 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Communication endpoint for each node -- this is the only thing shared between nodes
+type RaymondNodeEndpoint struct {
+	nodeId int
+	recvChan chan RaymondMsg // Incoming messages for this node are sent here
+}
+
+func NewRaymondNodeEndpoint(nodeId int) RaymondNodeEndpoint {
+	return RaymondNodeEndpoint{nodeId, make(chan RaymondMsg, 10000)}
+}
+
+// Shape of the spanning tree that Raymond's Algorithm passes the token along.
+type TreeTopology int
+const (
+	TreeLine TreeTopology = iota // Each node's parent is the node before it
+	TreeStar // Every node's parent is the root
+	TreeBinary // Balanced binary tree, filled level by level
+)
+
+func (t TreeTopology) String() string {
+	switch t {
+	case TreeLine:
+		return "LINE"
+	case TreeStar:
+		return "STAR"
+	case TreeBinary:
+		return "BINARY"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(t))
+	}
+}
+
+// Returns the parent of each node in a spanning tree of `nodeIds` with the given topology, rooted at the lowest ID.
+// The root is its own parent.
+func TreeParents(topology TreeTopology, nodeIds []int) map[int]int {
+	sorted := append([]int{}, nodeIds...)
+	sort.Ints(sorted)
+
+	parents := make(map[int]int)
+	for i, nodeId := range sorted {
+		if i == 0 {
+			parents[nodeId] = nodeId
+			continue
+		}
+		switch topology {
+		case TreeLine:
+			parents[nodeId] = sorted[i-1]
+		case TreeStar:
+			parents[nodeId] = sorted[0]
+		case TreeBinary:
+			parents[nodeId] = sorted[(i-1)/2]
+		default:
+			panic(fmt.Sprintf("Unknown topology %v", topology))
+		}
+	}
+	return parents
+}
+
+// Node that follows Raymond's Tree-Based Algorithm.
+// Nodes only talk to their neighbours in a spanning tree. Each node points at the neighbour in the direction of the
+// token (its holder), and requests are passed along these pointers until they reach the token. The token then moves
+// back along the same path, reversing the pointers as it goes.
+type RaymondNode struct {
+	// Basic Setup
+	nodeId int
+	clock ClockVal
+	smPtr *SharedMemory
+	endpoint RaymondNodeEndpoint
+	allEndpoints map[int]RaymondNodeEndpoint
+
+	// Exit details
+	exit chan bool // Closed on Shutdown
+
+	// Variables for node's own request
+	ongoingReqLock *sync.Mutex // Locked while the node is REQUESTING
+	lock *sync.Mutex // Lock for all variables below
+	holder int // Neighbour in the direction of the token, or this node if it holds the token
+	requestQ []int // Neighbours (or this node) waiting for the token, in the order they asked
+	asked bool // True if we've sent a REQUEST to the holder that the token hasn't answered yet
+	inCS bool
+	acquired chan bool
+}
+
+// Initialise a new RaymondNode, whose holder starts as its parent in the tree (see TreeParents).
+func NewRaymondNode(nodeId int, parentId int, endpoints []RaymondNodeEndpoint, sm *SharedMemory) *RaymondNode {
+	if len(endpoints) == 0 {
+		panic("No endpoints given.")
+	}
+
+	endpointMap := make(map[int]RaymondNodeEndpoint, 0)
+	myEndpoint := endpoints[0]
+	for _, endpoint := range(endpoints) {
+		if endpoint.nodeId == nodeId {
+			myEndpoint = endpoint
+		}
+		endpointMap[endpoint.nodeId] = endpoint
+	}
+	return &RaymondNode{
+		nodeId, ClockVal(0), sm, myEndpoint, endpointMap,
+		make(chan bool),
+		&sync.Mutex{}, &sync.Mutex{}, parentId, make([]int, 0), false, false, make(chan bool, 1),
+	}
+}
+
+func (n *RaymondNode) Init() error {
+	go n.handleMsg()
+	return nil
+}
+
+func (n *RaymondNode) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	select {
+	case <-n.exit:
+	default:
+		close(n.exit)
+	}
+	return nil
+}
+
+// Handle incoming messages one at a time.
+func (n *RaymondNode) handleMsg() {
+	for {
+		select {
+		case rcvd_msg, ok := <-n.endpoint.recvChan:
+			if !ok {
+				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
+			}
+
+			n.lock.Lock()
+			// Update local clock to be elementwise max + 1
+			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
+			switch rcvd_msg.action {
+			case RTRequest:
+				log.Printf("[%d] - N%d: Received REQUEST from N%d.", n.clock, n.nodeId, rcvd_msg.nodeId)
+				n.requestQ = append(n.requestQ, rcvd_msg.nodeId)
+			case RTPrivilege:
+				log.Printf("[%d] - N%d: Received PRIVILEGE from N%d. Queue: %v", n.clock, n.nodeId, rcvd_msg.nodeId, n.requestQ)
+				n.holder = n.nodeId
+			}
+			n.assignPrivilege()
+			n.makeRequest()
+			n.lock.Unlock()
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+// If we hold the token and aren't using it, pass it to the head of the queue. Must be called with the lock held.
+func (n *RaymondNode) assignPrivilege() {
+	if n.holder != n.nodeId || n.inCS || len(n.requestQ) == 0 {
+		return
+	}
+
+	next := n.requestQ[0]
+	n.requestQ = n.requestQ[1:]
+	n.asked = false
+	if next == n.nodeId {
+		n.inCS = true
+		n.acquired <- true
+		return
+	}
+	n.holder = next
+	n.send(next, RTPrivilege)
+	log.Printf("[%d] - N%d: Sent PRIVILEGE to N%d.", n.clock, n.nodeId, next)
+}
+
+// If anyone is waiting on us and we don't hold the token, ask the holder for it. Must be called with the lock held.
+func (n *RaymondNode) makeRequest() {
+	if n.holder == n.nodeId || len(n.requestQ) == 0 || n.asked {
+		return
+	}
+
+	n.asked = true
+	n.send(n.holder, RTRequest)
+	log.Printf("[%d] - N%d: Sent REQUEST to N%d.", n.clock, n.nodeId, n.holder)
+}
+
+// Attempt to acquire the lock
+func (n *RaymondNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	// Block until we can start an ongoing request
+	n.ongoingReqLock.Lock()
+
+	n.lock.Lock()
+	n.clock++
+	log.Printf("[%d] - N%d: Start request", n.clock, n.nodeId)
+	n.requestQ = append(n.requestQ, n.nodeId)
+	n.assignPrivilege()
+	n.makeRequest()
+	n.lock.Unlock()
+
+	// BLOCK until the token reaches us
+	select {
+	case <-n.acquired:
+	case <-n.exit:
+		return 0, ErrShutdown // node was shut down
+	case <-ctx.Done():
+		n.withdraw()
+		return 0, ctx.Err()
+	}
+
+	n.lock.Lock()
+	n.clock++; token := FencingToken(n.clock)
+	log.Printf("[%d] - N%d: Lock acquired. Entering CS.", n.clock, n.nodeId)
+	n.lock.Unlock()
+	if err := n.smPtr.EnterCS(n.nodeId, token); err != nil { // (Simulated method of entering unsafe CS)
+		// Our token is later than the last holder's, unless mutual exclusion was already broken. Give up the lock, so the
+		// other nodes aren't held up.
+		n.release()
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+func (n *RaymondNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+// Withdraw a request that was cancelled before entering the CS.
+// A REQUEST we've sent can't be taken back, so the token may still come to us. It then stays here, or is passed on to
+// whoever asks for it next.
+func (n *RaymondNode) withdraw() {
+	n.lock.Lock()
+	n.clock++
+	if n.inCS {
+		// The token arrived as we were cancelled
+		<-n.acquired
+		n.inCS = false
+	} else {
+		for i, nodeId := range n.requestQ {
+			if nodeId == n.nodeId {
+				n.requestQ = append(n.requestQ[:i], n.requestQ[i+1:]...)
+				break
+			}
+		}
+	}
+	log.Printf("[%d] - N%d: Request cancelled. Queue: %v", n.clock, n.nodeId, n.requestQ)
+	n.assignPrivilege()
+	n.makeRequest()
+	n.lock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Attempt to release the lock
+func (n *RaymondNode) ReleaseLock() {
+	n.smPtr.ExitCS(n.nodeId) // (Simulated method of exiting unsafe CS)
+	n.release()
+}
+
+// Give up the lock, after exiting the CS or failing to enter it.
+func (n *RaymondNode) release() {
+	n.lock.Lock()
+	n.clock++
+	log.Printf("[%d] - N%d: Lock released. Queue: %v", n.clock, n.nodeId, n.requestQ)
+	n.inCS = false
+	n.assignPrivilege()
+	n.makeRequest()
+	n.lock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Send a message to a neighbour. Must be called with the lock held.
+func (n *RaymondNode) send(dstId int, action RaymondMsgAction) {
+	if _, ok := n.allEndpoints[dstId]; !ok {
+		panic(fmt.Sprintf("N%d: Tried to send %v to unknown endpoint with ID %d.", n.nodeId, getRaymondMsgAction(action), dstId))
+	}
+	n.clock++
+	n.allEndpoints[dstId].recvChan <- RaymondMsg{n.nodeId, n.clock, action}
+}
+
+// -----
+// HELPER STRUCTS
+// -----
+
+// Message used for inter-RaymondNode communication.
+type RaymondMsg struct {
+	nodeId int
+	timestamp ClockVal
+	action RaymondMsgAction
+}
+
+type RaymondMsgAction int
+const (
+	RTRequest RaymondMsgAction = iota
+	RTPrivilege // The token
+)
+
+func getRaymondMsgAction(action RaymondMsgAction) string {
+	switch action {
+	case RTRequest:
+		return "REQUEST"
+	case RTPrivilege:
+		return "PRIVILEGE"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", action)
+	}
+}
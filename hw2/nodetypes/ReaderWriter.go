@@ -0,0 +1,94 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+)
+
+/**
+  READER-WRITER LOCKS
+  Lamport and Ricart-Agrawala nodes can also take the lock in shared mode (see RWNode). Shared requests don't conflict
+  with each other, so readers may be in the CS together, while an exclusive request conflicts with every other request.
+
+  Of two conflicting requests, the one that goes first is decided by the node's RWPolicy. Every node decides the same
+  way, as it only depends on the two requests.
+  - RWFair: The earlier request goes first, so neither readers nor writers starve.
+  - RWPreferReaders: A shared request goes before an exclusive one, even an earlier one. Writers may starve.
+  - RWPreferWriters: An exclusive request goes before a shared one, even an earlier one. Readers may starve.
+  Requests of the same mode always go in timestamp order.
+*/
+
+type LockMode int
+const (
+	Exclusive LockMode = iota
+	Shared
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case Exclusive:
+		return "EXCLUSIVE"
+	case Shared:
+		return "SHARED"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(m))
+	}
+}
+
+// Returns true if requests in modes `m1` and `m2` can't be in the CS together.
+func conflicts(m1, m2 LockMode) bool {
+	return m1 == Exclusive || m2 == Exclusive
+}
+
+type RWPolicy int
+const (
+	RWFair RWPolicy = iota
+	RWPreferReaders
+	RWPreferWriters
+)
+
+func (p RWPolicy) String() string {
+	switch p {
+	case RWFair:
+		return "FAIR"
+	case RWPreferReaders:
+		return "PREFER_READERS"
+	case RWPreferWriters:
+		return "PREFER_WRITERS"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", int(p))
+	}
+}
+
+// A request, as far as the RWPolicy is concerned
+type rwRequest struct {
+	nodeId int
+	timestamp ClockVal
+	mode LockMode
+}
+
+// Returns true if request `r1` goes before the conflicting request `r2`.
+func (p RWPolicy) precedes(r1, r2 rwRequest) bool {
+	if r1.mode != r2.mode {
+		switch p {
+		case RWPreferReaders:
+			return r1.mode == Shared
+		case RWPreferWriters:
+			return r1.mode == Exclusive
+		}
+	}
+
+	// Earlier request goes first. Break tie with nodeId, LOWER ID is prioritised
+	if r1.timestamp != r2.timestamp {
+		return r1.timestamp < r2.timestamp
+	}
+	return r1.nodeId < r2.nodeId
+}
+
+// Interface for a node that can also take the lock in shared mode
+type RWNode interface {
+	Node
+	// Like AcquireLock, but other nodes may hold the lock in shared mode at the same time. It is released with
+	// ReleaseLock.
+	AcquireSharedLock(ctx context.Context) (FencingToken, error)
+}
@@ -1,9 +1,12 @@
 package nodetypes
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 type RicartNode struct {
@@ -18,23 +21,67 @@ type RicartNode struct {
 	// Exit Details
 	exit chan bool
 	exited bool
+	wake chan bool // Signalled when our request may be able to enter the CS, see signalEntry
 
 	// Variables for node's own request
 	ongoingReq *sync.Mutex // Locked while the request is ONGOING, i.e. not complete
+	reqStateLock *sync.Mutex // Lock to modify hasOngoingReq, lastReqTimestamp, reqMode and inCS, and defer requests to the queue
 	hasOngoingReq bool
 	lastReqTimestamp ClockVal // timestamp of this node's most recent request
-	req_ack_lock *sync.Mutex // Lock to modify req_ack_count
-	req_ack_count int // Reset to 0 when a new request starts
+	reqMode LockMode // Mode of this node's most recent request
+	inCS bool // True from entering the CS until the request is completed
+	req_ack_lock *sync.Mutex // Lock to modify req_acks
+	req_acks map[int]bool // Nodes that acknowledged our request. Reset when a new request starts
 
 	// Variables for tracking requests
 	queue *pqueue
+
+	// Fault tolerance, only used by nodes with a lease
+	lease time.Duration // How long the node may stay in the CS. 0 if the node has no lease
+	detector *failureDetector // nil if the node has no lease
+	crashed chan int // Nodes presumed crashed, handled by handleMsg
+	monitorExit chan bool
+	leaseLock *sync.Mutex // Lock to modify holding and leaseTimer
+	holding bool // True while in the CS with a lease that hasn't expired
+	leaseTimer *time.Timer
+
+	// Reader-writer locking, see ReaderWriter.go
+	policy RWPolicy
+
+	// k-mutual exclusion: up to k nodes may be in the CS at once, so we enter with up to k-1 REQ_ACKs missing
+	k int
 }
 
 func NewRicartNode(nodeId int, endpoints []RicartNodeEndpoint, sm *SharedMemory) *RicartNode {
+	return NewRicartNodeWithLease(nodeId, endpoints, sm, 0)
+}
+
+// Like NewRicartNode, but the node gives up the lock if it stays in the CS for longer than `lease`, and recovers from
+// other nodes crashing (see FailureDetector.go). A lease of 0 disables both.
+func NewRicartNodeWithLease(nodeId int, endpoints []RicartNodeEndpoint, sm *SharedMemory, lease time.Duration) *RicartNode {
+	return NewRicartNodeWithPolicy(nodeId, endpoints, sm, RWFair, lease)
+}
+
+// Like NewRicartNodeWithLease, but conflicting shared and exclusive requests go in the order set by `policy`.
+func NewRicartNodeWithPolicy(nodeId int, endpoints []RicartNodeEndpoint, sm *SharedMemory, policy RWPolicy, lease time.Duration) *RicartNode {
+	return newRicartNode(nodeId, endpoints, sm, policy, lease, 1)
+}
+
+// Like NewRicartNode, but up to k nodes may be in the CS at once, where `sm` came from NewKSharedMemory(k).
+// Each node enters once all but k-1 of the other nodes acknowledged its request. A node in the CS, or with an earlier
+// request, defers its REQ_ACK, so the k-1 missing REQ_ACKs account for every node that may be inside.
+func NewKRicartNode(nodeId int, endpoints []RicartNodeEndpoint, sm *SharedMemory) *RicartNode {
+	return newRicartNode(nodeId, endpoints, sm, RWFair, 0, sm.K())
+}
+
+func newRicartNode(nodeId int, endpoints []RicartNodeEndpoint, sm *SharedMemory, policy RWPolicy, lease time.Duration, k int) *RicartNode {
 	// Loop through endpoints and get self endpoint
 	if len(endpoints) == 0 {
 		panic("No endpoints given.")
 	}
+	if k < 1 || k > len(endpoints) {
+		panic(fmt.Sprintf("k must be between 1 and %d, got %d.", len(endpoints), k))
+	}
 
 	nodeIds := make([]int, 0)
 	endpointMap := make(map[int]RicartNodeEndpoint, 0)
@@ -46,33 +93,61 @@ func NewRicartNode(nodeId int, endpoints []RicartNodeEndpoint, sm *SharedMemory)
 		nodeIds = append(nodeIds, endpoint.nodeId)
 		endpointMap[endpoint.nodeId] = endpoint
 	}
+	var detector *failureDetector
+	if lease > 0 {
+		detector = newFailureDetector(nodeIds, nodeId)
+	}
 	return &RicartNode{
 		nodeId, ClockVal(0), sm, myEndpoint, endpointMap, len(endpoints),
-		make(chan bool), false,
-		&sync.Mutex{}, false, ClockVal(-1), &sync.Mutex{}, 0,
+		make(chan bool), false, make(chan bool, 1),
+		&sync.Mutex{}, &sync.Mutex{}, false, ClockVal(-1), Exclusive, false, &sync.Mutex{}, make(map[int]bool),
 		newPQueue(),
+		lease, detector, make(chan int, len(endpoints)), make(chan bool), &sync.Mutex{}, false, nil,
+		policy,
+		k,
 	}
 }
 
 func (n *RicartNode) Init() error {
 	//log.Printf("N%d: Initialised.", n.nodeId)
 	go n.handleMsg()
+	if n.detector != nil {
+		n.detector.Reset()
+		go n.monitor()
+	}
 	return nil
 }
 
 func (n *RicartNode) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	if n.exited {
+		return nil
+	}
 	n.exit <- true
 	n.exited = true
+	n.signalEntry() // Wake up any AcquireLock, so it returns ErrShutdown
+	if n.detector != nil {
+		n.monitorExit <- true
+	}
+
+	// A crashed node can't give up its lease. The other nodes expire it once they presume it crashed.
+	n.leaseLock.Lock()
+	if n.leaseTimer != nil {
+		n.leaseTimer.Stop()
+	}
+	n.leaseLock.Unlock()
 	return nil
 }
 
-// Send a message. Responsibility for updating clock is on the caller.
-func (n *RicartNode) send(dstId int, action RSPQMsgAction, timestamp ClockVal) {
+// Send a message about the request made at `reqTimestamp`. Responsibility for updating clock is on the caller.
+func (n *RicartNode) send(dstId int, action RSPQMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
 	// Build message
 	msg := RSPQMsg{
 		n.nodeId,
 		timestamp,
+		reqTimestamp,
 		action,
+		n.reqMode,
 	}
 
 	// Send the message
@@ -91,6 +166,12 @@ func (n *RicartNode) handleMsg() {
 			if !ok {
 				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
 			}
+			// Ignore nodes presumed crashed, as we've already removed their requests
+			if n.detector.Crashed(rcvd_msg.nodeId) {
+				continue
+			}
+			n.detector.Heard(rcvd_msg.nodeId)
+
 			// Update local clock to be elementwise max + 1
 			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
 			
@@ -100,8 +181,13 @@ func (n *RicartNode) handleMsg() {
 			case RSPQRequest: // REQUEST
 				go n.handleRequest(rcvd_msg)
 			case RSPQReqAck: // REQ_ACK
-				go n.handleReqAck(rcvd_msg)
+				// Handled before any later REQUEST from the same node, which may ask us to forget this REQ_ACK
+				n.handleReqAck(rcvd_msg)
+			case RSPQWithdraw: // WITHDRAW
+				go n.handleWithdraw(rcvd_msg)
 			}
+		case nodeId := <-n.crashed:
+			go n.handleCrash(nodeId)
 		case <-n.exit:
 			return
 		}
@@ -109,109 +195,308 @@ func (n *RicartNode) handleMsg() {
 }
 
 func (n *RicartNode) handleRequest(rcvd_msg RSPQMsg) {
+	// Lock, so our request can't complete between deciding to defer the request and adding it to the queue
+	n.reqStateLock.Lock(); defer n.reqStateLock.Unlock()
+	if n.detector.Crashed(rcvd_msg.nodeId) {
+		// Presumed crashed since the REQUEST arrived. Deferring it would leave it in the queue.
+		return
+	}
 	if !n.hasOngoingReq {
 		// No ongoing requests, just ack
-		n.clock++; n.send(rcvd_msg.nodeId, RSPQReqAck, n.clock)
+		n.clock++; n.send(rcvd_msg.nodeId, RSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
 		return
 	}
 
 	// Here, we have an ongoing request.
 
-	// If our request is "EARLIER", add that request to the queue and return
-	if n.lastReqTimestamp < rcvd_msg.timestamp {
-		n.queue.Insert(rcvd_msg.nodeId, rcvd_msg.timestamp)
+	// If it conflicts with ours, and we're in the CS or ours goes FIRST (see ReaderWriter.go), add that request to the
+	// queue and return
+	ours := rwRequest{n.nodeId, n.lastReqTimestamp, n.reqMode}
+	theirs := rwRequest{rcvd_msg.nodeId, rcvd_msg.reqTimestamp, rcvd_msg.mode}
+	if !conflicts(ours.mode, theirs.mode) {
+		n.clock++; n.send(rcvd_msg.nodeId, RSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
+		return
+	}
+	if n.inCS || n.policy.precedes(ours, theirs) {
+		n.queue.Insert(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
 		return
-	} else if n.lastReqTimestamp == rcvd_msg.timestamp {
-		// Break tie with nodeId, LOWER ID is prioritised
-		if n.nodeId < rcvd_msg.nodeId {
-			n.queue.Insert(rcvd_msg.nodeId, rcvd_msg.timestamp)
-			return
-		}
 	}
 
 	// Otherwise, we acknowledge their request
 	n.clock++
-	n.send(rcvd_msg.nodeId, RSPQReqAck, n.clock)
+	n.send(rcvd_msg.nodeId, RSPQReqAck, n.clock, rcvd_msg.reqTimestamp)
+
+	// Unless requests go in timestamp order, they may have acknowledged ours before making theirs. That REQ_ACK no
+	// longer holds, so we send our REQUEST again, which they defer until they're done.
+	n.req_ack_lock.Lock(); defer n.req_ack_lock.Unlock()
+	if n.req_acks[rcvd_msg.nodeId] {
+		delete(n.req_acks, rcvd_msg.nodeId)
+		n.clock++
+		n.send(rcvd_msg.nodeId, RSPQRequest, n.clock, n.lastReqTimestamp)
+	}
 }
 
 func (n *RicartNode) handleReqAck(rcvd_msg RSPQMsg) {
-	// Only handle REQ_ACK if we have an ongoing request
-	if !n.hasOngoingReq {
+	// Only handle REQ_ACK if it is for our ongoing request. We hold the lock while counting it, so the request can't be
+	// withdrawn and replaced in between.
+	n.reqStateLock.Lock(); defer n.reqStateLock.Unlock()
+	if !n.hasOngoingReq || rcvd_msg.reqTimestamp != n.lastReqTimestamp {
 		log.Printf("N%d: Received late REQ_ACK from %d", n.nodeId, rcvd_msg.nodeId)
 		return
 	}
-	
+
 	// Need to lock, otherwise we might have a race condition when two REQ_ACKs come in.
 	n.req_ack_lock.Lock(); defer n.req_ack_lock.Unlock() 
-	n.req_ack_count += 1
+	if n.req_acks[rcvd_msg.nodeId] {
+		panic(fmt.Sprintf("N%d: Received a second REQ_ACK from %d", n.nodeId, rcvd_msg.nodeId))
+	}
+	n.req_acks[rcvd_msg.nodeId] = true
+	n.signalEntry()
+}
+
+// Returns true if every node that hasn't crashed, but k-1 at most, acknowledged our request.
+func (n *RicartNode) enoughAcked() bool {
+	n.req_ack_lock.Lock(); defer n.req_ack_lock.Unlock()
+	missing := 0
+	for nodeId := range n.allEndpoints {
+		if !n.req_acks[nodeId] && !n.detector.Crashed(nodeId) {
+			missing++
+		}
+	}
+	return missing < n.k
 }
 
+// Marks our request as in the CS if enough nodes acknowledged it. Deciding this under reqStateLock means any REQUEST we
+// haven't handled yet is deferred.
+func (n *RicartNode) tryEnter() bool {
+	n.reqStateLock.Lock(); defer n.reqStateLock.Unlock()
+	if !n.enoughAcked() {
+		return false
+	}
+	n.inCS = true
+	return true
+}
+
+// Handle a withdrawn request, which we no longer need to acknowledge.
+// If the WITHDRAW overtakes the REQUEST, the request is acknowledged anyway, and the acknowledgement ignored.
+func (n *RicartNode) handleWithdraw(rcvd_msg RSPQMsg) {
+	n.reqStateLock.Lock(); defer n.reqStateLock.Unlock()
+	n.queue.Remove(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+}
 
+// Handle a node presumed crashed: drop its deferred requests. We stop waiting for it to acknowledge ours, as
+// enoughAcked skips it. If it crashed in the CS, its lease is expired, which we merge into our clock like a message's timestamp.
+func (n *RicartNode) handleCrash(nodeId int) {
+	n.reqStateLock.Lock(); defer n.reqStateLock.Unlock()
+	n.queue.RemoveNode(nodeId)
+	n.clock = MaxClockVal(n.clock, n.smPtr.ExpireLease(nodeId, n.clock)) + 1
+	log.Printf("N%d: %d: N%d presumed crashed. Queue: %v", n.nodeId, n.clock, nodeId, n.queue.contents)
+	n.signalEntry()
+}
 
-func (n *RicartNode) broadcast(action RSPQMsgAction, timestamp ClockVal) {
+// Send a HEARTBEAT to every node not presumed crashed, and report the nodes we've stopped hearing from to handleMsg.
+func (n *RicartNode) monitor() {
+	ticker := time.NewTicker(LEASE_HEARTBEAT_INTV)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for dstId, endpoint := range n.allEndpoints {
+				if dstId == n.nodeId || n.detector.Crashed(dstId) {
+					continue
+				}
+				select {
+				case endpoint.recvChan <- RSPQMsg{n.nodeId, n.clock, ClockVal(-1), RSPQHeartbeat, Exclusive}:
+				default: // Don't block on a node that has stopped receiving
+				}
+			}
+			for _, nodeId := range n.detector.Check() {
+				n.crashed <- nodeId
+			}
+		case <-n.monitorExit:
+			return
+		}
+	}
+}
+
+
+func (n *RicartNode) broadcast(action RSPQMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
 	for dstId := range(n.allEndpoints) {
-		if dstId != n.nodeId {
-			n.send(dstId, action, timestamp)
+		if dstId != n.nodeId && !n.detector.Crashed(dstId) {
+			n.send(dstId, action, timestamp, reqTimestamp)
 		}
 	}
 }	
 
 
-func (n *RicartNode) AcquireLock() {
+func (n *RicartNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	return n.acquire(ctx, Exclusive)
+}
+
+func (n *RicartNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+func (n *RicartNode) AcquireSharedLock(ctx context.Context) (FencingToken, error) {
+	if n.k > 1 {
+		return 0, errors.New(fmt.Sprintf("N%d: Shared mode isn't supported with k = %d.", n.nodeId, n.k))
+	}
+	return n.acquire(ctx, Shared)
+}
+
+func (n *RicartNode) acquire(ctx context.Context, mode LockMode) (FencingToken, error) {
 	// Block until we can obtain an ongoing request lock.
 	n.ongoingReq.Lock()
-	n.hasOngoingReq = true
 	
 	// Make a request with timestamp, and add req to queue
+	n.reqStateLock.Lock()
+	n.hasOngoingReq = true
+	n.reqMode = mode
 	n.clock++
 	req_timestamp := n.clock
 	n.lastReqTimestamp = req_timestamp
 	n.queue.Insert(n.nodeId, req_timestamp)
+	n.reqStateLock.Unlock()
 
 	// Reset value of REQ_ACKs for current request
 	n.req_ack_lock.Lock()
-	n.req_ack_count = 1 // We acknowledge ourselves <3
+	n.req_acks = map[int]bool{n.nodeId: true} // We acknowledge ourselves <3
 
 	// BROADCAST REQUEST
-	n.broadcast(RSPQRequest, req_timestamp)
+	n.broadcast(RSPQRequest, req_timestamp, req_timestamp)
 	n.req_ack_lock.Unlock()
 
 	// Block until we've received responses from all nodes
-	for {
-		if n.exited { return }
-		n.req_ack_lock.Lock()
-		if n.req_ack_count != n.nodeCount {
-			n.req_ack_lock.Unlock()
-			continue
+	for !n.tryEnter() {
+		if n.exited { return 0, ErrShutdown }
+		select {
+		case <-n.wake:
+		case <-ctx.Done():
+			n.withdraw(req_timestamp)
+			return 0, ctx.Err()
 		}
-		n.req_ack_lock.Unlock()
-		break
 	}
 	log.Printf("N%d: %d: Lock acquired. Entering CS. Queue: %v", n.nodeId, n.clock, n.queue.contents)
 
-	// Enter the CS
-	n.smPtr.EnterCS(n.nodeId, req_timestamp)
+	// Enter the CS, using the current time rather than the request's as our fencing token
+	n.reqStateLock.Lock(); n.clock++; token := FencingToken(n.clock); n.reqStateLock.Unlock()
+	// The lease runs from when we're granted the lock, so it also expires if we're paused before entering
+	n.startLease()
+	enterCS := n.smPtr.EnterCS
+	if mode == Shared {
+		enterCS = n.smPtr.EnterCSShared
+	}
+	if err := enterCS(n.nodeId, token); err != nil {
+		// Our token is later than the last holder's, unless our lease expired before we could enter (e.g. we were
+		// paused) and the lock has moved on. Give up the lock, unless the expiry already has.
+		if n.stopLease() {
+			n.release()
+		}
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
 }
 
 func (n *RicartNode) ReleaseLock() {
+	if !n.stopLease() {
+		log.Printf("N%d: %d: Exiting CS. Lease already expired.", n.nodeId, n.clock)
+		return
+	}
+
 	// Exit the CS
-	n.smPtr.ExitCS(n.nodeId)
-	
-	// Pop head of queue
-	n.queue.Extract()
+	if n.reqMode == Shared {
+		n.smPtr.ExitCSShared(n.nodeId)
+	} else {
+		n.smPtr.ExitCS(n.nodeId)
+	}
 	log.Printf("N%d: %d: Exiting CS. Lock Released. Queue: %v", n.nodeId, n.clock, n.queue.contents)
+	n.release()
+}
+
+func (n *RicartNode) release() {
+	n.reqStateLock.Lock()
+	// Remove our request. Requests deferred while we were in the CS may be ahead of it.
+	n.queue.Remove(n.nodeId, n.lastReqTimestamp)
+	n.completeRequest()
+	n.reqStateLock.Unlock()
+	n.ongoingReq.Unlock()
+}
+
+// Start the lease on being granted the lock, if the node has one.
+func (n *RicartNode) startLease() {
+	if n.lease == 0 {
+		return
+	}
+	n.leaseLock.Lock(); defer n.leaseLock.Unlock()
+	n.holding = true
+	n.leaseTimer = time.AfterFunc(n.lease, n.expireLease)
+}
+
+// Stop the lease on leaving the CS. Returns false if it has already expired, in which case the lock was released.
+func (n *RicartNode) stopLease() bool {
+	if n.lease == 0 {
+		return true
+	}
+	n.leaseLock.Lock(); defer n.leaseLock.Unlock()
+	if !n.holding {
+		return false
+	}
+	n.holding = false
+	n.leaseTimer.Stop()
+	return true
+}
+
+// Give up the lock when the lease expires, recording the expiry in SharedMemory instead of exiting the CS.
+func (n *RicartNode) expireLease() {
+	n.leaseLock.Lock()
+	if !n.holding || n.exited {
+		n.leaseLock.Unlock()
+		return
+	}
+	n.holding = false
+	n.leaseLock.Unlock()
+
+	n.reqStateLock.Lock()
+	n.clock++
+	n.clock = MaxClockVal(n.clock, n.smPtr.ExpireLease(n.nodeId, n.clock)) + 1
+	log.Printf("N%d: %d: Lease expired. Lock Released. Queue: %v", n.nodeId, n.clock, n.queue.contents)
+	n.reqStateLock.Unlock()
+	n.release()
+}
+
+// Wake up AcquireLock to check whether our request can enter the CS, e.g. once it is acknowledged or a node we were
+// waiting on is presumed crashed. Never blocks: a signal that isn't waited on yet is kept for the next check.
+func (n *RicartNode) signalEntry() {
+	select {
+	case n.wake <- true:
+	default:
+	}
+}
+
+// Withdraw a request that was cancelled before entering the CS.
+func (n *RicartNode) withdraw(req_timestamp ClockVal) {
+	n.reqStateLock.Lock()
+	n.queue.Remove(n.nodeId, req_timestamp)
+	n.clock++
+	n.broadcast(RSPQWithdraw, n.clock, req_timestamp)
+	log.Printf("N%d: %d: Request cancelled. Withdrew request %d. Queue: %v", n.nodeId, n.clock, req_timestamp, n.queue.contents)
+	n.completeRequest()
+	n.reqStateLock.Unlock()
+	n.ongoingReq.Unlock()
+}
 
-	// Now, we can respond to all requests
+// Respond to all deferred requests, and mark our request as completed. Must be called with reqStateLock held.
+func (n *RicartNode) completeRequest() {
 	for n.queue.Length() > 0 {
-		tgtId := n.queue.Extract()
+		tgt := n.queue.ExtractElem()
 		n.clock++
 		resp_timestamp := n.clock
-		n.send(tgtId, RSPQReqAck, resp_timestamp)
+		n.send(tgt.nodeId, RSPQReqAck, resp_timestamp, tgt.timestamp)
 	}
 
 	// Request is completed
 	n.hasOngoingReq = false
-	n.ongoingReq.Unlock()
+	n.inCS = false
 }
 
 
@@ -219,12 +504,16 @@ type RSPQMsgAction int
 const (
 	RSPQRequest RSPQMsgAction = iota
 	RSPQReqAck
+	RSPQWithdraw // A cancelled request that no longer needs a REQ_ACK
+	RSPQHeartbeat // Only sent by nodes with a lease, see FailureDetector.go
 )
 
 type RSPQMsg struct {
 	nodeId int
 	timestamp ClockVal
+	reqTimestamp ClockVal // Timestamp of the request being acknowledged or withdrawn
 	action RSPQMsgAction
+	mode LockMode // Mode of the sender's latest request, which only matters for REQUEST
 }
 
 type RicartNodeEndpoint struct {
@@ -235,6 +524,6 @@ type RicartNodeEndpoint struct {
 func NewRicartNodeEndpoint(nodeId int) RicartNodeEndpoint {
 	return RicartNodeEndpoint{
 		nodeId,
-		make(chan RSPQMsg),
+		make(chan RSPQMsg, 10000), // Buffered, so sending to a crashed node doesn't block
 	}
 }
@@ -0,0 +1,426 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Ricart-Agrawala's algorithm, run separately for every named resource (see LockManager.go)
+type RicartLockManager struct {
+	// Basic Setup
+	nodeId int
+	rmPtr *ResourceMemory
+	endpoint RicartLockManagerEndpoint
+	allEndpoints map[int]RicartLockManagerEndpoint
+
+	// Exit Details
+	exit chan bool // Closed on Shutdown
+
+	// Variables for tracking resources
+	resourcesLock *sync.Mutex // Lock to modify resources, waiting, probeSeq and probed
+	resources map[string]*rlmResource
+	waiting int // Number of our requests waiting to enter the CS
+	probeSeq int // Sequence number of the last PROBE we started
+	probed map[rlmProbe]bool // PROBEs we've already passed on while waiting, so we don't pass them on again
+}
+
+// A resource's Ricart-Agrawala state, like a RicartNode's
+type rlmResource struct {
+	name string
+	lock *sync.Mutex // Lock to modify everything below
+	clock ClockVal
+	hasOngoingReq bool
+	lastReqTimestamp ClockVal // timestamp of this node's most recent request
+	inCS bool
+	deadlocked bool // True once a PROBE for our ongoing request comes back
+	req_acks map[int]bool // Nodes that acknowledged our request. Reset when a new request starts
+	queue *pqueue // Requests we deferred
+	wake chan bool // Signalled when our request may be able to enter the CS, or is deadlocked, see signalEntry
+}
+
+// Identifies a PROBE, and the request it was started for
+type rlmProbe struct {
+	initiator int
+	seq int
+	resource string
+	reqTimestamp ClockVal
+}
+
+func NewRicartLockManager(nodeId int, endpoints []RicartLockManagerEndpoint, rm *ResourceMemory) *RicartLockManager {
+	// Loop through endpoints and get self endpoint
+	if len(endpoints) == 0 {
+		panic("No endpoints given.")
+	}
+
+	endpointMap := make(map[int]RicartLockManagerEndpoint, 0)
+	myEndpoint := endpoints[0]
+	for _, endpoint := range(endpoints) {
+		if endpoint.nodeId == nodeId {
+			myEndpoint = endpoint
+		}
+		endpointMap[endpoint.nodeId] = endpoint
+	}
+	return &RicartLockManager{
+		nodeId, rm, myEndpoint, endpointMap,
+		make(chan bool),
+		&sync.Mutex{}, make(map[string]*rlmResource), 0, 0, make(map[rlmProbe]bool),
+	}
+}
+
+func (n *RicartLockManager) Init() error {
+	go n.handleMsg()
+	return nil
+}
+
+func (n *RicartLockManager) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	n.resourcesLock.Lock(); defer n.resourcesLock.Unlock()
+	select {
+	case <-n.exit:
+	default:
+		close(n.exit)
+	}
+	return nil
+}
+
+// Returns resource `name`'s state, creating it when first used.
+func (n *RicartLockManager) getResource(name string) *rlmResource {
+	n.resourcesLock.Lock(); defer n.resourcesLock.Unlock()
+	r, ok := n.resources[name]
+	if !ok {
+		r = &rlmResource{name, &sync.Mutex{}, ClockVal(0), false, ClockVal(-1), false, false, make(map[int]bool), newPQueue(), make(chan bool, 1)}
+		n.resources[name] = r
+	}
+	return r
+}
+
+// Send a message about our request for `resource` made at `reqTimestamp`. Responsibility for updating clock is on the
+// caller.
+func (n *RicartLockManager) send(dstId int, resource string, action RLMMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
+	n.deliver(dstId, RLMMsg{n.nodeId, resource, timestamp, reqTimestamp, action, rlmProbe{}})
+}
+
+// Send a PROBE, saying we're waiting on `dstId` to acknowledge our request for `resource` made at `reqTimestamp`.
+func (n *RicartLockManager) sendProbe(dstId int, resource string, timestamp ClockVal, reqTimestamp ClockVal, probe rlmProbe) {
+	n.deliver(dstId, RLMMsg{n.nodeId, resource, timestamp, reqTimestamp, RLMProbe, probe})
+}
+
+func (n *RicartLockManager) deliver(dstId int, msg RLMMsg) {
+	if dstId == n.nodeId {
+		panic("Attempted to send message to self")
+	} else if _, ok := n.allEndpoints[dstId]; !ok {
+		panic(fmt.Sprintf("N%d: Unknown endpoint with ID %d.", n.nodeId, dstId))
+	}
+	n.allEndpoints[dstId].recvChan <- msg
+}
+
+func (n *RicartLockManager) broadcast(resource string, action RLMMsgAction, timestamp ClockVal, reqTimestamp ClockVal) {
+	for dstId := range(n.allEndpoints) {
+		if dstId != n.nodeId {
+			n.send(dstId, resource, action, timestamp, reqTimestamp)
+		}
+	}
+}
+
+func (n *RicartLockManager) handleMsg() {
+	for {
+		select {
+		case rcvd_msg, ok := <-n.endpoint.recvChan:
+			if !ok {
+				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
+			}
+			r := n.getResource(rcvd_msg.resource)
+
+			// We want to throw these messages to separate goroutines ASAP so we don't block the next send if any.
+			// Each handler updates the resource's clock under its lock.
+			switch rcvd_msg.action {
+			case RLMRequest: // REQUEST
+				go n.handleRequest(r, rcvd_msg)
+			case RLMReqAck: // REQ_ACK
+				go n.handleReqAck(r, rcvd_msg)
+			case RLMWithdraw: // WITHDRAW
+				go n.handleWithdraw(r, rcvd_msg)
+			case RLMProbe: // PROBE
+				go n.handleProbe(r, rcvd_msg)
+			}
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+func (n *RicartLockManager) handleRequest(r *rlmResource, rcvd_msg RLMMsg) {
+	// Lock, so our request can't complete between deciding to defer the request and adding it to the queue
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+
+	// If we have an ongoing request that is "EARLIER", add that request to the queue and return.
+	// Break ties with nodeId, LOWER ID is prioritised
+	ours := pqueueElem{n.nodeId, r.lastReqTimestamp}
+	theirs := pqueueElem{rcvd_msg.nodeId, rcvd_msg.reqTimestamp}
+	if r.hasOngoingReq && compareElems(ours, theirs) == -1 {
+		r.queue.Insert(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+		return
+	}
+
+	// Otherwise, we acknowledge their request
+	r.clock++
+	n.send(rcvd_msg.nodeId, r.name, RLMReqAck, r.clock, rcvd_msg.reqTimestamp)
+}
+
+func (n *RicartLockManager) handleReqAck(r *rlmResource, rcvd_msg RLMMsg) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+
+	// Only handle REQ_ACK if it is for our ongoing request
+	if !r.hasOngoingReq || rcvd_msg.reqTimestamp != r.lastReqTimestamp {
+		log.Printf("N%d: Received late REQ_ACK for %q from %d", n.nodeId, r.name, rcvd_msg.nodeId)
+		return
+	}
+	if r.req_acks[rcvd_msg.nodeId] {
+		panic(fmt.Sprintf("N%d: Received a second REQ_ACK for %q from %d", n.nodeId, r.name, rcvd_msg.nodeId))
+	}
+	r.req_acks[rcvd_msg.nodeId] = true
+	r.signalEntry()
+}
+
+// Handle a withdrawn request, which we no longer need to acknowledge.
+func (n *RicartLockManager) handleWithdraw(r *rlmResource, rcvd_msg RLMMsg) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+	r.queue.Remove(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+}
+
+// Handle a PROBE from a node waiting on us to acknowledge its request for `r`.
+func (n *RicartLockManager) handleProbe(r *rlmResource, rcvd_msg RLMMsg) {
+	// Only pass it on if we're why the sender is waiting, i.e. we deferred its request. Otherwise our REQ_ACK is on its
+	// way, or the request was withdrawn.
+	r.lock.Lock()
+	r.clock = MaxClockVal(r.clock, rcvd_msg.timestamp) + 1
+	deferred := r.queue.Contains(rcvd_msg.nodeId, rcvd_msg.reqTimestamp)
+	r.lock.Unlock()
+	if !deferred {
+		return
+	}
+
+	probe := rcvd_msg.probe
+	if probe.initiator == n.nodeId {
+		// The PROBE came back. If we're still waiting on the request we started it for, we're deadlocked.
+		initR := n.getResource(probe.resource)
+		initR.lock.Lock(); defer initR.lock.Unlock()
+		if initR.hasOngoingReq && !initR.inCS && initR.lastReqTimestamp == probe.reqTimestamp {
+			initR.deadlocked = true
+			initR.signalEntry()
+			log.Printf("N%d: %d: Deadlock detected on %q. Via: N%d", n.nodeId, initR.clock, initR.name, rcvd_msg.nodeId)
+		}
+		return
+	}
+
+	n.resourcesLock.Lock()
+	if n.waiting == 0 || n.probed[probe] {
+		// Not waiting on anything to pass it on along, or passed on already
+		n.resourcesLock.Unlock()
+		return
+	}
+	n.probed[probe] = true
+	resources := make([]*rlmResource, 0, len(n.resources))
+	for _, res := range n.resources {
+		resources = append(resources, res)
+	}
+	n.resourcesLock.Unlock()
+
+	// Pass it on along every request we're waiting on
+	for _, res := range resources {
+		n.probeWaitingOn(res, probe)
+	}
+}
+
+// Send `probe` to every node that hasn't acknowledged our request for `r`, if we're waiting on one.
+func (n *RicartLockManager) probeWaitingOn(r *rlmResource, probe rlmProbe) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	if !r.hasOngoingReq || r.inCS {
+		return
+	}
+	r.clock++
+	for dstId := range n.allEndpoints {
+		if !r.req_acks[dstId] {
+			n.sendProbe(dstId, r.name, r.clock, r.lastReqTimestamp, probe)
+		}
+	}
+}
+
+// Start a PROBE for our request for `r` (see LockManager.go).
+func (n *RicartLockManager) startProbe(r *rlmResource) {
+	r.lock.Lock()
+	reqTimestamp := r.lastReqTimestamp
+	r.lock.Unlock()
+
+	n.resourcesLock.Lock()
+	n.probeSeq++
+	probe := rlmProbe{n.nodeId, n.probeSeq, r.name, reqTimestamp}
+	n.probed[probe] = true
+	n.resourcesLock.Unlock()
+	n.probeWaitingOn(r, probe)
+}
+
+func (n *RicartLockManager) AcquireLock(ctx context.Context, name string) (FencingToken, error) {
+	r := n.getResource(name)
+
+	// Make a request with timestamp, and broadcast it
+	r.lock.Lock()
+	if r.hasOngoingReq {
+		r.lock.Unlock()
+		return 0, ErrAlreadyRequested
+	}
+	r.hasOngoingReq = true
+	r.deadlocked = false
+	r.clock++
+	req_timestamp := r.clock
+	r.lastReqTimestamp = req_timestamp
+	r.req_acks = map[int]bool{n.nodeId: true} // We acknowledge ourselves <3
+	n.broadcast(name, RLMRequest, req_timestamp, req_timestamp)
+	r.lock.Unlock()
+	n.resourcesLock.Lock(); n.waiting++; n.resourcesLock.Unlock()
+
+	// Block until we've received responses from all nodes, probing for deadlocks while we wait
+	probeTimer := time.NewTimer(DEADLOCK_PROBE_INTV)
+	defer probeTimer.Stop()
+	for {
+		entered, deadlocked := n.tryEnter(r)
+		if entered {
+			n.stopWaiting(r, req_timestamp)
+			break
+		} else if deadlocked {
+			n.withdraw(r)
+			n.stopWaiting(r, req_timestamp)
+			return 0, ErrDeadlock
+		}
+		select {
+		case <-r.wake:
+		case <-probeTimer.C:
+			n.startProbe(r)
+			probeTimer.Reset(DEADLOCK_PROBE_INTV)
+		case <-n.exit:
+			return 0, ErrShutdown // node was shut down
+		case <-ctx.Done():
+			n.withdraw(r)
+			n.stopWaiting(r, req_timestamp)
+			return 0, ctx.Err()
+		}
+	}
+
+	// Enter the CS, using the resource's current time rather than the request's as our fencing token
+	r.lock.Lock(); r.clock++; token := FencingToken(r.clock); r.lock.Unlock()
+	log.Printf("N%d: %d: Lock %q acquired. Entering CS. Queue: %v", n.nodeId, token, name, r.queue.contents)
+	if err := n.rmPtr.Get(name).EnterCS(n.nodeId, token); err != nil {
+		// Our token is later than the last holder's, unless mutual exclusion was already broken. Give up the lock, so
+		// the other nodes aren't held up.
+		n.release(r)
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+// Wake up AcquireLock to check whether our request for `r` can enter the CS, or is deadlocked. Never blocks: a signal
+// that isn't waited on yet is kept for the next check.
+func (r *rlmResource) signalEntry() {
+	select {
+	case r.wake <- true:
+	default:
+	}
+}
+
+// Stop waiting on our request for `r` made at `reqTimestamp`, once it is granted or withdrawn. Forgets the PROBEs we
+// started for it, and once we aren't waiting on any request, the PROBEs we passed on too.
+func (n *RicartLockManager) stopWaiting(r *rlmResource, reqTimestamp ClockVal) {
+	n.resourcesLock.Lock(); defer n.resourcesLock.Unlock()
+	n.waiting--
+	for probe := range n.probed {
+		if n.waiting == 0 || (probe.initiator == n.nodeId && probe.resource == r.name && probe.reqTimestamp == reqTimestamp) {
+			delete(n.probed, probe)
+		}
+	}
+}
+
+// Marks our request for `r` as in the CS if every node acknowledged it. Otherwise, returns whether it is deadlocked.
+func (n *RicartLockManager) tryEnter(r *rlmResource) (entered bool, deadlocked bool) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	if r.deadlocked {
+		return false, true
+	}
+	if len(r.req_acks) < len(n.allEndpoints) {
+		return false, false
+	}
+	r.inCS = true
+	return true, false
+}
+
+func (n *RicartLockManager) ReleaseLock(name string) {
+	r := n.getResource(name)
+
+	// Exit the CS
+	n.rmPtr.Get(name).ExitCS(n.nodeId)
+	n.release(r)
+}
+
+// Give up the lock on `r`, after exiting the CS or failing to enter it.
+func (n *RicartLockManager) release(r *rlmResource) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	log.Printf("N%d: %d: Exiting CS. Lock %q Released. Queue: %v", n.nodeId, r.clock, r.name, r.queue.contents)
+	n.completeRequest(r)
+}
+
+// Withdraw a request that was cancelled, or deadlocked, before entering the CS.
+func (n *RicartLockManager) withdraw(r *rlmResource) {
+	r.lock.Lock(); defer r.lock.Unlock()
+	r.clock++
+	n.broadcast(r.name, RLMWithdraw, r.clock, r.lastReqTimestamp)
+	log.Printf("N%d: %d: Withdrew request %d for %q. Queue: %v", n.nodeId, r.clock, r.lastReqTimestamp, r.name, r.queue.contents)
+	n.completeRequest(r)
+}
+
+// Respond to all deferred requests, and mark our request as completed. Must be called with r.lock held.
+func (n *RicartLockManager) completeRequest(r *rlmResource) {
+	for r.queue.Length() > 0 {
+		tgt := r.queue.ExtractElem()
+		r.clock++
+		n.send(tgt.nodeId, r.name, RLMReqAck, r.clock, tgt.timestamp)
+	}
+
+	// Request is completed
+	r.hasOngoingReq = false
+	r.inCS = false
+}
+
+
+type RLMMsgAction int
+const (
+	RLMRequest RLMMsgAction = iota
+	RLMReqAck
+	RLMWithdraw // A cancelled request that no longer needs a REQ_ACK
+	RLMProbe // Deadlock detection, see LockManager.go
+)
+
+type RLMMsg struct {
+	nodeId int
+	resource string // Name of the lock this message is about
+	timestamp ClockVal // Sender's clock for `resource`
+	reqTimestamp ClockVal // Timestamp of the request being acknowledged, withdrawn or probed
+	action RLMMsgAction
+	probe rlmProbe // Only set for PROBE
+}
+
+type RicartLockManagerEndpoint struct {
+	nodeId int
+	recvChan chan RLMMsg
+}
+
+func NewRicartLockManagerEndpoint(nodeId int) RicartLockManagerEndpoint {
+	return RicartLockManagerEndpoint{
+		nodeId,
+		make(chan RLMMsg, 10000),
+	}
+}
@@ -1,29 +1,82 @@
 package nodetypes
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 )
 
-// Record of who obtained the lock at what timestamp
+// What happened to the lock in an smData record
+type smEvent int
+const (
+	smEntered smEvent = iota
+	smEnteredShared // Entered alongside other readers
+	smExpired // The holder's lease expired
+	smRejected // The node's fencing token was stale, so it wasn't let in
+)
+
+// Record of who obtained the lock with what token, whose lease on the lock expired at what timestamp, or whose stale
+// token was rejected
 type smData struct {
 	lockHolder int
 	timestamp ClockVal
+	event smEvent
 }
 
 // SharedMemory struct that has no innate protection over concurrent usage.
 type SharedMemory struct {
 	history []smData
 	currentHolderId int // current holder, default is -1. this is the shared memory that is being modified and checked
+	readers map[int]bool // Nodes in the CS in shared mode
+	maxReaders int // Most readers that were ever in the CS at once
+	lastToken FencingToken // Latest fencing token let in, or logical time of the latest lease expiry. Default is -1
+	lastExclusiveToken FencingToken // Like lastToken, but only counting exclusive holders. Default is -1
+	k int // Most nodes that may hold the lock at once. Default is 1
+	holders map[int]bool // Nodes in the CS, only used if k > 1 (instead of currentHolderId)
+	maxHolders int // Most holders that were ever in the CS at once, only used if k > 1
+	marks map[int]FencingToken // Latest token each node entered with, or expiry of its lease inside, only used if k > 1
+	fences map[int]FencingToken // Latest expiry of each node's lease while it wasn't inside, e.g. as it was paused
+	pauses map[int]smPause // Nodes to hold back the next time they enter, see PauseEntry
+	historyLock *sync.Mutex // Protects everything, as readers and expiries may happen at once
+}
+
+// A node held back on entering the CS, see PauseEntry
+type smPause struct {
+	paused chan bool // Closed once the node is held back
+	resume chan bool // Closed to let the node go on
 }
 
+// Returned by EnterCS if the node's fencing token is stale.
+var ErrStaleToken = errors.New("Fencing token is stale.")
+
 func NewSharedMemory() *SharedMemory {
-	return &SharedMemory{make([]smData, 0), -1}
+	return NewKSharedMemory(1)
+}
+
+// Like NewSharedMemory, but up to `k` nodes may hold the lock at once (k-mutual exclusion). The (k+1)th panics.
+func NewKSharedMemory(k int) *SharedMemory {
+	if k < 1 {
+		panic(fmt.Sprintf("At least 1 node must be able to hold the lock, got k = %d.", k))
+	}
+	return &SharedMemory{
+		make([]smData, 0), -1, make(map[int]bool), 0, FencingToken(-1), FencingToken(-1),
+		k, make(map[int]bool), 0, make(map[int]FencingToken), make(map[int]FencingToken), make(map[int]smPause), &sync.Mutex{},
+	}
 }
 
 func (sm *SharedMemory) DumpHistory() string {
 	ret := "["
 	for _, smDat := range sm.history {
-		ret += fmt.Sprintf("N%d: %d, ", smDat.lockHolder, smDat.timestamp)
+		switch smDat.event {
+		case smEnteredShared:
+			ret += fmt.Sprintf("N%d: %d (shared), ", smDat.lockHolder, smDat.timestamp)
+		case smExpired:
+			ret += fmt.Sprintf("N%d: %d (expired), ", smDat.lockHolder, smDat.timestamp)
+		case smRejected:
+			ret += fmt.Sprintf("N%d: %d (rejected), ", smDat.lockHolder, smDat.timestamp)
+		default:
+			ret += fmt.Sprintf("N%d: %d, ", smDat.lockHolder, smDat.timestamp)
+		}
 	}
 
 	ret = ret[:len(ret)-2] + "]"
@@ -31,22 +84,136 @@ func (sm *SharedMemory) DumpHistory() string {
 	return ret
 }
 
-// Enter the critical section.
-func (sm *SharedMemory) EnterCS(nodeId int, timestamp ClockVal) {
+// Holds `nodeId` back the next time it enters the CS, as if it were paused (e.g. by garbage collection) between being
+// granted the lock and using it. `paused` is closed once the node is held back, and calling `resume` lets it go on.
+func (sm *SharedMemory) PauseEntry(nodeId int) (paused chan bool, resume func()) {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	pause := smPause{make(chan bool), make(chan bool)}
+	sm.pauses[nodeId] = pause
+	return pause.paused, func() { close(pause.resume) }
+}
+
+// Blocks while `nodeId` is held back by PauseEntry.
+func (sm *SharedMemory) waitIfPaused(nodeId int) {
+	sm.historyLock.Lock()
+	pause, ok := sm.pauses[nodeId]
+	delete(sm.pauses, nodeId)
+	sm.historyLock.Unlock()
+	if ok {
+		close(pause.paused)
+		<-pause.resume
+	}
+}
+
+// Returns true if `nodeId`'s token is no later than `last`, or than the expiry of its lease before it entered.
+// Must be called with historyLock held.
+func (sm *SharedMemory) isStale(nodeId int, token FencingToken, last FencingToken) bool {
+	fence, ok := sm.fences[nodeId]
+	return token <= last || (ok && token <= fence)
+}
+
+// Enter the critical section with the fencing token from AcquireLock.
+// A token no later than the last one let in (or the last lease expiry) belongs to a holder that has since lost the
+// lock, so it is rejected with ErrStaleToken rather than treated as a safety breach.
+func (sm *SharedMemory) EnterCS(nodeId int, token FencingToken) error {
+	sm.waitIfPaused(nodeId)
+	if sm.k > 1 {
+		return sm.enterCSK(nodeId, token)
+	}
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
 	if sm.currentHolderId == nodeId {
 		panic(fmt.Sprintf("Node %d tried to start CS again", nodeId))
 	}
-	sm.history = append(sm.history, smData{nodeId, timestamp})
+	if sm.isStale(nodeId, token, sm.lastToken) {
+		sm.history = append(sm.history, smData{nodeId, ClockVal(token), smRejected})
+		return ErrStaleToken
+	}
+	sm.history = append(sm.history, smData{nodeId, ClockVal(token), smEntered})
 
 	if sm.currentHolderId != -1 {
 		panic(fmt.Sprintf("Safety condition breached: Current holder is %d, but node %d entered too.", sm.currentHolderId, nodeId))
 	}
+	if len(sm.readers) > 0 {
+		panic(fmt.Sprintf("Safety condition breached: Nodes %v are reading, but node %d entered to write.", sm.getReaders(), nodeId))
+	}
 
 	sm.currentHolderId = nodeId
+	sm.lastToken = token
+	sm.lastExclusiveToken = token
+	return nil
+}
+
+// Enter the critical section alongside up to k-1 other holders. Concurrent holders' tokens aren't ordered, so holders
+// may enter in any order, but each node's own tokens increase. A token no later than the node's mark (see ExpireLease)
+// or its lease's expiry before it entered is stale.
+func (sm *SharedMemory) enterCSK(nodeId int, token FencingToken) error {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	if sm.holders[nodeId] {
+		panic(fmt.Sprintf("Node %d tried to start CS again", nodeId))
+	}
+	mark, ok := sm.marks[nodeId]
+	if !ok {
+		mark = FencingToken(-1)
+	}
+	if sm.isStale(nodeId, token, mark) {
+		sm.history = append(sm.history, smData{nodeId, ClockVal(token), smRejected})
+		return ErrStaleToken
+	}
+	sm.history = append(sm.history, smData{nodeId, ClockVal(token), smEntered})
+
+	if len(sm.holders) >= sm.k {
+		panic(fmt.Sprintf("Safety condition breached: Nodes %v hold all %d places, but node %d entered too.", sm.getHolders(), sm.k, nodeId))
+	}
+
+	sm.holders[nodeId] = true
+	sm.marks[nodeId] = token
+	if len(sm.holders) > sm.maxHolders {
+		sm.maxHolders = len(sm.holders)
+	}
+	if token > sm.lastToken {
+		sm.lastToken = token
+	}
+	return nil
+}
+
+// Enter the critical section in shared mode, alongside any other readers. Only a token no later than the last
+// exclusive holder's (or the last expiry of an exclusive holder's lease) is stale, as readers may enter in any order.
+func (sm *SharedMemory) EnterCSShared(nodeId int, token FencingToken) error {
+	sm.waitIfPaused(nodeId)
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	if sm.currentHolderId == nodeId || sm.readers[nodeId] {
+		panic(fmt.Sprintf("Node %d tried to start CS again", nodeId))
+	}
+	if sm.isStale(nodeId, token, sm.lastExclusiveToken) {
+		sm.history = append(sm.history, smData{nodeId, ClockVal(token), smRejected})
+		return ErrStaleToken
+	}
+	sm.history = append(sm.history, smData{nodeId, ClockVal(token), smEnteredShared})
+
+	if sm.currentHolderId != -1 {
+		panic(fmt.Sprintf("Safety condition breached: Current holder is %d, but node %d entered to read.", sm.currentHolderId, nodeId))
+	}
+
+	sm.readers[nodeId] = true
+	if len(sm.readers) > sm.maxReaders {
+		sm.maxReaders = len(sm.readers)
+	}
+	if token > sm.lastToken {
+		sm.lastToken = token
+	}
+	return nil
 }
 
 // Exits the critical section
 func (sm *SharedMemory) ExitCS(nodeId int) {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	if sm.k > 1 {
+		if !sm.holders[nodeId] {
+			panic(fmt.Sprintf("Node %d tried to exit CS without entering.", nodeId))
+		}
+		delete(sm.holders, nodeId)
+		return
+	}
 	if sm.currentHolderId != nodeId {
 		if sm.currentHolderId == -1 {
 			panic(fmt.Sprintf("Node %d tried to exit CS without entering.", nodeId))
@@ -55,5 +222,120 @@ func (sm *SharedMemory) ExitCS(nodeId int) {
 	}
 
 	sm.currentHolderId = -1
-	
+}
+
+// Exits the critical section after EnterCSShared
+func (sm *SharedMemory) ExitCSShared(nodeId int) {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	if !sm.readers[nodeId] {
+		panic(fmt.Sprintf("Node %d tried to exit CS without entering to read.", nodeId))
+	}
+	delete(sm.readers, nodeId)
+}
+
+// Returns the most readers that were ever in the CS at once.
+func (sm *SharedMemory) MaxReaders() int {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	return sm.maxReaders
+}
+
+// Returns the most nodes that may hold the lock at once, as given to NewKSharedMemory.
+func (sm *SharedMemory) K() int {
+	return sm.k
+}
+
+// Returns the most holders that were ever in the CS at once, if k > 1.
+func (sm *SharedMemory) MaxHolders() int {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	return sm.maxHolders
+}
+
+// Returns the holders in the CS, if k > 1. Must be called with historyLock held.
+func (sm *SharedMemory) getHolders() []int {
+	ret := make([]int, 0)
+	for nodeId := range sm.holders {
+		ret = append(ret, nodeId)
+	}
+	return ret
+}
+
+// Returns the readers in the CS. Must be called with historyLock held.
+func (sm *SharedMemory) getReaders() []int {
+	ret := make([]int, 0)
+	for nodeId := range sm.readers {
+		ret = append(ret, nodeId)
+	}
+	return ret
+}
+
+// Records that `nodeId`'s lease on the CS expired at `timestamp` if it is still inside, so another node may enter. If it
+// isn't inside yet, its token is rejected when it tries to enter.
+// Returns the latest fencing token or expiry, which the caller must merge into its clock as it would a message's
+// timestamp. Any node entering after the expiry then does so with a later token, as EnterCS requires.
+func (sm *SharedMemory) ExpireLease(nodeId int, timestamp ClockVal) ClockVal {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	if sm.currentHolderId == nodeId {
+		sm.history = append(sm.history, smData{nodeId, timestamp, smExpired})
+		sm.currentHolderId = -1
+		if FencingToken(timestamp) > sm.lastToken {
+			sm.lastToken = FencingToken(timestamp)
+		}
+		if FencingToken(timestamp) > sm.lastExclusiveToken {
+			sm.lastExclusiveToken = FencingToken(timestamp)
+		}
+	} else if sm.holders[nodeId] {
+		sm.history = append(sm.history, smData{nodeId, timestamp, smExpired})
+		delete(sm.holders, nodeId)
+		if FencingToken(timestamp) > sm.marks[nodeId] {
+			// Its lease is over, so it mustn't enter again with the token it held
+			sm.marks[nodeId] = FencingToken(timestamp)
+		}
+		if FencingToken(timestamp) > sm.lastToken {
+			sm.lastToken = FencingToken(timestamp)
+		}
+	} else if sm.readers[nodeId] {
+		// Other readers may still be inside, so only writers have to wait for the expiry
+		sm.history = append(sm.history, smData{nodeId, timestamp, smExpired})
+		delete(sm.readers, nodeId)
+		if FencingToken(timestamp) > sm.lastToken {
+			sm.lastToken = FencingToken(timestamp)
+		}
+	} else if FencingToken(timestamp) > sm.fences[nodeId] {
+		// Not inside, e.g. paused after being granted the lock, so it mustn't enter with the token it was granted
+		sm.fences[nodeId] = FencingToken(timestamp)
+	}
+	return ClockVal(sm.lastToken)
+}
+
+// Returns the nodes whose lease expired while they were in the CS, in order of expiry.
+func (sm *SharedMemory) ExpiredLeases() []int {
+	sm.historyLock.Lock(); defer sm.historyLock.Unlock()
+	ret := make([]int, 0)
+	for _, smDat := range sm.history {
+		if smDat.event == smExpired {
+			ret = append(ret, smDat.lockHolder)
+		}
+	}
+	return ret
+}
+
+// A SharedMemory for each named resource (see LockManager.go), created when the resource is first used.
+type ResourceMemory struct {
+	mems map[string]*SharedMemory
+	lock *sync.Mutex
+}
+
+func NewResourceMemory() *ResourceMemory {
+	return &ResourceMemory{make(map[string]*SharedMemory), &sync.Mutex{}}
+}
+
+// Returns the SharedMemory guarding resource `name`.
+func (rm *ResourceMemory) Get(name string) *SharedMemory {
+	rm.lock.Lock(); defer rm.lock.Unlock()
+	sm, ok := rm.mems[name]
+	if !ok {
+		sm = NewSharedMemory()
+		rm.mems[name] = sm
+	}
+	return sm
 }
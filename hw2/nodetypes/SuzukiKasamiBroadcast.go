@@ -0,0 +1,383 @@
+package nodetypes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Communication endpoint for each node -- this is the only thing shared between nodes
+type SuzukiKasamiNodeEndpoint struct {
+	nodeId int
+	recvChan chan SKMsg // Incoming messages for this node are sent here
+}
+
+func NewSuzukiKasamiNodeEndpoint(nodeId int) SuzukiKasamiNodeEndpoint {
+	return SuzukiKasamiNodeEndpoint{nodeId, make(chan SKMsg, 10000)}
+}
+
+// Token that is passed between nodes. Only a node holding one may enter the CS.
+type skToken struct {
+	lastGranted map[int]int // Sequence number of each node's last request that was granted
+	queue []int // Nodes waiting for the token, in the order they will receive it
+}
+
+// Node that follows the Suzuki-Kasami Broadcast Algorithm.
+// A node broadcasts a REQUEST with its next sequence number, and waits for the token. A node that holds the token
+// can enter the CS again without sending any message.
+// With k tokens, up to k nodes may be in the CS at once (see NewKSuzukiKasamiNode).
+type SuzukiKasamiNode struct {
+	// Basic Setup
+	nodeId int
+	clock ClockVal
+	smPtr *SharedMemory
+	endpoint SuzukiKasamiNodeEndpoint
+	allEndpoints map[int]SuzukiKasamiNodeEndpoint
+	nodeIds []int // Sorted, so nodes are added to the token's queue in a fixed order
+
+	// Exit details
+	exit chan bool // Closed on Shutdown
+
+	// Variables for node's own request
+	ongoingReqLock *sync.Mutex // Locked while the node is REQUESTING
+	lock *sync.Mutex // Lock for all variables below
+	requested map[int]int // Highest sequence number received from each node
+	withdrawn map[int]int // Highest sequence number each node has withdrawn
+	tokens []*skToken // Tokens this node holds. While in the CS, it is using tokens[0]
+	requesting bool
+	inCS bool
+	acquired chan bool
+}
+
+// Initialise a new SuzukiKasamiNode. The node with the lowest ID starts with the token.
+func NewSuzukiKasamiNode(nodeId int, endpoints []SuzukiKasamiNodeEndpoint, sm *SharedMemory) *SuzukiKasamiNode {
+	return newSuzukiKasamiNode(nodeId, endpoints, sm, 1)
+}
+
+// Like NewSuzukiKasamiNode, but there are k tokens, so up to k nodes may be in the CS at once, where `sm` came from
+// NewKSharedMemory(k). The k nodes with the lowest IDs start with a token each.
+// Every idle holder that hears a REQUEST may send it a token, so a node may get a token it no longer needs. It passes it
+// on as if it had used it, so every token learns the request was granted.
+func NewKSuzukiKasamiNode(nodeId int, endpoints []SuzukiKasamiNodeEndpoint, sm *SharedMemory) *SuzukiKasamiNode {
+	return newSuzukiKasamiNode(nodeId, endpoints, sm, sm.K())
+}
+
+func newSuzukiKasamiNode(nodeId int, endpoints []SuzukiKasamiNodeEndpoint, sm *SharedMemory, k int) *SuzukiKasamiNode {
+	if len(endpoints) == 0 {
+		panic("No endpoints given.")
+	}
+	if k < 1 || k > len(endpoints) {
+		panic(fmt.Sprintf("k must be between 1 and %d, got %d.", len(endpoints), k))
+	}
+
+	nodeIds := make([]int, 0)
+	endpointMap := make(map[int]SuzukiKasamiNodeEndpoint, 0)
+	myEndpoint := endpoints[0]
+	for _, endpoint := range(endpoints) {
+		if endpoint.nodeId == nodeId {
+			myEndpoint = endpoint
+		}
+		nodeIds = append(nodeIds, endpoint.nodeId)
+		endpointMap[endpoint.nodeId] = endpoint
+	}
+	sort.Ints(nodeIds)
+
+	requested := make(map[int]int)
+	tokens := make([]*skToken, 0)
+	for _, tokenHolder := range nodeIds[:k] {
+		if nodeId == tokenHolder {
+			tokens = append(tokens, &skToken{make(map[int]int), make([]int, 0)})
+		}
+	}
+	return &SuzukiKasamiNode{
+		nodeId, ClockVal(0), sm, myEndpoint, endpointMap, nodeIds,
+		make(chan bool),
+		&sync.Mutex{}, &sync.Mutex{}, requested, make(map[int]int), tokens, false, false, make(chan bool, 1),
+	}
+}
+
+func (n *SuzukiKasamiNode) Init() error {
+	go n.handleMsg()
+	return nil
+}
+
+func (n *SuzukiKasamiNode) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	select {
+	case <-n.exit:
+	default:
+		close(n.exit)
+	}
+	return nil
+}
+
+// Handle incoming messages one at a time.
+func (n *SuzukiKasamiNode) handleMsg() {
+	for {
+		select {
+		case rcvd_msg, ok := <-n.endpoint.recvChan:
+			if !ok {
+				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
+			}
+
+			n.lock.Lock()
+			// Update local clock to be elementwise max + 1
+			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
+			switch rcvd_msg.action {
+			case SKRequest:
+				n.handleRequest(rcvd_msg)
+			case SKToken:
+				n.handleToken(rcvd_msg)
+			case SKWithdraw:
+				n.handleWithdraw(rcvd_msg)
+			}
+			n.lock.Unlock()
+		case <-n.exit:
+			return
+		}
+	}
+}
+
+// Handle an incoming request, passing a token on if we hold one and aren't using it.
+func (n *SuzukiKasamiNode) handleRequest(msg SKMsg) {
+	if msg.seq <= n.requested[msg.nodeId] {
+		// Outdated request
+		return
+	}
+	n.requested[msg.nodeId] = msg.seq
+	log.Printf("[%d] - N%d: Received REQUEST %d from N%d.", n.clock, n.nodeId, msg.seq, msg.nodeId)
+
+	for i, token := range n.tokens {
+		if (i > 0 || !n.inCS) && n.outstanding(token, msg.nodeId) {
+			n.tokens = append(n.tokens[:i], n.tokens[i+1:]...)
+			n.sendToken(msg.nodeId, token)
+			return
+		}
+	}
+}
+
+// Handle a cancelled request, so the token isn't passed to a node that no longer wants it.
+func (n *SuzukiKasamiNode) handleWithdraw(msg SKMsg) {
+	if msg.seq > n.withdrawn[msg.nodeId] {
+		n.withdrawn[msg.nodeId] = msg.seq
+	}
+	log.Printf("[%d] - N%d: Received WITHDRAW %d from N%d.", n.clock, n.nodeId, msg.seq, msg.nodeId)
+}
+
+// Handle the incoming token.
+func (n *SuzukiKasamiNode) handleToken(msg SKMsg) {
+	log.Printf("[%d] - N%d: Received TOKEN from N%d. Queue: %v", n.clock, n.nodeId, msg.nodeId, msg.token.queue)
+	n.tokens = append(n.tokens, msg.token)
+	if !n.requesting {
+		// We withdrew our request after the token was sent to us, or another token got to us first
+		n.passTokens("Request was withdrawn or already granted.")
+		return
+	}
+	n.requesting = false
+	n.inCS = true
+	n.acquired <- true
+}
+
+// Returns true if `nodeId` has a request that `token` hasn't granted, and that wasn't withdrawn. Must be called with the
+// lock held.
+func (n *SuzukiKasamiNode) outstanding(token *skToken, nodeId int) bool {
+	seq := n.requested[nodeId]
+	return seq > token.lastGranted[nodeId] && seq > n.withdrawn[nodeId]
+}
+
+// Mark our own request as done, and pass each token we aren't using to the next node that wants it, if any. No two
+// tokens go to the same node. `event` is logged along with each queue. Must be called with the lock held.
+func (n *SuzukiKasamiNode) passTokens(event string) {
+	// A request granted by any token was granted, so each token learns what the others know
+	for _, token := range n.tokens {
+		for _, other := range n.tokens {
+			for nodeId, seq := range other.lastGranted {
+				if seq > token.lastGranted[nodeId] {
+					token.lastGranted[nodeId] = seq
+				}
+			}
+		}
+	}
+
+	kept := make([]*skToken, 0)
+	idle := n.tokens
+	if n.inCS {
+		kept = append(kept, n.tokens[0])
+		idle = n.tokens[1:]
+	}
+	sent := make(map[int]bool)
+	for _, token := range idle {
+		token.lastGranted[n.nodeId] = n.requested[n.nodeId]
+
+		// Queue every node with an outstanding request that isn't queued yet
+		queued := make(map[int]bool)
+		for _, nodeId := range token.queue {
+			queued[nodeId] = true
+		}
+		for _, nodeId := range n.nodeIds {
+			if !queued[nodeId] && n.outstanding(token, nodeId) {
+				token.queue = append(token.queue, nodeId)
+			}
+		}
+		log.Printf("[%d] - N%d: %s Queue: %v", n.clock, n.nodeId, event, token.queue)
+
+		passed := false
+		for !passed && len(token.queue) > 0 {
+			next := token.queue[0]
+			token.queue = token.queue[1:]
+			// Skip nodes that have withdrawn since they were queued, or were just sent another token. The latter are
+			// queued again next time if they still want one.
+			if n.outstanding(token, next) && !sent[next] {
+				// The token belongs to `next` once sent, so we mustn't touch it again
+				n.sendToken(next, token)
+				sent[next] = true
+				passed = true
+			}
+		}
+		if !passed {
+			kept = append(kept, token)
+		}
+	}
+	n.tokens = kept
+}
+
+// Pass `token` on. The caller must have removed it from n.tokens. Must be called with the lock held.
+func (n *SuzukiKasamiNode) sendToken(dstId int, token *skToken) {
+	n.clock++
+	n.send(dstId, SKMsg{n.nodeId, n.clock, 0, SKToken, token})
+	log.Printf("[%d] - N%d: Sent TOKEN to N%d.", n.clock, n.nodeId, dstId)
+}
+
+// Attempt to acquire the lock
+func (n *SuzukiKasamiNode) AcquireLock(ctx context.Context) (FencingToken, error) {
+	// Block until we can start an ongoing request
+	n.ongoingReqLock.Lock()
+
+	n.lock.Lock()
+	n.clock++
+	if len(n.tokens) > 0 {
+		// We hold a token already, so we can enter without asking anyone
+		n.inCS = true
+		n.lock.Unlock()
+	} else {
+		n.requesting = true
+		n.requested[n.nodeId]++
+		seq := n.requested[n.nodeId]
+		for _, dstId := range n.nodeIds {
+			if dstId != n.nodeId {
+				n.send(dstId, SKMsg{n.nodeId, n.clock, seq, SKRequest, nil})
+			}
+		}
+		log.Printf("[%d] - N%d: Start request %d", n.clock, n.nodeId, seq)
+		n.lock.Unlock()
+
+		// BLOCK until we receive the token
+		select {
+		case <-n.acquired:
+		case <-n.exit:
+			return 0, ErrShutdown // node was shut down
+		case <-ctx.Done():
+			n.withdraw(seq)
+			return 0, ctx.Err()
+		}
+	}
+
+	n.lock.Lock()
+	n.clock++; token := FencingToken(n.clock)
+	log.Printf("[%d] - N%d: Lock acquired. Entering CS.", n.clock, n.nodeId)
+	n.lock.Unlock()
+	if err := n.smPtr.EnterCS(n.nodeId, token); err != nil { // (Simulated method of entering unsafe CS)
+		// Our token is later than the last holder's, unless mutual exclusion was already broken. Give up the lock, so the
+		// other nodes aren't held up.
+		n.release()
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+func (n *SuzukiKasamiNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+// Withdraw a request that was cancelled before entering the CS.
+func (n *SuzukiKasamiNode) withdraw(seq int) {
+	n.lock.Lock()
+	n.clock++
+	if n.inCS {
+		// The token arrived as we were cancelled, so pass it on as if we had used it
+		<-n.acquired
+		n.inCS = false
+		n.passTokens(fmt.Sprintf("Request %d cancelled.", seq))
+	} else {
+		log.Printf("[%d] - N%d: Request %d cancelled.", n.clock, n.nodeId, seq)
+		n.requesting = false
+		n.withdrawn[n.nodeId] = seq
+		for _, dstId := range n.nodeIds {
+			if dstId != n.nodeId {
+				n.send(dstId, SKMsg{n.nodeId, n.clock, seq, SKWithdraw, nil})
+			}
+		}
+	}
+	n.lock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Attempt to release the lock
+func (n *SuzukiKasamiNode) ReleaseLock() {
+	n.smPtr.ExitCS(n.nodeId) // (Simulated method of exiting unsafe CS)
+	n.release()
+}
+
+// Give up the lock, after exiting the CS or failing to enter it.
+func (n *SuzukiKasamiNode) release() {
+	n.lock.Lock()
+	n.clock++
+	n.inCS = false
+	n.passTokens("Lock released.")
+	n.lock.Unlock()
+	n.ongoingReqLock.Unlock()
+}
+
+// Send a message.
+func (n *SuzukiKasamiNode) send(dstId int, msg SKMsg) {
+	if _, ok := n.allEndpoints[dstId]; !ok {
+		panic(fmt.Sprintf("N%d: Tried to send %v to unknown endpoint with ID %d.", n.nodeId, getSKMsgAction(msg.action), dstId))
+	}
+	n.allEndpoints[dstId].recvChan <- msg
+}
+
+// -----
+// HELPER STRUCTS
+// -----
+
+// Message used for inter-SuzukiKasamiNode communication.
+type SKMsg struct {
+	nodeId int
+	timestamp ClockVal
+	seq int // Sequence number of a REQUEST or WITHDRAW
+	action SKMsgAction
+	token *skToken // The token, for a TOKEN
+}
+
+type SKMsgAction int
+const (
+	SKRequest SKMsgAction = iota
+	SKToken
+	SKWithdraw // Cancels a REQUEST that hasn't received the token yet
+)
+
+func getSKMsgAction(action SKMsgAction) string {
+	switch action {
+	case SKRequest:
+		return "REQUEST"
+	case SKToken:
+		return "TOKEN"
+	case SKWithdraw:
+		return "WITHDRAW"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", action)
+	}
+}
@@ -1,9 +1,11 @@
 package nodetypes
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 // Communication endpoint for each node -- this is the only thing shared between nodes, which allows us to prevent nodes from modifying each others' memory
@@ -13,7 +15,7 @@ type VoterNodeEndpoint struct {
 }
 
 func NewVoterNodeEndpoint(nodeId int) VoterNodeEndpoint {
-	return VoterNodeEndpoint{nodeId, make(chan VoterMsg)}
+	return VoterNodeEndpoint{nodeId, make(chan VoterMsg, 10000)} // Buffered, so sending to a crashed node doesn't block
 }
 
 // Node that follows the Voting Protocol.
@@ -29,7 +31,8 @@ type VoterNode struct {
 	// Exit details
 	exit chan bool
 	voterExit chan bool
-	reqSeshExit chan bool
+	reqSeshExit chan bool // Closed on shutdown
+	exited bool
 
 	// Variables for node's own request
 	ongoingReqLock *sync.Mutex // Locked while the node is REQUESTING
@@ -42,10 +45,26 @@ type VoterNode struct {
 	attemptingRescind bool     // True if this node has rescinded but is waiting for the vote
 	votedForReq VoterMsg // Request that we've voted for
 	voteMsgs chan VoterMsg // Channel of unhandled requests/releases (i.e. not in queue)
+
+	// Fault tolerance, only used by nodes with a lease
+	lease time.Duration // How long the node may stay in the CS. 0 if the node has no lease
+	detector *failureDetector // nil if the node has no lease
+	crashed chan int // Nodes presumed crashed, handled by the Voter goroutine
+	monitorExit chan bool
+	leaseLock *sync.Mutex // Lock to modify holding and leaseTimer
+	holding bool // True while in the CS with a lease that hasn't expired
+	leaseTimer *time.Timer
 }
 
 // Initialise a new VoterNode. This connects the node to SharedMemory, and to the other nodes' endpoints.
 func NewVoterNode(nodeId int, endpoints []VoterNodeEndpoint, sm *SharedMemory) *VoterNode {
+	return NewVoterNodeWithLease(nodeId, endpoints, sm, 0)
+}
+
+// Like NewVoterNode, but the node gives up the lock if it stays in the CS for longer than `lease`, and recovers from
+// other nodes crashing (see FailureDetector.go). A lease of 0 disables both.
+// A majority is still counted out of every node, so fewer than half the nodes may crash.
+func NewVoterNodeWithLease(nodeId int, endpoints []VoterNodeEndpoint, sm *SharedMemory, lease time.Duration) *VoterNode {
 	if len(endpoints) == 0 {
 		panic("No endpoints given.")
 	}
@@ -60,24 +79,47 @@ func NewVoterNode(nodeId int, endpoints []VoterNodeEndpoint, sm *SharedMemory) *
 		nodeIds = append(nodeIds, endpoint.nodeId)
 		endpointMap[endpoint.nodeId] = endpoint
 	}
+	var detector *failureDetector
+	if lease > 0 {
+		detector = newFailureDetector(nodeIds, nodeId)
+	}
 	return &VoterNode{
 		nodeId, ClockVal(0), sm, myEndpoint, endpointMap, len(endpoints),
-		make(chan bool), make(chan bool), make(chan bool),
+		make(chan bool), make(chan bool), make(chan bool), false,
 		&sync.Mutex{}, false, newVoteSession("", ClockVal(-1), endpointMap, 0, make(chan bool)), 0,
 		newPQueueVP(), false, getEmptyVoterMsg(), make(chan VoterMsg),
+		lease, detector, make(chan int, len(endpoints)), make(chan bool), &sync.Mutex{}, false, nil,
 	}
 }
 
 func (n *VoterNode) Init() error {
 	go n.handleMsg(); go n.Voter()
+	if n.detector != nil {
+		n.detector.Reset()
+		go n.monitor()
+	}
 	return nil
 }
 
 func (n *VoterNode) Shutdown() error {
+	// A node may be shut down twice, e.g. by the Orchestrator after a test crashed it
+	if n.exited {
+		return nil
+	}
 	n.exit <- true; n.voterExit <- true;
-	if n.hasOngoingReq {
-		n.reqSeshExit <- true
+	n.exited = true
+	// Closed rather than sent to, as the node may be in the CS rather than waiting for votes
+	close(n.reqSeshExit)
+	if n.detector != nil {
+		n.monitorExit <- true
+	}
+
+	// A crashed node can't give up its lease. The other nodes expire it once they presume it crashed.
+	n.leaseLock.Lock()
+	if n.leaseTimer != nil {
+		n.leaseTimer.Stop()
 	}
+	n.leaseLock.Unlock()
 	return nil
 }
 
@@ -89,6 +131,12 @@ func (n *VoterNode) handleMsg() {
 			if !ok {
 				panic(fmt.Sprintf("N%d: My channel was closed!", n.nodeId))
 			}
+			// Ignore nodes presumed crashed, as we've already taken back our vote
+			if n.detector.Crashed(rcvd_msg.nodeId) {
+				continue
+			}
+			n.detector.Heard(rcvd_msg.nodeId)
+
 			// Update local clock to be elementwise max + 1
 			n.clock = MaxClockVal(n.clock, rcvd_msg.timestamp) + 1
 			
@@ -101,7 +149,7 @@ func (n *VoterNode) handleMsg() {
 				go n.handleVote(rcvd_msg)
 			case VPRescind:
 				go n.handleRescind(rcvd_msg)
-			case VPRelease:
+			case VPRelease, VPWithdraw:
 				// Handover to the Voter goroutine
 				go func(msg VoterMsg){n.voteMsgs <- msg}(rcvd_msg)
 			}
@@ -122,7 +170,11 @@ func (n *VoterNode) Voter() {
 				n.voterHandleRequest(msg)
 			case VPRelease:
 				n.voterHandleRelease(msg)
+			case VPWithdraw:
+				n.voterHandleWithdraw(msg)
 			}
+		case nodeId := <-n.crashed:
+			n.voterHandleCrash(nodeId)
 		case <-n.voterExit:
 			for range n.voteMsgs {
 				// drop messages
@@ -136,6 +188,10 @@ func (n *VoterNode) Voter() {
 
 // Handle an incoming request.
 func (n *VoterNode) voterHandleRequest(msg VoterMsg) {
+	if n.detector.Crashed(msg.nodeId) {
+		// Presumed crashed since the REQUEST arrived. Voting for it would lose our vote.
+		return
+	}
 	if n.votedForReq.action == VPInvalid {
 		// We haven't voted!
 		n.votedForReq = msg
@@ -176,8 +232,9 @@ func (n *VoterNode) voterHandleRequest(msg VoterMsg) {
 // Handle an incoming release
 func (n *VoterNode) voterHandleRelease(msg VoterMsg) {
 	if msg.electionId != n.votedForReq.electionId {
-		panic(fmt.Sprintf("N%d: Received INVALID RELEASE from N%d: Expected ID: %v, received ID: %v", n.nodeId, msg.nodeId, n.votedForReq.electionId, msg.electionId))
-		
+		// A cancelled request may return a vote that was already released -- it no longer holds our vote either way
+		log.Printf("[%d] - N%d: Received stale RELEASE from N%d: Expected ID: %v, received ID: %v", n.clock, n.nodeId, msg.nodeId, n.votedForReq.electionId, msg.electionId)
+		return
 	}
 
 	n.attemptingRescind = false
@@ -196,6 +253,57 @@ func (n *VoterNode) voterHandleRelease(msg VoterMsg) {
 	log.Printf("[%d] - N%d: Received RELEASE from N%d. VOTED for N%d.", n.clock, n.nodeId, msg.nodeId, next.nodeId)
 }
 
+// Handle a cancelled request
+func (n *VoterNode) voterHandleWithdraw(msg VoterMsg) {
+	if msg.electionId == n.votedForReq.electionId {
+		// The requester returns our vote with a RELEASE
+		return
+	}
+	if n.voteBacklog.Remove(msg.nodeId, msg.electionId) {
+		log.Printf("[%d] - N%d: Received WITHDRAW from N%d. Removed from backlog.", n.clock, n.nodeId, msg.nodeId)
+	}
+}
+
+// Handle a node presumed crashed: drop its requests from the backlog, and take back our vote if it holds it, as if it
+// had released it. If it crashed in the CS, its lease is expired, which we merge into our clock like a message's
+// timestamp, before voting for the next request.
+func (n *VoterNode) voterHandleCrash(nodeId int) {
+	n.voteBacklog.RemoveNode(nodeId)
+	n.clock = MaxClockVal(n.clock, n.smPtr.ExpireLease(nodeId, n.clock)) + 1
+	if n.votedForReq.nodeId != nodeId {
+		log.Printf("[%d] - N%d: N%d presumed crashed.", n.clock, n.nodeId, nodeId)
+		return
+	}
+
+	log.Printf("[%d] - N%d: N%d presumed crashed. Taking back vote.", n.clock, n.nodeId, nodeId)
+	n.voterHandleRelease(VoterMsg{nodeId, n.votedForReq.electionId, n.clock, VPRelease})
+}
+
+// Send a HEARTBEAT to every node not presumed crashed, and report the nodes we've stopped hearing from to the Voter.
+func (n *VoterNode) monitor() {
+	ticker := time.NewTicker(LEASE_HEARTBEAT_INTV)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for dstId, endpoint := range n.allEndpoints {
+				if dstId == n.nodeId || n.detector.Crashed(dstId) {
+					continue
+				}
+				select {
+				case endpoint.recvChan <- VoterMsg{n.nodeId, "", n.clock, VPHeartbeat}:
+				default: // Don't block on a node that has stopped receiving
+				}
+			}
+			for _, nodeId := range n.detector.Check() {
+				n.crashed <- nodeId
+			}
+		case <-n.monitorExit:
+			return
+		}
+	}
+}
+
 func (n *VoterNode) handleVote(rcvd_msg VoterMsg) {
 	if !n.hasOngoingReq {
 		log.Printf("[%d] - N%d: Received late VOTE from N%d.", n.clock, n.nodeId, rcvd_msg.nodeId)
@@ -239,7 +347,7 @@ func (n *VoterNode) handleRescind(rcvd_msg VoterMsg) {
 }
 
 // Attempt to acquire the lock
-func (n *VoterNode) AcquireLock() {
+func (n *VoterNode) AcquireLock(ctx context.Context) (FencingToken, error) {
 	// Block until we can start an ongoing request
 	n.ongoingReqLock.Lock(); n.hasOngoingReq = true
 	n.clock++; req_ts := n.clock
@@ -254,22 +362,65 @@ func (n *VoterNode) AcquireLock() {
 	log.Printf("[%d] - N%d: Start request", n.clock, n.nodeId)
 
 	// BLOCK until we have majority responses
-	successfulVote := n.ongoingReqSesh.Wait()
-	if !successfulVote { return } // node was shut down
+	err := n.ongoingReqSesh.Wait(ctx)
+	if err == ErrShutdown {
+		return 0, err // node was shut down
+	} else if err != nil {
+		n.withdraw()
+		return 0, err
+	}
 
 	log.Printf("[%d] - N%d: Lock acquired. Entering CS. Voters: %v", n.clock, n.nodeId, n.ongoingReqSesh.GetVoters())
 
-	n.smPtr.EnterCS(n.nodeId, req_ts) // (Simulated method of entering unsafe CS)
+	// Enter using the current time rather than the request's as our fencing token
+	n.clock++; token := FencingToken(n.clock)
+	// The lease runs from when we're granted the lock, so it also expires if we're paused before entering
+	n.startLease()
+	if err := n.smPtr.EnterCS(n.nodeId, token); err != nil { // (Simulated method of entering unsafe CS)
+		// Our token is later than the last holder's, unless our lease expired before we could enter (e.g. we were
+		// paused) and the lock has moved on. Give up the lock, unless the expiry already has.
+		if n.stopLease() {
+			n.release()
+		}
+		return 0, enterError(n.nodeId, token, err)
+	}
+	return token, nil
+}
+
+func (n *VoterNode) TryAcquire(timeout time.Duration) (FencingToken, bool) {
+	return tryAcquire(n, timeout)
+}
+
+// Withdraw a request that was cancelled before entering the CS. Any votes we hold are released, and votes that
+// arrive later are returned as late votes.
+func (n *VoterNode) withdraw() {
+	voters := n.ongoingReqSesh.Close()
+	n.clock++; withdraw_ts := n.clock
+	log.Printf("[%d] - N%d: Request cancelled. Releasing voters: %v", n.clock, n.nodeId, voters)
+
+	for _, voterId := range(voters) {
+		n.send(n.ongoingReqSesh.electionId, voterId, VPRelease, withdraw_ts)
+	}
+	n.broadcast(n.ongoingReqSesh.electionId, VPWithdraw, withdraw_ts)
+	n.ongoingReqLock.Unlock(); n.hasOngoingReq = false
 }
 
 // Attempt to release the lock
 func (n *VoterNode) ReleaseLock() {
+	if !n.stopLease() {
+		log.Printf("[%d] - N%d: Lease already expired", n.clock, n.nodeId)
+		return
+	}
+
 	n.smPtr.ExitCS(n.nodeId)  // (Simulated method of exiting unsafe CS)
+	log.Printf("[%d] - N%d: Lock released", n.clock, n.nodeId)
+	n.release()
+}
 
+func (n *VoterNode) release() {
 	// Send releases
 	voters := n.ongoingReqSesh.GetVoters()
 	n.clock++; release_ts := n.clock
-	log.Printf("[%d] - N%d: Lock released", n.clock, n.nodeId)
 	
 	for _, voterId := range(voters) {
 		log.Printf("[%d] - N%d: Sent RELEASE to N%d.", n.clock, n.nodeId, voterId)
@@ -278,6 +429,46 @@ func (n *VoterNode) ReleaseLock() {
 	n.ongoingReqLock.Unlock(); n.hasOngoingReq = false
 }
 
+// Start the lease on being granted the lock, if the node has one.
+func (n *VoterNode) startLease() {
+	if n.lease == 0 {
+		return
+	}
+	n.leaseLock.Lock(); defer n.leaseLock.Unlock()
+	n.holding = true
+	n.leaseTimer = time.AfterFunc(n.lease, n.expireLease)
+}
+
+// Stop the lease on leaving the CS. Returns false if it has already expired, in which case the lock was released.
+func (n *VoterNode) stopLease() bool {
+	if n.lease == 0 {
+		return true
+	}
+	n.leaseLock.Lock(); defer n.leaseLock.Unlock()
+	if !n.holding {
+		return false
+	}
+	n.holding = false
+	n.leaseTimer.Stop()
+	return true
+}
+
+// Give up the lock when the lease expires, recording the expiry in SharedMemory instead of exiting the CS.
+func (n *VoterNode) expireLease() {
+	n.leaseLock.Lock()
+	if !n.holding || n.exited {
+		n.leaseLock.Unlock()
+		return
+	}
+	n.holding = false
+	n.leaseLock.Unlock()
+
+	n.clock++
+	n.clock = MaxClockVal(n.clock, n.smPtr.ExpireLease(n.nodeId, n.clock)) + 1
+	log.Printf("[%d] - N%d: Lease expired. Lock released", n.clock, n.nodeId)
+	n.release()
+}
+
 
 // Send a message. Responsibility for updating clock is on the caller.
 func (n *VoterNode) send(elId string, dstId int, action VoterMsgAction, timestamp ClockVal) {
@@ -299,6 +490,9 @@ func (n *VoterNode) send(elId string, dstId int, action VoterMsgAction, timestam
 // Broadcast to ALL including self
 func (n *VoterNode) broadcast(elId string, action VoterMsgAction, timestamp ClockVal) {
 	for dstId := range(n.allEndpoints) {
+		if n.detector.Crashed(dstId) {
+			continue
+		}
 		n.send(elId, dstId, action, timestamp)
 	}
 }
@@ -326,6 +520,8 @@ const (
 	VPVote
 	VPRescind
 	VPRelease
+	VPWithdraw // A cancelled request, which voters should drop from their backlog
+	VPHeartbeat // Only sent by nodes with a lease, see FailureDetector.go
 	VPInvalid
 )
 
@@ -339,6 +535,10 @@ func getVoterMsgAction(action VoterMsgAction) string {
 		return "RESCIND"
 	case VPRelease:
 		return "RELEASE"
+	case VPWithdraw:
+		return "WITHDRAW"
+	case VPHeartbeat:
+		return "HEARTBEAT"
 	case VPInvalid:
 		return "INVALID"
 	default:
@@ -356,6 +556,7 @@ type voteSession struct {
 	doneChan chan bool
 	exitChan chan bool
 	majority int
+	closed bool // True once the request is cancelled -- no further votes are accepted
 }
 
 func newVoteSession(electionId string, req_ts ClockVal, endpointMap map[int]VoterNodeEndpoint, expectedMajority int, exitChan chan bool) *voteSession {
@@ -364,7 +565,7 @@ func newVoteSession(electionId string, req_ts ClockVal, endpointMap map[int]Vote
 		voteMap[nodeId] = 0
 	}
 	
-	return &voteSession{electionId, req_ts, voteMap, &sync.Mutex{}, make(chan bool), exitChan, expectedMajority}
+	return &voteSession{electionId, req_ts, voteMap, &sync.Mutex{}, make(chan bool, 1), exitChan, expectedMajority, false}
 }
 
 func (s *voteSession) AddVote(electionId string, nodeId int) bool {
@@ -373,14 +574,17 @@ func (s *voteSession) AddVote(electionId string, nodeId int) bool {
 		return false
 	}
 
-	if s.checkVotes() == s.majority { // we REJECT any further votes
+	if s.votes[nodeId] == -1 { // RESCINDED, and the vote was already released
+		s.votes[nodeId] = 0
+		return true
+	}
+
+	if s.closed || s.checkVotes() == s.majority { // we REJECT any further votes
 		// This prevents the case where this node receives a new vote while it is releasing the votes and forgets the received node.
 		return false
 	}
 
-	if s.votes[nodeId] == -1 { // RESCINDED
-		s.votes[nodeId] = 0
-	} else if s.votes[nodeId] == 0 { // NOT VOTED
+	if s.votes[nodeId] == 0 { // NOT VOTED
 		s.votes[nodeId] = 1
 	} else {
 		panic(fmt.Sprintf("s.votes[%d] = %d", nodeId, s.votes[nodeId] + 1))
@@ -399,7 +603,7 @@ func (s *voteSession) RemoveVote(electionId string, nodeId int) bool {
 		return false
 	}
 	
-	if s.checkVotes() >= s.majority { // too late, prevent any further modification
+	if s.closed || s.checkVotes() >= s.majority { // too late, prevent any further modification
 		return false
 	}
 
@@ -436,12 +640,22 @@ func (s *voteSession) GetVoters() []int {
 	return ret
 }
 
-// Blocks until the vote session reaches the expected majority
-func (s *voteSession) Wait() bool {
+// Stops accepting votes, returning the voters whose votes we hold
+func (s *voteSession) Close() []int {
+	s.sessionLock.Lock()
+	s.closed = true
+	s.sessionLock.Unlock()
+	return s.GetVoters()
+}
+
+// Blocks until the vote session reaches the expected majority, returning ErrShutdown or ctx.Err() if it doesn't
+func (s *voteSession) Wait(ctx context.Context) error {
 	select {
 	case <-s.doneChan:
-		return true
+		return nil
 	case <-s.exitChan:
-		return false
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }